@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"otter/models"
+	"sort"
+)
+
+// Marker types on a token chart.
+const (
+	MARKER_BUY     = "BUY"
+	MARKER_SELL    = "SELL"
+	MARKER_SKIPPED = "SKIPPED"
+)
+
+// ChartMarker is a trade, or a trade the sim skipped, to overlay on a token's price chart.
+type ChartMarker struct {
+	Type        string  `json:"type"`
+	Timestamp   int64   `json:"timestamp"`
+	BlockNumber int64   `json:"block_number"`
+	Price       float64 `json:"price"`                // SOL, 0 if there was no swap to price it at
+	SOLChange   float64 `json:"sol_change,omitempty"` // BUY and SELL
+	Skipped     string  `json:"skipped,omitempty"`    // SKIPPED, the trade that was skipped: BUY or SELL
+	Reason      string  `json:"reason,omitempty"`     // SKIPPED, one of the models.SKIP_ reasons
+}
+
+// ChartWindow is the time a sim held a token: from its first buy to its last sell, or the end of the sim if it
+// was still holding. A token that was never bought just has its call.
+func ChartWindow(call int64, trades []models.SimEvent, holding bool, simEnd int64) (int64, int64) {
+	if len(trades) == 0 {
+		return call, call
+	}
+
+	from, to := trades[0].Timestamp, trades[len(trades)-1].Timestamp
+	if holding {
+		to = max(to, simEnd)
+	}
+
+	return from, to
+}
+
+// ChartMarkers merges a token's trades and skips into markers, in time order. A call in the sim's range that was
+// neither bought nor skipped had no swap to buy on, which gets a SKIPPED marker at the call.
+func ChartMarkers(trades []models.SimEvent, skips []models.Skip, call int64, simStart int64, simEnd int64) []ChartMarker {
+	markers := []ChartMarker{}
+
+	for _, t := range trades {
+		markers = append(markers, ChartMarker{
+			Type:        t.Type,
+			Timestamp:   t.Timestamp,
+			BlockNumber: t.BlockNumber,
+			Price:       t.TokenPrice,
+			SOLChange:   t.SOLChange,
+		})
+	}
+
+	buySkipped := false
+	for _, s := range skips {
+		buySkipped = buySkipped || s.Type == MARKER_BUY
+		markers = append(markers, ChartMarker{
+			Type:        MARKER_SKIPPED,
+			Timestamp:   s.Timestamp,
+			BlockNumber: s.BlockNumber,
+			Price:       s.TokenPrice,
+			Skipped:     s.Type,
+			Reason:      s.Reason,
+		})
+	}
+
+	if len(trades) == 0 && !buySkipped && call >= simStart && call <= simEnd {
+		markers = append(markers, ChartMarker{
+			Type:      MARKER_SKIPPED,
+			Timestamp: call,
+			Skipped:   MARKER_BUY,
+			Reason:    models.SKIP_NO_SWAP,
+		})
+	}
+
+	sort.SliceStable(markers, func(i, j int) bool {
+		if markers[i].Timestamp != markers[j].Timestamp {
+			return markers[i].Timestamp < markers[j].Timestamp
+		}
+		return markers[i].BlockNumber < markers[j].BlockNumber
+	})
+
+	return markers
+}
+
+// DownsamplePrices reduces a price series to about threshold points with LTTB, the same as the balance curve.
+// The swaps markers sit on are always kept, so they stay on the line.
+func DownsamplePrices(points []models.PricePoint, markers []ChartMarker, threshold int) []models.PricePoint {
+	if threshold >= len(points) || threshold < 3 {
+		return points
+	}
+
+	curve := make([]models.BalancePoint, len(points))
+	for i, p := range points {
+		curve[i] = models.BalancePoint{BlockNumber: p.BlockNumber, Timestamp: p.Timestamp, USD: p.Price}
+	}
+
+	// a block can have several swaps, so LTTB's picks are kept by index and the markers' by (timestamp, block)
+	keep := make([]bool, len(points))
+	for _, i := range lttbIndices(curve, threshold) {
+		keep[i] = true
+	}
+
+	marked := map[[2]int64]bool{}
+	for _, m := range markers {
+		marked[[2]int64{m.Timestamp, m.BlockNumber}] = true
+	}
+
+	sampled := []models.PricePoint{}
+	for i, p := range points {
+		if keep[i] || marked[[2]int64{p.Timestamp, p.BlockNumber}] {
+			sampled = append(sampled, p)
+		}
+	}
+
+	return sampled
+}
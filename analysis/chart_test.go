@@ -0,0 +1,136 @@
+package analysis
+
+import (
+	"otter/models"
+	"reflect"
+	"testing"
+)
+
+func TestChartWindow(t *testing.T) {
+	trades := []models.SimEvent{{Type: "BUY", Timestamp: 110}, {Type: "SELL", Timestamp: 150}}
+
+	tests := map[string]struct {
+		trades   []models.SimEvent
+		holding  bool
+		from, to int64
+	}{
+		"never bought":            {nil, false, 100, 100},
+		"sold out":                {trades, false, 110, 150},
+		"still holding":           {trades, true, 110, 500},
+		"holding after a partial": {trades[:1], true, 110, 500},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			from, to := ChartWindow(100, test.trades, test.holding, 500)
+			if from != test.from || to != test.to {
+				t.Errorf("got %d..%d, want %d..%d", from, to, test.from, test.to)
+			}
+		})
+	}
+}
+
+func TestChartMarkers(t *testing.T) {
+	buy := models.SimEvent{Type: "BUY", Timestamp: 100, BlockNumber: 10, TokenPrice: 0.001, SOLChange: -1}
+	sell := models.SimEvent{Type: "SELL", Timestamp: 120, BlockNumber: 30, TokenPrice: 0.002, SOLChange: 2}
+	skippedSell := models.Skip{Type: "SELL", Timestamp: 120, BlockNumber: 29, TokenPrice: 0.003, Reason: models.SKIP_SLIPPAGE}
+	skippedBuy := models.Skip{Type: "BUY", Timestamp: 100, BlockNumber: 10, TokenPrice: 0.001, Reason: models.SKIP_BALANCE}
+
+	tests := map[string]struct {
+		trades []models.SimEvent
+		skips  []models.Skip
+		call   int64
+		want   []ChartMarker
+	}{
+		"bought and sold": {[]models.SimEvent{buy, sell}, nil, 100, []ChartMarker{
+			{Type: MARKER_BUY, Timestamp: 100, BlockNumber: 10, Price: 0.001, SOLChange: -1},
+			{Type: MARKER_SELL, Timestamp: 120, BlockNumber: 30, Price: 0.002, SOLChange: 2},
+		}},
+		// same timestamp, in block order
+		"a skip in an earlier block": {[]models.SimEvent{buy, sell}, []models.Skip{skippedSell}, 100, []ChartMarker{
+			{Type: MARKER_BUY, Timestamp: 100, BlockNumber: 10, Price: 0.001, SOLChange: -1},
+			{Type: MARKER_SKIPPED, Timestamp: 120, BlockNumber: 29, Price: 0.003, Skipped: "SELL", Reason: models.SKIP_SLIPPAGE},
+			{Type: MARKER_SELL, Timestamp: 120, BlockNumber: 30, Price: 0.002, SOLChange: 2},
+		}},
+		// same block, trades first
+		"a skip in the same block": {[]models.SimEvent{buy}, []models.Skip{skippedBuy}, 100, []ChartMarker{
+			{Type: MARKER_BUY, Timestamp: 100, BlockNumber: 10, Price: 0.001, SOLChange: -1},
+			{Type: MARKER_SKIPPED, Timestamp: 100, BlockNumber: 10, Price: 0.001, Skipped: "BUY", Reason: models.SKIP_BALANCE},
+		}},
+		"a skipped buy": {nil, []models.Skip{skippedBuy}, 100, []ChartMarker{
+			{Type: MARKER_SKIPPED, Timestamp: 100, BlockNumber: 10, Price: 0.001, Skipped: "BUY", Reason: models.SKIP_BALANCE},
+		}},
+		"no swap at the call": {nil, nil, 100, []ChartMarker{
+			{Type: MARKER_SKIPPED, Timestamp: 100, Skipped: "BUY", Reason: models.SKIP_NO_SWAP},
+		}},
+		"no swap, only a skipped sell": {nil, []models.Skip{skippedSell}, 100, []ChartMarker{
+			{Type: MARKER_SKIPPED, Timestamp: 100, Skipped: "BUY", Reason: models.SKIP_NO_SWAP},
+			{Type: MARKER_SKIPPED, Timestamp: 120, BlockNumber: 29, Price: 0.003, Skipped: "SELL", Reason: models.SKIP_SLIPPAGE},
+		}},
+		"called before the sim": {nil, nil, 10, []ChartMarker{}},
+		"called after the sim":  {nil, nil, 1000, []ChartMarker{}},
+		"called at the sim's end": {nil, nil, 500, []ChartMarker{
+			{Type: MARKER_SKIPPED, Timestamp: 500, Skipped: "BUY", Reason: models.SKIP_NO_SWAP},
+		}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := ChartMarkers(test.trades, test.skips, test.call, 50, 500)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// prices is a swap a second, one per block, with these prices.
+func prices(price ...float64) []models.PricePoint {
+	points := make([]models.PricePoint, len(price))
+	for i, p := range price {
+		points[i] = models.PricePoint{BlockNumber: int64(i + 1), Timestamp: int64(1000 + i), Price: p}
+	}
+	return points
+}
+
+func TestDownsamplePrices(t *testing.T) {
+	points := prices(10, 11, 10, 50, 10, 2, 10, 11, 10, 11)
+
+	tests := map[string]struct {
+		markers   []ChartMarker
+		threshold int
+		want      []float64
+	}{
+		"lttb":                   {nil, 4, []float64{10, 50, 2, 11}},
+		"with a marker":          {[]ChartMarker{{Type: MARKER_BUY, Timestamp: 1001, BlockNumber: 2}}, 4, []float64{10, 11, 50, 2, 11}},
+		"threshold under three":  {nil, 2, []float64{10, 11, 10, 50, 10, 2, 10, 11, 10, 11}},
+		"threshold of the curve": {nil, 10, []float64{10, 11, 10, 50, 10, 2, 10, 11, 10, 11}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := []float64{}
+			for _, p := range DownsamplePrices(points, test.markers, test.threshold) {
+				got = append(got, p.Price)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDownsamplePricesWithSeveralSwapsABlock(t *testing.T) {
+	points := prices(10, 11, 10, 50, 10, 2, 10, 11, 10, 11)
+
+	// every swap is in one of two blocks, so keeping a block would keep everything
+	for i := range points {
+		points[i].BlockNumber = int64(1 + i/5)
+	}
+
+	got := DownsamplePrices(points, []ChartMarker{{Type: MARKER_SELL, Timestamp: 1001, BlockNumber: 1}}, 4)
+	want := []models.PricePoint{points[0], points[1], points[3], points[5], points[9]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
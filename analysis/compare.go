@@ -0,0 +1,221 @@
+package analysis
+
+import (
+	"encoding/json"
+	"math"
+	"otter/models"
+	"reflect"
+	"sort"
+)
+
+// SimData is everything needed from a stored sim to compare it against others.
+type SimData struct {
+	Metadata models.SimulatorMetadata
+	Metrics  models.SimMetrics
+	Balances []models.BalancePoint
+	Trades   []models.SimEvent
+	Ledger   []models.LedgerEntry
+}
+
+type Comparison struct {
+	IDs          []int               `json:"ids"`
+	MetadataDiff map[string][]any    `json:"metadata_diff"` // setting -> value per sim, only settings that differ
+	Metrics      []models.SimMetrics `json:"metrics"`
+	EquityCurves EquityGrid          `json:"equity_curves"`
+	CallDiffs    []CallDiff          `json:"call_diffs"`
+}
+
+// EquityGrid holds every sim's USD balance sampled on the same timestamps. Values[i] belongs to IDs[i],
+// a nil value means the sim had no balance point yet at that time.
+type EquityGrid struct {
+	Timestamps []int64      `json:"timestamps"`
+	Values     [][]*float64 `json:"values"`
+}
+
+// CallDiff is a call that was traded differently by at least one of the compared sims.
+type CallDiff struct {
+	FileID   int           `json:"file_id"`
+	Name     string        `json:"name"`
+	Outcomes []CallOutcome `json:"outcomes"` // one per sim, same order as IDs
+}
+
+type CallOutcome struct {
+	Bought     bool      `json:"bought"`
+	EntryPrice float64   `json:"entry_price"`
+	SellPrices []float64 `json:"sell_prices"`
+	SOLIn      float64   `json:"sol_in"`
+	SOLOut     float64   `json:"sol_out"`
+	PnL        float64   `json:"pnl"`
+}
+
+// metadata fields that always differ between runs, and so are left out of the diff
+var ignoredMetadata = map[string]bool{"id": true, "date": true}
+
+// Compare lines up two or more sims. points is the number of samples on the common equity grid.
+func Compare(sims []SimData, points int) Comparison {
+	c := Comparison{
+		IDs:          make([]int, len(sims)),
+		MetadataDiff: diffMetadata(sims),
+		Metrics:      make([]models.SimMetrics, len(sims)),
+		EquityCurves: alignEquityCurves(sims, points),
+		CallDiffs:    diffCalls(sims),
+	}
+
+	for i, sim := range sims {
+		c.IDs[i] = sim.Metadata.ID
+		c.Metrics[i] = sim.Metrics
+	}
+
+	return c
+}
+
+// diffMetadata compares the JSON form of each sim's metadata, so new settings are picked up without changes here.
+func diffMetadata(sims []SimData) map[string][]any {
+	fields := make([]map[string]any, len(sims))
+	keys := make(map[string]bool)
+
+	for i, sim := range sims {
+		raw, _ := json.Marshal(sim.Metadata)
+		json.Unmarshal(raw, &fields[i])
+
+		for k := range fields[i] {
+			keys[k] = true
+		}
+	}
+
+	diff := make(map[string][]any)
+	for k := range keys {
+		if ignoredMetadata[k] {
+			continue
+		}
+
+		values := make([]any, len(sims))
+		differs := false
+		for i := range sims {
+			values[i] = fields[i][k]
+			if !reflect.DeepEqual(values[i], values[0]) {
+				differs = true
+			}
+		}
+
+		if differs {
+			diff[k] = values
+		}
+	}
+
+	return diff
+}
+
+// alignEquityCurves samples every sim's balance on an evenly spaced time grid covering all of the sims,
+// carrying the last known balance forward between points.
+func alignEquityCurves(sims []SimData, points int) EquityGrid {
+	grid := EquityGrid{Values: make([][]*float64, len(sims))}
+
+	var start, end int64 = math.MaxInt64, math.MinInt64
+	for _, sim := range sims {
+		for _, b := range sim.Balances {
+			// sims imported from the old JSON output have no timestamps
+			if b.Timestamp == 0 {
+				continue
+			}
+			start = min(start, b.Timestamp)
+			end = max(end, b.Timestamp)
+		}
+	}
+
+	if start > end || points < 1 {
+		return grid
+	}
+
+	if points == 1 || start == end {
+		grid.Timestamps = []int64{end}
+	} else {
+		step := float64(end-start) / float64(points-1)
+		for i := 0; i < points; i++ {
+			grid.Timestamps = append(grid.Timestamps, start+int64(math.Round(step*float64(i))))
+		}
+	}
+
+	for i, sim := range sims {
+		balances := make([]models.BalancePoint, 0, len(sim.Balances))
+		for _, b := range sim.Balances {
+			if b.Timestamp != 0 {
+				balances = append(balances, b)
+			}
+		}
+
+		sort.SliceStable(balances, func(a, b int) bool {
+			return balances[a].Timestamp < balances[b].Timestamp
+		})
+
+		values := make([]*float64, len(grid.Timestamps))
+		next := 0
+		for j, ts := range grid.Timestamps {
+			for next < len(balances) && balances[next].Timestamp <= ts {
+				next += 1
+			}
+
+			if next > 0 {
+				usd := balances[next-1].USD
+				values[j] = &usd
+			}
+		}
+
+		grid.Values[i] = values
+	}
+
+	return grid
+}
+
+// diffCalls returns the calls that weren't traded the same way by every sim: bought by some but not others,
+// or sold at different prices.
+func diffCalls(sims []SimData) []CallDiff {
+	names := make(map[int]string)
+	outcomes := make(map[int][]CallOutcome)
+
+	for i, sim := range sims {
+		sells := make(map[int][]float64)
+		for _, e := range sim.Trades {
+			if e.Type == "SELL" {
+				sells[e.FileID] = append(sells[e.FileID], e.TokenPrice)
+			}
+		}
+
+		for _, l := range sim.Ledger {
+			if _, ok := outcomes[l.FileID]; !ok {
+				outcomes[l.FileID] = make([]CallOutcome, len(sims))
+				names[l.FileID] = l.Name
+			}
+
+			outcomes[l.FileID][i] = CallOutcome{
+				Bought:     l.Buys > 0,
+				EntryPrice: l.EntryPrice,
+				SellPrices: sells[l.FileID],
+				SOLIn:      l.SOLIn,
+				SOLOut:     l.SOLOut,
+				PnL:        l.PnL,
+			}
+		}
+	}
+
+	diffs := []CallDiff{}
+	for fileID, o := range outcomes {
+		same := true
+		for i := 1; i < len(o); i++ {
+			if o[i].Bought != o[0].Bought || !reflect.DeepEqual(o[i].SellPrices, o[0].SellPrices) {
+				same = false
+				break
+			}
+		}
+
+		if !same {
+			diffs = append(diffs, CallDiff{FileID: fileID, Name: names[fileID], Outcomes: o})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].FileID < diffs[j].FileID
+	})
+
+	return diffs
+}
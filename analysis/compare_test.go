@@ -0,0 +1,120 @@
+package analysis
+
+import (
+	"otter/models"
+	"reflect"
+	"testing"
+)
+
+func sim(id int, name string, slippage float64, balances []models.BalancePoint, trades []models.SimEvent, ledger []models.LedgerEntry) SimData {
+	return SimData{
+		Metadata: models.SimulatorMetadata{
+			SimConfig: models.SimConfig{Name: name, Slippage: slippage, BuyAmount: 1},
+			Date:      "2026-01-02 03:04:05",
+			ID:        id,
+		},
+		Metrics:  models.SimMetrics{SimID: id, Name: name},
+		Balances: balances,
+		Trades:   trades,
+		Ledger:   ledger,
+	}
+}
+
+// values turns an equity grid column into plain numbers, -1 for a sim with no balance yet.
+func values(column []*float64) []float64 {
+	got := make([]float64, len(column))
+	for i, v := range column {
+		got[i] = -1
+		if v != nil {
+			got[i] = *v
+		}
+	}
+	return got
+}
+
+func TestCompare(t *testing.T) {
+	a := sim(1, "a", 5,
+		[]models.BalancePoint{{BlockNumber: 1, Timestamp: 100, USD: 100}, {BlockNumber: 2, Timestamp: 200, USD: 150}},
+		[]models.SimEvent{
+			{Type: "BUY", FileID: 1, TokenPrice: 1},
+			{Type: "SELL", FileID: 1, TokenPrice: 2},
+			{Type: "BUY", FileID: 2, TokenPrice: 1},
+			{Type: "BUY", FileID: 3, TokenPrice: 1},
+			{Type: "SELL", FileID: 3, TokenPrice: 2},
+		},
+		[]models.LedgerEntry{{FileID: 1, Name: "one", Buys: 1}, {FileID: 2, Name: "two", Buys: 1}, {FileID: 3, Name: "three", Buys: 1}},
+	)
+	b := sim(2, "b", 10,
+		// the point without a timestamp is from an old import, and is left out of the grid
+		[]models.BalancePoint{{BlockNumber: 1, USD: 1}, {BlockNumber: 5, Timestamp: 300, USD: 80}, {BlockNumber: 3, Timestamp: 150, USD: 50}},
+		[]models.SimEvent{
+			{Type: "BUY", FileID: 1, TokenPrice: 1},
+			{Type: "SELL", FileID: 1, TokenPrice: 2},
+			{Type: "BUY", FileID: 3, TokenPrice: 1},
+			{Type: "SELL", FileID: 3, TokenPrice: 3},
+		},
+		[]models.LedgerEntry{{FileID: 1, Name: "one", Buys: 1}, {FileID: 2, Name: "two"}, {FileID: 3, Name: "three", Buys: 1}},
+	)
+
+	c := Compare([]SimData{a, b}, 3)
+
+	if !reflect.DeepEqual(c.IDs, []int{1, 2}) || c.Metrics[0].Name != "a" || c.Metrics[1].Name != "b" {
+		t.Errorf("got ids %v and metrics %+v", c.IDs, c.Metrics)
+	}
+
+	// id and date always differ, so only the settings are diffed
+	wantDiff := map[string][]any{"name": {"a", "b"}, "slippage": {5.0, 10.0}}
+	if !reflect.DeepEqual(c.MetadataDiff, wantDiff) {
+		t.Errorf("got metadata diff %v, want %v", c.MetadataDiff, wantDiff)
+	}
+
+	if !reflect.DeepEqual(c.EquityCurves.Timestamps, []int64{100, 200, 300}) {
+		t.Errorf("got grid %v", c.EquityCurves.Timestamps)
+	}
+	for i, want := range [][]float64{{100, 150, 150}, {-1, 50, 80}} {
+		if got := values(c.EquityCurves.Values[i]); !reflect.DeepEqual(got, want) {
+			t.Errorf("sim %d: got equity %v, want %v", i, got, want)
+		}
+	}
+
+	// one was traded the same way by both
+	if len(c.CallDiffs) != 2 || c.CallDiffs[0].FileID != 2 || c.CallDiffs[1].FileID != 3 {
+		t.Fatalf("got call diffs %+v", c.CallDiffs)
+	}
+	if two := c.CallDiffs[0]; two.Name != "two" || !two.Outcomes[0].Bought || two.Outcomes[1].Bought {
+		t.Errorf("got %+v for the call only a bought", two)
+	}
+	if three := c.CallDiffs[1].Outcomes; !reflect.DeepEqual(three[0].SellPrices, []float64{2}) || !reflect.DeepEqual(three[1].SellPrices, []float64{3}) {
+		t.Errorf("got %+v for the call sold at different prices", three)
+	}
+}
+
+func TestEquityGrid(t *testing.T) {
+	balances := []models.BalancePoint{{Timestamp: 100, USD: 1}, {Timestamp: 110, USD: 2}, {Timestamp: 130, USD: 3}}
+
+	tests := map[string]struct {
+		balances []models.BalancePoint
+		points   int
+		want     []int64
+	}{
+		"evenly spaced": {balances, 4, []int64{100, 110, 120, 130}},
+		"rounded":       {balances, 3, []int64{100, 115, 130}},
+		"one point":     {balances, 1, []int64{130}},
+		"no points":     {balances, 0, nil},
+		"one timestamp": {[]models.BalancePoint{{Timestamp: 100, USD: 1}, {Timestamp: 100, USD: 2}}, 5, []int64{100}},
+		"no timestamps": {[]models.BalancePoint{{BlockNumber: 1, USD: 1}}, 5, nil},
+		"no balances":   {nil, 5, nil},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			grid := alignEquityCurves([]SimData{{Balances: test.balances}}, test.points)
+			if !reflect.DeepEqual(grid.Timestamps, test.want) {
+				t.Errorf("got %v, want %v", grid.Timestamps, test.want)
+			}
+			if len(grid.Values) != 1 || len(grid.Values[0]) != len(test.want) {
+				t.Errorf("got values %v", grid.Values)
+			}
+		})
+	}
+}
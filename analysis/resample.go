@@ -0,0 +1,165 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"otter/models"
+	"strings"
+)
+
+// Resolution describes how an equity curve should be resampled when it's read.
+type Resolution struct {
+	Kind   string // "raw", "bucket" or "lttb"
+	Bucket int64  // bucket width in seconds, for "bucket"
+	Points int    // target number of points, for "lttb"
+}
+
+// EquityBucket is the OHLC of the wallet's USD balance over one time bucket.
+type EquityBucket struct {
+	Timestamp int64   `json:"timestamp"` // start of the bucket
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+}
+
+var bucketWidths = map[string]int64{
+	"1m": 60,
+	"5m": 5 * 60,
+	"1h": 60 * 60,
+}
+
+// ParseResolution accepts "raw", "1m", "5m", "1h" or "lttb". points is only used by lttb.
+func ParseResolution(resolution string, points int) (Resolution, error) {
+	resolution = strings.ToLower(strings.TrimSpace(resolution))
+
+	if width, ok := bucketWidths[resolution]; ok {
+		return Resolution{Kind: "bucket", Bucket: width}, nil
+	}
+
+	switch resolution {
+	case "", "raw":
+		return Resolution{Kind: "raw"}, nil
+	case "lttb":
+		if points < 3 {
+			return Resolution{}, fmt.Errorf("lttb needs at least 3 points, got %d", points)
+		}
+		return Resolution{Kind: "lttb", Points: points}, nil
+	}
+
+	return Resolution{}, fmt.Errorf("unknown resolution %q, expected raw, 1m, 5m, 1h or lttb", resolution)
+}
+
+// Resample applies the resolution to a curve. Raw and lttb return []models.BalancePoint,
+// buckets return []EquityBucket.
+func Resample(points []models.BalancePoint, r Resolution) (any, error) {
+	switch r.Kind {
+	case "bucket":
+		if !hasTimestamps(points) {
+			return nil, fmt.Errorf("this sim has no balance timestamps, only raw and lttb are available")
+		}
+		return BucketOHLC(points, r.Bucket), nil
+	case "lttb":
+		return LTTB(points, r.Points), nil
+	}
+
+	return points, nil
+}
+
+func hasTimestamps(points []models.BalancePoint) bool {
+	for _, p := range points {
+		if p.Timestamp != 0 {
+			return true
+		}
+	}
+
+	return len(points) == 0
+}
+
+// BucketOHLC groups the curve into fixed width time buckets. Points are expected in block (and so time) order.
+func BucketOHLC(points []models.BalancePoint, width int64) []EquityBucket {
+	buckets := []EquityBucket{}
+
+	for _, p := range points {
+		start := p.Timestamp - p.Timestamp%width
+
+		n := len(buckets)
+		if n == 0 || buckets[n-1].Timestamp != start {
+			buckets = append(buckets, EquityBucket{Timestamp: start, Open: p.USD, High: p.USD, Low: p.USD, Close: p.USD})
+			continue
+		}
+
+		b := &buckets[n-1]
+		b.High = math.Max(b.High, p.USD)
+		b.Low = math.Min(b.Low, p.USD)
+		b.Close = p.USD
+	}
+
+	return buckets
+}
+
+// LTTB downsamples the curve to at most threshold points with the largest-triangle-three-buckets algorithm,
+// which keeps the visual shape (peaks and troughs) of the curve. The first and last points are always kept.
+func LTTB(points []models.BalancePoint, threshold int) []models.BalancePoint {
+	if threshold >= len(points) || threshold < 3 {
+		return points
+	}
+
+	sampled := make([]models.BalancePoint, 0, threshold)
+	for _, i := range lttbIndices(points, threshold) {
+		sampled = append(sampled, points[i])
+	}
+
+	return sampled
+}
+
+// lttbIndices is the indices of the points LTTB keeps, in order, for 3 <= threshold < len(points).
+func lttbIndices(points []models.BalancePoint, threshold int) []int {
+	// old sims have no timestamps, fall back to the block number for the x axis
+	x := func(p models.BalancePoint) float64 {
+		if p.Timestamp == 0 {
+			return float64(p.BlockNumber)
+		}
+		return float64(p.Timestamp)
+	}
+
+	sampled := make([]int, 0, threshold)
+	sampled = append(sampled, 0)
+
+	every := float64(len(points)-2) / float64(threshold-2)
+	a := 0
+
+	for i := 0; i < threshold-2; i++ {
+		// average of the next bucket, the third point of the triangle
+		nextStart := int(math.Floor(float64(i+1)*every)) + 1
+		nextEnd := min(int(math.Floor(float64(i+2)*every))+1, len(points))
+
+		avgX, avgY := 0.0, 0.0
+		for _, p := range points[nextStart:nextEnd] {
+			avgX += x(p)
+			avgY += p.USD
+		}
+		count := float64(nextEnd - nextStart)
+		avgX /= count
+		avgY /= count
+
+		// pick the point in this bucket with the largest triangle
+		start := int(math.Floor(float64(i)*every)) + 1
+		end := int(math.Floor(float64(i+1)*every)) + 1
+
+		maxArea := -1.0
+		next := start
+		for j := start; j < end; j++ {
+			area := math.Abs((x(points[a])-avgX)*(points[j].USD-points[a].USD) - (x(points[a])-x(points[j]))*(avgY-points[a].USD))
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+
+		sampled = append(sampled, next)
+		a = next
+	}
+
+	return append(sampled, len(points)-1)
+}
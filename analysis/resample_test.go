@@ -0,0 +1,121 @@
+package analysis
+
+import (
+	"otter/models"
+	"reflect"
+	"testing"
+)
+
+// curve is a balance point a second, with these USD values.
+func curve(usd ...float64) []models.BalancePoint {
+	points := make([]models.BalancePoint, len(usd))
+	for i, v := range usd {
+		points[i] = models.BalancePoint{BlockNumber: int64(i + 1), Timestamp: int64(1000 + i), USD: v}
+	}
+	return points
+}
+
+func TestParseResolution(t *testing.T) {
+	tests := map[string]struct {
+		resolution string
+		points     int
+		want       Resolution
+		err        bool
+	}{
+		"default":          {"", 0, Resolution{Kind: "raw"}, false},
+		"raw":              {"raw", 0, Resolution{Kind: "raw"}, false},
+		"bucket":           {"5m", 0, Resolution{Kind: "bucket", Bucket: 300}, false},
+		"any case":         {" 1H ", 0, Resolution{Kind: "bucket", Bucket: 3600}, false},
+		"lttb":             {"lttb", 500, Resolution{Kind: "lttb", Points: 500}, false},
+		"lttb under three": {"lttb", 2, Resolution{}, true},
+		"unknown":          {"1d", 0, Resolution{}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseResolution(test.resolution, test.points)
+			if (err != nil) != test.err || got != test.want {
+				t.Errorf("got %+v, %v, want %+v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestResample(t *testing.T) {
+	points := curve(1, 5, 2, 8, 3)
+
+	tests := map[string]struct {
+		points []models.BalancePoint
+		r      Resolution
+		want   any
+		err    bool
+	}{
+		"raw":  {points, Resolution{Kind: "raw"}, points, false},
+		"lttb": {points, Resolution{Kind: "lttb", Points: 3}, LTTB(points, 3), false},
+		"bucket": {points, Resolution{Kind: "bucket", Bucket: 2}, []EquityBucket{
+			{Timestamp: 1000, Open: 1, High: 5, Low: 1, Close: 5},
+			{Timestamp: 1002, Open: 2, High: 8, Low: 2, Close: 8},
+			{Timestamp: 1004, Open: 3, High: 3, Low: 3, Close: 3},
+		}, false},
+		"bucket without timestamps": {[]models.BalancePoint{{BlockNumber: 1, USD: 1}}, Resolution{Kind: "bucket", Bucket: 60}, nil, true},
+		"bucket of nothing":         {[]models.BalancePoint{}, Resolution{Kind: "bucket", Bucket: 60}, []EquityBucket{}, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Resample(test.points, test.r)
+			if (err != nil) != test.err || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, %v, want %+v", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestLTTB(t *testing.T) {
+	points := curve(10, 11, 10, 50, 10, 2, 10, 11, 10, 11)
+
+	tests := map[string]struct {
+		points    []models.BalancePoint
+		threshold int
+		want      []float64 // USD of the points kept
+	}{
+		"keeps the peak and trough": {points, 4, []float64{10, 50, 2, 11}},
+		"ends only":                 {points, 3, []float64{10, 50, 11}},
+		"threshold under three":     {points, 2, []float64{10, 11, 10, 50, 10, 2, 10, 11, 10, 11}},
+		"threshold over the curve":  {points, 20, []float64{10, 11, 10, 50, 10, 2, 10, 11, 10, 11}},
+		"threshold of the curve":    {points, 10, []float64{10, 11, 10, 50, 10, 2, 10, 11, 10, 11}},
+		"empty":                     {[]models.BalancePoint{}, 3, []float64{}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := LTTB(test.points, test.threshold)
+
+			usd := make([]float64, len(got))
+			for i, p := range got {
+				usd[i] = p.USD
+			}
+			if !reflect.DeepEqual(usd, test.want) {
+				t.Fatalf("got %v, want %v", usd, test.want)
+			}
+
+			// the ends are always kept
+			if len(got) > 0 && (got[0] != test.points[0] || got[len(got)-1] != test.points[len(test.points)-1]) {
+				t.Errorf("got ends %+v and %+v", got[0], got[len(got)-1])
+			}
+		})
+	}
+}
+
+func TestLTTBWithoutTimestamps(t *testing.T) {
+	// old sims fall back to the block number for the x axis
+	points := curve(10, 11, 10, 50, 10, 2, 10, 11, 10, 11)
+	for i := range points {
+		points[i].Timestamp = 0
+	}
+
+	got := LTTB(points, 4)
+	if len(got) != 4 || got[1].USD != 50 || got[2].USD != 2 {
+		t.Errorf("got %+v", got)
+	}
+}
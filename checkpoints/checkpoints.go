@@ -0,0 +1,144 @@
+// Package checkpoints keeps unfinished sim jobs and their latest checkpoint on disk, so the server can carry
+// them on after a restart.
+package checkpoints
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"otter/jobs"
+	"otter/models"
+	"otter/simulator"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	JOB_SUFFIX   = ".job.json"
+	STATE_SUFFIX = ".state.gob"
+)
+
+// Record is an unfinished job, as saved in the journal.
+type Record struct {
+	Status jobs.Status      `json:"status"`
+	Config models.SimConfig `json:"config"`
+}
+
+// Store is a directory with a job file and, once the sim has saved one, a state file per unfinished job.
+// It's a jobs.Journal.
+type Store struct {
+	Dir string
+}
+
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating the checkpoint directory: %w", err)
+	}
+
+	return &Store{Dir: dir}, nil
+}
+
+func (s *Store) SaveJob(status jobs.Status, config models.SimConfig) error {
+	data, err := json.Marshal(Record{Status: status, Config: config})
+	if err != nil {
+		return err
+	}
+
+	return s.write(status.ID+JOB_SUFFIX, data)
+}
+
+// RemoveJob forgets a job and its checkpoint.
+func (s *Store) RemoveJob(id string) error {
+	for _, name := range []string{id + JOB_SUFFIX, id + STATE_SUFFIX} {
+		if err := os.Remove(filepath.Join(s.Dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Jobs returns every job in the journal, oldest first.
+func (s *Store) Jobs() ([]Record, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), JOB_SUFFIX) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(s.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var r Record
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Status.QueuedAt.Before(records[j].Status.QueuedAt) })
+
+	return records, nil
+}
+
+func (s *Store) SaveState(id string, c *simulator.Checkpoint) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return err
+	}
+
+	return s.write(id+STATE_SUFFIX, buf.Bytes())
+}
+
+// LoadState returns a job's latest checkpoint, nil if it hasn't saved one.
+func (s *Store) LoadState(id string) (*simulator.Checkpoint, error) {
+	f, err := os.Open(filepath.Join(s.Dir, id+STATE_SUFFIX))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c simulator.Checkpoint
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("checkpoint of job %s: %w", id, err)
+	}
+
+	return &c, nil
+}
+
+// write replaces a file in one go, so a crash mid-write leaves the old one.
+func (s *Store) write(name string, data []byte) error {
+	tmp, err := os.CreateTemp(s.Dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(s.Dir, name))
+}
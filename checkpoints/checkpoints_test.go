@@ -0,0 +1,178 @@
+package checkpoints
+
+import (
+	"context"
+	"otter/database"
+	"otter/jobs"
+	"otter/models"
+	"otter/simulator"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, manager *jobs.Manager, id string, state jobs.State) {
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		if status, _ := manager.Get(id); status.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s never got %s", id, state)
+}
+
+func TestJobsSurviveARestart(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runs until it's stopped the first time, then finishes
+	runs := 0
+	run := func(ctx context.Context, job *jobs.Job) (int, error) {
+		runs++
+		if runs > 1 {
+			return 42, nil
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	manager := jobs.NewManager(1)
+	manager.SetJournal(store)
+
+	config := models.SimConfig{Name: "long"}
+	running := manager.SubmitPausable(config, run)
+	paused := manager.SubmitPausable(config, run)
+	waitFor(t, manager, running.ID, jobs.Running)
+
+	if err := manager.Pause(paused.ID); err != nil {
+		t.Fatal(err)
+	}
+	manager.Shutdown()
+
+	records, err := store.Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Status.ID != running.ID || records[1].Status.State != jobs.Paused || records[0].Config.Name != "long" {
+		t.Fatalf("got records %+v", records)
+	}
+
+	// the running job carries on, the paused one waits to be resumed
+	manager = jobs.NewManager(1)
+	manager.SetJournal(store)
+	for _, r := range records {
+		manager.Restore(r.Status, r.Config, run)
+	}
+	waitFor(t, manager, running.ID, jobs.Done)
+	waitFor(t, manager, paused.ID, jobs.Paused)
+
+	if err := manager.Resume(paused.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, manager, paused.ID, jobs.Done)
+	manager.Shutdown()
+
+	if records, err := store.Jobs(); err != nil || len(records) != 0 {
+		t.Errorf("got records %+v, %v after the jobs finished", records, err)
+	}
+}
+
+func TestPausingARunningJob(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := jobs.NewManager(1)
+	manager.SetJournal(store)
+	defer manager.Shutdown()
+
+	started := make(chan bool, 2)
+	status := manager.SubmitPausable(models.SimConfig{}, func(ctx context.Context, job *jobs.Job) (int, error) {
+		started <- true
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+
+	<-started
+	messages, unsubscribe, err := manager.Subscribe(status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	if err := manager.Pause(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg.Event != "paused" {
+		t.Fatalf("got %s, want paused", msg.Event)
+	}
+	if err := manager.Resume(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg.Event != "resumed" {
+		t.Fatalf("got %s, want resumed", msg.Event)
+	}
+	<-started
+
+	if err := manager.Resume(status.ID); err != jobs.ErrJobNotPaused {
+		t.Errorf("resuming a running job: got %v", err)
+	}
+	if err := manager.Cancel(status.ID); err != nil {
+		t.Fatal(err)
+	}
+	for range messages {
+	}
+
+	if records, _ := store.Jobs(); len(records) != 0 {
+		t.Errorf("a cancelled job is still in the journal: %+v", records)
+	}
+
+	// other jobs can't be paused
+	other := manager.Submit(models.SimConfig{}, func(ctx context.Context, job *jobs.Job) (int, error) { return 1, nil })
+	if err := manager.Pause(other.ID); err != jobs.ErrNotPausable {
+		t.Errorf("pausing a job that isn't pausable: got %v", err)
+	}
+}
+
+func TestStateRoundTrips(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err := store.LoadState("job"); c != nil || err != nil {
+		t.Fatalf("got %+v, %v before anything was saved", c, err)
+	}
+
+	want := &simulator.Checkpoint{
+		ConfigHash: "hash",
+		Cursor:     database.Cursor{Timestamp: 1700000000, BlockNumber: 12, FileID: 3},
+		Wallet: models.Wallet{
+			Balance: 7.5,
+			Assets:  map[int]models.Asset{3: {FileID: 3, EntryPrice: 0.001, Balance: 1000}},
+		},
+		EventsProcessed: 100,
+	}
+	if err := store.SaveState("job", want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.LoadState("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Cursor != want.Cursor || got.Wallet.Balance != 7.5 || got.Wallet.Assets[3].EntryPrice != 0.001 || got.EventsProcessed != 100 {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if err := store.RemoveJob("job"); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := store.LoadState("job"); c != nil {
+		t.Error("the state outlived its job")
+	}
+}
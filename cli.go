@@ -0,0 +1,1020 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"otter/database"
+	"otter/jobs"
+	"otter/live"
+	"otter/models"
+	"otter/simulator"
+	"otter/webhooks"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/yaml.v3"
+)
+
+// exit codes of the commands, so CI jobs can tell a failed sim from a bad invocation
+const (
+	EXIT_OK      = 0
+	EXIT_FAILED  = 1
+	EXIT_USAGE   = 2
+	FORMAT_TABLE = "table"
+	FORMAT_JSON  = "json"
+)
+
+// SimOutcome is what run and sweep report for every sim they ran.
+type SimOutcome struct {
+	JobID   string             `json:"job_id"`
+	SimID   int                `json:"sim_id,omitempty"`
+	State   jobs.State         `json:"state"`
+	Error   string             `json:"error,omitempty"`
+	Config  models.SimConfig   `json:"config"`
+	Metrics *models.SimMetrics `json:"metrics,omitempty"`
+}
+
+// parseArgs parses flags that may come before or after the positional arguments, e.g. "show 12 --panel ledger".
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func checkFormat(format string) bool {
+	if format == FORMAT_TABLE || format == FORMAT_JSON {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown format %q, expected table or json\n", format)
+	return false
+}
+
+// loadConfigFile reads a sim config from a YAML or JSON file. Both get the same sim defaults and go through
+// the same migration as /run_sim.
+func loadConfigFile(path string) (models.SimConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return models.SimConfig{}, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc map[string]any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return models.SimConfig{}, fmt.Errorf("%s: %w", path, err)
+		}
+
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return models.SimConfig{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	data, err = Settings.MergeSimDefaults(data)
+	if err != nil {
+		return models.SimConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	config, err := models.MigrateSimConfig(data)
+	if err != nil {
+		return models.SimConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// validateConfig prints the same field errors /run_sim returns. label prefixes each line, so a sweep can
+// say which of its configs is invalid.
+func validateConfig(config models.SimConfig, label string) bool {
+	err := binding.Validator.ValidateStruct(config)
+	if err == nil {
+		return true
+	}
+
+	fields, ok := validationErrors(err)
+	if !ok {
+		fmt.Fprintln(os.Stderr, label+err.Error())
+		return false
+	}
+
+	for _, f := range fields {
+		fmt.Fprintln(os.Stderr, label+f.Message)
+	}
+
+	return false
+}
+
+// waitForJobs blocks until every job is finished, passing their messages to onMessage as they arrive.
+// Ctrl-C cancels the jobs that are still queued or running.
+func waitForJobs(ids []string, onMessage func(i int, msg jobs.Message)) []jobs.DoneMessage {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	type indexed struct {
+		i   int
+		msg jobs.Message
+	}
+
+	done := make([]jobs.DoneMessage, len(ids))
+	remaining := len(ids)
+
+	merged := make(chan indexed)
+	for i, id := range ids {
+		messages, unsubscribe, err := Jobs.Subscribe(id)
+		if err != nil {
+			done[i] = jobs.DoneMessage{JobID: id, State: jobs.Failed, Error: err.Error()}
+			remaining -= 1
+			continue
+		}
+
+		go func(i int) {
+			defer unsubscribe()
+			for msg := range messages {
+				merged <- indexed{i, msg}
+			}
+		}(i)
+	}
+
+	cancelled := false
+
+	for remaining > 0 {
+		select {
+		case m := <-merged:
+			if m.msg.Event == "done" {
+				done[m.i] = m.msg.Data.(jobs.DoneMessage)
+				remaining -= 1
+			}
+			if onMessage != nil {
+				onMessage(m.i, m.msg)
+			}
+		case <-ctx.Done():
+			if !cancelled {
+				cancelled = true
+				for _, id := range ids {
+					Jobs.Cancel(id)
+				}
+			}
+		}
+	}
+
+	return done
+}
+
+// outcome collects the result of a finished job, with its metrics if it stored a sim.
+func outcome(config models.SimConfig, done jobs.DoneMessage) SimOutcome {
+	o := SimOutcome{
+		JobID:  done.JobID,
+		SimID:  done.SimID,
+		State:  done.State,
+		Error:  done.Error,
+		Config: config,
+	}
+
+	if done.SimID != 0 {
+		metrics, err := Results.GetMetrics(done.SimID)
+		if err != nil {
+			o.Error = "loading metrics: " + err.Error()
+		} else {
+			o.Metrics = &metrics
+		}
+	}
+
+	return o
+}
+
+func printOutcomes(w io.Writer, outcomes []SimOutcome) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIM ID\tNAME\tSTATE\tRETURN %\tMAX DD %\tCALLS\tWIN RATE\tPNL SOL\tERROR")
+
+	for _, o := range outcomes {
+		m := o.Metrics
+		if m == nil {
+			m = &models.SimMetrics{}
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%.2f\t%.2f\t%d\t%.2f\t%.4f\t%s\n",
+			o.SimID, o.Config.Name, o.State, m.ReturnPct, m.MaxDrawdownPct, m.CallsTraded, m.WinRate, m.PnL, o.Error)
+	}
+
+	tw.Flush()
+}
+
+func printJSON(w io.Writer, v any) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printProgress keeps a single progress line updated on stderr.
+func printProgress(msg jobs.Message) {
+	switch msg.Event {
+	case "progress":
+		p := msg.Data.(simulator.Progress)
+		fmt.Fprintf(os.Stderr, "\r%5.1f%%  %s  %d events  %.0f events/s  $%.2f  %d open   ",
+			p.Percent, time.Unix(p.CurrentTimestamp, 0).UTC().Format(time.DateTime), p.EventsProcessed, p.EventsPerSecond, p.EquityUSD, p.OpenPositions)
+	case "feed":
+		if f := msg.Data.(live.FeedStatus); f.Error != "" {
+			fmt.Fprintf(os.Stderr, "\nlost %s: %s, reconnecting\n", f.Feed, f.Error)
+		}
+	case "done":
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// runCommand runs a single sim to completion, stores it and prints its metrics.
+// The exit code is 0 if the sim finished, 1 if it failed or was cancelled and 2 if the config is invalid.
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "", "sim config file, YAML or JSON")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	quiet := fs.Bool("quiet", false, "don't print progress to stderr")
+	parseArgs(fs, args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: otter run --config <sim.yaml> [--format table|json] [--quiet]")
+		return EXIT_USAGE
+	}
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+
+	config, err := loadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+
+	if err := openStores(1, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer shutdown()
+
+	if !validateConfig(config, "") {
+		return EXIT_USAGE
+	}
+
+	status := Jobs.Submit(config, simJob(config))
+
+	onMessage := func(i int, msg jobs.Message) { printProgress(msg) }
+	if *quiet {
+		onMessage = nil
+	}
+
+	result := outcome(config, waitForJobs([]string{status.ID}, onMessage)[0])
+
+	if *format == FORMAT_JSON {
+		printJSON(os.Stdout, result)
+	} else {
+		printOutcomes(os.Stdout, []SimOutcome{result})
+	}
+
+	if result.State != jobs.Done {
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
+
+// tpLadders collects repeated --tp flags, each "tps:tp_amounts", e.g. "2,10:0.5,1".
+type tpLadders [][2][]float64
+
+func (l *tpLadders) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *tpLadders) Set(value string) error {
+	tps, amounts, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("expected tps:tp_amounts, e.g. 2,10:0.5,1")
+	}
+
+	t, err := parseFloats(tps)
+	if err != nil {
+		return err
+	}
+
+	a, err := parseFloats(amounts)
+	if err != nil {
+		return err
+	}
+
+	*l = append(*l, [2][]float64{t, a})
+	return nil
+}
+
+func parseFloats(list string) ([]float64, error) {
+	values := []float64{}
+	for _, raw := range strings.Split(list, ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", raw)
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func formatFloats(values []float64) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return strings.Join(s, ",")
+}
+
+// sweepConfigs expands the base config into every combination of the swept values. A setting that isn't
+// swept keeps the base config's value. Each sim is named after the values it was run with.
+func sweepConfigs(base models.SimConfig, buyAmounts []float64, slippages []float64, ladders tpLadders) []models.SimConfig {
+	if len(buyAmounts) == 0 {
+		buyAmounts = []float64{base.BuyAmount}
+	}
+	if len(slippages) == 0 {
+		slippages = []float64{base.Slippage}
+	}
+	if len(ladders) == 0 {
+		ladders = tpLadders{{base.TPs, base.TPAmounts}}
+	}
+
+	configs := []models.SimConfig{}
+	for _, buy := range buyAmounts {
+		for _, slippage := range slippages {
+			for _, ladder := range ladders {
+				config := base
+				config.BuyAmount = buy
+				config.Slippage = slippage
+				config.TPs = ladder[0]
+				config.TPAmounts = ladder[1]
+				config.Name = fmt.Sprintf("%s [buy=%g slip=%g tp=%s:%s]", base.Name, buy, slippage, formatFloats(ladder[0]), formatFloats(ladder[1]))
+
+				configs = append(configs, config)
+			}
+		}
+	}
+
+	return configs
+}
+
+// sweepCommand runs a base config over a grid of buy amounts, slippages and TP ladders on the job manager,
+// then prints every sim's metrics. The exit code is 1 if any sim didn't finish.
+func sweepCommand(args []string) int {
+	var ladders tpLadders
+
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	configPath := fs.String("config", "", "base sim config file, YAML or JSON")
+	buyList := fs.String("buy-amounts", "", "comma separated buy amounts to sweep, e.g. 0.5,1,2")
+	slippageList := fs.String("slippages", "", "comma separated slippage percentages to sweep, e.g. 1,5")
+	fs.Var(&ladders, "tp", "a TP ladder to sweep as tps:tp_amounts, e.g. 2,10:0.5,1 (repeatable)")
+	parallel := fs.Int("parallel", 2, "number of sims that run at the same time")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	quiet := fs.Bool("quiet", false, "don't print progress to stderr")
+	parseArgs(fs, args)
+
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: otter sweep --config <sim.yaml> [--buy-amounts a,b] [--slippages a,b] [--tp tps:tp_amounts ...] [--parallel n]")
+		return EXIT_USAGE
+	}
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+
+	buyAmounts, err := parseFloats(*buyList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "--buy-amounts:", err)
+		return EXIT_USAGE
+	}
+
+	slippages, err := parseFloats(*slippageList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "--slippages:", err)
+		return EXIT_USAGE
+	}
+
+	base, err := loadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+
+	if err := openStores(*parallel, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer shutdown()
+
+	// nothing runs unless every config in the grid is valid
+	configs := sweepConfigs(base, buyAmounts, slippages, ladders)
+	valid := true
+	for _, config := range configs {
+		if !validateConfig(config, config.Name+": ") {
+			valid = false
+		}
+	}
+	if !valid {
+		return EXIT_USAGE
+	}
+
+	ids := make([]string, len(configs))
+	for i, config := range configs {
+		ids[i] = Jobs.Submit(config, simJob(config)).ID
+	}
+
+	finished := 0
+	onMessage := func(i int, msg jobs.Message) {
+		if msg.Event != "done" {
+			return
+		}
+
+		finished += 1
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s: %s\n", finished, len(configs), configs[i].Name, msg.Data.(jobs.DoneMessage).State)
+	}
+	if *quiet {
+		onMessage = nil
+	}
+
+	outcomes := make([]SimOutcome, len(configs))
+	code := EXIT_OK
+	for i, done := range waitForJobs(ids, onMessage) {
+		outcomes[i] = outcome(configs[i], done)
+		if done.State != jobs.Done {
+			code = EXIT_FAILED
+		}
+	}
+
+	// a sweep cut short with Ctrl-C didn't complete
+	sims := make([]webhooks.Sim, len(outcomes))
+	completed := true
+	for i, o := range outcomes {
+		sims[i] = webhooks.Sim{
+			JobID:      o.JobID,
+			SimID:      o.SimID,
+			Name:       o.Config.Name,
+			ConfigHash: o.Config.Hash(),
+			State:      o.State,
+			Error:      o.Error,
+			Metrics:    o.Metrics,
+		}
+		completed = completed && o.State != jobs.Cancelled
+	}
+	if completed {
+		Webhooks.SweepCompleted(base.Name, sims)
+	}
+
+	if *format == FORMAT_JSON {
+		printJSON(os.Stdout, outcomes)
+	} else {
+		printOutcomes(os.Stdout, outcomes)
+	}
+
+	return code
+}
+
+// listCommand prints every stored sim with its headline metrics.
+func listCommand(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	parseArgs(fs, args)
+
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+
+	var err error
+	Results, err = database.OpenResultStore(Settings.Database.ResultsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer Results.Close()
+
+	metrics, err := Results.ListMetrics()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	if *format == FORMAT_JSON {
+		printJSON(os.Stdout, metrics)
+		return EXIT_OK
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIM ID\tNAME\tRETURN %\tMAX DD %\tCALLS\tWIN RATE\tPNL SOL\tFINAL SOL")
+	for _, m := range metrics {
+		fmt.Fprintf(tw, "%d\t%s\t%.2f\t%.2f\t%d\t%.2f\t%.4f\t%.4f\n",
+			m.SimID, m.Name, m.ReturnPct, m.MaxDrawdownPct, m.CallsTraded, m.WinRate, m.PnL, m.FinalSOLBalance)
+	}
+	tw.Flush()
+
+	return EXIT_OK
+}
+
+// showCommand prints one panel of a stored sim, the same panels /load_sim serves. Without a panel it
+// prints the sim's config and metrics.
+func showCommand(args []string) int {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	panel := fs.String("panel", "", "panel to show: metadata, config, portfolio, assets, balance_updates, trade_history, ledger or metrics")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: otter show <sim_id> [--panel name] [--format table|json]")
+		return EXIT_USAGE
+	}
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+
+	id, err := strconv.Atoi(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid sim id", positional[0])
+		return EXIT_USAGE
+	}
+
+	Results, err = database.OpenResultStore(Settings.Database.ResultsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer Results.Close()
+
+	if *panel == "" {
+		config, err := loadSimPanel(id, "config", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+
+		metrics, err := loadSimPanel(id, "metrics", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+
+		if *format == FORMAT_JSON {
+			printJSON(os.Stdout, map[string]any{"config": config, "metrics": metrics})
+			return EXIT_OK
+		}
+
+		printFields(os.Stdout, config)
+		fmt.Println()
+		printFields(os.Stdout, metrics)
+		return EXIT_OK
+	}
+
+	data, err := loadSimPanel(id, *panel, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	if data == nil {
+		fmt.Fprintln(os.Stderr, "unknown panel", *panel)
+		return EXIT_USAGE
+	}
+
+	if *format == FORMAT_JSON {
+		printJSON(os.Stdout, data)
+		return EXIT_OK
+	}
+
+	printPanel(os.Stdout, data)
+	return EXIT_OK
+}
+
+// printPanel prints a panel as a table. Panels without a natural table shape (assets) are printed as JSON.
+func printPanel(w io.Writer, data any) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	switch d := data.(type) {
+	case []models.LedgerEntry:
+		fmt.Fprintln(tw, "FILE ID\tNAME\tCONTRACT\tENTRY PRICE\tTP STAGE\tBUYS\tSELLS\tSOL IN\tSOL OUT\tPNL SOL")
+		for _, l := range d {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%g\t%d\t%d\t%d\t%.4f\t%.4f\t%.4f\n",
+				l.FileID, l.Name, l.ContractAddress, l.EntryPrice, l.TPStage, l.Buys, l.Sells, l.SOLIn, l.SOLOut, l.PnL)
+		}
+	case []models.SimEvent:
+		fmt.Fprintln(tw, "TIME\tTYPE\tFILE ID\tTOKEN PRICE\tSOL CHANGE")
+		for _, e := range d {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%g\t%.4f\n",
+				time.Unix(e.Timestamp, 0).UTC().Format(time.DateTime), e.Type, e.FileID, e.TokenPrice, e.SOLChange)
+		}
+	case map[int64]float64:
+		blocks := make([]int64, 0, len(d))
+		for block := range d {
+			blocks = append(blocks, block)
+		}
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+
+		fmt.Fprintln(tw, "BLOCK\tUSD")
+		for _, block := range blocks {
+			fmt.Fprintf(tw, "%d\t%.2f\n", block, d[block])
+		}
+	default:
+		if reflect.Indirect(reflect.ValueOf(data)).Kind() == reflect.Struct {
+			printFields(tw, data)
+			return
+		}
+		printJSON(tw, data)
+	}
+}
+
+// printFields prints a struct as one "json_name  value" row per field. Embedded structs are flattened.
+func printFields(w io.Writer, v any) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	var walk func(rv reflect.Value)
+	walk = func(rv reflect.Value) {
+		rv = reflect.Indirect(rv)
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				walk(rv.Field(i))
+				continue
+			}
+
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			value := rv.Field(i).Interface()
+			if k := field.Type.Kind(); k == reflect.Struct || k == reflect.Slice || k == reflect.Map {
+				raw, _ := json.Marshal(value)
+				value = string(raw)
+			}
+
+			fmt.Fprintf(tw, "%s\t%v\n", name, value)
+		}
+	}
+	walk(reflect.ValueOf(v))
+}
+
+// ingestCommand bulk loads event and token metadata files into the events database, in one transaction.
+func ingestCommand(args []string) int {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	events := fs.String("events", "", "events file or glob to load, CSV or Parquet, e.g. 'harvest/events_*.csv'")
+	metadata := fs.String("metadata", "", "token metadata file or glob to load into file_metadata, CSV or Parquet")
+	maxRejects := fs.Int64("max-rejects", 0, "CSV rows that can be rejected before the whole ingest is rolled back")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	parseArgs(fs, args)
+
+	if *events == "" && *metadata == "" {
+		fmt.Fprintln(os.Stderr, "usage: otter ingest [--events <glob>] [--metadata <file>] [--max-rejects 0] [--format table|json]")
+		return EXIT_USAGE
+	}
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+
+	// loading events is asking for the database to be written, so a new one is created here
+	db, _, err := database.ConnectAndMigrate(Settings.Database.EventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	// metadata first, so the events' file IDs have something to refer to
+	loads := []database.Load{}
+	if *metadata != "" {
+		loads = append(loads, database.Load{Table: "file_metadata", Path: *metadata})
+	}
+	if *events != "" {
+		loads = append(loads, database.Load{Table: "events", Path: *events})
+	}
+
+	results, err := db.Ingest(loads, *maxRejects)
+
+	if *format == FORMAT_JSON {
+		report := map[string]any{"loads": results, "committed": err == nil}
+		if err != nil {
+			report["error"] = err.Error()
+		}
+		printJSON(os.Stdout, report)
+	} else if len(results) > 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TABLE\tPATH\tFILES\tROWS\tREJECTED\tALREADY LOADED")
+		for _, r := range results {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", r.Table, r.Path, r.Files, r.Rows, r.Rejected, r.Existing)
+		}
+		tw.Flush()
+
+		for _, r := range results {
+			for _, reject := range r.Rejects {
+				fmt.Printf("rejected %s:%d %s: %s\n", reject.File, reject.Line, reject.Column, reject.Error)
+			}
+			if int(r.Rejected) > len(r.Rejects) {
+				fmt.Printf("... and %d more rejected rows in %s\n", int(r.Rejected)-len(r.Rejects), r.Path)
+			}
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "nothing was loaded")
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
+
+// auditCommand reports problems in the events table, and can write a cleaned copy sims can be pointed at
+// with the database.events_table setting.
+func auditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	table := fs.String("table", "events", "events table to audit")
+	gap := fs.Duration("gap", time.Hour, "report tokens with no events for longer than this")
+	samples := fs.Int("samples", 10, "example rows listed per problem")
+	clean := fs.Bool("clean", false, "write the cleaned events into events_clean")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	parseArgs(fs, args)
+
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+	if *gap < time.Second || *samples < 1 {
+		fmt.Fprintln(os.Stderr, "--gap must be at least 1s and --samples at least 1")
+		return EXIT_USAGE
+	}
+
+	db, err := database.Connect(Settings.Database.EventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	report, err := db.Audit(ctx, database.AuditOptions{
+		Table:       *table,
+		GapSeconds:  int64(gap.Seconds()),
+		MinSOLPrice: Settings.Simulator.MinSOLPrice,
+		Samples:     *samples,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	var cleaned int64
+	if *clean {
+		if cleaned, err = db.WriteCleanEvents(ctx, *table); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+	}
+
+	if *format == FORMAT_JSON {
+		out := map[string]any{"report": report}
+		if *clean {
+			out["events_clean"] = cleaned
+		}
+		printJSON(os.Stdout, out)
+		return EXIT_OK
+	}
+
+	printAudit(os.Stdout, report)
+	if *clean {
+		fmt.Printf("\nwrote %d events to events_clean, set database.events_table (or OTTER_EVENTS_TABLE) to events_clean to sim on them\n", cleaned)
+	}
+
+	return EXIT_OK
+}
+
+// migrateCommand brings the events database up to the latest schema. Other commands refuse to open one that
+// isn't, so nothing changes the user's events without being asked to.
+func migrateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	parseArgs(fs, args)
+
+	db, from, err := database.ConnectAndMigrate(Settings.Database.EventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	if from < database.SCHEMA_VERSION {
+		fmt.Printf("migrated %s from schema version %d\n", Settings.Database.EventsPath, from)
+	}
+	fmt.Printf("%s is at schema version %d\n", Settings.Database.EventsPath, database.SCHEMA_VERSION)
+
+	return EXIT_OK
+}
+
+// candlesCommand materialises the candles of the events table, so /candles and candle sims read them instead of
+// aggregating the events every time.
+func candlesCommand(args []string) int {
+	fs := flag.NewFlagSet("candles", flag.ExitOnError)
+	intervals := fs.String("intervals", strings.Join(database.CANDLE_INTERVAL_NAMES, ","), "comma separated candle intervals to write")
+	drop := fs.Bool("drop", false, "drop the materialised candles instead, so they're computed from the events")
+	parseArgs(fs, args)
+
+	names := strings.Split(*intervals, ",")
+	for _, name := range names {
+		if _, err := database.CandleInterval(name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+	}
+
+	db, err := database.Connect(Settings.Database.EventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	if err := db.UseEventsTable(Settings.Database.EventsTable); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *drop {
+		if err := db.DropCandles(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+		fmt.Printf("dropped the candles of %s\n", Settings.Database.EventsTable)
+		return EXIT_OK
+	}
+
+	for _, name := range names {
+		began := time.Now()
+		n, err := db.MaterialiseCandles(ctx, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+		fmt.Printf("wrote %d %s candles of %s in %s\n", n, name, Settings.Database.EventsTable, time.Since(began).Round(time.Millisecond))
+	}
+
+	return EXIT_OK
+}
+
+func printAudit(w io.Writer, r database.AuditReport) {
+	fmt.Fprintf(w, "%s: %d events over %d tokens\n\n", r.Table, r.Events, r.Tokens)
+
+	checks := []struct {
+		name  string
+		check database.AuditCheck
+	}{
+		{"inverted prices", r.InvertedPrices},
+		{"invalid prices", r.InvalidPrices},
+		{"low SOL prices", r.LowSOLPrices},
+		{"duplicates", r.Duplicates},
+		{"orphan events", r.OrphanEvents},
+		{"block/timestamp", r.BlockTimestamps},
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tCOUNT\tMEANING")
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", c.name, c.check.Count, c.check.Description)
+	}
+	fmt.Fprintf(tw, "orphan tokens\t%d\tfile_ids with events but no file_metadata row\n", r.OrphanTokens)
+	fmt.Fprintf(tw, "gaps\t%d\ta token had no events for more than %s\n", r.GapCount, time.Duration(r.GapSeconds)*time.Second)
+	tw.Flush()
+
+	price := func(p *float64) string {
+		if p == nil {
+			return "NaN/NULL"
+		}
+		return strconv.FormatFloat(*p, 'g', 6, 64)
+	}
+
+	for _, c := range checks {
+		if len(c.check.Samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", c.name)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  FILE_ID\tTIMESTAMP\tBLOCK\tTOKEN0_USD\tTOKEN1_USD")
+		for _, e := range c.check.Samples {
+			fmt.Fprintf(tw, "  %d\t%d\t%d\t%s\t%s\n", e.FileID, e.Timestamp, e.BlockNumber, price(e.Token0USD), price(e.Token1USD))
+		}
+		tw.Flush()
+	}
+
+	if len(r.Gaps) > 0 {
+		fmt.Fprintln(w, "\nlargest gaps:")
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  FILE_ID\tFROM\tTO\tLENGTH")
+		for _, g := range r.Gaps {
+			fmt.Fprintf(tw, "  %d\t%d\t%d\t%s\n", g.FileID, g.From, g.To, time.Duration(g.Seconds)*time.Second)
+		}
+		tw.Flush()
+	}
+}
+
+// importCommand loads an old sim_output JSON directory into the results database.
+// The directory defaults to the output directory in the settings.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	positional := parseArgs(fs, args)
+
+	if len(positional) == 0 {
+		positional = []string{Settings.Database.OutputDir}
+	}
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: otter import [sim_output dir]")
+		return EXIT_USAGE
+	}
+
+	var err error
+	Results, err = database.OpenResultStore(Settings.Database.ResultsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer Results.Close()
+
+	n, err := Results.ImportJSONDir(positional[0])
+	fmt.Println("imported", n, "sims from", positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
+
+// exportCommand writes every table of a stored sim to Parquet or Arrow files.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", database.FormatParquet, "export format, parquet or arrow")
+	dir := fs.String("out", Settings.Database.OutputDir, "directory exported files are written to")
+	positional := parseArgs(fs, args)
+
+	usage := "usage: otter export <sim_id> [--format parquet|arrow] [--out dir]"
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+	if *format != database.FormatParquet && *format != database.FormatArrow {
+		fmt.Fprintf(os.Stderr, "unknown format %q, expected parquet or arrow\n", *format)
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+
+	id, err := strconv.Atoi(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid sim id", positional[0])
+		return EXIT_USAGE
+	}
+
+	Results, err = database.OpenResultStore(Settings.Database.ResultsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer Results.Close()
+
+	if err := exportSimFiles(id, *format, *dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
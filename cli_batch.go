@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"otter/database"
+	"otter/jobs"
+	"otter/models"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// batch line states on top of the job states
+const (
+	BATCH_SKIPPED = "skipped" // a sim with the same config hash is already stored
+	BATCH_INVALID = "invalid" // the line isn't a valid config, nothing was run
+)
+
+// BatchResult is one line of the summary otter batch writes, for one line of its input.
+type BatchResult struct {
+	Line       int                `json:"line"`
+	Name       string             `json:"name"`
+	ConfigHash string             `json:"config_hash,omitempty"`
+	State      string             `json:"state"`
+	SimID      int                `json:"sim_id,omitempty"`
+	Metrics    *models.SimMetrics `json:"metrics,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	Fields     []FieldError       `json:"fields,omitempty"`
+}
+
+// batchLine is an input line that passed validation.
+type batchLine struct {
+	line   int
+	config models.SimConfig
+	hash   string
+}
+
+// batchCommand runs every config in a JSONL file, one /run_sim document per line, and writes a JSONL summary
+// as each one finishes. Lines whose config hash already has a stored sim are skipped, so an interrupted
+// batch can be re-run to pick up where it stopped.
+func batchCommand(args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	out := fs.String("out", "", "file the JSONL summary is written to, stdout if empty")
+	parallel := fs.Int("parallel", Settings.Server.MaxSims, "number of sims that run at the same time")
+	force := fs.Bool("force", false, "run every line, even if a sim with the same config is already stored")
+	positional := parseArgs(fs, args)
+
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: otter batch <requests.jsonl> [--out summary.jsonl] [--parallel n] [--force]")
+		return EXIT_USAGE
+	}
+
+	input, err := os.Open(positional[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	defer input.Close()
+
+	summary := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+		defer f.Close()
+		summary = f
+	}
+	enc := json.NewEncoder(summary)
+
+	if err := openStores(*parallel, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer shutdown()
+
+	code := EXIT_OK
+	write := func(r BatchResult) {
+		if r.State != string(jobs.Done) && r.State != BATCH_SKIPPED {
+			code = EXIT_FAILED
+		}
+		enc.Encode(r)
+	}
+
+	lines, err := readBatchLines(input, *force, write)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	ids := make([]string, len(lines))
+	for i, l := range lines {
+		ids[i] = Jobs.Submit(l.config, simJob(l.config)).ID
+	}
+
+	finished := 0
+	waitForJobs(ids, func(i int, msg jobs.Message) {
+		if msg.Event != "done" {
+			return
+		}
+
+		l := lines[i]
+		o := outcome(l.config, msg.Data.(jobs.DoneMessage))
+		write(BatchResult{
+			Line:       l.line,
+			Name:       l.config.Name,
+			ConfigHash: l.hash,
+			State:      string(o.State),
+			SimID:      o.SimID,
+			Metrics:    o.Metrics,
+			Error:      o.Error,
+		})
+
+		finished += 1
+		fmt.Fprintf(os.Stderr, "[%d/%d] line %d %s: %s\n", finished, len(lines), l.line, l.config.Name, o.State)
+	})
+
+	return code
+}
+
+// readBatchLines parses and validates every line, writing the summary for lines that are invalid or already
+// stored straight away. The rest are returned to be run, with duplicate configs in the file only run once.
+func readBatchLines(input io.Reader, force bool, write func(BatchResult)) ([]batchLine, error) {
+	lines := []batchLine{}
+	queued := map[string]bool{}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	n := 0
+	for scanner.Scan() {
+		n += 1
+
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+
+		config, fields, err := parseBatchLine([]byte(raw))
+		if err != nil {
+			write(BatchResult{Line: n, Name: config.Name, State: BATCH_INVALID, Error: err.Error(), Fields: fields})
+			continue
+		}
+
+		hash := config.Hash()
+		if queued[hash] {
+			write(BatchResult{Line: n, Name: config.Name, ConfigHash: hash, State: BATCH_SKIPPED, Error: "same config as an earlier line"})
+			continue
+		}
+
+		if !force {
+			simID, err := Results.FindSimByConfigHash(hash)
+			if err == nil {
+				r := BatchResult{Line: n, Name: config.Name, ConfigHash: hash, State: BATCH_SKIPPED, SimID: simID}
+				if metrics, err := Results.GetMetrics(simID); err == nil {
+					r.Metrics = &metrics
+				}
+
+				write(r)
+				continue
+			}
+			if !errors.Is(err, database.ErrSimNotFound) {
+				return nil, err
+			}
+		}
+
+		queued[hash] = true
+		lines = append(lines, batchLine{line: n, config: config, hash: hash})
+	}
+
+	return lines, scanner.Err()
+}
+
+// parseBatchLine reads a line the same way /run_sim reads a request body.
+func parseBatchLine(raw []byte) (models.SimConfig, []FieldError, error) {
+	raw, err := Settings.MergeSimDefaults(raw)
+	if err != nil {
+		return models.SimConfig{}, nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	config, err := models.MigrateSimConfig(raw)
+	if err != nil {
+		return config, nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	if err := binding.Validator.ValidateStruct(config); err != nil {
+		fields, ok := validationErrors(err)
+		if !ok {
+			return config, nil, err
+		}
+		return config, fields, errors.New("invalid sim config")
+	}
+
+	return config, nil, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"otter/models"
+	"otter/settings"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// batchLines reads input with a sim of validConfig already stored as 7, and returns the lines to run and the
+// summary written for the others, as line:state.
+func batchLines(t *testing.T, input string, force bool) ([]int, []string) {
+	t.Helper()
+
+	Settings = settings.Default()
+	setupValidation()
+	storeSim(t, 1)
+
+	config, err := models.MigrateSimConfig([]byte(validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Results.SaveSim(&models.SimResult{
+		Metadata:        models.SimulatorMetadata{ID: 7, Date: "2026-01-02 03:04:05", SimConfig: config},
+		BalanceTracking: []models.BalancePoint{},
+		Events:          []models.SimEvent{},
+		Skips:           []models.Skip{},
+		Ledger:          []models.LedgerEntry{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := []string{}
+	lines, err := readBatchLines(strings.NewReader(input), force, func(r BatchResult) {
+		summary := fmt.Sprintf("%d:%s", r.Line, r.State)
+		if r.SimID != 0 {
+			summary += fmt.Sprintf(":%d", r.SimID)
+		}
+		written = append(written, summary)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := []int{}
+	for _, l := range lines {
+		run = append(run, l.line)
+	}
+
+	return run, written
+}
+
+func TestReadBatchLines(t *testing.T) {
+	// validConfig on one line, with a field replaced
+	line := func(old string, new string) string {
+		return strings.ReplaceAll(strings.Replace(validConfig, old, new, 1), "\n", " ")
+	}
+
+	input := strings.Join([]string{
+		line(`"name": "test"`, `"name": "renamed"`), // stored already, under another name
+		line(`"slippage": 5`, `"slippage": 6`),
+		"",
+		line(`"slippage": 5`, `"slippage": 6, "name": "again"`), // the same as line 2
+		`{"name": "broken"`,
+		line(`"slippage": 5`, `"slippage": 7`),
+	}, "\n")
+
+	tests := map[string]struct {
+		force   bool
+		run     []int
+		written []string
+	}{
+		"resuming": {false, []int{2, 6}, []string{"1:skipped:7", "4:skipped", "5:invalid"}},
+		"forced":   {true, []int{1, 2, 6}, []string{"4:skipped", "5:invalid"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			run, written := batchLines(t, input, test.force)
+
+			if !reflect.DeepEqual(run, test.run) {
+				t.Errorf("ran lines %v, want %v", run, test.run)
+			}
+			if !reflect.DeepEqual(written, test.written) {
+				t.Errorf("wrote %v, want %v", written, test.written)
+			}
+		})
+	}
+}
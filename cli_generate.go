@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"otter/database"
+	"otter/synth"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// scenarioWeights is a --scenarios flag, a comma separated list of scenario=weight. A scenario without a
+// weight gets 1.
+type scenarioWeights map[string]float64
+
+func (s scenarioWeights) String() string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.FormatFloat(s[name], 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s scenarioWeights) Set(value string) error {
+	for _, part := range strings.Split(value, ",") {
+		name, weight, found := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+
+		w := 1.0
+		if found {
+			var err error
+			if w, err = strconv.ParseFloat(weight, 64); err != nil {
+				return fmt.Errorf("weight for %s: %w", name, err)
+			}
+		}
+		s[name] = w
+	}
+
+	return nil
+}
+
+// generateCommand writes synthetic calls and events, following known price paths, into a new events database.
+// Pointing database.events_path at it lets strategies be checked against answers that are known up front.
+func generateCommand(args []string) int {
+	defaults := synth.DefaultConfig()
+	scenarios := scenarioWeights{}
+
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := fs.String("out", "synthetic.duckdb", "DuckDB file the calls and events are written to")
+	force := fs.Bool("force", false, "replace --out if it already exists")
+	seed := fs.Int64("seed", defaults.Seed, "random seed, the same seed and flags always generate the same data")
+	start := fs.Int64("start", defaults.Start, "unix timestamp the first day starts at")
+	days := fs.Int("days", defaults.Days, "days of calls to generate")
+	callsPerDay := fs.Float64("calls-per-day", defaults.CallsPerDay, "mean calls a day")
+	fs.Var(scenarios, "scenarios", "scenarios to pick from and their weights, e.g. 'pump_and_dump=2,rug_pull=1', all equally by default")
+	duration := fs.Duration("duration", defaults.Duration, "events generated after each call")
+	interval := fs.Duration("interval", defaults.Interval, "mean time between a token's swaps")
+	rugAfter := fs.Duration("rug-after", defaults.RugAfter, "time after the call a rug pull happens")
+	solPrice := fs.Float64("sol-price", defaults.SOLPrice, "SOL/USD at the start")
+	solVol := fs.Float64("sol-vol", defaults.SOLVol, "annualised volatility of SOL/USD")
+	parseArgs(fs, args)
+
+	cfg := synth.Config{
+		Seed:        *seed,
+		Start:       *start,
+		Days:        *days,
+		CallsPerDay: *callsPerDay,
+		Scenarios:   scenarios,
+		Duration:    *duration,
+		Interval:    *interval,
+		RugAfter:    *rugAfter,
+		SOLPrice:    *solPrice,
+		SOLVol:      *solVol,
+		StartBlock:  defaults.StartBlock,
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid flags:", err)
+		return EXIT_USAGE
+	}
+
+	if _, err := os.Stat(*out); err == nil {
+		if !*force {
+			fmt.Fprintf(os.Stderr, "%s already exists, use --force to replace it\n", *out)
+			return EXIT_USAGE
+		}
+		if err := os.Remove(*out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+		os.Remove(*out + ".wal")
+	}
+
+	// written out as CSVs first, so they go through the same checks and loading as real data
+	dir, err := os.MkdirTemp("", "otter-generate")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := synth.NewCSVWriter(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	began := time.Now()
+	calls, err := synth.Generate(cfg, w)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "generating:", err)
+		return EXIT_FAILED
+	}
+
+	db, _, err := database.ConnectAndMigrate(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	_, err = db.Ingest([]database.Load{
+		{Table: "file_metadata", Path: w.MetadataPath},
+		{Table: "events", Path: w.EventsPath},
+	}, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	type summary struct{ calls, events int }
+	byScenario := map[string]*summary{}
+	total := summary{}
+	for _, c := range calls {
+		if byScenario[c.Scenario] == nil {
+			byScenario[c.Scenario] = &summary{}
+		}
+		byScenario[c.Scenario].calls += 1
+		byScenario[c.Scenario].events += c.Events
+		total.calls += 1
+		total.events += c.Events
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCENARIO\tCALLS\tEVENTS")
+	for _, name := range synth.SCENARIOS {
+		if s, ok := byScenario[name]; ok {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", name, s.calls, s.events)
+		}
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\n", total.calls, total.events)
+	tw.Flush()
+
+	fmt.Printf("\nwrote %s in %s, set database.events_path (or OTTER_EVENTS_DB) to it to sim on it\n", *out, time.Since(began).Round(time.Millisecond))
+
+	return EXIT_OK
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"otter/ingest"
+	"syscall"
+	"time"
+)
+
+// harvestCommand pages the events and metadata of every call in a calls CSV out of Codex into CSV files,
+// ready for otter ingest. Re-running it with the same --out resumes where it stopped.
+func harvestCommand(args []string) int {
+	fs := flag.NewFlagSet("harvest", flag.ExitOnError)
+	callsPath := fs.String("calls", "", "CSV of calls to harvest, with a file_id,ca,call_timestamp header")
+	out := fs.String("out", "harvest", "directory the CSV files and the resume state are written to")
+	rps := fs.Float64("rps", 5, "most requests a second sent to Codex")
+	before := fs.Duration("before", 0, "harvest events from this long before each call")
+	after := fs.Duration("after", 24*time.Hour, "harvest events until this long after each call")
+	endpoint := fs.String("endpoint", ingest.CODEX_ENDPOINT, "Codex GraphQL endpoint")
+	record := fs.String("record", "", "record every response into this fixtures file")
+	mock := fs.String("mock", "", "serve responses from this fixtures file instead of calling Codex")
+	parseArgs(fs, args)
+
+	if *callsPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: otter harvest --calls <calls.csv> [--out dir] [--rps 5] [--before 0s] [--after 24h] [--record file | --mock file]")
+		return EXIT_USAGE
+	}
+
+	f, err := os.Open(*callsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	calls, err := ingest.ReadCalls(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *callsPath+":", err)
+		return EXIT_USAGE
+	}
+
+	// the API key is only read from the environment, so it never ends up in shell history
+	client := ingest.NewClient(os.Getenv("CODEX_API_KEY"), *rps)
+	client.Endpoint = *endpoint
+
+	if *mock != "" {
+		fixtures, err := ingest.LoadFixtures(*mock)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+
+		server := ingest.NewMockServer(fixtures)
+		defer server.Close()
+		client.Endpoint = server.URL
+	} else if client.APIKey == "" {
+		fmt.Fprintln(os.Stderr, "CODEX_API_KEY isn't set")
+		return EXIT_USAGE
+	}
+
+	var recorder *ingest.Recorder
+	if *record != "" {
+		recorder = ingest.NewRecorder(client.HTTP)
+		client.HTTP = recorder
+	}
+
+	h := ingest.NewHarvester(client, *out)
+	h.Before = *before
+	h.After = *after
+	h.OnPage = func(call ingest.Call, events int64) {
+		fmt.Fprintf(os.Stderr, "\rfile %d (%s): %d events   ", call.FileID, call.Address, events)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err = h.Harvest(ctx, calls)
+	fmt.Fprintln(os.Stderr)
+
+	if recorder != nil {
+		if err := recorder.Fixtures.Save(*record); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "run the same command again to resume")
+		return EXIT_FAILED
+	}
+
+	fmt.Printf("harvested %d calls into %s, load them with: otter ingest --events '%s/events_*.csv' --metadata %s/%s\n",
+		len(calls), *out, *out, *out, ingest.METADATA_FILE)
+
+	return EXIT_OK
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"otter/database"
+	"otter/jobs"
+	"otter/live"
+	"otter/simulator"
+)
+
+// paperCommand paper trades a sim config on a live feed until the feed ends, end_timestamp passes or it's
+// stopped with Ctrl-C. The session is stored as it runs, and can be loaded like any other sim.
+// --replay plays the events database over the config's time range as the feed, like otter replay does.
+func paperCommand(args []string) int {
+	fs := flag.NewFlagSet("paper", flag.ExitOnError)
+	configPath := fs.String("config", "", "sim config file, YAML or JSON")
+	feed := fs.String("feed", "", "live feed, a ws://, wss://, http:// or https:// URL")
+	replay := fs.Bool("replay", false, "replay the events database as the feed, instead of --feed")
+	speed := fs.Float64("speed", 1, "replay speed, 1 is real time, 0 as fast as possible")
+	format := fs.String("format", FORMAT_TABLE, "output format, table or json")
+	quiet := fs.Bool("quiet", false, "don't print progress to stderr")
+	parseArgs(fs, args)
+
+	if *configPath == "" || (*feed == "") == !*replay {
+		fmt.Fprintln(os.Stderr, "usage: otter paper --config <sim.yaml> <--feed <url> | --replay [--speed 1]> [--format table|json] [--quiet]")
+		return EXIT_USAGE
+	}
+	if !checkFormat(*format) {
+		return EXIT_USAGE
+	}
+	if *feed != "" {
+		if err := live.CheckFeed(*feed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_USAGE
+		}
+	}
+
+	config, err := loadConfigFile(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE
+	}
+	if config.Candles != "" {
+		fmt.Fprintln(os.Stderr, "paper trading plays swaps, candles can't be used")
+		return EXIT_USAGE
+	}
+
+	if err := openStores(1, false); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer shutdown()
+
+	if !validateConfig(config, "") {
+		return EXIT_USAGE
+	}
+
+	if *replay {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+
+		// calls are sent as early as a backtest could buy them, so the session trades the same
+		player := live.NewPlayer(&DBConnection, config.StartTimestamp, config.EndTimestamp, *speed)
+		player.Lead = simulator.BUY_WINDOW
+		player.Options = database.StreamOptions{
+			Window:   Settings.Simulator.BatchSize,
+			PageSize: Settings.Simulator.PageSize,
+			Prefetch: Settings.Simulator.Prefetch,
+		}
+
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go player.Run(ctx)
+
+		server := &http.Server{Handler: player.Handler()}
+		go server.Serve(listener)
+		defer server.Close()
+
+		*feed = "http://" + listener.Addr().String() + "/feed"
+	}
+
+	status := Jobs.Submit(config, paperJob(config, *feed))
+
+	onMessage := func(i int, msg jobs.Message) { printProgress(msg) }
+	if *quiet {
+		onMessage = nil
+	}
+
+	result := outcome(config, waitForJobs([]string{status.ID}, onMessage)[0])
+
+	if *format == FORMAT_JSON {
+		printJSON(os.Stdout, result)
+	} else {
+		printOutcomes(os.Stdout, []SimOutcome{result})
+	}
+
+	// stopping a session with Ctrl-C is how it normally ends
+	if result.State == jobs.Failed {
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"otter/database"
+	"otter/live"
+	"syscall"
+)
+
+// replayCommand serves the events database as a live feed, a local stand-in for a live data provider that
+// paper trading and anything else reading a feed can connect to.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	port := fs.Int("port", 8900, "port the replay listens on")
+	from := fs.Int64("from", 0, "unix timestamp to replay from, defaults to the first event")
+	to := fs.Int64("to", 0, "unix timestamp to replay to, defaults to the last event")
+	speed := fs.Float64("speed", 1, "replay speed, 1 is real time, 10 ten times as fast, 0 as fast as the clients read")
+	lead := fs.Int64("call-lead", 0, "send calls this many seconds before their call_timestamp")
+	parseArgs(fs, args)
+
+	if *speed < 0 || *lead < 0 {
+		fmt.Fprintln(os.Stderr, "--speed and --call-lead can't be negative")
+		return EXIT_USAGE
+	}
+
+	db, err := database.Connect(Settings.Database.EventsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+	defer db.Disconnect()
+
+	if err := db.UseEventsTable(Settings.Database.EventsTable); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	if *from == 0 || *to == 0 {
+		start, end, err := db.GetSimulationStartAndEnd()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return EXIT_FAILED
+		}
+		if *from == 0 {
+			*from = start
+		}
+		if *to == 0 {
+			*to = end
+		}
+	}
+	if *from > *to {
+		fmt.Fprintf(os.Stderr, "--from %d is after --to %d\n", *from, *to)
+		return EXIT_USAGE
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	player := live.NewPlayer(&db, *from, *to, *speed)
+	player.Lead = *lead
+	player.Options = database.StreamOptions{
+		Window:   Settings.Simulator.BatchSize,
+		PageSize: Settings.Simulator.PageSize,
+		Prefetch: Settings.Simulator.Prefetch,
+	}
+
+	played := make(chan error, 1)
+	go func() {
+		played <- player.Run(ctx)
+		stop()
+	}()
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: player.Handler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("replaying %d to %d at %gx on http://localhost:%d/feed, it starts when the first client connects", *from, *to, *speed, *port)
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	if err := <-played; err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_FAILED
+	}
+
+	return EXIT_OK
+}
@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+)
+
+// AuditOptions tunes what counts as a problem, the zero value uses the defaults.
+type AuditOptions struct {
+	Table       string  // events table to audit, "events" by default
+	GapSeconds  int64   // a token with no events for longer than this has a gap, an hour by default
+	MinSOLPrice float64 // SOL prices at or below this are reported as implausible
+	Samples     int     // examples listed per check, 10 by default
+}
+
+// AuditEvent is an example row of a check. Prices that are NaN, infinite or NULL are nil.
+type AuditEvent struct {
+	FileID      int      `json:"file_id"`
+	Timestamp   int64    `json:"timestamp"`
+	BlockNumber int64    `json:"block_number"`
+	Token0USD   *float64 `json:"token0_swap_value_usd"`
+	Token1USD   *float64 `json:"token1_swap_value_usd"`
+}
+
+type AuditCheck struct {
+	Description string       `json:"description"`
+	Count       int64        `json:"count"`
+	Samples     []AuditEvent `json:"samples"`
+}
+
+// AuditGap is a stretch of time in which a token has no events.
+type AuditGap struct {
+	FileID  int   `json:"file_id"`
+	From    int64 `json:"from"`
+	To      int64 `json:"to"`
+	Seconds int64 `json:"seconds"`
+}
+
+type AuditReport struct {
+	Table  string `json:"table"`
+	Events int64  `json:"events"`
+	Tokens int64  `json:"tokens"`
+
+	InvertedPrices  AuditCheck `json:"inverted_prices"`
+	InvalidPrices   AuditCheck `json:"invalid_prices"`
+	LowSOLPrices    AuditCheck `json:"low_sol_prices"`
+	Duplicates      AuditCheck `json:"duplicates"`
+	OrphanEvents    AuditCheck `json:"orphan_events"`
+	OrphanTokens    int64      `json:"orphan_tokens"`
+	BlockTimestamps AuditCheck `json:"block_timestamp_inconsistencies"`
+
+	GapSeconds int64      `json:"gap_seconds"`
+	GapCount   int64      `json:"gap_count"`
+	Gaps       []AuditGap `json:"largest_gaps"`
+
+	Duration time.Duration `json:"duration_ns"`
+}
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (o AuditOptions) withDefaults() AuditOptions {
+	if o.Table == "" {
+		o.Table = "events"
+	}
+	if o.GapSeconds <= 0 {
+		o.GapSeconds = 60 * 60
+	}
+	if o.Samples <= 0 {
+		o.Samples = 10
+	}
+
+	return o
+}
+
+// the sim treats token0 as the SOL price and token1 as the token's price in SOL, and swaps them when
+// token1 is the larger of the two
+const (
+	invalidPrice = `(%[1]s IS NULL OR isnan(%[1]s) OR isinf(%[1]s) OR %[1]s <= 0)`
+	validPrices  = `NOT ` + `(token0_swap_value_usd IS NULL OR isnan(token0_swap_value_usd) OR isinf(token0_swap_value_usd) OR token0_swap_value_usd <= 0)` +
+		` AND NOT ` + `(token1_swap_value_usd IS NULL OR isnan(token1_swap_value_usd) OR isinf(token1_swap_value_usd) OR token1_swap_value_usd <= 0)`
+)
+
+// Audit checks the events table for the data problems the simulator otherwise papers over at query time.
+func (db *Database) Audit(ctx context.Context, opts AuditOptions) (AuditReport, error) {
+	opts = opts.withDefaults()
+	if !tableName.MatchString(opts.Table) {
+		return AuditReport{}, fmt.Errorf("invalid table name %q", opts.Table)
+	}
+
+	started := time.Now()
+	t := opts.Table
+	r := AuditReport{Table: t, GapSeconds: opts.GapSeconds}
+
+	err := db.c.QueryRowContext(ctx, `SELECT count(*), count(DISTINCT file_id) FROM `+t).Scan(&r.Events, &r.Tokens)
+	if err != nil {
+		return r, fmt.Errorf("auditing %s: %w", t, err)
+	}
+
+	checks := []struct {
+		check       *AuditCheck
+		description string
+		where       string
+	}{
+		{&r.InvertedPrices, "token1 (the token's price) is larger than token0 (the SOL price), the sim swaps these when it reads them",
+			validPrices + ` AND token1_swap_value_usd > token0_swap_value_usd`},
+		{&r.InvalidPrices, "a price is NaN, infinite, zero, negative or missing",
+			fmt.Sprintf(invalidPrice, "token0_swap_value_usd") + ` OR ` + fmt.Sprintf(invalidPrice, "token1_swap_value_usd")},
+		{&r.LowSOLPrices, fmt.Sprintf("the SOL price (after swapping inverted pairs) is at or below $%g, the sim doesn't track the balance on these", opts.MinSOLPrice),
+			validPrices + fmt.Sprintf(` AND greatest(token0_swap_value_usd, token1_swap_value_usd) <= %g`, opts.MinSOLPrice)},
+		{&r.OrphanEvents, "the event's file_id has no row in file_metadata, the sim never trades it",
+			`file_id NOT IN (SELECT file_id FROM file_metadata)`},
+	}
+
+	for _, c := range checks {
+		c.check.Description = c.description
+		if err := db.auditWhere(ctx, t, c.where, opts.Samples, c.check); err != nil {
+			return r, err
+		}
+	}
+
+	err = db.c.QueryRowContext(ctx, `SELECT count(DISTINCT file_id) FROM `+t+` WHERE file_id NOT IN (SELECT file_id FROM file_metadata)`).Scan(&r.OrphanTokens)
+	if err != nil {
+		return r, err
+	}
+
+	// every copy of a row after the first is a duplicate
+	r.Duplicates.Description = "an identical event appears more than once, the extra copies are counted. A block can have identical swaps, so these are only reported"
+	duplicates := `SELECT file_id, timestamp, block_number, token0_swap_value_usd, token1_swap_value_usd, count(*) - 1 AS extra
+		FROM ` + t + ` GROUP BY ALL HAVING count(*) > 1`
+	if err := db.auditQuery(ctx, `SELECT coalesce(sum(extra), 0) FROM (`+duplicates+`)`, `SELECT * EXCLUDE (extra) FROM (`+duplicates+`)`, opts.Samples, &r.Duplicates); err != nil {
+		return r, err
+	}
+
+	// a block has a single timestamp, and timestamps can't go backwards as blocks go forwards
+	r.BlockTimestamps.Description = "the block has events with different timestamps, or an earlier timestamp than a lower block"
+	inconsistent := `SELECT file_id, timestamp, block_number, token0_swap_value_usd, token1_swap_value_usd FROM (
+			SELECT *,
+				count(DISTINCT timestamp) OVER (PARTITION BY block_number) AS timestamps,
+				max(timestamp) OVER (ORDER BY block_number RANGE BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS previous_max
+			FROM ` + t + `
+		) WHERE timestamps > 1 OR timestamp < previous_max`
+	if err := db.auditQuery(ctx, `SELECT count(*) FROM (`+inconsistent+`)`, inconsistent, opts.Samples, &r.BlockTimestamps); err != nil {
+		return r, err
+	}
+
+	gaps := fmt.Sprintf(`SELECT file_id, previous AS "from", timestamp AS "to", timestamp - previous AS seconds FROM (
+			SELECT file_id, timestamp, lag(timestamp) OVER (PARTITION BY file_id ORDER BY timestamp) AS previous FROM %s
+		) WHERE timestamp - previous > %d`, t, opts.GapSeconds)
+
+	if err := db.c.QueryRowContext(ctx, `SELECT count(*) FROM (`+gaps+`)`).Scan(&r.GapCount); err != nil {
+		return r, err
+	}
+
+	rows, err := db.c.QueryContext(ctx, gaps+fmt.Sprintf(` ORDER BY seconds DESC LIMIT %d`, opts.Samples))
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+
+	r.Gaps = []AuditGap{}
+	for rows.Next() {
+		var g AuditGap
+		if err := rows.Scan(&g.FileID, &g.From, &g.To, &g.Seconds); err != nil {
+			return r, err
+		}
+		r.Gaps = append(r.Gaps, g)
+	}
+	if err := rows.Err(); err != nil {
+		return r, err
+	}
+
+	r.Duration = time.Since(started)
+
+	return r, nil
+}
+
+func (db *Database) auditWhere(ctx context.Context, table string, where string, samples int, check *AuditCheck) error {
+	query := `SELECT file_id, timestamp, block_number, token0_swap_value_usd, token1_swap_value_usd FROM ` + table + ` WHERE ` + where
+	return db.auditQuery(ctx, `SELECT count(*) FROM `+table+` WHERE `+where, query, samples, check)
+}
+
+func (db *Database) auditQuery(ctx context.Context, countQuery string, sampleQuery string, samples int, check *AuditCheck) error {
+	if err := db.c.QueryRowContext(ctx, countQuery).Scan(&check.Count); err != nil {
+		return fmt.Errorf("%s: %w", check.Description, err)
+	}
+
+	rows, err := db.c.QueryContext(ctx, sampleQuery+fmt.Sprintf(` ORDER BY timestamp, block_number, file_id LIMIT %d`, samples))
+	if err != nil {
+		return fmt.Errorf("%s: %w", check.Description, err)
+	}
+	defer rows.Close()
+
+	check.Samples = []AuditEvent{}
+	for rows.Next() {
+		var (
+			e      AuditEvent
+			t0, t1 sql.NullFloat64
+		)
+		if err := rows.Scan(&e.FileID, &e.Timestamp, &e.BlockNumber, &t0, &t1); err != nil {
+			return err
+		}
+
+		e.Token0USD = finite(t0)
+		e.Token1USD = finite(t1)
+		check.Samples = append(check.Samples, e)
+	}
+
+	return rows.Err()
+}
+
+func finite(f sql.NullFloat64) *float64 {
+	if !f.Valid || math.IsNaN(f.Float64) || math.IsInf(f.Float64, 0) {
+		return nil
+	}
+
+	return &f.Float64
+}
+
+// WriteCleanEvents replaces events_clean with a copy of the events table that has inverted price pairs
+// swapped, and events with invalid prices and events without metadata removed. A swap is only ever copied once,
+// by its swap_id: identical swaps in a block are real, so they're all kept. Block and timestamp inconsistencies
+// and gaps are left as they are, there's no way to tell which side is wrong.
+// It returns the number of rows written.
+func (db *Database) WriteCleanEvents(ctx context.Context, table string) (int64, error) {
+	if table == "" {
+		table = "events"
+	}
+	if !tableName.MatchString(table) {
+		return 0, fmt.Errorf("invalid table name %q", table)
+	}
+	if table == "events_clean" {
+		return 0, fmt.Errorf("events_clean can't be cleaned into itself")
+	}
+
+	_, err := db.c.ExecContext(ctx, `CREATE OR REPLACE TABLE events_clean AS
+		SELECT
+			file_id,
+			event_display_type,
+			quote_token,
+			greatest(token0_swap_value_usd, token1_swap_value_usd) AS token0_swap_value_usd,
+			least(token0_swap_value_usd, token1_swap_value_usd) AS token1_swap_value_usd,
+			timestamp,
+			block_number,
+			swap_id
+		FROM `+table+`
+		WHERE `+validPrices+`
+			AND file_id IN (SELECT file_id FROM file_metadata)
+		QUALIFY row_number() OVER (PARTITION BY swap_id) = 1
+		ORDER BY timestamp, block_number, swap_id`)
+	if err != nil {
+		return 0, fmt.Errorf("writing events_clean: %w", err)
+	}
+	if err := dropCandles(ctx, db.c, "events_clean"); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err = db.c.QueryRowContext(ctx, `SELECT count(*) FROM events_clean`).Scan(&n)
+
+	return n, err
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// newAuditDatabase has a problem of every kind the audit looks for. Tokens 1 and 2 are called, 3 isn't.
+func newAuditDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db := newEventsDatabase(t)
+
+	_, err := db.c.Exec(`
+		INSERT INTO tokens (token_id, ca) VALUES (1, 'CA1'), (2, 'CA2');
+		INSERT INTO calls (file_id, token_id, call_timestamp) VALUES (1, 1, 90), (2, 2, 90);
+		INSERT INTO swaps VALUES
+			(1, 1, 'Buy', 'token1', 150, 0.001, 100, 10),
+			(2, 1, 'Buy', 'token1', 0.001, 150, 100, 10),        -- inverted
+			(3, 1, 'Buy', 'token1', 'NaN', 0.001, 101, 11),      -- invalid
+			(4, 1, 'Buy', 'token1', 150, NULL, 101, 11),         -- invalid
+			(5, 1, 'Buy', 'token1', 150, 0, 101, 11),            -- invalid
+			(6, 1, 'Buy', 'token1', 0.5, 0.001, 102, 12),        -- a low SOL price
+			(7, 3, 'Buy', 'token1', 150, 0.001, 102, 12),        -- an orphan
+			(8, 1, 'Buy', 'token1', 150, 0.002, 103, 13),        -- two identical swaps,
+			(9, 1, 'Buy', 'token1', 150, 0.002, 103, 13),        -- in a block with two timestamps
+			(10, 2, 'Buy', 'token1', 150, 0.001, 104, 13),
+			(11, 2, 'Buy', 'token1', 150, 0.001, 99, 14),        -- earlier than block 13
+			(12, 2, 'Buy', 'token1', 150, 0.001, 5000, 15)       -- after a gap
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestAudit(t *testing.T) {
+	db := newAuditDatabase(t)
+
+	r, err := db.Audit(context.Background(), AuditOptions{MinSOLPrice: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Events != 12 || r.Tokens != 3 || r.OrphanTokens != 1 {
+		t.Errorf("got %d events, %d tokens, %d orphan tokens", r.Events, r.Tokens, r.OrphanTokens)
+	}
+
+	tests := map[string]struct {
+		check AuditCheck
+		count int64
+		block int64 // of the first sample, in timestamp order
+	}{
+		"inverted prices":  {r.InvertedPrices, 1, 10},
+		"invalid prices":   {r.InvalidPrices, 3, 11},
+		"low SOL prices":   {r.LowSOLPrices, 1, 12},
+		"orphan events":    {r.OrphanEvents, 1, 12},
+		"duplicates":       {r.Duplicates, 1, 13},
+		"block timestamps": {r.BlockTimestamps, 4, 14},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if test.check.Count != test.count || test.check.Description == "" {
+				t.Errorf("got %+v, want a count of %d", test.check, test.count)
+			}
+			if len(test.check.Samples) == 0 || int64(len(test.check.Samples)) > test.count {
+				t.Fatalf("got %d samples", len(test.check.Samples))
+			}
+			if got := test.check.Samples[0].BlockNumber; got != test.block {
+				t.Errorf("got block %d, want %d", got, test.block)
+			}
+		})
+	}
+
+	// NaN and NULL prices are left out of the samples
+	for _, e := range r.InvalidPrices.Samples {
+		if e.Token0USD == nil && e.Token1USD == nil {
+			t.Errorf("got no prices for %+v", e)
+		}
+	}
+
+	want := []AuditGap{{FileID: 2, From: 104, To: 5000, Seconds: 4896}}
+	if r.GapSeconds != 60*60 || r.GapCount != 1 || !reflect.DeepEqual(r.Gaps, want) {
+		t.Errorf("got %d gaps over %ds: %+v", r.GapCount, r.GapSeconds, r.Gaps)
+	}
+}
+
+func TestWriteCleanEvents(t *testing.T) {
+	db := newAuditDatabase(t)
+
+	// a table pieced together from two copies of the events has every swap_id twice
+	if _, err := db.c.Exec(`CREATE TABLE twice AS SELECT * FROM events UNION ALL SELECT * FROM events`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"events", "twice"} {
+		t.Run(table, func(t *testing.T) {
+			written, err := db.WriteCleanEvents(context.Background(), table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != 8 {
+				t.Errorf("wrote %d rows, want 8", written)
+			}
+
+			rows, err := db.c.Query(`SELECT concat_ws('/', swap_id, file_id, token0_swap_value_usd, token1_swap_value_usd) FROM events_clean`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			got := []string{}
+			for rows.Next() {
+				var row string
+				if err := rows.Scan(&row); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, row)
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			// invalid prices and the orphan are dropped, the inverted pair is swapped and both identical swaps are kept
+			want := []string{
+				"11/2/150.0/0.001",
+				"1/1/150.0/0.001", "2/1/150.0/0.001",
+				"6/1/0.5/0.001",
+				"8/1/150.0/0.002", "9/1/150.0/0.002",
+				"10/2/150.0/0.001",
+				"12/2/150.0/0.001",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	if _, err := db.WriteCleanEvents(context.Background(), "events_clean"); err == nil {
+		t.Error("cleaned events_clean into itself")
+	}
+}
@@ -0,0 +1,364 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"otter/models"
+	"sort"
+	"strings"
+)
+
+// CANDLE_INTERVALS are the candle sizes that can be built, in seconds.
+var CANDLE_INTERVALS = map[string]int64{"1s": 1, "1m": 60, "5m": 300, "1h": 3600}
+
+// CANDLE_INTERVAL_NAMES are the CANDLE_INTERVALS smallest first.
+var CANDLE_INTERVAL_NAMES = []string{"1s", "1m", "5m", "1h"}
+
+func CandleInterval(name string) (int64, error) {
+	seconds, ok := CANDLE_INTERVALS[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown candle interval %q, expected one of %s", name, strings.Join(CANDLE_INTERVAL_NAMES, ", "))
+	}
+	return seconds, nil
+}
+
+// Candle is the OHLC of a token's price in SOL, or of SOL's price in USD, over one interval. The events carry no
+// amounts, so the number of swaps is the only volume there is.
+type Candle struct {
+	Timestamp int64   `json:"timestamp"` // start of the interval
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Swaps     int64   `json:"swaps"`
+}
+
+// candleRow is a candle as it's stored. A token's candle also has the SOL price and block of its last swap, which
+// a sim needs to play it as an event. SOL/USD candles have no file ID.
+type candleRow struct {
+	FileID sql.NullInt64
+	Candle
+	SOLClose  float64
+	LastBlock int64
+}
+
+const candleColumns = `file_id, timestamp, open, high, low, close, swaps, sol_close, last_block`
+
+// candleRange widens from..to to whole candles.
+func candleRange(from int64, to int64, interval int64) (int64, int64) {
+	return from - from%interval, to - to%interval + interval - 1
+}
+
+// candlesTable is where the candles of an events table are materialised, e.g. events_candles_1m.
+func candlesTable(events string, interval string) string {
+	return events + "_candles_" + interval
+}
+
+// computeCandles aggregates the events between its two parameters into token and SOL/USD candles, with
+// inverted prices swapped and invalid ones left out, the same as the sim reads them.
+func computeCandles(events string, interval int64) string {
+	return fmt.Sprintf(`WITH prices AS (
+			SELECT file_id, timestamp, block_number, swap_id, timestamp - timestamp %% %[2]d AS bucket,
+				greatest(token0_swap_value_usd, token1_swap_value_usd) AS sol_price,
+				least(token0_swap_value_usd, token1_swap_value_usd) AS token_price
+			FROM %[1]s
+			WHERE timestamp >= ? AND timestamp <= ? AND %[3]s
+		)
+		SELECT file_id, bucket AS timestamp,
+			first(token_price ORDER BY timestamp, block_number, swap_id) AS open, max(token_price) AS high, min(token_price) AS low,
+			last(token_price ORDER BY timestamp, block_number, swap_id) AS close, count(*) AS swaps,
+			last(sol_price ORDER BY timestamp, block_number, swap_id) AS sol_close, max(block_number) AS last_block
+		FROM prices GROUP BY file_id, bucket
+		UNION ALL
+		SELECT NULL, bucket,
+			first(sol_price ORDER BY timestamp, block_number, swap_id), max(sol_price), min(sol_price),
+			last(sol_price ORDER BY timestamp, block_number, swap_id), count(*),
+			last(sol_price ORDER BY timestamp, block_number, swap_id), max(block_number)
+		FROM prices GROUP BY bucket`, events, interval, validPrices)
+}
+
+// candleSource is a query for the candles between its two parameters, which have to be whole candles. It reads
+// the materialised table if there is one, and computes them from the events otherwise.
+func (db *Database) candleSource(ctx context.Context, interval string) (string, error) {
+	seconds, err := CandleInterval(interval)
+	if err != nil {
+		return "", err
+	}
+
+	table := candlesTable(db.events, interval)
+
+	var n int
+	err = db.c.QueryRowContext(ctx, `SELECT count(*) FROM information_schema.tables WHERE table_name = ?`, table).Scan(&n)
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		return `SELECT ` + candleColumns + ` FROM ` + table + ` WHERE timestamp >= ? AND timestamp <= ?`, nil
+	}
+
+	return computeCandles(db.events, seconds), nil
+}
+
+// TokenCandles returns a token's candles that overlap from..to, in SOL.
+func (db *Database) TokenCandles(ctx context.Context, fileID int, interval string, from int64, to int64) ([]Candle, error) {
+	return db.readCandles(ctx, interval, from, to, `file_id = ?`, fileID)
+}
+
+// SOLCandles returns the SOL/USD candles that overlap from..to, built from every token's swaps.
+func (db *Database) SOLCandles(ctx context.Context, interval string, from int64, to int64) ([]Candle, error) {
+	return db.readCandles(ctx, interval, from, to, `file_id IS NULL`)
+}
+
+func (db *Database) readCandles(ctx context.Context, interval string, from int64, to int64, where string, args ...any) ([]Candle, error) {
+	source, err := db.candleSource(ctx, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to = candleRange(from, to, CANDLE_INTERVALS[interval])
+
+	rows, err := db.c.QueryContext(ctx, `SELECT timestamp, open, high, low, close, swaps FROM (`+source+`)
+		WHERE `+where+` ORDER BY timestamp`, append([]any{from, to}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s candles: %w", interval, err)
+	}
+	defer rows.Close()
+
+	candles := []Candle{}
+	for rows.Next() {
+		var c Candle
+		if err := rows.Scan(&c.Timestamp, &c.Open, &c.High, &c.Low, &c.Close, &c.Swaps); err != nil {
+			return nil, fmt.Errorf("reading %s candles: %w", interval, err)
+		}
+		candles = append(candles, c)
+	}
+
+	return candles, rows.Err()
+}
+
+// TokenPrices returns every valid price of a token from..to, both inclusive, in (timestamp, block_number) order.
+func (db *Database) TokenPrices(ctx context.Context, fileID int, from int64, to int64) ([]models.PricePoint, error) {
+	rows, err := db.c.QueryContext(ctx, `SELECT block_number, timestamp, least(token0_swap_value_usd, token1_swap_value_usd)
+		FROM `+db.events+`
+		WHERE timestamp >= ? AND timestamp <= ? AND file_id = ? AND `+validPrices+`
+		ORDER BY timestamp, block_number`, from, to, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("reading prices of %d: %w", fileID, err)
+	}
+	defer rows.Close()
+
+	points := []models.PricePoint{}
+	for rows.Next() {
+		var p models.PricePoint
+		if err := rows.Scan(&p.BlockNumber, &p.Timestamp, &p.Price); err != nil {
+			return nil, fmt.Errorf("reading prices of %d: %w", fileID, err)
+		}
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+// MaterialiseCandles writes every candle of the events table into its candles table, e.g. events_candles_1m,
+// which is read instead of aggregating the events from then on. Ingesting events drops the tables again, as
+// they'd be out of date. It returns the number of candles written.
+func (db *Database) MaterialiseCandles(ctx context.Context, interval string) (int64, error) {
+	seconds, err := CandleInterval(interval)
+	if err != nil {
+		return 0, err
+	}
+
+	table := candlesTable(db.events, interval)
+
+	// ordered the way sims read them, so the zone maps on timestamp are useful
+	_, err = db.c.ExecContext(ctx, `CREATE OR REPLACE TABLE `+table+` AS
+		SELECT `+candleColumns+` FROM (`+computeCandles(db.events, seconds)+`)
+		ORDER BY timestamp, last_block, file_id NULLS FIRST`, int64(math.MinInt64), int64(math.MaxInt64))
+	if err != nil {
+		return 0, fmt.Errorf("writing %s: %w", table, err)
+	}
+
+	var n int64
+	err = db.c.QueryRowContext(ctx, `SELECT count(*) FROM `+table).Scan(&n)
+
+	return n, err
+}
+
+// DropCandles drops the events table's materialised candles, so they're computed from the events again.
+func (db *Database) DropCandles(ctx context.Context) error {
+	return dropCandles(ctx, db.c, db.events)
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func dropCandles(ctx context.Context, c execer, events string) error {
+	for _, interval := range CANDLE_INTERVAL_NAMES {
+		if _, err := c.ExecContext(ctx, `DROP TABLE IF EXISTS `+candlesTable(events, interval)); err != nil {
+			return fmt.Errorf("dropping %s: %w", candlesTable(events, interval), err)
+		}
+	}
+	return nil
+}
+
+// candleEvent is a token's candle played as a single event, at the end of its interval and its closing prices,
+// so no price is played before it existed.
+func candleEvent(r candleRow, interval int64) models.Event {
+	return models.Event{
+		FileID:           int(r.FileID.Int64),
+		EventDisplayType: "Candle",
+		SOLPrice:         r.SOLClose,
+		TokenPrice:       r.Close,
+		Timestamp:        r.Timestamp + interval - 1,
+		BlockNumber:      r.LastBlock,
+	}
+}
+
+// StreamCandles streams the token candles that overlap from..to as events, one per token and interval, in
+// (timestamp, block_number) order. Each event is at the last second of its interval, in the block of the candle's last
+// swap, with its closing prices. opts.Window is in candles here.
+func (db *Database) StreamCandles(ctx context.Context, from int64, to int64, interval string, opts StreamOptions) *EventStream {
+	return startStream(ctx, opts.Prefetch, func(ctx context.Context, send func(eventPage) bool) {
+		db.readCandlePages(ctx, send, from, to, interval, opts)
+	})
+}
+
+func (db *Database) readCandlePages(ctx context.Context, send func(eventPage) bool, from int64, to int64, interval string, opts StreamOptions) {
+	source, err := db.candleSource(ctx, interval)
+	if err != nil {
+		send(eventPage{err: err})
+		return
+	}
+
+	// (timestamp, file_id) is unique, so pages can start strictly after the last candle read
+	page, err := db.c.PrepareContext(ctx, `SELECT `+candleColumns+` FROM (`+source+`)
+		WHERE file_id IS NOT NULL
+			AND (timestamp > ? OR (timestamp = ? AND (last_block > ? OR (last_block = ? AND file_id > ?))))
+		ORDER BY timestamp, last_block, file_id
+		LIMIT ?`)
+	if err != nil {
+		send(eventPage{err: fmt.Errorf("preparing the candles query: %w", err)})
+		return
+	}
+	defer page.Close()
+
+	seconds := CANDLE_INTERVALS[interval]
+	limit := max(opts.PageSize, 1)
+
+	// a window is opts.Window candles rather than seconds, so coarse candles take fewer, larger queries
+	window := max(opts.Window, 1) * seconds
+
+	from, to = candleRange(from, to, seconds)
+
+	for start := from; start <= to; start += window {
+		end := min(start+window-1, to)
+
+		after := candleRow{Candle: Candle{Timestamp: start - 1}}
+		if c := opts.After; c != nil {
+			// the cursor is at the end of its candle
+			candle := c.Timestamp - seconds + 1
+			if candle > end {
+				continue
+			}
+			if candle >= start {
+				after = candleRow{Candle: Candle{Timestamp: candle}, LastBlock: c.BlockNumber, FileID: sql.NullInt64{Int64: int64(c.FileID), Valid: true}}
+			}
+		}
+
+		for {
+			rows, err := readCandleRows(ctx, page, start, end,
+				after.Timestamp, after.Timestamp, after.LastBlock, after.LastBlock, after.FileID.Int64, limit)
+			if err != nil {
+				send(eventPage{err: fmt.Errorf("reading %s candles from %d: %w", interval, start, err)})
+				return
+			}
+
+			if len(rows) > 0 {
+				events := make([]models.Event, len(rows))
+				for i, r := range rows {
+					events[i] = candleEvent(r, seconds)
+				}
+				if !send(eventPage{events: events}) {
+					return
+				}
+				after = rows[len(rows)-1]
+			}
+
+			if len(rows) < limit {
+				break
+			}
+		}
+	}
+}
+
+func readCandleRows(ctx context.Context, stmt *sql.Stmt, args ...any) ([]candleRow, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candles := []candleRow{}
+	for rows.Next() {
+		var r candleRow
+		if err := rows.Scan(&r.FileID, &r.Timestamp, &r.Open, &r.High, &r.Low, &r.Close, &r.Swaps, &r.SOLClose, &r.LastBlock); err != nil {
+			return nil, err
+		}
+		candles = append(candles, r)
+	}
+
+	return candles, rows.Err()
+}
+
+// aggregateCandles builds the token candles of events that are already in (timestamp, block_number) order,
+// the same way computeCandles does, ordered the way they're streamed.
+func aggregateCandles(events []models.Event, interval int64) []candleRow {
+	index := map[[2]int64]int{}
+	candles := []candleRow{}
+
+	for _, e := range events {
+		NormalisePrices(&e)
+		if !validPrice(e.SOLPrice) || !validPrice(e.TokenPrice) {
+			continue
+		}
+
+		key := [2]int64{int64(e.FileID), e.Timestamp - e.Timestamp%interval}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(candles)
+			candles = append(candles, candleRow{
+				FileID: sql.NullInt64{Int64: int64(e.FileID), Valid: true},
+				Candle: Candle{Timestamp: key[1], Open: e.TokenPrice, High: e.TokenPrice, Low: e.TokenPrice},
+			})
+			i = len(candles) - 1
+		}
+
+		c := &candles[i]
+		c.High = max(c.High, e.TokenPrice)
+		c.Low = min(c.Low, e.TokenPrice)
+		c.Close = e.TokenPrice
+		c.Swaps += 1
+		c.SOLClose = e.SOLPrice
+		c.LastBlock = max(c.LastBlock, e.BlockNumber)
+	}
+
+	sort.Slice(candles, func(i, j int) bool {
+		a, b := candles[i], candles[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		if a.LastBlock != b.LastBlock {
+			return a.LastBlock < b.LastBlock
+		}
+		return a.FileID.Int64 < b.FileID.Int64
+	})
+
+	return candles
+}
+
+func validPrice(p float64) bool {
+	return !math.IsNaN(p) && !math.IsInf(p, 0) && p > 0
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"otter/models"
+	"reflect"
+	"testing"
+)
+
+// candleEvents are two tokens' swaps over two minutes, with an inverted pair and an invalid price.
+var candleEvents = []models.Event{
+	{FileID: 1, SOLPrice: 150, TokenPrice: 0.002, Timestamp: 60, BlockNumber: 150},
+	{FileID: 2, SOLPrice: 150, TokenPrice: 0.5, Timestamp: 61, BlockNumber: 152},
+	{FileID: 1, SOLPrice: 0.004, TokenPrice: 151, Timestamp: 70, BlockNumber: 175}, // inverted
+	{FileID: 1, SOLPrice: 152, TokenPrice: 0.001, Timestamp: 80, BlockNumber: 200},
+	{FileID: 1, SOLPrice: 152, TokenPrice: math.NaN(), Timestamp: 90, BlockNumber: 225}, // left out
+	{FileID: 1, SOLPrice: 153, TokenPrice: 0.003, Timestamp: 119, BlockNumber: 297},
+	{FileID: 1, SOLPrice: 149, TokenPrice: 0.005, Timestamp: 120, BlockNumber: 300},
+	{FileID: 2, SOLPrice: 148, TokenPrice: 0.4, Timestamp: 150, BlockNumber: 375},
+}
+
+func newCandleDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, _, err := ConnectAndMigrate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Disconnect)
+
+	for i, e := range candleEvents {
+		_, err := db.c.Exec(`INSERT INTO swaps VALUES (?, ?, 'Buy', 'token1', ?, ?, ?, ?)`, i+1, e.FileID, e.SOLPrice, e.TokenPrice, e.Timestamp, e.BlockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &db
+}
+
+func TestCandles(t *testing.T) {
+	db := newCandleDatabase(t)
+	ctx := context.Background()
+
+	check := func(label string) {
+		t.Helper()
+
+		got, err := db.TokenCandles(ctx, 1, "1m", 60, 179)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Candle{
+			{Timestamp: 60, Open: 0.002, High: 0.004, Low: 0.001, Close: 0.003, Swaps: 4},
+			{Timestamp: 120, Open: 0.005, High: 0.005, Low: 0.005, Close: 0.005, Swaps: 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got token candles %+v, want %+v", label, got, want)
+		}
+
+		// a range inside a candle still gets the whole candle
+		got, err = db.SOLCandles(ctx, "1m", 100, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []Candle{{Timestamp: 60, Open: 150, High: 153, Low: 150, Close: 153, Swaps: 5}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got SOL candles %+v, want %+v", label, got, want)
+		}
+	}
+
+	check("computed")
+
+	if _, err := db.MaterialiseCandles(ctx, "1m"); err != nil {
+		t.Fatal(err)
+	}
+	check("materialised")
+
+	if _, err := db.TokenCandles(ctx, 1, "2m", 0, 100); err == nil {
+		t.Error("an unknown interval was accepted")
+	}
+}
+
+func streamCandles(t *testing.T, stream *EventStream) []string {
+	t.Helper()
+	defer stream.Close()
+
+	got := []string{}
+	for stream.Next() {
+		for _, e := range stream.Page() {
+			got = append(got, fmt.Sprintf("%d/%d/%d/%g/%g", e.Timestamp, e.BlockNumber, e.FileID, e.TokenPrice, e.SOLPrice))
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func TestStreamCandlesMatchesMemory(t *testing.T) {
+	db := newCandleDatabase(t)
+	memory := NewMemory(nil, candleEvents)
+
+	for _, interval := range CANDLE_INTERVAL_NAMES {
+		want := streamCandles(t, memory.StreamCandles(context.Background(), 0, 200, interval, StreamOptions{PageSize: 100}))
+		if len(want) == 0 {
+			t.Fatalf("%s: no candles", interval)
+		}
+
+		for _, opts := range []StreamOptions{{Window: 1, PageSize: 1}, {Window: 7, PageSize: 2}, {Window: 1000, PageSize: 1000}} {
+			got := streamCandles(t, db.StreamCandles(context.Background(), 0, 200, interval, opts))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %+v: got %v, want %v", interval, opts, got, want)
+			}
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"otter/models"
 	"strconv"
 
@@ -11,18 +12,87 @@ import (
 )
 
 type Database struct {
-	c *sql.DB // the "connection" object - (the database, loaded in memory)
+	c      *sql.DB // the "connection" object - (the database, loaded in memory)
+	events string  // the table sims read events from, "events" unless it's been pointed at a cleaned copy
 }
 
-func Connect() Database {
-	db, err := sql.Open("duckdb", "ultracalls.duckdb")
+// ErrNeedsMigration is returned by Connect for an events database behind SCHEMA_VERSION.
+var ErrNeedsMigration = errors.New("the events database needs migrating, run otter migrate")
+
+// Connect opens the events database, ultracalls.duckdb unless the settings file says otherwise. It has to be at
+// the latest schema already, opening it never changes it.
+func Connect(path string) (Database, error) {
+	d, err := open(path)
+	if err != nil {
+		return Database{}, err
+	}
+
+	version, err := d.SchemaVersion(context.Background())
+	if err != nil {
+		d.Disconnect()
+		return Database{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if version < SCHEMA_VERSION {
+		d.Disconnect()
+		return Database{}, fmt.Errorf("%s is at schema version %d, not %d: %w", path, version, SCHEMA_VERSION, ErrNeedsMigration)
+	}
+
+	return d, nil
+}
+
+// ConnectAndMigrate opens the events database, creating it if it's new, and migrates it to the latest schema.
+// It returns the version it was at before. Only otter migrate, serve and the commands that load events use it.
+func ConnectAndMigrate(path string) (Database, int, error) {
+	d, err := open(path)
+	if err != nil {
+		return Database{}, 0, err
+	}
+
+	from, err := d.Migrate(context.Background())
+	if err != nil {
+		d.Disconnect()
+		return Database{}, 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return d, from, nil
+}
+
+func open(path string) (Database, error) {
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return Database{}, err
+	}
+
+	return Database{c: db, events: "events"}, nil
+}
+
+// UseEventsTable points sims at another events table with the same columns, like the events_clean table
+// written by otter audit --clean.
+func (db *Database) UseEventsTable(table string) error {
+	if !tableName.MatchString(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+
+	var n int
+	err := db.c.QueryRow(`SELECT count(*) FROM information_schema.tables WHERE table_name = ?`, table).Scan(&n)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("the events database has no %s table", table)
 	}
 
-	return Database{
-		c: db,
+	// streams are ordered by swap_id, which tables written before it existed don't have
+	err = db.c.QueryRow(`SELECT count(*) FROM information_schema.columns WHERE table_name = ? AND column_name = 'swap_id'`, table).Scan(&n)
+	if err != nil {
+		return err
 	}
+	if n == 0 {
+		return fmt.Errorf("the %s table has no swap_id column, write it again", table)
+	}
+
+	db.events = table
+	return nil
 }
 
 func (db *Database) GetSimulationStartAndEnd() (int64, int64, error) {
@@ -31,7 +101,7 @@ func (db *Database) GetSimulationStartAndEnd() (int64, int64, error) {
 		simulation_end   int64
 	)
 
-	row := db.c.QueryRow(`SELECT min(timestamp) as simulation_start, max(timestamp) as simulation_end FROM events`)
+	row := db.c.QueryRow(`SELECT min(timestamp) as simulation_start, max(timestamp) as simulation_end FROM ` + db.events)
 
 	err := row.Scan(&simulation_start, &simulation_end)
 
@@ -46,8 +116,9 @@ func (db *Database) GetSimulationStartAndEnd() (int64, int64, error) {
 func (db *Database) GetContractAddressInfo() (map[int]models.Asset, error) {
 	rows, err := db.c.Query(`SELECT file_id, ca, CAST(call_timestamp AS BIGINT), name, description, image_uri FROM file_metadata;`)
 	if err != nil {
-		fmt.Println(err)
+		return nil, fmt.Errorf("loading file_metadata: %w", err)
 	}
+	defer rows.Close()
 
 	var assets = make(map[int]models.Asset, 0)
 
@@ -56,8 +127,7 @@ func (db *Database) GetContractAddressInfo() (map[int]models.Asset, error) {
 	for rows.Next() {
 		var a models.Asset
 		if err := rows.Scan(&a.FileID, &a.ContractAddress, &a.CallTimestamp, &nameP, &descriptionP, &imageURLP); err != nil {
-			fmt.Println(err)
-			return assets, nil
+			return nil, fmt.Errorf("reading file_metadata: %w", err)
 		}
 
 		a.Price = 0.0
@@ -91,7 +161,7 @@ func (db *Database) GetContractAddressInfo() (map[int]models.Asset, error) {
 	}
 
 	if err := rows.Err(); err != nil {
-		return assets, err
+		return nil, fmt.Errorf("reading file_metadata: %w", err)
 	}
 
 	return assets, nil
@@ -99,53 +169,26 @@ func (db *Database) GetContractAddressInfo() (map[int]models.Asset, error) {
 
 // @deprecated - only iused when batchrequesting events for timestamps is disabled
 func (db *Database) EventsOccuringAtTimestamp(timestamp int64) ([]models.Event, error) {
-	rows, err := db.c.Query(`SELECT * FROM events WHERE timestamp = ` + strconv.FormatInt(timestamp, 10))
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	var events []models.Event
-
-	for rows.Next() {
-		var e models.Event
-		if err := rows.Scan(&e.FileID, &e.EventDisplayType, &e.QuoteToken, &e.SOLPrice, &e.TokenPrice, &e.Timestamp, &e.BlockNumber); err != nil {
-			return events, nil
-		}
-
-		events = append(events, e)
-	}
-
-	if err := rows.Err(); err != nil {
-		return events, err
-	}
-
-	return events, nil
-}
-
-func (db *Database) BatchGetEventsForTimestamps(timestamp int64, batch_size int64) ([]models.Event, error) {
-	rows, err := db.c.Query(`SELECT * FROM events WHERE timestamp >= ` + strconv.FormatInt(timestamp, 10) + ` AND timestamp < ` + strconv.FormatInt(timestamp+batch_size, 10) + `;`)
+	rows, err := db.c.Query(`SELECT file_id, event_display_type, quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number, swap_id
+		FROM ` + db.events + ` WHERE timestamp = ` + strconv.FormatInt(timestamp, 10))
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+	defer rows.Close()
 
 	var events []models.Event
 
 	for rows.Next() {
 		var e models.Event
-		if err := rows.Scan(&e.FileID, &e.EventDisplayType, &e.QuoteToken, &e.SOLPrice, &e.TokenPrice, &e.Timestamp, &e.BlockNumber); err != nil {
-			return events, nil
-		}
-		if e.SOLPrice < e.TokenPrice {
-			tokenPriceBackup := e.TokenPrice
-			e.TokenPrice = e.SOLPrice
-			e.SOLPrice = tokenPriceBackup
+		if err := rows.Scan(&e.FileID, &e.EventDisplayType, &e.QuoteToken, &e.SOLPrice, &e.TokenPrice, &e.Timestamp, &e.BlockNumber, &e.SwapID); err != nil {
+			return nil, err
 		}
 
 		events = append(events, e)
 	}
 
 	if err := rows.Err(); err != nil {
-		return events, err
+		return nil, err
 	}
 
 	return events, nil
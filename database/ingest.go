@@ -0,0 +1,400 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Column is a column of one of the tables sims read from.
+type Column struct {
+	Name     string
+	Type     string
+	Optional bool // may be left out of a file, it's loaded as NULL
+}
+
+// SourceTables is the schema files are checked against, and the shape of the file_metadata and events views. The
+// events view also has the swap_id each swap is given when it's loaded.
+var SourceTables = map[string][]Column{
+	"file_metadata": {
+		{Name: "file_id", Type: "INTEGER"},
+		{Name: "ca", Type: "VARCHAR"},
+		{Name: "call_timestamp", Type: "DOUBLE"},
+		{Name: "from_value", Type: "DOUBLE", Optional: true},
+		{Name: "to_value", Type: "DOUBLE", Optional: true},
+		{Name: "additional", Type: "JSON", Optional: true},
+		{Name: "name", Type: "VARCHAR", Optional: true},
+		{Name: "symbol", Type: "VARCHAR", Optional: true},
+		{Name: "description", Type: "VARCHAR", Optional: true},
+		{Name: "total_supply", Type: "DOUBLE", Optional: true},
+		{Name: "image_uri", Type: "VARCHAR", Optional: true},
+	},
+	"events": {
+		{Name: "file_id", Type: "INTEGER"},
+		{Name: "event_display_type", Type: "VARCHAR"},
+		{Name: "quote_token", Type: "VARCHAR"},
+		{Name: "token0_swap_value_usd", Type: "DOUBLE"},
+		{Name: "token1_swap_value_usd", Type: "DOUBLE"},
+		{Name: "timestamp", Type: "BIGINT"},
+		{Name: "block_number", Type: "BIGINT"},
+	},
+}
+
+// MAX_REPORTED_REJECTS is how many rejected rows are listed per load, all of them are counted.
+const MAX_REPORTED_REJECTS = 20
+
+// Load is a file, or a glob of files, to load into a source table.
+type Load struct {
+	Table string
+	Path  string
+}
+
+type LoadResult struct {
+	Table    string   `json:"table"`
+	Path     string   `json:"path"`
+	Files    int      `json:"files"`
+	Rows     int64    `json:"rows"`
+	Rejected int64    `json:"rejected"`
+	Rejects  []Reject `json:"rejects,omitempty"`
+	Existing int64    `json:"existing"` // events that were already loaded, and were left out
+}
+
+// Reject is a CSV row that couldn't be converted to the table's types, and was left out.
+type Reject struct {
+	File   string `json:"file"`
+	Line   int64  `json:"line"`
+	Column string `json:"column"`
+	Error  string `json:"error"`
+}
+
+// Ingest bulk loads CSV or Parquet files into the tokens, calls and swaps tables behind file_metadata and events.
+// Every file's columns are checked against SourceTables first. Everything is loaded in one transaction:
+// if any load fails, or more than maxRejects CSV rows are rejected in total, nothing is loaded.
+// The results are returned either way, so the caller can report what was found.
+func (db *Database) Ingest(loads []Load, maxRejects int64) ([]LoadResult, error) {
+	ctx := context.Background()
+
+	conn, err := db.c.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN TRANSACTION`); err != nil {
+		return nil, err
+	}
+
+	results, err := ingest(ctx, conn, loads, maxRejects)
+	if err != nil {
+		conn.ExecContext(ctx, `ROLLBACK`)
+		return results, err
+	}
+
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	return results, err
+}
+
+func ingest(ctx context.Context, conn *sql.Conn, loads []Load, maxRejects int64) ([]LoadResult, error) {
+	results := []LoadResult{}
+	rejected := int64(0)
+
+	for i, load := range loads {
+		result, err := loadFiles(ctx, conn, load, fmt.Sprintf("ingest_%d", i))
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", load.Path, err)
+		}
+
+		results = append(results, result)
+		rejected += result.Rejected
+	}
+
+	if rejected > maxRejects {
+		return results, fmt.Errorf("%d rows were rejected, more than the %d allowed", rejected, maxRejects)
+	}
+
+	return results, nil
+}
+
+// loadFiles reads files into a temporary staging table with the source table's columns, and then publishes the
+// rows into the normalised tables behind it.
+func loadFiles(ctx context.Context, conn *sql.Conn, load Load, staging string) (LoadResult, error) {
+	result := LoadResult{Table: load.Table, Path: load.Path}
+
+	expected, ok := SourceTables[load.Table]
+	if !ok {
+		return result, fmt.Errorf("can't load into table %q", load.Table)
+	}
+
+	defs := make([]string, len(expected))
+	for i, c := range expected {
+		defs[i] = c.Name + " " + c.Type
+	}
+	if _, err := conn.ExecContext(ctx, `CREATE OR REPLACE TEMP TABLE `+staging+` (`+strings.Join(defs, ", ")+`)`); err != nil {
+		return result, err
+	}
+	defer conn.ExecContext(ctx, `DROP TABLE IF EXISTS `+staging)
+
+	path := quote(load.Path)
+
+	if err := conn.QueryRowContext(ctx, `SELECT count(*) FROM glob(`+path+`)`).Scan(&result.Files); err != nil {
+		return result, err
+	}
+	if result.Files == 0 {
+		return result, fmt.Errorf("no files match")
+	}
+
+	var csv bool
+	switch strings.ToLower(filepath.Ext(load.Path)) {
+	case ".csv":
+		csv = true
+	case ".parquet":
+	default:
+		return result, fmt.Errorf("unsupported file type %q, expected .csv or .parquet", filepath.Ext(load.Path))
+	}
+
+	sniff := `read_parquet(` + path + `)`
+	if csv {
+		sniff = `read_csv(` + path + `, header = true)`
+	}
+
+	found, err := describe(ctx, conn, `DESCRIBE SELECT * FROM `+sniff)
+	if err != nil {
+		return result, err
+	}
+
+	columns, err := checkColumns(expected, found, csv)
+	if err != nil {
+		return result, err
+	}
+
+	names := make([]string, len(columns))
+	types := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+
+		// JSON is read as text, and parsed when it's inserted
+		readAs := c.Type
+		if readAs == "JSON" {
+			readAs = "VARCHAR"
+		}
+		types[i] = quote(c.Name) + ": " + quote(readAs)
+	}
+
+	// rows that can't be converted are left out and logged to the rejects table, rather than failing the load
+	source := sniff
+	if csv {
+		source = `read_csv(` + path + `, header = true, types = {` + strings.Join(types, ", ") + `},
+			store_rejects = true, rejects_table = ` + quote(staging+"_rejects") + `, rejects_scan = ` + quote(staging+"_rejects_scans") + `)`
+	}
+
+	list := strings.Join(names, ", ")
+	res, err := conn.ExecContext(ctx, `INSERT INTO `+staging+` (`+list+`) SELECT `+list+` FROM `+source)
+	if err != nil {
+		return result, err
+	}
+
+	result.Rows, err = res.RowsAffected()
+	if err != nil {
+		return result, err
+	}
+
+	if csv {
+		result.Rejected, result.Rejects, err = readRejects(ctx, conn, staging+"_rejects")
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Existing, err = publish(ctx, conn, load.Table, staging, result.Rows)
+	return result, err
+}
+
+// publish moves staged rows into the normalised tables. New contract addresses get a token, existing ones keep
+// their metadata. A call that's loaded again replaces the old one, so re-running an ingest of the same metadata is safe.
+// Events that are already in swaps are left out, so re-running an ingest of the same events, or loading files
+// that overlap, is safe too. It returns how many of the staged rows were left out.
+func publish(ctx context.Context, conn *sql.Conn, table string, staging string, staged int64) (int64, error) {
+	var statements []string
+
+	switch table {
+	case "file_metadata":
+		statements = []string{
+			`INSERT INTO tokens (ca, name, symbol, description, total_supply, image_uri)
+				SELECT ca, arg_max(name, call_timestamp), arg_max(symbol, call_timestamp), arg_max(description, call_timestamp),
+					arg_max(total_supply, call_timestamp), arg_max(image_uri, call_timestamp)
+				FROM ` + staging + ` GROUP BY ca ORDER BY min(call_timestamp), ca
+				ON CONFLICT (ca) DO NOTHING`,
+			`INSERT OR REPLACE INTO calls
+				SELECT DISTINCT s.file_id, t.token_id, s.call_timestamp, s.from_value, s.to_value, s.additional
+				FROM ` + staging + ` s JOIN tokens t USING (ca)`,
+		}
+	case "events":
+		// each load is appended in (timestamp, block_number) order, keeping the zone maps useful, and numbered on
+		// from the last swap_id in that order, swaps of the same token and block in the order they were in the file.
+		// Swaps have no identity but their columns, and a block can have identical swaps, so the nth copy of a
+		// swap is left out only if swaps already has n of it.
+		statements = []string{
+			`INSERT INTO swaps
+				SELECT (SELECT coalesce(max(swap_id), 0) FROM swaps) + row_number() OVER (ORDER BY s.timestamp, s.block_number, s.file_id, s.row),
+					s.file_id, s.event_display_type, s.quote_token, s.token0_swap_value_usd, s.token1_swap_value_usd, s.timestamp, s.block_number
+				FROM (
+					SELECT *, rowid AS row, row_number() OVER (PARTITION BY ` + swapColumns + ` ORDER BY rowid) AS copy
+					FROM ` + staging + `
+				) s
+				LEFT JOIN (
+					SELECT ` + swapColumns + `, count(*) AS copies
+					FROM swaps
+					WHERE timestamp >= (SELECT min(timestamp) FROM ` + staging + `) AND timestamp <= (SELECT max(timestamp) FROM ` + staging + `)
+					GROUP BY ALL
+				) l ON s.file_id = l.file_id AND s.timestamp = l.timestamp AND s.block_number = l.block_number
+					AND s.event_display_type IS NOT DISTINCT FROM l.event_display_type AND s.quote_token IS NOT DISTINCT FROM l.quote_token
+					AND s.token0_swap_value_usd IS NOT DISTINCT FROM l.token0_swap_value_usd
+					AND s.token1_swap_value_usd IS NOT DISTINCT FROM l.token1_swap_value_usd
+				WHERE s.copy > coalesce(l.copies, 0)
+				ORDER BY s.timestamp, s.block_number, s.file_id, s.row`,
+		}
+	}
+
+	published := staged
+	for _, s := range statements {
+		res, err := conn.ExecContext(ctx, s)
+		if err != nil {
+			return 0, fmt.Errorf("publishing into %s: %w", table, err)
+		}
+		if table == "events" {
+			if published, err = res.RowsAffected(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// materialised candles don't have the new events, they're computed from the events until they're written again
+	if table == "events" {
+		return staged - published, dropCandles(ctx, conn, "events")
+	}
+
+	return 0, nil
+}
+
+// swapColumns are every column of a swap but its swap_id.
+const swapColumns = `file_id, event_display_type, quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number`
+
+// checkColumns matches a file's columns to the table's. Every required column has to be there, and nothing
+// else. CSV types aren't checked here, rows that don't convert are rejected instead.
+func checkColumns(expected []Column, found map[string]string, csv bool) ([]Column, error) {
+	problems := []string{}
+	columns := []Column{}
+	known := map[string]bool{}
+
+	for _, c := range expected {
+		known[c.Name] = true
+
+		got, ok := found[c.Name]
+		if !ok {
+			if !c.Optional {
+				problems = append(problems, "missing column "+c.Name)
+			}
+			continue
+		}
+
+		if !csv && !compatibleType(c.Type, got) {
+			problems = append(problems, fmt.Sprintf("column %s is %s, expected %s", c.Name, got, c.Type))
+		}
+
+		columns = append(columns, c)
+	}
+
+	for name := range found {
+		if !known[name] {
+			problems = append(problems, "unexpected column "+name)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("schema mismatch: %s", strings.Join(problems, ", "))
+	}
+
+	return columns, nil
+}
+
+var integerTypes = map[string]bool{
+	"TINYINT": true, "SMALLINT": true, "INTEGER": true, "BIGINT": true, "HUGEINT": true,
+	"UTINYINT": true, "USMALLINT": true, "UINTEGER": true, "UBIGINT": true,
+}
+
+// compatibleType is true if a column of type got can hold values of type want, or the other way round for
+// Parquet files, without losing their meaning. Integers that overflow still fail the load when they're inserted.
+func compatibleType(want string, got string) bool {
+	switch want {
+	case "INTEGER", "BIGINT":
+		return integerTypes[got]
+	case "DOUBLE":
+		return integerTypes[got] || got == "FLOAT" || got == "DOUBLE" || strings.HasPrefix(got, "DECIMAL")
+	case "JSON":
+		return got == "JSON" || got == "VARCHAR"
+	}
+
+	return got == want
+}
+
+func readRejects(ctx context.Context, conn *sql.Conn, table string) (int64, []Reject, error) {
+	var count int64
+	if err := conn.QueryRowContext(ctx, `SELECT count(*) FROM `+table).Scan(&count); err != nil {
+		return 0, nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`SELECT s.file_path, e.line, coalesce(e.column_name, ''), e.error_message
+		FROM %s e JOIN %s_scans s USING (scan_id, file_id) ORDER BY s.file_path, e.line LIMIT %d`, table, table, MAX_REPORTED_REJECTS))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	rejects := []Reject{}
+	for rows.Next() {
+		var r Reject
+		if err := rows.Scan(&r.File, &r.Line, &r.Column, &r.Error); err != nil {
+			return 0, nil, err
+		}
+		rejects = append(rejects, r)
+	}
+
+	return count, rejects, rows.Err()
+}
+
+// describe returns the column names and types of a table or query.
+func describe(ctx context.Context, conn *sql.Conn, query string) (map[string]string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	types := map[string]string{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]any, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		// the first two columns are the name and type
+		types[values[0].String] = values[1].String
+	}
+
+	return types, rows.Err()
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
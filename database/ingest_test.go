@@ -0,0 +1,181 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const eventsHeader = "file_id,event_display_type,quote_token,token0_swap_value_usd,token1_swap_value_usd,timestamp,block_number\n"
+
+// eventsCSV writes an events file in a new directory, one row per line.
+func eventsCSV(t *testing.T, rows ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "events.csv")
+	if err := os.WriteFile(path, []byte(eventsHeader+strings.Join(rows, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// swapRows are the swaps table as file_id/timestamp/block/token price, in swap_id order.
+func swapRows(t *testing.T, db *Database) []string {
+	t.Helper()
+
+	rows, err := db.c.Query(`SELECT concat_ws('/', file_id, timestamp, block_number, token1_swap_value_usd) FROM swaps ORDER BY swap_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	got := []string{}
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func newEventsDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	db, _, err := ConnectAndMigrate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Disconnect)
+
+	return &db
+}
+
+func TestIngest(t *testing.T) {
+	db := newEventsDatabase(t)
+
+	dir := t.TempDir()
+	metadata := filepath.Join(dir, "metadata.csv")
+	err := os.WriteFile(metadata, []byte("file_id,ca,call_timestamp,name\n1,CA1,100,One\n2,CA2,101,Two\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token 1 swaps twice at the same price in block 20
+	events := eventsCSV(t,
+		"2,Buy,token1,150,0.2,101,20",
+		"1,Buy,token1,150,0.1,100,10",
+		"1,Buy,token1,150,0.3,101,20",
+		"1,Buy,token1,150,0.3,101,20",
+	)
+
+	results, err := db.Ingest([]Load{{Table: "file_metadata", Path: metadata}, {Table: "events", Path: events}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Rows != 2 || results[1].Rows != 4 || results[1].Rejected != 0 || results[1].Existing != 0 {
+		t.Errorf("got %+v", results)
+	}
+
+	// in (timestamp, block_number, file_id) order, then the order they were in the file
+	want := []string{"1/100/10/0.1", "1/101/20/0.3", "1/101/20/0.3", "2/101/20/0.2"}
+	if got := swapRows(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	assets, err := db.GetContractAddressInfo()
+	if err != nil || len(assets) != 2 || assets[2].Name != "Two" {
+		t.Errorf("got %+v, %v", assets, err)
+	}
+}
+
+func TestIngestRejectsRows(t *testing.T) {
+	events := eventsCSV(t,
+		"1,Buy,token1,150,0.1,100,10",
+		"1,Buy,token1,150,0.2,soon,11",
+		"1,Buy,token1,150,0.3,102,12",
+	)
+
+	t.Run("more than allowed", func(t *testing.T) {
+		db := newEventsDatabase(t)
+
+		results, err := db.Ingest([]Load{{Table: "events", Path: events}}, 0)
+		if err == nil || len(results) != 1 || results[0].Rejected != 1 {
+			t.Fatalf("got %+v, %v", results, err)
+		}
+		if got := swapRows(t, db); len(got) != 0 {
+			t.Errorf("got %v loaded", got)
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		db := newEventsDatabase(t)
+
+		results, err := db.Ingest([]Load{{Table: "events", Path: events}}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rejects := results[0].Rejects
+		if results[0].Rows != 2 || len(rejects) != 1 || rejects[0].Line != 3 || rejects[0].Column != "timestamp" || rejects[0].File != events {
+			t.Errorf("got %+v", results[0])
+		}
+		if got := swapRows(t, db); !reflect.DeepEqual(got, []string{"1/100/10/0.1", "1/102/12/0.3"}) {
+			t.Errorf("got %v", got)
+		}
+	})
+}
+
+func TestIngestingAgainLeavesOutLoadedEvents(t *testing.T) {
+	db := newEventsDatabase(t)
+
+	first := eventsCSV(t,
+		"1,Buy,token1,150,0.1,100,10",
+		"1,Buy,token1,150,0.3,101,20",
+		"1,Buy,token1,150,0.3,101,20",
+	)
+	if _, err := db.Ingest([]Load{{Table: "events", Path: first}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	loaded := swapRows(t, db)
+
+	// the same file again adds nothing
+	results, err := db.Ingest([]Load{{Table: "events", Path: first}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Rows != 3 || results[0].Existing != 3 {
+		t.Errorf("got %+v", results[0])
+	}
+	if got := swapRows(t, db); !reflect.DeepEqual(got, loaded) {
+		t.Errorf("got %v, want %v", got, loaded)
+	}
+
+	// an overlapping file only adds what isn't there, a third copy of a swap included
+	overlapping := eventsCSV(t,
+		"1,Buy,token1,150,0.3,101,20",
+		"1,Buy,token1,150,0.3,101,20",
+		"1,Buy,token1,150,0.3,101,20",
+		"1,Buy,token1,150,0.4,102,30",
+	)
+	results, err = db.Ingest([]Load{{Table: "events", Path: overlapping}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Existing != 2 {
+		t.Errorf("got %+v", results[0])
+	}
+
+	want := append(loaded, "1/101/20/0.3", "1/102/30/0.4")
+	if got := swapRows(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"otter/models"
+	"sort"
+	"strconv"
+)
+
+// Memory holds a small set of calls and events in memory, and serves them the way the events database does,
+// so a sim can run without one. It's meant for tests and fixtures.
+type Memory struct {
+	assets []models.Asset
+	events []models.Event
+}
+
+// NewMemory copies the assets and events. Only the call fields of an asset (file ID, contract address, call
+// timestamp, name, description and image) are used. Events can be in any order, and inverted price pairs are
+// swapped as they're read, same as the database. Events read from the database keep their swap IDs. If any
+// event has none, they're all numbered in (timestamp, block_number, file_id) order instead, the same as
+// migrating the database numbers them.
+func NewMemory(assets []models.Asset, events []models.Event) *Memory {
+	m := &Memory{
+		assets: append([]models.Asset{}, assets...),
+		events: append([]models.Event{}, events...),
+	}
+
+	numbered := true
+	for _, e := range m.events {
+		numbered = numbered && e.SwapID != 0
+	}
+
+	sort.SliceStable(m.events, func(i, j int) bool {
+		a, b := m.events[i], m.events[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		if a.BlockNumber != b.BlockNumber {
+			return a.BlockNumber < b.BlockNumber
+		}
+		if numbered {
+			return a.SwapID < b.SwapID
+		}
+		return a.FileID < b.FileID
+	})
+
+	if !numbered {
+		for i := range m.events {
+			m.events[i].SwapID = int64(i + 1)
+		}
+	}
+
+	return m
+}
+
+// LoadMemory reads a metadata CSV and an events CSV, in the same format otter ingest loads.
+func LoadMemory(metadataPath string, eventsPath string) (*Memory, error) {
+	metadata, err := readCSVFile(metadataPath, SourceTables["file_metadata"])
+	if err != nil {
+		return nil, err
+	}
+
+	assets := make([]models.Asset, 0, len(metadata))
+	for i, row := range metadata {
+		a := models.Asset{
+			ContractAddress: row["ca"],
+			Name:            row["name"],
+			Description:     row["description"],
+			ImageURL:        row["image_uri"],
+		}
+
+		callTimestamp, err := strconv.ParseFloat(row["call_timestamp"], 64)
+		if err == nil {
+			// rounded, the same as the database's CAST
+			a.CallTimestamp = int64(math.Round(callTimestamp))
+			a.FileID, err = strconv.Atoi(row["file_id"])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", metadataPath, i+2, err)
+		}
+
+		assets = append(assets, a)
+	}
+
+	rows, err := readCSVFile(eventsPath, SourceTables["events"])
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]models.Event, 0, len(rows))
+	for i, row := range rows {
+		e := models.Event{
+			EventDisplayType: row["event_display_type"],
+			QuoteToken:       row["quote_token"],
+		}
+
+		var errs [5]error
+		e.FileID, errs[0] = strconv.Atoi(row["file_id"])
+		e.SOLPrice, errs[1] = strconv.ParseFloat(row["token0_swap_value_usd"], 64)
+		e.TokenPrice, errs[2] = strconv.ParseFloat(row["token1_swap_value_usd"], 64)
+		e.Timestamp, errs[3] = strconv.ParseInt(row["timestamp"], 10, 64)
+		e.BlockNumber, errs[4] = strconv.ParseInt(row["block_number"], 10, 64)
+
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", eventsPath, i+2, err)
+			}
+		}
+
+		events = append(events, e)
+	}
+
+	return NewMemory(assets, events), nil
+}
+
+// readCSVFile reads a CSV with a header into one map per row, checking the required columns are there.
+func readCSVFile(path string, columns []Column) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: no header", path)
+	}
+
+	header := records[0]
+	index := map[string]int{}
+	for i, name := range header {
+		index[name] = i
+	}
+	for _, c := range columns {
+		if _, ok := index[c.Name]; !ok && !c.Optional {
+			return nil, fmt.Errorf("%s: missing column %s", path, c.Name)
+		}
+	}
+
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for name, i := range index {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// GetContractAddressInfo returns fresh assets every time, as a sim's wallet changes them.
+func (m *Memory) GetContractAddressInfo() (map[int]models.Asset, error) {
+	assets := make(map[int]models.Asset, len(m.assets))
+	for _, a := range m.assets {
+		assets[a.FileID] = models.Asset{
+			FileID:          a.FileID,
+			Name:            a.Name,
+			ContractAddress: a.ContractAddress,
+			Description:     a.Description,
+			CallTimestamp:   a.CallTimestamp,
+			ImageURL:        a.ImageURL,
+			TradingHistory:  make(map[int64]float64, 0),
+		}
+	}
+
+	return assets, nil
+}
+
+// StreamEvents streams the events from..to, both inclusive, in pages of about opts.PageSize. Like the database,
+// a page always ends with the whole of its last (timestamp, block_number).
+func (m *Memory) StreamEvents(ctx context.Context, from int64, to int64, opts StreamOptions) *EventStream {
+	return startStream(ctx, opts.Prefetch, func(ctx context.Context, send func(eventPage) bool) {
+		limit := max(opts.PageSize, 1)
+
+		page := []models.Event{}
+		for _, e := range m.events {
+			if e.Timestamp < from || e.Timestamp > to || (opts.After != nil && !opts.After.Before(e)) {
+				continue
+			}
+
+			if n := len(page); n >= limit && (page[n-1].Timestamp != e.Timestamp || page[n-1].BlockNumber != e.BlockNumber) {
+				if !send(eventPage{events: page}) {
+					return
+				}
+				page = []models.Event{}
+			}
+
+			NormalisePrices(&e)
+			page = append(page, e)
+		}
+
+		if len(page) > 0 {
+			send(eventPage{events: page})
+		}
+	})
+}
+
+// StreamCandles streams the token candles that overlap from..to as events, the same way the database does.
+func (m *Memory) StreamCandles(ctx context.Context, from int64, to int64, interval string, opts StreamOptions) *EventStream {
+	return startStream(ctx, opts.Prefetch, func(ctx context.Context, send func(eventPage) bool) {
+		seconds, err := CandleInterval(interval)
+		if err != nil {
+			send(eventPage{err: err})
+			return
+		}
+
+		from, to = candleRange(from, to, seconds)
+
+		events := []models.Event{}
+		for _, e := range m.events {
+			if e.Timestamp >= from && e.Timestamp <= to {
+				events = append(events, e)
+			}
+		}
+
+		limit := max(opts.PageSize, 1)
+
+		page := []models.Event{}
+		for _, c := range aggregateCandles(events, seconds) {
+			e := candleEvent(c, seconds)
+			if opts.After != nil && !opts.After.Before(e) {
+				continue
+			}
+
+			page = append(page, e)
+
+			if len(page) == limit {
+				if !send(eventPage{events: page}) {
+					return
+				}
+				page = []models.Event{}
+			}
+		}
+
+		if len(page) > 0 {
+			send(eventPage{events: page})
+		}
+	})
+}
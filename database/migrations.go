@@ -0,0 +1,290 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migration is one step of the events database schema. Each one runs in its own transaction, and is recorded
+// in schema_migrations so it only ever runs once.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations are applied in order, new ones go at the end. Never edit one that has shipped.
+var migrations = []migration{
+	{1, "source tables", createSourceTables},
+	{2, "normalised tokens, calls and swaps", normaliseTables},
+	{3, "swap ids", numberSwaps},
+}
+
+// SCHEMA_VERSION is the version a migrated events database is at.
+var SCHEMA_VERSION = migrations[len(migrations)-1].version
+
+// Migrate brings the events database up to SCHEMA_VERSION, returning the version it was at before.
+func (db *Database) Migrate(ctx context.Context) (int, error) {
+	_, err := db.c.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT current_timestamp
+	)`)
+	if err != nil {
+		return 0, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	from, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+
+		log.Printf("migrating the events database to version %d (%s)", m.version, m.name)
+		if err := db.apply(ctx, m); err != nil {
+			return from, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	return from, nil
+}
+
+// SchemaVersion is the version the events database is at, 0 if it's new or older than migrations.
+func (db *Database) SchemaVersion(ctx context.Context) (int, error) {
+	var n int
+	err := db.c.QueryRowContext(ctx, `SELECT count(*) FROM information_schema.tables WHERE table_name = 'schema_migrations'`).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err = db.c.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("reading the schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+func (db *Database) apply(ctx context.Context, m migration) error {
+	tx, err := db.c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(ctx, tx); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// createSourceTables is the original, denormalised schema. Databases made before migrations existed already have it.
+func createSourceTables(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS file_metadata (
+			file_id INTEGER,
+			ca TEXT,
+			call_timestamp DOUBLE,
+			from_value DOUBLE,
+			to_value DOUBLE,
+			additional JSON,
+			name TEXT,
+			symbol TEXT,
+			description TEXT,
+			total_supply DOUBLE,
+			image_uri TEXT
+		);
+		CREATE TABLE IF NOT EXISTS events (
+			file_id INTEGER,
+			event_display_type TEXT,
+			quote_token TEXT,
+			token0_swap_value_usd DOUBLE,
+			token1_swap_value_usd DOUBLE,
+			timestamp INTEGER,
+			block_number INTEGER
+		);`)
+
+	return err
+}
+
+// normaliseTables splits file_metadata into tokens (one row per contract address) and calls (one row per file_id),
+// and moves events into swaps, sorted by (timestamp, block_number) so DuckDB's zone maps can skip most of the
+// table on a time range scan. events and file_metadata are replaced with views of the same shape, so nothing
+// reading them has to change.
+//
+// swaps.file_id isn't declared as a foreign key: DuckDB checks those row by row, which doesn't scale to bulk
+// loads, and events with no call are kept (otter audit reports them). swaps has no index either, an ART index over
+// billions of rows costs more memory than the sorted layout saves.
+func normaliseTables(ctx context.Context, tx *sql.Tx) error {
+	conflicting, err := listFileIDs(ctx, tx, `SELECT file_id FROM (SELECT DISTINCT * FROM file_metadata) GROUP BY file_id HAVING count(*) > 1`)
+	if err != nil {
+		return err
+	}
+	if conflicting != "" {
+		return fmt.Errorf("file_ids %s have more than one different row in file_metadata, remove the wrong ones first", conflicting)
+	}
+
+	// tokens are keyed by contract address, so a call without one has no token. Calls of the same address are
+	// fine, they share a token.
+	missing, err := listFileIDs(ctx, tx, `SELECT DISTINCT file_id FROM file_metadata WHERE ca IS NULL OR trim(ca) = ''`)
+	if err != nil {
+		return err
+	}
+	if missing != "" {
+		return fmt.Errorf("file_ids %s have no ca in file_metadata, fill it in or remove them first", missing)
+	}
+
+	statements := []string{
+		`CREATE SEQUENCE token_ids START 1`,
+		`CREATE TABLE tokens (
+			token_id INTEGER PRIMARY KEY DEFAULT nextval('token_ids'),
+			ca VARCHAR NOT NULL UNIQUE,
+			name VARCHAR,
+			symbol VARCHAR,
+			description VARCHAR,
+			total_supply DOUBLE,
+			image_uri VARCHAR
+		)`,
+		`CREATE TABLE calls (
+			file_id INTEGER PRIMARY KEY,
+			token_id INTEGER NOT NULL REFERENCES tokens (token_id),
+			call_timestamp DOUBLE NOT NULL,
+			from_value DOUBLE,
+			to_value DOUBLE,
+			additional JSON
+		)`,
+		`CREATE TABLE swaps (
+			file_id INTEGER NOT NULL,
+			event_display_type VARCHAR,
+			quote_token VARCHAR,
+			token0_swap_value_usd DOUBLE,
+			token1_swap_value_usd DOUBLE,
+			timestamp BIGINT NOT NULL,
+			block_number BIGINT NOT NULL
+		)`,
+
+		// a token called more than once keeps the metadata of its latest call
+		`INSERT INTO tokens (ca, name, symbol, description, total_supply, image_uri)
+			SELECT ca, arg_max(name, call_timestamp), arg_max(symbol, call_timestamp), arg_max(description, call_timestamp),
+				arg_max(total_supply, call_timestamp), arg_max(image_uri, call_timestamp)
+			FROM file_metadata GROUP BY ca ORDER BY min(call_timestamp), ca`,
+		`INSERT INTO calls
+			SELECT DISTINCT f.file_id, t.token_id, f.call_timestamp, f.from_value, f.to_value, f.additional
+			FROM file_metadata f JOIN tokens t USING (ca)`,
+		`INSERT INTO swaps
+			SELECT file_id, event_display_type, quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number
+			FROM events ORDER BY timestamp, block_number`,
+
+		`DROP TABLE events`,
+		`DROP TABLE file_metadata`,
+		`CREATE VIEW events AS
+			SELECT file_id, event_display_type, quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number
+			FROM swaps`,
+		`CREATE VIEW file_metadata AS
+			SELECT c.file_id, t.ca, c.call_timestamp, c.from_value, c.to_value, c.additional,
+				t.name, t.symbol, t.description, t.total_supply, t.image_uri
+			FROM calls c JOIN tokens t USING (token_id)`,
+	}
+
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MAX_LISTED_FILE_IDS is how many file_ids a migration error lists, the rest are counted.
+const MAX_LISTED_FILE_IDS = 10
+
+// listFileIDs runs a query for file_ids, and lists them for an error, "" if there are none.
+func listFileIDs(ctx context.Context, tx *sql.Tx, query string) (string, error) {
+	rows, err := tx.QueryContext(ctx, query+` ORDER BY file_id`)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	n := 0
+	for rows.Next() {
+		var id sql.NullInt64
+		if err := rows.Scan(&id); err != nil {
+			return "", err
+		}
+
+		label := "NULL"
+		if id.Valid {
+			label = fmt.Sprint(id.Int64)
+		}
+		if len(ids) < MAX_LISTED_FILE_IDS {
+			ids = append(ids, label)
+		}
+		n += 1
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	list := strings.Join(ids, ", ")
+	if n > len(ids) {
+		list += fmt.Sprintf(" and %d more", n-len(ids))
+	}
+
+	return list, nil
+}
+
+// numberSwaps gives every swap a swap_id, so the swaps in a block have an order of their own and a stream can
+// be resumed part way through one. Existing swaps are numbered in (timestamp, block_number, file_id) order, then
+// the order they were loaded in, which is the order they were already streamed in. There's no sequence behind
+// it, a load numbers its swaps on from the largest swap_id so they stay in the order they're written in.
+func numberSwaps(ctx context.Context, tx *sql.Tx) error {
+	statements := []string{
+		`CREATE TABLE swaps_numbered (
+			swap_id BIGINT NOT NULL,
+			file_id INTEGER NOT NULL,
+			event_display_type VARCHAR,
+			quote_token VARCHAR,
+			token0_swap_value_usd DOUBLE,
+			token1_swap_value_usd DOUBLE,
+			timestamp BIGINT NOT NULL,
+			block_number BIGINT NOT NULL
+		)`,
+		`INSERT INTO swaps_numbered
+			SELECT row_number() OVER (ORDER BY timestamp, block_number, file_id, rowid), file_id, event_display_type,
+				quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number
+			FROM swaps ORDER BY timestamp, block_number, file_id, rowid`,
+
+		`DROP VIEW events`,
+		`DROP TABLE swaps`,
+		`ALTER TABLE swaps_numbered RENAME TO swaps`,
+		`CREATE VIEW events AS
+			SELECT file_id, event_display_type, quote_token, token0_swap_value_usd, token1_swap_value_usd, timestamp, block_number, swap_id
+			FROM swaps`,
+	}
+
+	for _, s := range statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOnlyMigratingChangesTheSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.duckdb")
+
+	// an events database from before migrations
+	c, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Exec(`CREATE TABLE events (file_id INTEGER, event_display_type TEXT, quote_token TEXT,
+		token0_swap_value_usd DOUBLE, token1_swap_value_usd DOUBLE, timestamp INTEGER, block_number INTEGER)`)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Connect(path); !errors.Is(err, ErrNeedsMigration) {
+		t.Fatalf("got %v, want ErrNeedsMigration", err)
+	}
+
+	// and it's still as it was
+	c, err = sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = c.QueryRow(`SELECT count(*) FROM information_schema.tables WHERE table_name IN ('schema_migrations', 'swaps')`).Scan(&n)
+	c.Close()
+	if err != nil || n != 0 {
+		t.Fatalf("connecting changed the database: %d new tables, %v", n, err)
+	}
+
+	db, from, err := ConnectAndMigrate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Disconnect()
+	if from != 0 {
+		t.Errorf("migrated from version %d, want 0", from)
+	}
+
+	db, err = Connect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Disconnect()
+}
+
+func TestMigratingNumbersTheSwaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.duckdb")
+
+	c, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Exec(`CREATE TABLE events (file_id INTEGER, event_display_type TEXT, quote_token TEXT,
+			token0_swap_value_usd DOUBLE, token1_swap_value_usd DOUBLE, timestamp INTEGER, block_number INTEGER);
+		INSERT INTO events VALUES (2, 'Buy', 'token1', 150, 0.3, 100, 1000), (1, 'Buy', 'token1', 150, 0.2, 100, 1000),
+			(1, 'Buy', 'token1', 150, 0.1, 99, 990), (1, 'Sell', 'token1', 150, 0.4, 100, 1000)`)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, _, err := ConnectAndMigrate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Disconnect()
+
+	// in (timestamp, block_number, file_id) order, then the order they were in
+	rows, err := db.c.Query(`SELECT token1_swap_value_usd FROM events ORDER BY swap_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	got := []float64{}
+	for rows.Next() {
+		var price float64
+		if err := rows.Scan(&price); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, price)
+	}
+	if !reflect.DeepEqual(got, []float64{0.1, 0.2, 0.4, 0.3}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+// legacyDatabase is an events database from before migrations, with these file_metadata rows.
+func legacyDatabase(t *testing.T, metadata string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "events.duckdb")
+
+	c, err := sql.Open("duckdb", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Exec(`CREATE TABLE events (file_id INTEGER, event_display_type TEXT, quote_token TEXT,
+			token0_swap_value_usd DOUBLE, token1_swap_value_usd DOUBLE, timestamp INTEGER, block_number INTEGER);
+		CREATE TABLE file_metadata (file_id INTEGER, ca TEXT, call_timestamp DOUBLE, from_value DOUBLE, to_value DOUBLE,
+			additional JSON, name TEXT, symbol TEXT, description TEXT, total_supply DOUBLE, image_uri TEXT);
+		INSERT INTO file_metadata (file_id, ca, call_timestamp, name) VALUES ` + metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMigratingLegacyCalls(t *testing.T) {
+	tests := map[string]struct {
+		metadata string
+		err      string
+		tokens   int
+	}{
+		"calls of the same address share a token": {`(1, 'CA1', 100, 'old'), (2, 'CA1', 200, 'new'), (3, 'CA2', 150, 'other')`, "", 2},
+		"calls without an address": {`(1, 'CA1', 100, 'one'), (4, NULL, 100, 'four'), (2, ' ', 100, 'two')`,
+			"file_ids 2, 4 have no ca in file_metadata", 0},
+		"a call with two different rows": {`(1, 'CA1', 100, 'one'), (1, 'CA2', 100, 'one'), (2, 'CA2', 100, 'two')`,
+			"file_ids 1 have more than one different row in file_metadata", 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := legacyDatabase(t, test.metadata)
+
+			db, _, err := ConnectAndMigrate(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want %s", err, test.err)
+				}
+
+				// the failed migration left the calls as they were
+				if _, err := Connect(path); !errors.Is(err, ErrNeedsMigration) {
+					t.Fatalf("got %v, want ErrNeedsMigration", err)
+				}
+				c, err := sql.Open("duckdb", path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				var n int
+				if err := c.QueryRow(`SELECT count(*) FROM file_metadata`).Scan(&n); err != nil || n != 3 {
+					t.Errorf("got %d calls, %v", n, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Disconnect()
+
+			var tokens int
+			if err := db.c.QueryRow(`SELECT count(*) FROM tokens`).Scan(&tokens); err != nil || tokens != test.tokens {
+				t.Errorf("got %d tokens, %v, want %d", tokens, err, test.tokens)
+			}
+
+			// the token keeps the metadata of its latest call
+			var name string
+			if err := db.c.QueryRow(`SELECT name FROM file_metadata WHERE file_id = 1`).Scan(&name); err != nil || name != "new" {
+				t.Errorf("got %q, %v, want the latest call's name", name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"otter/models"
+	"time"
+
+	"github.com/marcboeker/go-duckdb"
+)
+
+var ErrSimNotFound = errors.New("sim not found")
+
+// SIM_ID_TRIES is how many IDs a new sim gets to find a free one.
+const SIM_ID_TRIES = 5
+
+// ResultStore holds the output of finished simulations. It lives in its own DuckDB file, so the
+// (very large) events database can stay read-only while sims are being written.
+type ResultStore struct {
+	c *sql.DB
+}
+
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS sims (
+	id BIGINT PRIMARY KEY,
+	name TEXT,
+	created_at TIMESTAMP,
+	metadata JSON,
+	sol_balance DOUBLE,
+	token_usd_worth DOUBLE,
+	token_sol_worth DOUBLE,
+	total_usd_worth DOUBLE
+);
+
+ALTER TABLE sims ADD COLUMN IF NOT EXISTS config JSON;
+ALTER TABLE sims ADD COLUMN IF NOT EXISTS config_hash TEXT;
+ALTER TABLE sims ADD COLUMN IF NOT EXISTS config_hash_version INTEGER;
+ALTER TABLE sims ADD COLUMN IF NOT EXISTS paper BOOLEAN DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS sim_trades (
+	sim_id BIGINT,
+	seq BIGINT,
+	block_number BIGINT,
+	timestamp BIGINT,
+	type TEXT,
+	sol_change DOUBLE,
+	file_id BIGINT,
+	token_price DOUBLE
+);
+
+CREATE TABLE IF NOT EXISTS sim_skips (
+	sim_id BIGINT,
+	seq BIGINT,
+	block_number BIGINT,
+	timestamp BIGINT,
+	type TEXT,
+	reason TEXT,
+	file_id BIGINT,
+	token_price DOUBLE
+);
+
+CREATE TABLE IF NOT EXISTS sim_balances (
+	sim_id BIGINT,
+	block_number BIGINT,
+	timestamp BIGINT,
+	usd DOUBLE
+);
+
+CREATE TABLE IF NOT EXISTS sim_ledger (
+	sim_id BIGINT,
+	file_id BIGINT,
+	name TEXT,
+	contract_address TEXT,
+	description TEXT,
+	image_url TEXT,
+	call_timestamp BIGINT,
+	entry_price DOUBLE,
+	tp_price DOUBLE,
+	tp_stage BIGINT,
+	price DOUBLE,
+	balance DOUBLE,
+	buys BIGINT,
+	sells BIGINT,
+	sol_in DOUBLE,
+	sol_out DOUBLE,
+	pnl DOUBLE
+);
+
+CREATE OR REPLACE VIEW sim_metrics AS
+WITH curve AS (
+	SELECT sim_id, block_number, usd,
+		max(usd) OVER (PARTITION BY sim_id ORDER BY block_number ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS peak
+	FROM sim_balances
+), balances AS (
+	SELECT sim_id,
+		arg_min(usd, block_number) AS start_usd,
+		arg_max(usd, block_number) AS end_usd,
+		min(CASE WHEN peak > 0 THEN (usd / peak - 1) * 100 ELSE 0 END) AS max_drawdown_pct
+	FROM curve
+	GROUP BY sim_id
+), calls AS (
+	SELECT sim_id,
+		count(*) AS calls_traded,
+		count(*) FILTER (WHERE pnl > 0) AS winning_calls,
+		sum(buys) AS total_buys,
+		sum(sells) AS total_sells,
+		sum(sol_in) AS sol_in,
+		sum(sol_out) AS sol_out,
+		sum(pnl) AS pnl
+	FROM sim_ledger
+	GROUP BY sim_id
+)
+SELECT s.id AS sim_id,
+	s.name,
+	coalesce(b.start_usd, 0) AS start_usd,
+	coalesce(b.end_usd, 0) AS end_usd,
+	CASE WHEN b.start_usd > 0 THEN (b.end_usd / b.start_usd - 1) * 100 ELSE 0 END AS return_pct,
+	coalesce(b.max_drawdown_pct, 0) AS max_drawdown_pct,
+	coalesce(c.calls_traded, 0) AS calls_traded,
+	coalesce(c.winning_calls, 0) AS winning_calls,
+	CASE WHEN c.calls_traded > 0 THEN c.winning_calls / c.calls_traded ELSE 0 END AS win_rate,
+	coalesce(c.total_buys, 0) AS total_buys,
+	coalesce(c.total_sells, 0) AS total_sells,
+	coalesce(c.sol_in, 0) AS sol_in,
+	coalesce(c.sol_out, 0) AS sol_out,
+	coalesce(c.pnl, 0) AS pnl,
+	s.sol_balance AS final_sol_balance
+FROM sims s
+LEFT JOIN balances b ON b.sim_id = s.id
+LEFT JOIN calls c ON c.sim_id = s.id;`
+
+func OpenResultStore(path string) (*ResultStore, error) {
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(resultsSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rs := &ResultStore{c: db}
+	if err := rs.backfillConfigHashes(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// backfillConfigHashes hashes the configs of sims stored before config hashes were, and hashes again the
+// ones hashed by an older SimConfig.Hash. Hashes from before they were versioned are version 1.
+func (rs *ResultStore) backfillConfigHashes() error {
+	rows, err := rs.c.Query(`SELECT id, CAST(metadata AS TEXT), CAST(config AS TEXT) FROM sims
+		WHERE config_hash IS NULL OR coalesce(config_hash_version, 1) < ?`, models.CONFIG_HASH_VERSION)
+	if err != nil {
+		return err
+	}
+
+	hashes := map[int64]string{}
+	for rows.Next() {
+		var (
+			id       int64
+			metadata string
+			config   sql.NullString
+		)
+		if err := rows.Scan(&id, &metadata, &config); err != nil {
+			rows.Close()
+			return err
+		}
+
+		meta, err := decodeMetadata(metadata, config)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("sim %d: %w", id, err)
+		}
+
+		hashes[id] = meta.SimConfig.Hash()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, hash := range hashes {
+		if _, err := rs.c.Exec(`UPDATE sims SET config_hash = ?, config_hash_version = ? WHERE id = ?`, hash, models.CONFIG_HASH_VERSION, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rs *ResultStore) Close() {
+	rs.c.Close()
+}
+
+// SaveSim writes a finished simulation in a single transaction, so a sim is either fully stored or not at all.
+// If its ID is taken by another sim, it's stored under a new one, and r.Metadata.ID is updated.
+func (rs *ResultStore) SaveSim(r *models.SimResult) error {
+	return rs.writeSim(r, nil)
+}
+
+// SimRows is how many of a sim's trades, skips and balance points are stored.
+type SimRows struct {
+	Saved    bool // the sim itself is stored
+	Trades   int
+	Skips    int
+	Balances int
+}
+
+// UpdateSim stores a newer state of a sim whose first stored rows are already there, in a single
+// transaction, and returns what's stored now. Trades, skips and balance points only ever grow, so only the
+// ones after stored are appended, the sim's row is updated in place, and the ledger (one row per call) is
+// rewritten. Paper trading saves its wallet this way as it runs, starting from SimRows{}, which stores it like
+// SaveSim, under a new ID if its own is taken.
+func (rs *ResultStore) UpdateSim(r *models.SimResult, stored SimRows) (SimRows, error) {
+	err := rs.writeSim(r, &stored)
+	if err != nil {
+		return stored, err
+	}
+
+	return SimRows{Saved: true, Trades: len(r.Events), Skips: len(r.Skips), Balances: len(r.BalanceTracking)}, nil
+}
+
+// writeSim writes a sim, or if stored is set, the rows of it that aren't stored yet. A new sim whose ID is
+// taken gets another, sim IDs are random so a few tries are plenty.
+func (rs *ResultStore) writeSim(r *models.SimResult, stored *SimRows) error {
+	if stored != nil && stored.Saved {
+		return rs.writeSimOnce(r, stored)
+	}
+
+	for tries := 1; ; tries++ {
+		err := rs.writeSimOnce(r, stored)
+
+		var duckErr *duckdb.Error
+		if tries == SIM_ID_TRIES || !errors.As(err, &duckErr) || duckErr.Type != duckdb.ErrorTypeConstraint {
+			return err
+		}
+
+		taken, existsErr := rs.SimExists(r.Metadata.ID)
+		if existsErr != nil || !taken {
+			return err
+		}
+		r.Metadata.ID = models.NewSimID()
+	}
+}
+
+func (rs *ResultStore) writeSimOnce(r *models.SimResult, stored *SimRows) error {
+	ctx := context.Background()
+
+	metaBytes, err := json.Marshal(r.Metadata)
+	if err != nil {
+		return err
+	}
+
+	createdAt, err := time.ParseInLocation("2006-01-02 15:04:05", r.Metadata.Date, time.Local)
+	if err != nil {
+		createdAt = time.Now()
+	}
+
+	conn, err := rs.c.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN TRANSACTION`); err != nil {
+		return err
+	}
+
+	err = rs.saveSimRows(ctx, conn, r, string(metaBytes), createdAt, stored)
+	if err != nil {
+		conn.ExecContext(ctx, `ROLLBACK`)
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	return err
+}
+
+func (rs *ResultStore) saveSimRows(ctx context.Context, conn *sql.Conn, r *models.SimResult, metadata string, createdAt time.Time, stored *SimRows) error {
+	simID := int64(r.Metadata.ID)
+
+	configBytes, err := json.Marshal(r.Metadata.SimConfig)
+	if err != nil {
+		return err
+	}
+
+	insert := `INSERT INTO sims (id, name, created_at, metadata, sol_balance, token_usd_worth, token_sol_worth, total_usd_worth, config, config_hash, config_hash_version, paper)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	from := SimRows{}
+	if stored != nil && stored.Saved {
+		from = *stored
+		insert += ` ON CONFLICT (id) DO UPDATE SET metadata = excluded.metadata, sol_balance = excluded.sol_balance,
+			token_usd_worth = excluded.token_usd_worth, token_sol_worth = excluded.token_sol_worth,
+			total_usd_worth = excluded.total_usd_worth`
+
+		// a call's ledger entry changes as the sim trades it
+		if _, err := conn.ExecContext(ctx, `DELETE FROM sim_ledger WHERE sim_id = ?`, simID); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, insert,
+		simID, r.Metadata.Name, createdAt, metadata,
+		r.Portfolio.SOLBalance, r.Portfolio.TokenUSDWorth, r.Portfolio.TokenSOLWorth, r.Portfolio.TotalUSDWorth,
+		string(configBytes), r.Metadata.SimConfig.Hash(), models.CONFIG_HASH_VERSION, r.Metadata.Paper,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the appender is much faster than individual inserts, balance tracking can run into the millions of rows
+	return conn.Raw(func(driverConn any) error {
+		dc := driverConn.(driver.Conn)
+
+		err := appendRows(dc, "sim_trades", from.Trades, len(r.Events), func(i int) []driver.Value {
+			e := r.Events[i]
+			return []driver.Value{simID, int64(i), e.BlockNumber, e.Timestamp, e.Type, e.SOLChange, int64(e.FileID), e.TokenPrice}
+		})
+		if err != nil {
+			return err
+		}
+
+		err = appendRows(dc, "sim_skips", from.Skips, len(r.Skips), func(i int) []driver.Value {
+			s := r.Skips[i]
+			return []driver.Value{simID, int64(i), s.BlockNumber, s.Timestamp, s.Type, s.Reason, int64(s.FileID), s.TokenPrice}
+		})
+		if err != nil {
+			return err
+		}
+
+		err = appendRows(dc, "sim_balances", from.Balances, len(r.BalanceTracking), func(i int) []driver.Value {
+			b := r.BalanceTracking[i]
+			return []driver.Value{simID, b.BlockNumber, b.Timestamp, b.USD}
+		})
+		if err != nil {
+			return err
+		}
+
+		return appendRows(dc, "sim_ledger", 0, len(r.Ledger), func(i int) []driver.Value {
+			l := r.Ledger[i]
+			return []driver.Value{
+				simID, int64(l.FileID), l.Name, l.ContractAddress, l.Description, l.ImageURL, l.CallTimestamp,
+				l.EntryPrice, l.TPPrice, int64(l.TPStage), l.Price, l.Balance,
+				int64(l.Buys), int64(l.Sells), l.SOLIn, l.SOLOut, l.PnL,
+			}
+		})
+	})
+}
+
+// appendRows appends rows from..n-1 of a table's rows.
+func appendRows(dc driver.Conn, table string, from int, n int, row func(i int) []driver.Value) error {
+	appender, err := duckdb.NewAppenderFromConn(dc, "", table)
+	if err != nil {
+		return err
+	}
+
+	for i := from; i < n; i++ {
+		if err := appender.AppendRow(row(i)...); err != nil {
+			appender.Close()
+			return err
+		}
+	}
+
+	return appender.Close()
+}
+
+func (rs *ResultStore) SimExists(id int) (bool, error) {
+	var count int
+	err := rs.c.QueryRow(`SELECT count(*) FROM sims WHERE id = ?`, int64(id)).Scan(&count)
+	return count > 0, err
+}
+
+func (rs *ResultStore) ListSims() ([]models.SimulatorMetadata, error) {
+	rows, err := rs.c.Query(`SELECT CAST(metadata AS TEXT), CAST(config AS TEXT) FROM sims ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sims := []models.SimulatorMetadata{}
+	for rows.Next() {
+		var (
+			metadata string
+			config   sql.NullString
+		)
+		if err := rows.Scan(&metadata, &config); err != nil {
+			return nil, err
+		}
+
+		meta, err := decodeMetadata(metadata, config)
+		if err != nil {
+			return nil, err
+		}
+
+		sims = append(sims, meta)
+	}
+
+	return sims, rows.Err()
+}
+
+func (rs *ResultStore) GetMetadata(id int) (models.SimulatorMetadata, error) {
+	var (
+		metadata string
+		config   sql.NullString
+	)
+
+	err := rs.c.QueryRow(`SELECT CAST(metadata AS TEXT), CAST(config AS TEXT) FROM sims WHERE id = ?`, int64(id)).Scan(&metadata, &config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.SimulatorMetadata{}, ErrSimNotFound
+	}
+	if err != nil {
+		return models.SimulatorMetadata{}, err
+	}
+
+	return decodeMetadata(metadata, config)
+}
+
+// FindSimByConfigHash returns the most recent sim run with the config hash, see SimConfig.Hash.
+// Paper traded sims never match, they didn't play the config's whole range.
+func (rs *ResultStore) FindSimByConfigHash(hash string) (int, error) {
+	var id int64
+	err := rs.c.QueryRow(`SELECT id FROM sims WHERE config_hash = ? AND NOT coalesce(paper, false) ORDER BY created_at DESC, id DESC LIMIT 1`, hash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrSimNotFound
+	}
+
+	return int(id), err
+}
+
+// GetConfig returns the exact config a sim was run with, upgraded to the current config version.
+func (rs *ResultStore) GetConfig(id int) (models.SimConfig, error) {
+	meta, err := rs.GetMetadata(id)
+	return meta.SimConfig, err
+}
+
+// decodeMetadata prefers the stored config document. Sims stored before configs were versioned
+// only have metadata, which is migrated instead.
+func decodeMetadata(metadata string, config sql.NullString) (models.SimulatorMetadata, error) {
+	var meta models.SimulatorMetadata
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		return meta, err
+	}
+
+	raw := metadata
+	if config.Valid {
+		raw = config.String
+	}
+
+	var err error
+	meta.SimConfig, err = models.MigrateSimConfig([]byte(raw))
+
+	return meta, err
+}
+
+func (rs *ResultStore) GetPortfolio(id int) (models.Portfolio, error) {
+	var p models.Portfolio
+
+	err := rs.c.QueryRow(`SELECT sol_balance, token_usd_worth, token_sol_worth, total_usd_worth FROM sims WHERE id = ?`, int64(id)).
+		Scan(&p.SOLBalance, &p.TokenUSDWorth, &p.TokenSOLWorth, &p.TotalUSDWorth)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrSimNotFound
+	}
+
+	return p, err
+}
+
+func (rs *ResultStore) GetBalanceTracking(id int) ([]models.BalancePoint, error) {
+	rows, err := rs.c.Query(`SELECT block_number, timestamp, usd FROM sim_balances WHERE sim_id = ? ORDER BY block_number`, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []models.BalancePoint{}
+	for rows.Next() {
+		var b models.BalancePoint
+		if err := rows.Scan(&b.BlockNumber, &b.Timestamp, &b.USD); err != nil {
+			return nil, err
+		}
+
+		points = append(points, b)
+	}
+
+	return points, rows.Err()
+}
+
+func (rs *ResultStore) GetTradeHistory(id int) ([]models.SimEvent, error) {
+	rows, err := rs.c.Query(`SELECT block_number, timestamp, type, sol_change, file_id, token_price FROM sim_trades WHERE sim_id = ? ORDER BY seq`, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.SimEvent{}
+	for rows.Next() {
+		var e models.SimEvent
+		if err := rows.Scan(&e.BlockNumber, &e.Timestamp, &e.Type, &e.SOLChange, &e.FileID, &e.TokenPrice); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// GetSkips returns the trades a sim skipped. Sims stored before skips were recorded have none.
+func (rs *ResultStore) GetSkips(id int) ([]models.Skip, error) {
+	rows, err := rs.c.Query(`SELECT block_number, timestamp, type, reason, file_id, token_price FROM sim_skips WHERE sim_id = ? ORDER BY seq`, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skips := []models.Skip{}
+	for rows.Next() {
+		var s models.Skip
+		if err := rows.Scan(&s.BlockNumber, &s.Timestamp, &s.Type, &s.Reason, &s.FileID, &s.TokenPrice); err != nil {
+			return nil, err
+		}
+
+		skips = append(skips, s)
+	}
+
+	return skips, rows.Err()
+}
+
+func (rs *ResultStore) GetMetrics(id int) (models.SimMetrics, error) {
+	var m models.SimMetrics
+
+	err := rs.c.QueryRow(`SELECT sim_id, name, start_usd, end_usd, return_pct, max_drawdown_pct, calls_traded, winning_calls, win_rate,
+		total_buys, total_sells, sol_in, sol_out, pnl, final_sol_balance FROM sim_metrics WHERE sim_id = ?`, int64(id)).
+		Scan(&m.SimID, &m.Name, &m.StartUSD, &m.EndUSD, &m.ReturnPct, &m.MaxDrawdownPct, &m.CallsTraded, &m.WinningCalls, &m.WinRate,
+			&m.TotalBuys, &m.TotalSells, &m.SOLIn, &m.SOLOut, &m.PnL, &m.FinalSOLBalance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrSimNotFound
+	}
+
+	return m, err
+}
+
+// ListMetrics returns the metrics of every stored sim, oldest first.
+func (rs *ResultStore) ListMetrics() ([]models.SimMetrics, error) {
+	rows, err := rs.c.Query(`SELECT m.sim_id, m.name, m.start_usd, m.end_usd, m.return_pct, m.max_drawdown_pct, m.calls_traded, m.winning_calls, m.win_rate,
+		m.total_buys, m.total_sells, m.sol_in, m.sol_out, m.pnl, m.final_sol_balance
+		FROM sim_metrics m JOIN sims s ON s.id = m.sim_id ORDER BY s.created_at, s.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []models.SimMetrics{}
+	for rows.Next() {
+		var m models.SimMetrics
+		if err := rows.Scan(&m.SimID, &m.Name, &m.StartUSD, &m.EndUSD, &m.ReturnPct, &m.MaxDrawdownPct, &m.CallsTraded, &m.WinningCalls, &m.WinRate,
+			&m.TotalBuys, &m.TotalSells, &m.SOLIn, &m.SOLOut, &m.PnL, &m.FinalSOLBalance); err != nil {
+			return nil, err
+		}
+
+		metrics = append(metrics, m)
+	}
+
+	return metrics, rows.Err()
+}
+
+func (rs *ResultStore) GetLedger(id int) ([]models.LedgerEntry, error) {
+	rows, err := rs.c.Query(`SELECT file_id, name, contract_address, description, image_url, call_timestamp, entry_price, tp_price, tp_stage,
+		price, balance, buys, sells, sol_in, sol_out, pnl FROM sim_ledger WHERE sim_id = ? ORDER BY file_id`, int64(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ledger := []models.LedgerEntry{}
+	for rows.Next() {
+		var l models.LedgerEntry
+		if err := rows.Scan(&l.FileID, &l.Name, &l.ContractAddress, &l.Description, &l.ImageURL, &l.CallTimestamp, &l.EntryPrice, &l.TPPrice, &l.TPStage,
+			&l.Price, &l.Balance, &l.Buys, &l.Sells, &l.SOLIn, &l.SOLOut, &l.PnL); err != nil {
+			return nil, err
+		}
+
+		ledger = append(ledger, l)
+	}
+
+	return ledger, rows.Err()
+}
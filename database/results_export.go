@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/marcboeker/go-duckdb"
+)
+
+const (
+	FormatParquet = "parquet"
+	FormatArrow   = "arrow"
+)
+
+// exportQueries are the typed tables a sim can be exported as. Timestamps are exported as real TIMESTAMP
+// columns, so pandas / polars read them as datetimes without any conversion. %d is replaced with the sim ID.
+var exportQueries = map[string]string{
+	"trades": `SELECT seq, block_number, make_timestamp(timestamp * 1000000) AS timestamp, type, file_id, sol_change, token_price
+		FROM sim_trades WHERE sim_id = %d ORDER BY seq`,
+	"balances": `SELECT block_number, make_timestamp(timestamp * 1000000) AS timestamp, usd
+		FROM sim_balances WHERE sim_id = %d ORDER BY block_number`,
+	"ledger": `SELECT file_id, name, contract_address, make_timestamp(call_timestamp * 1000000) AS call_timestamp, entry_price, tp_price, tp_stage,
+		price, balance, buys, sells, sol_in, sol_out, pnl
+		FROM sim_ledger WHERE sim_id = %d ORDER BY file_id`,
+	"metrics": `SELECT * FROM sim_metrics WHERE sim_id = %d`,
+}
+
+// ExportTables lists the tables accepted by ExportSim, in the order they should be written.
+var ExportTables = []string{"trades", "balances", "ledger", "metrics"}
+
+func ExportExtension(format string) string {
+	if format == FormatArrow {
+		return ".arrow"
+	}
+
+	return ".parquet"
+}
+
+// ExportSim writes one table of a stored sim to w, as either Parquet or an Arrow IPC file.
+func (rs *ResultStore) ExportSim(id int, table string, format string, w io.Writer) error {
+	if _, err := rs.GetMetadata(id); err != nil {
+		return err
+	}
+
+	query, ok := exportQueries[table]
+	if !ok {
+		return fmt.Errorf("unknown export table %q", table)
+	}
+	query = fmt.Sprintf(query, id)
+
+	switch format {
+	case FormatParquet:
+		return rs.exportParquet(query, w)
+	case FormatArrow:
+		return rs.exportArrow(query, w)
+	}
+
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// exportParquet lets DuckDB write the parquet file, then streams it to w.
+func (rs *ResultStore) exportParquet(query string, w io.Writer) error {
+	f, err := os.CreateTemp("", "otter-export-*.parquet")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	_, err = rs.c.Exec(`COPY (` + query + `) TO '` + strings.ReplaceAll(path, "'", "''") + `' (FORMAT PARQUET)`)
+	if err != nil {
+		return err
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (rs *ResultStore) exportArrow(query string, w io.Writer) error {
+	ctx := context.Background()
+
+	conn, err := rs.c.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		ar, err := duckdb.NewArrowFromConn(driverConn.(driver.Conn))
+		if err != nil {
+			return err
+		}
+
+		reader, err := ar.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer reader.Release()
+
+		writer, err := ipc.NewFileWriter(w, ipc.WithSchema(reader.Schema()))
+		if err != nil {
+			return err
+		}
+
+		for reader.Next() {
+			if err := writer.Write(reader.Record()); err != nil {
+				writer.Close()
+				return err
+			}
+		}
+
+		if err := reader.Err(); err != nil {
+			writer.Close()
+			return err
+		}
+
+		return writer.Close()
+	})
+}
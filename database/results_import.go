@@ -0,0 +1,111 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"otter/models"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ImportJSONDir loads every sim found in an old sim_output directory into the result store.
+// Sims that are already stored are skipped, so the import can safely be re-run.
+func (rs *ResultStore) ImportJSONDir(dir string) (int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), "_metadata.json") {
+			continue
+		}
+
+		id, err := strconv.Atoi(strings.TrimSuffix(f.Name(), "_metadata.json"))
+		if err != nil {
+			continue
+		}
+
+		exists, err := rs.SimExists(id)
+		if err != nil {
+			return imported, err
+		}
+		if exists {
+			continue
+		}
+
+		result, err := readLegacySim(dir, id)
+		if err != nil {
+			return imported, fmt.Errorf("sim %d: %w", id, err)
+		}
+
+		if err := rs.SaveSim(result); err != nil {
+			return imported, fmt.Errorf("sim %d: %w", id, err)
+		}
+
+		imported += 1
+	}
+
+	return imported, nil
+}
+
+func readLegacySim(dir string, id int) (*models.SimResult, error) {
+	var (
+		metadata json.RawMessage
+		result   models.SimResult
+		balances map[int64]float64
+		assets   map[int]models.Asset
+	)
+
+	panels := map[string]any{
+		"metadata":        &metadata,
+		"portfolio":       &result.Portfolio,
+		"assets":          &assets,
+		"balance_updates": &balances,
+		"trade_history":   &result.Events,
+	}
+
+	for panel, dst := range panels {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprint(id)+"_"+panel+".json"))
+		if os.IsNotExist(err) && panel != "metadata" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, dst); err != nil {
+			return nil, fmt.Errorf("%s: %w", panel, err)
+		}
+	}
+
+	if err := json.Unmarshal(metadata, &result.Metadata); err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+
+	// the old struct tag for TPAmounts was malformed, the migration picks up its Go field name instead
+	config, err := models.MigrateSimConfig(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+
+	result.Metadata.SimConfig = config
+	result.Metadata.ID = id
+
+	// the old balance updates were keyed by block number only, the timestamp was never stored
+	for block, usd := range balances {
+		result.BalanceTracking = append(result.BalanceTracking, models.BalancePoint{BlockNumber: block, USD: usd})
+	}
+
+	sort.Slice(result.BalanceTracking, func(i, j int) bool {
+		return result.BalanceTracking[i].BlockNumber < result.BalanceTracking[j].BlockNumber
+	})
+
+	result.Ledger = models.BuildLedger(assets, result.Events)
+
+	return &result, nil
+}
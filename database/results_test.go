@@ -0,0 +1,176 @@
+package database
+
+import (
+	"otter/models"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newResultStore(t *testing.T) *ResultStore {
+	t.Helper()
+
+	rs, err := OpenResultStore(filepath.Join(t.TempDir(), "results.duckdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rs.Close)
+
+	return rs
+}
+
+func TestUpdateSimAppendsOnlyNewRows(t *testing.T) {
+	rs := newResultStore(t)
+
+	r := &models.SimResult{
+		Metadata:        models.SimulatorMetadata{ID: 42, Date: "2026-01-02 03:04:05", Paper: true, SimConfig: models.SimConfig{Name: "paper"}},
+		BalanceTracking: []models.BalancePoint{{BlockNumber: 1, Timestamp: 100, USD: 15000}},
+		Events:          []models.SimEvent{},
+		Skips:           []models.Skip{},
+		Ledger:          []models.LedgerEntry{},
+	}
+
+	stored, err := rs.UpdateSim(r, SimRows{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session trades, and is saved again
+	r.Events = append(r.Events, models.SimEvent{BlockNumber: 2, Timestamp: 101, Type: "BUY", SOLChange: -1, FileID: 7, TokenPrice: 0.001})
+	r.Skips = append(r.Skips, models.Skip{BlockNumber: 3, Timestamp: 102, FileID: 8, Type: "BUY", Reason: models.SKIP_BALANCE})
+	r.BalanceTracking = append(r.BalanceTracking, models.BalancePoint{BlockNumber: 2, Timestamp: 101, USD: 15010})
+	r.Ledger = append(r.Ledger, models.LedgerEntry{FileID: 7, Buys: 1, SOLIn: 1})
+	r.Portfolio.SOLBalance = 99
+
+	stored, err = rs.UpdateSim(r, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != (SimRows{Saved: true, Trades: 1, Skips: 1, Balances: 2}) {
+		t.Errorf("got %+v stored", stored)
+	}
+
+	// and once more, with only the ledger and wallet changed
+	r.Ledger[0].Price = 0.002
+	r.Portfolio.SOLBalance = 98
+	if _, err := rs.UpdateSim(r, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := rs.GetBalanceTracking(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(balances, r.BalanceTracking) {
+		t.Errorf("got balances %+v, want %+v", balances, r.BalanceTracking)
+	}
+
+	trades, err := rs.GetTradeHistory(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(trades, r.Events) {
+		t.Errorf("got trades %+v, want %+v", trades, r.Events)
+	}
+
+	skips, err := rs.GetSkips(42)
+	if err != nil || len(skips) != 1 {
+		t.Errorf("got skips %+v, %v", skips, err)
+	}
+
+	ledger, err := rs.GetLedger(42)
+	if err != nil || len(ledger) != 1 || ledger[0].Price != 0.002 {
+		t.Errorf("got ledger %+v, %v", ledger, err)
+	}
+
+	portfolio, err := rs.GetPortfolio(42)
+	if err != nil || portfolio.SOLBalance != 98 {
+		t.Errorf("got portfolio %+v, %v", portfolio, err)
+	}
+}
+
+func TestATakenSimIDIsReplaced(t *testing.T) {
+	rs := newResultStore(t)
+
+	sim := func(name string) *models.SimResult {
+		return &models.SimResult{
+			Metadata:        models.SimulatorMetadata{ID: 42, Date: "2026-01-02 03:04:05", SimConfig: models.SimConfig{Name: name}},
+			BalanceTracking: []models.BalancePoint{{BlockNumber: 1, Timestamp: 100, USD: 15000}},
+			Events:          []models.SimEvent{},
+			Skips:           []models.Skip{},
+			Ledger:          []models.LedgerEntry{},
+		}
+	}
+
+	first := sim("first")
+	if err := rs.SaveSim(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := sim("second")
+	if err := rs.SaveSim(second); err != nil {
+		t.Fatal(err)
+	}
+
+	paper := sim("paper")
+	stored, err := rs.UpdateSim(paper, SimRows{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a paper session keeps its ID once it's stored
+	id := paper.Metadata.ID
+	if _, err := rs.UpdateSim(paper, stored); err != nil || paper.Metadata.ID != id {
+		t.Fatalf("the paper session moved from %d to %d, %v", id, paper.Metadata.ID, err)
+	}
+
+	for _, r := range []*models.SimResult{second, paper} {
+		if r.Metadata.ID == 42 {
+			t.Fatalf("%s was stored under a taken ID", r.Metadata.Name)
+		}
+	}
+
+	for _, r := range []*models.SimResult{first, second, paper} {
+		meta, err := rs.GetMetadata(r.Metadata.ID)
+		if err != nil || meta.Name != r.Metadata.Name || meta.ID != r.Metadata.ID {
+			t.Errorf("sim %d is %+v, %v, want %s", r.Metadata.ID, meta, err, r.Metadata.Name)
+		}
+	}
+}
+
+func TestOldConfigHashesAreRedone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.duckdb")
+	rs, err := OpenResultStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := models.SimConfig{Version: models.SIM_CONFIG_VERSION, Name: "old", BuyAmount: 1, TPs: []float64{2}, TPAmounts: []float64{1}}
+	err = rs.SaveSim(&models.SimResult{
+		Metadata:        models.SimulatorMetadata{ID: 42, Date: "2026-01-02 03:04:05", SimConfig: config},
+		BalanceTracking: []models.BalancePoint{},
+		Events:          []models.SimEvent{},
+		Skips:           []models.Skip{},
+		Ledger:          []models.LedgerEntry{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as it was stored before hashes left out the name
+	if _, err := rs.c.Exec(`UPDATE sims SET config_hash = 'with the name', config_hash_version = NULL`); err != nil {
+		t.Fatal(err)
+	}
+	rs.Close()
+
+	rs, err = OpenResultStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	config.Name = "renamed"
+	if id, err := rs.FindSimByConfigHash(config.Hash()); err != nil || id != 42 {
+		t.Errorf("got %d, %v", id, err)
+	}
+}
@@ -0,0 +1,273 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"otter/models"
+)
+
+// StreamOptions bound how much of the events table a stream reads at once.
+type StreamOptions struct {
+	Window   int64 // seconds of events a single query scans, so it only touches those row groups
+	PageSize int   // most events read by a single query
+	Prefetch int   // pages read ahead of the consumer
+
+	// After carries on a stream strictly after a cursor, which can be part way through a block. After the
+	// last event of a page it sent before, with the same range and options, the pages are the same as the rest
+	// of the original stream's.
+	After *Cursor
+}
+
+// Cursor is the position of an event in a stream. Swaps are ordered by (timestamp, block_number, swap_id), and
+// candles, which have no swap ID, by (timestamp, block_number, file_id).
+type Cursor struct {
+	Timestamp   int64
+	BlockNumber int64
+	FileID      int
+	SwapID      int64
+}
+
+// CursorOf is the position of an event.
+func CursorOf(e models.Event) Cursor {
+	return Cursor{Timestamp: e.Timestamp, BlockNumber: e.BlockNumber, FileID: e.FileID, SwapID: e.SwapID}
+}
+
+// Before is whether c comes before an event's position.
+func (c Cursor) Before(e models.Event) bool {
+	if c.Timestamp != e.Timestamp {
+		return c.Timestamp < e.Timestamp
+	}
+	if c.BlockNumber != e.BlockNumber {
+		return c.BlockNumber < e.BlockNumber
+	}
+	// a cursor without a swap ID, from a checkpoint saved before swaps had one, is at the end of its block
+	if c.SwapID != e.SwapID {
+		return c.SwapID != 0 && c.SwapID < e.SwapID
+	}
+	return c.FileID < e.FileID
+}
+
+// EventStream reads the events between two timestamps in (timestamp, block_number) order, a page at a time.
+// Pages are read ahead in the background, at most Prefetch of them, so memory stays at about
+// (Prefetch + 2) * PageSize events however large the range is.
+//
+//	stream := db.StreamEvents(ctx, from, to, opts)
+//	defer stream.Close()
+//	for stream.Next() {
+//		process(stream.Page())
+//	}
+//	if err := stream.Err(); err != nil { ... }
+type EventStream struct {
+	pages  chan eventPage
+	cancel context.CancelFunc
+	page   []models.Event
+	err    error
+}
+
+type eventPage struct {
+	events []models.Event
+	err    error
+}
+
+// eventKey is the position of the last event read. Every event of its (timestamp, block_number) is always read
+// in the same page, so the next page can start strictly after it. A cursor can be part way through a block, so
+// the swap_id is kept too.
+type eventKey struct {
+	timestamp   int64
+	blockNumber int64
+	swapID      int64
+}
+
+// StreamEvents starts streaming the events from..to, both inclusive.
+func (db *Database) StreamEvents(ctx context.Context, from int64, to int64, opts StreamOptions) *EventStream {
+	return startStream(ctx, opts.Prefetch, func(ctx context.Context, send func(eventPage) bool) {
+		db.readPages(ctx, send, from, to, opts)
+	})
+}
+
+// startStream runs read in the background, passing it a send that blocks while prefetch pages are waiting,
+// and returns false once the stream is closed.
+func startStream(ctx context.Context, prefetch int, read func(ctx context.Context, send func(eventPage) bool)) *EventStream {
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &EventStream{
+		pages:  make(chan eventPage, max(prefetch, 0)),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(s.pages)
+
+		read(ctx, func(p eventPage) bool {
+			select {
+			case s.pages <- p:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return s
+}
+
+// Next waits for the next page, and returns false once the range is finished or reading failed.
+// Pages are never empty.
+func (s *EventStream) Next() bool {
+	if s.err != nil {
+		return false
+	}
+
+	p, ok := <-s.pages
+	if !ok {
+		return false
+	}
+	if p.err != nil {
+		s.err = p.err
+		return false
+	}
+
+	s.page = p.events
+	return true
+}
+
+func (s *EventStream) Page() []models.Event {
+	return s.page
+}
+
+func (s *EventStream) Err() error {
+	return s.err
+}
+
+// Close stops the read ahead. It's safe to call more than once, and after the stream has finished.
+func (s *EventStream) Close() {
+	s.cancel()
+
+	// the reader exits once it sees the cancel, this lets it finish a send it's blocked on
+	for range s.pages {
+	}
+}
+
+func (db *Database) readPages(ctx context.Context, send func(eventPage) bool, from int64, to int64, opts StreamOptions) {
+	// the statements are prepared once, the table is the only part that isn't a parameter and it's checked
+	// when it's set
+	page, err := db.c.PrepareContext(ctx, `SELECT file_id, event_display_type, quote_token, token0_swap_value_usd,
+			token1_swap_value_usd, timestamp, block_number, swap_id
+		FROM `+db.events+`
+		WHERE timestamp >= ? AND timestamp <= ?
+			AND (timestamp > ? OR (timestamp = ? AND (block_number > ? OR (block_number = ? AND swap_id > ?))))
+		ORDER BY timestamp, block_number, swap_id
+		LIMIT ?`)
+	if err != nil {
+		send(eventPage{err: fmt.Errorf("preparing the events query: %w", err)})
+		return
+	}
+	defer page.Close()
+
+	group, err := db.c.PrepareContext(ctx, `SELECT file_id, event_display_type, quote_token, token0_swap_value_usd,
+			token1_swap_value_usd, timestamp, block_number, swap_id
+		FROM `+db.events+`
+		WHERE timestamp = ? AND block_number = ? AND swap_id > ?
+		ORDER BY swap_id`)
+	if err != nil {
+		send(eventPage{err: fmt.Errorf("preparing the events query: %w", err)})
+		return
+	}
+	defer group.Close()
+
+	window := max(opts.Window, 1)
+	limit := max(opts.PageSize, 1)
+
+	// starts before anything in the range
+	after := eventKey{timestamp: from - 1, swapID: math.MinInt64}
+	start := from
+
+	// a page always ends with the whole of its last key, so the next one starts after that key, in the same
+	// window it would have
+	if c := opts.After; c != nil && c.Timestamp >= from {
+		after = eventKey{timestamp: c.Timestamp, blockNumber: c.BlockNumber, swapID: c.SwapID}
+		if c.SwapID == 0 {
+			after.swapID = math.MaxInt64
+		}
+		start = from + (c.Timestamp-from)/window*window
+	}
+
+	for start <= to {
+		end := min(start+window-1, to)
+
+		// the lower bound moves up with the cursor, so zone maps skip what's been read already
+		events, err := readEvents(ctx, page, max(start, after.timestamp), end,
+			after.timestamp, after.timestamp, after.blockNumber, after.blockNumber, after.swapID, limit)
+		if err != nil {
+			send(eventPage{err: fmt.Errorf("reading events from %d: %w", start, err)})
+			return
+		}
+
+		full := len(events) == limit
+		if full {
+			// the last key's events may carry on past the limit, so they're dropped and read whole instead
+			last := events[len(events)-1]
+			for len(events) > 0 && events[len(events)-1].Timestamp == last.Timestamp && events[len(events)-1].BlockNumber == last.BlockNumber {
+				events = events[:len(events)-1]
+			}
+
+			// the block the cursor is part way through carries on after it
+			swapID := int64(math.MinInt64)
+			if last.Timestamp == after.timestamp && last.BlockNumber == after.blockNumber {
+				swapID = after.swapID
+			}
+
+			rest, err := readEvents(ctx, group, last.Timestamp, last.BlockNumber, swapID)
+			if err != nil {
+				send(eventPage{err: fmt.Errorf("reading events at %d: %w", last.Timestamp, err)})
+				return
+			}
+			events = append(events, rest...)
+		}
+
+		if len(events) > 0 {
+			last := events[len(events)-1]
+			after = eventKey{timestamp: last.Timestamp, blockNumber: last.BlockNumber, swapID: last.SwapID}
+
+			if !send(eventPage{events: events}) {
+				return
+			}
+		}
+
+		// a full page means the window may have more, anything less and it's done
+		if !full {
+			start = end + 1
+		}
+	}
+}
+
+func readEvents(ctx context.Context, stmt *sql.Stmt, args ...any) ([]models.Event, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.Event{}
+	for rows.Next() {
+		var e models.Event
+		if err := rows.Scan(&e.FileID, &e.EventDisplayType, &e.QuoteToken, &e.SOLPrice, &e.TokenPrice, &e.Timestamp, &e.BlockNumber, &e.SwapID); err != nil {
+			return nil, err
+		}
+
+		NormalisePrices(&e)
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// NormalisePrices un-inverts a price pair, some come out of Codex the wrong way round. The SOL price is always
+// the larger of the two.
+func NormalisePrices(e *models.Event) {
+	if e.SOLPrice < e.TokenPrice {
+		e.SOLPrice, e.TokenPrice = e.TokenPrice, e.SOLPrice
+	}
+}
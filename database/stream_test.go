@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"otter/models"
+	"reflect"
+	"testing"
+)
+
+// newTestDatabase is an in-memory events database, migrated, with events at these timestamps. Each timestamp
+// gets four events in block timestamp*10 and one in the block after, so key groups straddle page boundaries.
+// Token 1 swaps twice in the first block, and the swap IDs aren't in file_id order.
+func newTestDatabase(t *testing.T, timestamps ...int64) *Database {
+	t.Helper()
+
+	db, _, err := ConnectAndMigrate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Disconnect)
+
+	for _, ts := range timestamps {
+		// inserted newest block first, so the order has to come from the query
+		for _, e := range []struct{ swapID, fileID, block int64 }{{5, 1, ts*10 + 1}, {3, 3, ts * 10}, {4, 1, ts * 10}, {2, 1, ts * 10}, {1, 2, ts * 10}} {
+			_, err := db.c.Exec(`INSERT INTO swaps VALUES (?, ?, 'Buy', 'token1', 150, 0.001, ?, ?)`, ts*10+e.swapID, e.fileID, ts, e.block)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return &db
+}
+
+func streamAll(t *testing.T, db *Database, from int64, to int64, opts StreamOptions) []string {
+	t.Helper()
+
+	stream := db.StreamEvents(context.Background(), from, to, opts)
+	defer stream.Close()
+
+	got := []string{}
+	for stream.Next() {
+		if len(stream.Page()) == 0 {
+			t.Fatal("got an empty page")
+		}
+		for _, e := range stream.Page() {
+			got = append(got, fmt.Sprintf("%d/%d/%d", e.Timestamp, e.BlockNumber, e.FileID))
+		}
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func TestStreamOrderAcrossPages(t *testing.T) {
+	db := newTestDatabase(t, 100, 101, 105, 300)
+
+	want := streamAll(t, db, 100, 300, StreamOptions{Window: 1000, PageSize: 1000})
+	if len(want) != 20 {
+		t.Fatalf("got %d events, want 20", len(want))
+	}
+	if want[0] != "100/1000/2" || want[1] != "100/1000/1" || want[2] != "100/1000/3" || want[3] != "100/1000/1" || want[4] != "100/1001/1" || want[19] != "300/3001/1" {
+		t.Fatalf("events out of order: %v", want)
+	}
+
+	for _, window := range []int64{1, 2, 7, 1000} {
+		for _, pageSize := range []int{1, 2, 3, 5} {
+			for _, prefetch := range []int{0, 2} {
+				got := streamAll(t, db, 100, 300, StreamOptions{Window: window, PageSize: pageSize, Prefetch: prefetch})
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("window %d, page size %d: got %v, want %v", window, pageSize, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestStreamRange(t *testing.T) {
+	db := newTestDatabase(t, 100, 200, 300)
+
+	// both ends are inclusive, and nothing past the end is read
+	got := streamAll(t, db, 200, 200, StreamOptions{Window: 250, PageSize: 10})
+	if len(got) != 5 {
+		t.Errorf("got %v, want the 5 events at 200", got)
+	}
+
+	// gaps and a range that runs well past the data don't stall the stream
+	got = streamAll(t, db, 0, 100_000, StreamOptions{Window: 250, PageSize: 10})
+	if len(got) != 15 {
+		t.Errorf("got %d events, want 15", len(got))
+	}
+
+	if got := streamAll(t, db, 400, 500, StreamOptions{Window: 10, PageSize: 10}); len(got) != 0 {
+		t.Errorf("got %v from an empty range", got)
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	db := newTestDatabase(t, 100, 101, 102, 103)
+
+	// closing with the reader blocked on a full buffer doesn't hang
+	stream := db.StreamEvents(context.Background(), 100, 103, StreamOptions{Window: 1, PageSize: 1, Prefetch: 1})
+	if !stream.Next() {
+		t.Fatal(stream.Err())
+	}
+	stream.Close()
+	stream.Close()
+}
+
+func streamPages(t *testing.T, stream *EventStream) [][]models.Event {
+	t.Helper()
+	defer stream.Close()
+
+	pages := [][]models.Event{}
+	for stream.Next() {
+		pages = append(pages, stream.Page())
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return pages
+}
+
+func TestStreamResumesAfterACursor(t *testing.T) {
+	db := newTestDatabase(t, 100, 101, 105, 300)
+	memory := NewMemory(nil, streamPages(t, db.StreamEvents(context.Background(), 100, 300, StreamOptions{Window: 1000, PageSize: 1000}))[0])
+	ctx := context.Background()
+
+	for _, opts := range []StreamOptions{{Window: 1, PageSize: 1}, {Window: 2, PageSize: 3}, {Window: 7, PageSize: 5}, {Window: 1000, PageSize: 2}} {
+		sources := map[string]interface {
+			StreamEvents(ctx context.Context, from int64, to int64, opts StreamOptions) *EventStream
+		}{"database": db, "memory": memory}
+		for name, source := range sources {
+			pages := streamPages(t, source.StreamEvents(ctx, 100, 300, opts))
+
+			// carrying on after any page gives the same pages the stream would have
+			for i := range pages {
+				resumed := opts
+				c := CursorOf(pages[i][len(pages[i])-1])
+				resumed.After = &c
+
+				got := streamPages(t, source.StreamEvents(ctx, 100, 300, resumed))
+				if !reflect.DeepEqual(got, pages[i+1:]) {
+					t.Errorf("%s %+v after page %d: got %v, want %v", name, opts, i, got, pages[i+1:])
+				}
+			}
+		}
+	}
+}
+
+func TestStreamCandlesResumesAfterACursor(t *testing.T) {
+	db := newCandleDatabase(t)
+
+	for _, opts := range []StreamOptions{{Window: 1, PageSize: 1}, {Window: 7, PageSize: 2}} {
+		pages := streamPages(t, db.StreamCandles(context.Background(), 0, 200, "1s", opts))
+
+		for i := range pages {
+			resumed := opts
+			c := CursorOf(pages[i][len(pages[i])-1])
+			resumed.After = &c
+
+			got := streamPages(t, db.StreamCandles(context.Background(), 0, 200, "1s", resumed))
+			if !reflect.DeepEqual(got, pages[i+1:]) {
+				t.Errorf("%+v after page %d: got %v, want %v", opts, i, got, pages[i+1:])
+			}
+		}
+	}
+}
+
+func TestStreamResumesPartWayThroughABlock(t *testing.T) {
+	db := newTestDatabase(t, 100, 101, 105, 300)
+	memory := NewMemory(nil, streamPages(t, db.StreamEvents(context.Background(), 100, 300, StreamOptions{Window: 1000, PageSize: 1000}))[0])
+	ctx := context.Background()
+
+	all := streamPages(t, db.StreamEvents(ctx, 100, 300, StreamOptions{Window: 1000, PageSize: 1000}))[0]
+
+	for _, opts := range []StreamOptions{{Window: 1, PageSize: 1}, {Window: 7, PageSize: 2}, {Window: 1000, PageSize: 1000}} {
+		sources := map[string]interface {
+			StreamEvents(ctx context.Context, from int64, to int64, opts StreamOptions) *EventStream
+		}{"database": db, "memory": memory}
+		for name, source := range sources {
+			// a checkpoint can be after any event, not only the last of a page
+			for i := range all {
+				resumed := opts
+				c := CursorOf(all[i])
+				resumed.After = &c
+
+				got := []models.Event{}
+				for _, page := range streamPages(t, source.StreamEvents(ctx, 100, 300, resumed)) {
+					got = append(got, page...)
+				}
+				if !reflect.DeepEqual(got, all[i+1:]) {
+					t.Errorf("%s %+v after %+v: got %v, want %v", name, opts, c, got, all[i+1:])
+				}
+			}
+		}
+	}
+}
+
+func TestStreamCandlesResumesAfterAnyCandle(t *testing.T) {
+	db := newCandleDatabase(t)
+	ctx := context.Background()
+
+	all := []models.Event{}
+	for _, page := range streamPages(t, db.StreamCandles(ctx, 0, 200, "1s", StreamOptions{Window: 1000, PageSize: 1000})) {
+		all = append(all, page...)
+	}
+
+	for _, opts := range []StreamOptions{{Window: 1, PageSize: 1}, {Window: 7, PageSize: 2}} {
+		for i := range all {
+			resumed := opts
+			c := CursorOf(all[i])
+			resumed.After = &c
+
+			got := []models.Event{}
+			for _, page := range streamPages(t, db.StreamCandles(ctx, 0, 200, "1s", resumed)) {
+				got = append(got, page...)
+			}
+			if !reflect.DeepEqual(got, all[i+1:]) {
+				t.Errorf("%+v after %+v: got %v, want %v", opts, c, got, all[i+1:])
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"otter/database"
+	"otter/models"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+)
+
+// storeSim points Results at a new results database, with one sim stored in it.
+func storeSim(t *testing.T, id int) {
+	t.Helper()
+
+	rs, err := database.OpenResultStore(filepath.Join(t.TempDir(), "results.duckdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rs.Close)
+
+	previous := Results
+	Results = rs
+	t.Cleanup(func() { Results = previous })
+
+	err = rs.SaveSim(&models.SimResult{
+		Metadata:        models.SimulatorMetadata{ID: id, Date: "2026-01-02 03:04:05", SimConfig: models.SimConfig{Name: "export"}},
+		BalanceTracking: []models.BalancePoint{{BlockNumber: 1, Timestamp: 1700000000, USD: 15000}},
+		Events:          []models.SimEvent{{BlockNumber: 1, Timestamp: 1700000000, Type: "BUY", SOLChange: -1, FileID: 7, TokenPrice: 0.001}},
+		Skips:           []models.Skip{},
+		Ledger:          []models.LedgerEntry{{FileID: 7, Name: "Token", CallTimestamp: 1699999999, Buys: 1, SOLIn: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// parquetTypes is the type of every column in a Parquet file, as DuckDB reads it.
+func parquetTypes(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	c, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rows, err := c.Query(`SELECT column_name, column_type FROM (DESCRIBE SELECT * FROM read_parquet(?))`, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	types := map[string]string{}
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+		types[name] = typ
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return types
+}
+
+// arrowTypes is the type of every column in an Arrow IPC file.
+func arrowTypes(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := ipc.NewFileReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	types := map[string]string{}
+	for _, field := range r.Schema().Fields() {
+		types[field.Name] = field.Type.ID().String()
+	}
+
+	return types
+}
+
+func TestExportSimFiles(t *testing.T) {
+	storeSim(t, 42)
+
+	tests := map[string]struct {
+		types func(t *testing.T, path string) map[string]string
+		want  map[string]string // some of the trades file's columns
+	}{
+		database.FormatParquet: {parquetTypes, map[string]string{"timestamp": "TIMESTAMP", "sol_change": "DOUBLE", "type": "VARCHAR"}},
+		database.FormatArrow:   {arrowTypes, map[string]string{"timestamp": arrow.TIMESTAMP.String(), "sol_change": arrow.FLOAT64.String(), "type": arrow.STRING.String()}},
+	}
+
+	for format, test := range tests {
+		t.Run(format, func(t *testing.T) {
+			// the output directory doesn't exist yet
+			dir := filepath.Join(t.TempDir(), "sim_output")
+
+			if err := exportSimFiles(42, format, dir); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+
+			want := []string{}
+			for _, table := range database.ExportTables {
+				want = append(want, "42_"+table+database.ExportExtension(format))
+			}
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+
+			types := test.types(t, filepath.Join(dir, "42_trades"+database.ExportExtension(format)))
+			for column, typ := range test.want {
+				if types[column] != typ {
+					t.Errorf("got %s for %s, want %s", types[column], column, typ)
+				}
+			}
+		})
+	}
+}
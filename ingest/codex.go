@@ -0,0 +1,285 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const CODEX_ENDPOINT = "https://graph.codex.io/graphql"
+
+// SOLANA_NETWORK_ID is Solana's network ID on Codex.
+const SOLANA_NETWORK_ID = 1399811149
+
+// PAGE_SIZE is the most events getTokenEvents returns per request.
+const PAGE_SIZE = 200
+
+// HTTPDoer sends a request, *http.Client is the default. Swapping it (or the client's Transport) is how
+// requests are recorded, or sent to the mock server.
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Client queries the Codex GraphQL API. Every request waits on the rate limiter, and requests that fail
+// with a network error, a 429 or a 5xx are retried with exponential backoff.
+type Client struct {
+	Endpoint string
+	APIKey   string
+	HTTP     HTTPDoer
+	Limiter  *Limiter
+
+	Retries int           // retries after the first attempt
+	Backoff time.Duration // wait before the first retry, doubled for each one after
+}
+
+func NewClient(apiKey string, requestsPerSecond float64) *Client {
+	return &Client{
+		Endpoint: CODEX_ENDPOINT,
+		APIKey:   apiKey,
+		HTTP:     &http.Client{Timeout: 30 * time.Second},
+		Limiter:  NewLimiter(requestsPerSecond),
+		Retries:  5,
+		Backoff:  time.Second,
+	}
+}
+
+// GraphQLRequest is the body of a GraphQL POST.
+type GraphQLRequest struct {
+	OperationName string         `json:"operationName"`
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// statusError is a non-200 response.
+type statusError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("codex returned %d: %s", e.status, e.body)
+}
+
+func (e *statusError) retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// Query sends a GraphQL request and decodes its data into out.
+func (c *Client) Query(ctx context.Context, req GraphQLRequest, out any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			wait := c.Backoff << (attempt - 1)
+
+			var se *statusError
+			if errors.As(lastErr, &se) && se.retryAfter > wait {
+				wait = se.retryAfter
+			}
+
+			if err := sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		data, err := c.post(ctx, body)
+		if err == nil {
+			return decodeGraphQL(data, out)
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var se *statusError
+		if errors.As(err, &se) && !se.retryable() {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%s: giving up after %d attempts: %w", req.OperationName, c.Retries+1, lastErr)
+}
+
+func (c *Client) post(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.APIKey)
+
+	doer := c.HTTP
+	if doer == nil {
+		doer = http.DefaultClient
+	}
+
+	resp, err := doer.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		se := &statusError{status: resp.StatusCode, body: string(bytes.TrimSpace(data))}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			se.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, se
+	}
+
+	return data, nil
+}
+
+func decodeGraphQL(data []byte, out any) error {
+	var resp graphQLResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("invalid GraphQL response: %w", err)
+	}
+
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("codex: %s", resp.Errors[0].Message)
+	}
+
+	return json.Unmarshal(resp.Data, out)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TokenEvent is one item of getTokenEvents. The USD values are strings in Codex's schema.
+type TokenEvent struct {
+	BlockNumber        int64  `json:"blockNumber"`
+	Timestamp          int64  `json:"timestamp"`
+	TransactionHash    string `json:"transactionHash"`
+	EventDisplayType   string `json:"eventDisplayType"`
+	QuoteToken         string `json:"quoteToken"`
+	Token0SwapValueUsd string `json:"token0SwapValueUsd"`
+	Token1SwapValueUsd string `json:"token1SwapValueUsd"`
+}
+
+// EventPage is one page of getTokenEvents. An empty cursor means it's the last page.
+type EventPage struct {
+	Cursor string       `json:"cursor"`
+	Items  []TokenEvent `json:"items"`
+}
+
+const tokenEventsQuery = `query TokenEvents($cursor: String, $limit: Int, $query: EventsQueryInput!) {
+  getTokenEvents(cursor: $cursor, limit: $limit, direction: ASC, query: $query) {
+    cursor
+    items {
+      blockNumber
+      timestamp
+      transactionHash
+      eventDisplayType
+      quoteToken
+      token0SwapValueUsd
+      token1SwapValueUsd
+    }
+  }
+}`
+
+// TokenEvents fetches one page of a token's swaps between from and to (unix seconds), oldest first.
+func (c *Client) TokenEvents(ctx context.Context, networkID int, address string, from int64, to int64, cursor string, limit int) (EventPage, error) {
+	vars := map[string]any{
+		"limit": limit,
+		"query": map[string]any{
+			"address":   address,
+			"networkId": networkID,
+			"timestamp": map[string]any{"from": from, "to": to},
+		},
+	}
+	if cursor != "" {
+		vars["cursor"] = cursor
+	}
+
+	var data struct {
+		GetTokenEvents *EventPage `json:"getTokenEvents"`
+	}
+
+	err := c.Query(ctx, GraphQLRequest{OperationName: "TokenEvents", Query: tokenEventsQuery, Variables: vars}, &data)
+	if err != nil {
+		return EventPage{}, err
+	}
+	if data.GetTokenEvents == nil {
+		return EventPage{}, nil
+	}
+
+	return *data.GetTokenEvents, nil
+}
+
+// TokenMetadata is the token's details, as stored in file_metadata.
+type TokenMetadata struct {
+	Address     string `json:"address"`
+	Name        string `json:"name"`
+	Symbol      string `json:"symbol"`
+	TotalSupply string `json:"totalSupply"`
+	Info        struct {
+		Description   string `json:"description"`
+		ImageLargeURL string `json:"imageLargeUrl"`
+	} `json:"info"`
+}
+
+const tokenQuery = `query Token($input: TokenInput!) {
+  token(input: $input) {
+    address
+    name
+    symbol
+    totalSupply
+    info {
+      description
+      imageLargeUrl
+    }
+  }
+}`
+
+func (c *Client) Token(ctx context.Context, networkID int, address string) (TokenMetadata, error) {
+	vars := map[string]any{
+		"input": map[string]any{"address": address, "networkId": networkID},
+	}
+
+	var data struct {
+		Token TokenMetadata `json:"token"`
+	}
+
+	err := c.Query(ctx, GraphQLRequest{OperationName: "Token", Query: tokenQuery, Variables: vars}, &data)
+	return data.Token, err
+}
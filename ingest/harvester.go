@@ -0,0 +1,333 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EVENT_COLUMNS and METADATA_COLUMNS are the headers of the CSV files a harvest writes, in the column
+// order of the events and file_metadata tables, so they can be loaded with otter ingest.
+var (
+	EVENT_COLUMNS    = []string{"file_id", "event_display_type", "quote_token", "token0_swap_value_usd", "token1_swap_value_usd", "timestamp", "block_number"}
+	METADATA_COLUMNS = []string{"file_id", "ca", "call_timestamp", "from_value", "to_value", "additional", "name", "symbol", "description", "total_supply", "image_uri"}
+)
+
+const (
+	STATE_FILE    = "harvest_state.json"
+	METADATA_FILE = "metadata.csv"
+)
+
+// Call is a token to harvest, FileID is the ID its events are stored under.
+type Call struct {
+	FileID        int
+	Address       string
+	CallTimestamp int64
+}
+
+// ReadCalls reads a CSV of calls with a file_id,ca,call_timestamp header.
+func ReadCalls(r io.Reader) ([]Call, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	cols := map[string]int{}
+	for i, name := range rows[0] {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"file_id", "ca", "call_timestamp"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("calls file is missing the %s column", name)
+		}
+	}
+
+	calls := make([]Call, 0, len(rows)-1)
+	for i, row := range rows[1:] {
+		fileID, err := strconv.Atoi(strings.TrimSpace(row[cols["file_id"]]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid file_id", i+2)
+		}
+
+		// call timestamps are stored as DOUBLE in file_metadata
+		ts, err := strconv.ParseFloat(strings.TrimSpace(row[cols["call_timestamp"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid call_timestamp", i+2)
+		}
+
+		calls = append(calls, Call{FileID: fileID, Address: strings.TrimSpace(row[cols["ca"]]), CallTimestamp: int64(ts)})
+	}
+
+	return calls, nil
+}
+
+// TokenState is how far a token's harvest has got. Offset is the size of the token's events file when
+// Cursor was saved, anything written after it (a page that was written but never checkpointed) is
+// truncated on resume, so no page is ever written twice.
+type TokenState struct {
+	Cursor   string         `json:"cursor,omitempty"`
+	Offset   int64          `json:"offset"`
+	Events   int64          `json:"events"`
+	Done     bool           `json:"done"`
+	Metadata *TokenMetadata `json:"metadata,omitempty"`
+	From     int64          `json:"from"`
+	To       int64          `json:"to"`
+	Call     Call           `json:"call"`
+}
+
+// Harvester pages every call's events out of Codex into Dir, one events_<file_id>.csv per token plus a
+// metadata.csv. Progress is checkpointed after every page, a harvest that's stopped for any reason
+// picks up where it left off when it's run again with the same Dir.
+type Harvester struct {
+	Client    *Client
+	NetworkID int
+	PageSize  int
+	Before    time.Duration // events are harvested from the call timestamp less Before
+	After     time.Duration // up to the call timestamp plus After
+	Dir       string
+
+	// OnPage is called after every page is checkpointed, with the token's running total
+	OnPage func(call Call, events int64)
+
+	state map[int]*TokenState
+}
+
+func NewHarvester(client *Client, dir string) *Harvester {
+	return &Harvester{
+		Client:    client,
+		NetworkID: SOLANA_NETWORK_ID,
+		PageSize:  PAGE_SIZE,
+		After:     24 * time.Hour,
+		Dir:       dir,
+	}
+}
+
+// Harvest fetches the metadata and events of every call that isn't finished yet.
+func (h *Harvester) Harvest(ctx context.Context, calls []Call) error {
+	if err := os.MkdirAll(h.Dir, 0755); err != nil {
+		return err
+	}
+
+	if err := h.loadState(); err != nil {
+		return err
+	}
+
+	for _, call := range calls {
+		if err := h.harvestToken(ctx, call); err != nil {
+			return fmt.Errorf("file %d (%s): %w", call.FileID, call.Address, err)
+		}
+	}
+
+	return nil
+}
+
+// State returns a token's progress, nil if it hasn't been started.
+func (h *Harvester) State(fileID int) *TokenState {
+	return h.state[fileID]
+}
+
+func (h *Harvester) EventsPath(fileID int) string {
+	return filepath.Join(h.Dir, fmt.Sprintf("events_%d.csv", fileID))
+}
+
+func (h *Harvester) harvestToken(ctx context.Context, call Call) error {
+	st, ok := h.state[call.FileID]
+	if !ok {
+		st = &TokenState{
+			Call: call,
+			From: call.CallTimestamp - int64(h.Before.Seconds()),
+			To:   call.CallTimestamp + int64(h.After.Seconds()),
+		}
+		h.state[call.FileID] = st
+	}
+
+	if st.Done {
+		return nil
+	}
+
+	if st.Metadata == nil {
+		meta, err := h.Client.Token(ctx, h.NetworkID, call.Address)
+		if err != nil {
+			return err
+		}
+
+		st.Metadata = &meta
+		if err := h.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(h.EventsPath(call.FileID), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(st.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(st.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(f)
+	w := csv.NewWriter(buf)
+	if st.Offset == 0 {
+		w.Write(EVENT_COLUMNS)
+	}
+
+	for {
+		page, err := h.Client.TokenEvents(ctx, h.NetworkID, call.Address, st.From, st.To, st.Cursor, h.PageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range page.Items {
+			w.Write([]string{
+				strconv.Itoa(call.FileID),
+				e.EventDisplayType,
+				e.QuoteToken,
+				e.Token0SwapValueUsd,
+				e.Token1SwapValueUsd,
+				strconv.FormatInt(e.Timestamp, 10),
+				strconv.FormatInt(e.BlockNumber, 10),
+			})
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		st.Cursor = page.Cursor
+		st.Offset = offset
+		st.Events += int64(len(page.Items))
+		st.Done = page.Cursor == "" || len(page.Items) == 0
+
+		if err := h.checkpoint(); err != nil {
+			return err
+		}
+
+		if h.OnPage != nil {
+			h.OnPage(call, st.Events)
+		}
+
+		if st.Done {
+			return nil
+		}
+	}
+}
+
+func (h *Harvester) loadState() error {
+	h.state = map[int]*TokenState{}
+
+	data, err := os.ReadFile(filepath.Join(h.Dir, STATE_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &h.state); err != nil {
+		return fmt.Errorf("%s: %w", STATE_FILE, err)
+	}
+
+	return nil
+}
+
+// checkpoint saves the state, then rewrites metadata.csv from it. Both are replaced atomically.
+func (h *Harvester) checkpoint() error {
+	data, err := json.MarshalIndent(h.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeAtomic(filepath.Join(h.Dir, STATE_FILE), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	return writeAtomic(filepath.Join(h.Dir, METADATA_FILE), h.writeMetadata)
+}
+
+func (h *Harvester) writeMetadata(out io.Writer) error {
+	ids := make([]int, 0, len(h.state))
+	for id, st := range h.state {
+		if st.Metadata != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	w := csv.NewWriter(out)
+	w.Write(METADATA_COLUMNS)
+
+	for _, id := range ids {
+		st := h.state[id]
+		m := st.Metadata
+		w.Write([]string{
+			strconv.Itoa(id),
+			st.Call.Address,
+			strconv.FormatInt(st.Call.CallTimestamp, 10),
+			strconv.FormatInt(st.From, 10),
+			strconv.FormatInt(st.To, 10),
+			"",
+			m.Name,
+			m.Symbol,
+			m.Info.Description,
+			m.TotalSupply,
+			m.Info.ImageLargeURL,
+		})
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
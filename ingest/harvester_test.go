@@ -0,0 +1,208 @@
+package ingest
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHarvester(t *testing.T, server *MockServer, dir string) *Harvester {
+	t.Helper()
+
+	client := NewClient("test-key", 0)
+	client.Endpoint = server.URL
+	client.Backoff = time.Millisecond
+
+	return NewHarvester(client, dir)
+}
+
+func loadTestFixtures(t *testing.T) (*Fixtures, []Call) {
+	t.Helper()
+
+	fixtures, err := LoadFixtures("testdata/codex_fixtures.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open("testdata/calls.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	calls, err := ReadCalls(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fixtures, calls
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+func TestHarvestPaginates(t *testing.T) {
+	fixtures, calls := loadTestFixtures(t)
+	server := NewMockServer(fixtures)
+	defer server.Close()
+
+	dir := t.TempDir()
+	h := newTestHarvester(t, server, dir)
+
+	if err := h.Harvest(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileID, want := range map[int]int{1: 8, 2: 4} {
+		rows := readCSV(t, h.EventsPath(fileID))
+		if got := len(rows) - 1; got != want {
+			t.Errorf("file %d: got %d events, want %d", fileID, got, want)
+		}
+		if !h.State(fileID).Done {
+			t.Errorf("file %d isn't marked done", fileID)
+		}
+	}
+
+	meta := readCSV(t, filepath.Join(dir, METADATA_FILE))
+	if len(meta) != 3 || meta[1][6] != "Token One" || meta[2][7] != "TWO" {
+		t.Errorf("unexpected metadata.csv: %v", meta)
+	}
+
+	// metadata and three pages for CA1, metadata and one page for CA2
+	if got := server.Requests(); got != 6 {
+		t.Errorf("got %d requests, want 6", got)
+	}
+}
+
+func TestHarvestResumesFromCheckpoint(t *testing.T) {
+	fixtures, calls := loadTestFixtures(t)
+	server := NewMockServer(fixtures)
+	defer server.Close()
+
+	dir := t.TempDir()
+	h := newTestHarvester(t, server, dir)
+	h.Client.Retries = 1
+
+	// the second page of CA1 fails on every attempt, stopping the harvest after the first
+	h.OnPage = func(call Call, events int64) {
+		if call.FileID == 1 && events == 3 {
+			server.FailWith(http.StatusInternalServerError, http.StatusInternalServerError)
+		}
+	}
+
+	if err := h.Harvest(context.Background(), calls); err == nil {
+		t.Fatal("expected the harvest to fail")
+	}
+
+	st := h.State(1)
+	if st.Done || st.Cursor != "c1p2" || st.Events != 3 {
+		t.Fatalf("unexpected checkpoint %+v", st)
+	}
+
+	// a page written after the checkpoint, as if the process died before saving the cursor
+	f, err := os.OpenFile(h.EventsPath(1), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("1,Buy,token1,150,0.1,1700000019,1003\n")
+	f.Close()
+
+	before := server.Requests()
+
+	resumed := newTestHarvester(t, server, dir)
+	if err := resumed.Harvest(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readCSV(t, resumed.EventsPath(1))
+	if got := len(rows) - 1; got != 8 {
+		t.Errorf("got %d events after resuming, want 8", got)
+	}
+
+	// pages two and three of CA1, metadata and one page for CA2, nothing is fetched twice
+	if got := server.Requests() - before; got != 4 {
+		t.Errorf("resume made %d requests, want 4", got)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	fixtures, _ := loadTestFixtures(t)
+	server := NewMockServer(fixtures)
+	defer server.Close()
+
+	client := NewClient("test-key", 0)
+	client.Endpoint = server.URL
+	client.Backoff = time.Millisecond
+
+	server.FailWith(http.StatusTooManyRequests, http.StatusBadGateway)
+	meta, err := client.Token(context.Background(), SOLANA_NETWORK_ID, "CA1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Symbol != "ONE" || server.Requests() != 3 {
+		t.Errorf("got %q after %d requests", meta.Symbol, server.Requests())
+	}
+
+	// client errors aren't retried
+	server.FailWith(http.StatusUnauthorized)
+	if _, err := client.Token(context.Background(), SOLANA_NETWORK_ID, "CA1"); err == nil {
+		t.Error("expected a 401 to fail")
+	}
+	if server.Requests() != 4 {
+		t.Errorf("a 401 was retried, %d requests", server.Requests())
+	}
+}
+
+func TestRecordedFixturesReplay(t *testing.T) {
+	fixtures, calls := loadTestFixtures(t)
+	server := NewMockServer(fixtures)
+	defer server.Close()
+
+	h := newTestHarvester(t, server, t.TempDir())
+	recorder := NewRecorder(h.Client.HTTP)
+	h.Client.HTTP = recorder
+
+	if err := h.Harvest(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "recorded.json")
+	if err := recorder.Fixtures.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := LoadFixtures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay := NewMockServer(recorded)
+	defer replay.Close()
+
+	r := newTestHarvester(t, replay, t.TempDir())
+	if err := r.Harvest(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(readCSV(t, r.EventsPath(1))) - 1; got != 8 {
+		t.Errorf("replay harvested %d events, want 8", got)
+	}
+}
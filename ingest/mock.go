@@ -0,0 +1,200 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+)
+
+// Exchange is one recorded request to Codex and its response. Requests are matched on the operation,
+// the token address and the page cursor only, so a fixture keeps working if the time window or page size change.
+type Exchange struct {
+	Operation string          `json:"operation"`
+	Address   string          `json:"address"`
+	Cursor    string          `json:"cursor,omitempty"`
+	Response  json.RawMessage `json:"response"`
+}
+
+type Fixtures struct {
+	Exchanges []Exchange `json:"exchanges"`
+}
+
+func LoadFixtures(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f Fixtures
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *Fixtures) Save(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func (f *Fixtures) find(operation string, address string, cursor string) *Exchange {
+	for i := range f.Exchanges {
+		e := &f.Exchanges[i]
+		if e.Operation == operation && e.Address == address && e.Cursor == cursor {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// requestKey pulls the fields a request is matched on out of its body.
+func requestKey(body []byte) (operation string, address string, cursor string) {
+	var req GraphQLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", "", ""
+	}
+
+	// getTokenEvents takes the address in "query", token in "input"
+	for _, key := range []string{"query", "input"} {
+		if v, ok := req.Variables[key].(map[string]any); ok {
+			if a, ok := v["address"].(string); ok {
+				address = a
+			}
+		}
+	}
+
+	cursor, _ = req.Variables["cursor"].(string)
+
+	return req.OperationName, address, cursor
+}
+
+// MockServer answers like Codex from recorded fixtures, so a harvest can run offline.
+// Requests without a fixture get a GraphQL error.
+type MockServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	fixtures *Fixtures
+	faults   []int
+	requests int
+}
+
+func NewMockServer(fixtures *Fixtures) *MockServer {
+	m := &MockServer{fixtures: fixtures}
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+
+	return m
+}
+
+// FailWith makes the next requests fail with these HTTP statuses, one per request, before fixtures are served again.
+func (m *MockServer) FailWith(statuses ...int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.faults = append(m.faults, statuses...)
+}
+
+// Requests is the number of requests the server has received, failed ones included.
+func (m *MockServer) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.requests
+}
+
+func (m *MockServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	m.requests += 1
+	if len(m.faults) > 0 {
+		status := m.faults[0]
+		m.faults = m.faults[1:]
+		m.mu.Unlock()
+
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	exchange := m.fixtures.find(requestKey(body))
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if exchange == nil {
+		operation, address, cursor := requestKey(body)
+		json.NewEncoder(w).Encode(map[string]any{
+			"errors": []map[string]string{{"message": "no fixture for " + operation + " " + address + " cursor " + cursor}},
+		})
+		return
+	}
+
+	w.Write(exchange.Response)
+}
+
+// Recorder passes requests on to Next and records every successful response into Fixtures, to be
+// saved and served by a MockServer later.
+type Recorder struct {
+	Next     HTTPDoer
+	Fixtures *Fixtures
+
+	mu sync.Mutex
+}
+
+func NewRecorder(next HTTPDoer) *Recorder {
+	return &Recorder{Next: next, Fixtures: &Fixtures{}}
+}
+
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := r.Next.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	operation, address, cursor := requestKey(body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Fixtures.find(operation, address, cursor) == nil {
+		r.Fixtures.Exchanges = append(r.Fixtures.Exchanges, Exchange{
+			Operation: operation,
+			Address:   address,
+			Cursor:    cursor,
+			Response:  json.RawMessage(data),
+		})
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter spaces requests evenly, so a harvest never bursts over the API's rate limit.
+type Limiter struct {
+	mu    sync.Mutex
+	every time.Duration
+	next  time.Time
+}
+
+// NewLimiter allows requestsPerSecond requests a second. Zero or less means no limit.
+func NewLimiter(requestsPerSecond float64) *Limiter {
+	l := &Limiter{}
+	if requestsPerSecond > 0 {
+		l.every = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+
+	return l
+}
+
+// Wait blocks until the next request is allowed, or ctx is cancelled.
+func (l *Limiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(l.every)
+	l.mu.Unlock()
+
+	if wait := time.Until(at); wait > 0 {
+		return sleep(ctx, wait)
+	}
+
+	return ctx.Err()
+}
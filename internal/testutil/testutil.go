@@ -0,0 +1,16 @@
+// Package testutil has the helpers the simulator, synth and live tests share.
+package testutil
+
+import "math"
+
+// NoProgress is a simulator.ProgressReporter that drops everything.
+type NoProgress struct{}
+
+func (NoProgress) SetRange(start int64, end int64) {}
+func (NoProgress) SetProgress(current int64)       {}
+func (NoProgress) Publish(event string, data any)  {}
+
+// Near is whether two floats are equal but for rounding, relative to b's size once it's over 1.
+func Near(a float64, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
@@ -0,0 +1,687 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"otter/models"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type State string
+
+const (
+	Queued    State = "queued"
+	Running   State = "running"
+	Done      State = "done"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+	Paused    State = "paused"
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrJobFinished  = errors.New("job has already finished")
+	ErrNotPausable  = errors.New("job can't be paused")
+	ErrJobNotPaused = errors.New("job isn't paused")
+	ErrJobPaused    = errors.New("job is already paused")
+	ErrShutDown     = errors.New("job manager has shut down")
+)
+
+// RunFunc does the work of a job. It should return promptly once ctx is cancelled,
+// and returns the ID of the sim it produced.
+type RunFunc func(ctx context.Context, job *Job) (int, error)
+
+// Status is a point-in-time copy of a job, safe to hand to other goroutines and to serialise.
+type Status struct {
+	ID               string     `json:"id"`
+	SimName          string     `json:"sim_name"`
+	ConfigHash       string     `json:"config_hash,omitempty"`
+	State            State      `json:"state"`
+	Error            string     `json:"error,omitempty"`
+	SimID            int        `json:"sim_id,omitempty"` // set once the sim is stored
+	StartTimestamp   int64      `json:"start_timestamp"`
+	CurrentTimestamp int64      `json:"current_timestamp"`
+	EndTimestamp     int64      `json:"end_timestamp"`
+	Done             bool       `json:"done"`
+	QueuedAt         time.Time  `json:"queued_at"`
+	StartedAt        *time.Time `json:"started_at,omitempty"`
+	FinishedAt       *time.Time `json:"finished_at,omitempty"`
+}
+
+// Message is a live update from a job, streamed to subscribers as a server-sent event.
+type Message struct {
+	Event string
+	Data  any
+}
+
+// DoneMessage is always the last message a subscriber receives.
+type DoneMessage struct {
+	JobID string `json:"job_id"`
+	SimID int    `json:"sim_id,omitempty"`
+	State State  `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Observer is told about a job whenever it's queued, starts or finishes, e.g. to send webhooks. It's called
+// from whichever goroutine changed the job, so it shouldn't block.
+type Observer func(Status)
+
+// Journal keeps a record of the pausable jobs that haven't finished, so they can be restored with
+// Manager.Restore after a restart. A job is saved whenever it's queued, starts or is paused, and removed once
+// it finishes, unless it was stopped by Shutdown.
+type Journal interface {
+	SaveJob(status Status, config models.SimConfig) error
+	RemoveJob(id string) error
+}
+
+// subscribers that fall this far behind start missing messages, rather than slowing the sim down
+const subscriberBuffer = 1024
+
+// the manager forgets the oldest finished jobs beyond this many, the sims they stored are still in the results
+const finishedJobs = 1000
+
+type Job struct {
+	mu     sync.Mutex
+	status Status
+	run    RunFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	subscribers  map[chan Message]bool
+	lastProgress *Message
+
+	observer Observer
+
+	config   models.SimConfig
+	pausable bool
+	pausing  bool // paused while running, the worker pauses it once the run returns
+	kept     bool // stopped by Shutdown, so the journal keeps it
+	journal  Journal
+}
+
+// SetRange sets the timestamps the job will run between, used to report progress.
+func (j *Job) SetRange(start int64, end int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.StartTimestamp = start
+	j.status.CurrentTimestamp = start
+	j.status.EndTimestamp = end
+}
+
+// SetSimID records the sim a job stores as it runs, e.g. a paper trading session, so it can be loaded
+// before the job is done.
+func (j *Job) SetSimID(id int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.SimID = id
+}
+
+func (j *Job) SetProgress(current int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.CurrentTimestamp = current
+}
+
+// Publish sends a message to everyone subscribed to the job. The latest "progress" message is kept,
+// so late subscribers can start from it.
+func (j *Job) Publish(event string, data any) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status.Done {
+		return
+	}
+
+	msg := Message{Event: event, Data: data}
+	if event == "progress" {
+		j.lastProgress = &msg
+	}
+
+	for ch := range j.subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+func (j *Job) subscribe() (<-chan Message, func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ch := make(chan Message, subscriberBuffer)
+
+	if j.status.Done {
+		ch <- Message{Event: "done", Data: j.doneMessage()}
+		close(ch)
+		return ch, func() {}
+	}
+
+	if j.lastProgress != nil {
+		ch <- *j.lastProgress
+	}
+
+	if j.subscribers == nil {
+		j.subscribers = make(map[chan Message]bool)
+	}
+	j.subscribers[ch] = true
+
+	unsubscribe := func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		if j.subscribers[ch] {
+			delete(j.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+func (j *Job) doneMessage() DoneMessage {
+	return DoneMessage{
+		JobID: j.status.ID,
+		SimID: j.status.SimID,
+		State: j.status.State,
+		Error: j.status.Error,
+	}
+}
+
+func (j *Job) Status() Status {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.status
+}
+
+// notify tells the journal and the observer about the job's current state, j.mu must not be held.
+func (j *Job) notify() {
+	j.mu.Lock()
+	status := j.status
+	kept := j.kept
+	j.mu.Unlock()
+
+	if j.journal != nil && j.pausable {
+		var err error
+		switch {
+		case !status.Done:
+			err = j.journal.SaveJob(status, j.config)
+		case !kept:
+			err = j.journal.RemoveJob(status.ID)
+		}
+		if err != nil {
+			log.Printf("job %s: updating the journal: %s", status.ID, err)
+		}
+	}
+
+	if j.observer != nil {
+		j.observer(status)
+	}
+}
+
+// stop cancels the job's run.
+func (j *Job) stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.cancel()
+}
+
+// pause stops the job until it's resumed, keeping its subscribers.
+func (j *Job) pause() {
+	j.mu.Lock()
+	j.status.State = Paused
+	j.pausing = false
+	j.mu.Unlock()
+
+	j.notify()
+	j.Publish("paused", j.Status())
+}
+
+func (j *Job) finish(state State, simID int, err error) {
+	j.mu.Lock()
+	defer j.notify()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	j.status.State = state
+	if simID != 0 {
+		j.status.SimID = simID
+	}
+	j.status.Done = true
+	j.status.FinishedAt = &now
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+
+	// the done message is always delivered, even to subscribers that have fallen behind
+	done := Message{Event: "done", Data: j.doneMessage()}
+	for ch := range j.subscribers {
+		select {
+		case ch <- done:
+		default:
+			<-ch
+			ch <- done
+		}
+		close(ch)
+	}
+	j.subscribers = nil
+}
+
+// Manager runs sims on a fixed size pool of workers. Jobs beyond the pool size wait in a FIFO queue.
+type Manager struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	jobs  map[string]*Job
+	order []string // job IDs, oldest first
+	queue []*Job
+
+	closed   bool
+	wg       sync.WaitGroup
+	observer Observer
+	journal  Journal
+
+	keepFinished int // finished jobs kept for Get and List
+}
+
+func NewManager(workers int) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+
+	m := &Manager{
+		jobs:         make(map[string]*Job),
+		keepFinished: finishedJobs,
+	}
+	m.cond = sync.NewCond(&m.mu)
+
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+
+	return m
+}
+
+// Observe sets the observer every job submitted after it is reported to.
+func (m *Manager) Observe(observer Observer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.observer = observer
+}
+
+// SetJournal sets the journal every pausable job submitted after it is saved to.
+func (m *Manager) SetJournal(journal Journal) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.journal = journal
+}
+
+// Submit queues a job to run a sim config and returns its status straight away.
+func (m *Manager) Submit(config models.SimConfig, run RunFunc) Status {
+	return m.add(newJob(config, run, false), Queued, true)
+}
+
+// SubmitPausable queues a job that can be paused and resumed, and is kept in the journal until it finishes.
+// Its run has to pick up where it left off when it's started again, e.g. from a checkpoint.
+func (m *Manager) SubmitPausable(config models.SimConfig, run RunFunc) Status {
+	return m.add(newJob(config, run, true), Queued, true)
+}
+
+// Restore adds a pausable job from the journal under its old ID. A paused job stays paused, any other is
+// queued again. The observer isn't told, it heard about the job when it was first queued.
+func (m *Manager) Restore(status Status, config models.SimConfig, run RunFunc) Status {
+	job := newJob(config, run, true)
+	job.status.ID = status.ID
+	job.status.QueuedAt = status.QueuedAt
+
+	state := Queued
+	if status.State == Paused {
+		state = Paused
+	}
+
+	return m.add(job, state, false)
+}
+
+func newJob(config models.SimConfig, run RunFunc, pausable bool) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Job{
+		status: Status{
+			ID:         uuid.NewString(),
+			SimName:    config.Name,
+			ConfigHash: config.Hash(),
+			State:      Queued,
+			QueuedAt:   time.Now(),
+		},
+		run:      run,
+		ctx:      ctx,
+		cancel:   cancel,
+		config:   config,
+		pausable: pausable,
+	}
+}
+
+// add starts keeping track of a job, queueing it unless it's paused.
+func (m *Manager) add(job *Job, state State, notify bool) Status {
+	job.status.State = state
+
+	m.mu.Lock()
+	job.observer = m.observer
+	job.journal = m.journal
+	m.mu.Unlock()
+
+	// the observer hears the job is queued before a worker can start it
+	if notify {
+		job.notify()
+	}
+
+	m.mu.Lock()
+	m.forgetFinished()
+	m.jobs[job.status.ID] = job
+	m.order = append(m.order, job.status.ID)
+	if state == Queued {
+		m.queue = append(m.queue, job)
+	}
+	m.mu.Unlock()
+
+	m.cond.Signal()
+
+	return job.Status()
+}
+
+// forgetFinished drops the oldest finished jobs beyond keepFinished, m.mu must be held.
+func (m *Manager) forgetFinished() {
+	finished := 0
+	for _, id := range m.order {
+		if m.jobs[id].Status().Done {
+			finished += 1
+		}
+	}
+
+	order := m.order[:0]
+	for _, id := range m.order {
+		if finished > m.keepFinished && m.jobs[id].Status().Done {
+			delete(m.jobs, id)
+			finished -= 1
+			continue
+		}
+		order = append(order, id)
+	}
+	m.order = order
+}
+
+// Pause stops a pausable job until it's resumed. A queued job leaves the queue, a running one is cancelled
+// and paused once its run returns.
+func (m *Manager) Pause(id string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if !job.pausable {
+		m.mu.Unlock()
+		return ErrNotPausable
+	}
+
+	for i, queued := range m.queue {
+		if queued == job {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.mu.Unlock()
+
+			job.pause()
+			return nil
+		}
+	}
+	m.mu.Unlock()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	switch {
+	case job.status.Done:
+		return ErrJobFinished
+	case job.status.State == Paused, job.pausing:
+		return ErrJobPaused
+	}
+
+	job.pausing = true
+	job.cancel()
+
+	return nil
+}
+
+// Resume queues a paused job again. Once the manager has shut down paused jobs stay paused, to be restored
+// next time.
+func (m *Manager) Resume(id string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	closed := m.closed
+	m.mu.Unlock()
+
+	if !ok {
+		return ErrJobNotFound
+	}
+	if closed {
+		return ErrShutDown
+	}
+
+	job.mu.Lock()
+	if job.status.State != Paused {
+		job.mu.Unlock()
+		return ErrJobNotPaused
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.status.State = Queued
+	job.mu.Unlock()
+
+	job.notify()
+	job.Publish("resumed", job.Status())
+
+	// shut down since it was queued, the queue's already been cancelled
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		job.finish(Cancelled, 0, nil)
+		return ErrShutDown
+	}
+	m.queue = append(m.queue, job)
+	m.mu.Unlock()
+
+	m.cond.Signal()
+
+	return nil
+}
+
+// Cancel stops a running job, or removes a queued one from the queue.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+
+	// a queued job never reaches a worker, so it's finished here
+	for i, queued := range m.queue {
+		if queued == job {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.mu.Unlock()
+
+			job.stop()
+			job.finish(Cancelled, 0, nil)
+			return nil
+		}
+	}
+	m.mu.Unlock()
+
+	job.mu.Lock()
+	status := job.status
+	job.pausing = false
+	job.cancel()
+	job.mu.Unlock()
+
+	if status.Done {
+		return ErrJobFinished
+	}
+
+	// a paused job isn't on a worker either, the worker marks a running one as cancelled once the run returns
+	if status.State == Paused {
+		job.finish(Cancelled, 0, nil)
+	}
+
+	return nil
+}
+
+func (m *Manager) Get(id string) (Status, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	m.mu.Unlock()
+
+	if !ok {
+		return Status{}, ErrJobNotFound
+	}
+
+	return job.Status(), nil
+}
+
+// Subscribe streams a job's messages, ending with a "done" message after which the channel is closed.
+// The returned func must be called once the subscriber stops reading.
+func (m *Manager) Subscribe(id string) (<-chan Message, func(), error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	m.mu.Unlock()
+
+	if !ok {
+		return nil, nil, ErrJobNotFound
+	}
+
+	ch, unsubscribe := job.subscribe()
+	return ch, unsubscribe, nil
+}
+
+// List returns every job the manager knows about, oldest first.
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.order))
+	for _, id := range m.order {
+		jobs = append(jobs, m.jobs[id])
+	}
+	m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.Status())
+	}
+
+	return statuses
+}
+
+// Shutdown cancels every queued and running job, and waits for the workers to stop. Pausable jobs stay in
+// the journal, to be restored next time.
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	m.closed = true
+	queued := m.queue
+	m.queue = nil
+	for _, job := range m.jobs {
+		job.mu.Lock()
+		job.kept = true
+		job.pausing = false
+		job.cancel()
+		job.mu.Unlock()
+	}
+	m.mu.Unlock()
+
+	for _, job := range queued {
+		job.finish(Cancelled, 0, nil)
+	}
+
+	m.cond.Broadcast()
+	m.wg.Wait()
+}
+
+func (m *Manager) next() *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.queue) == 0 && !m.closed {
+		m.cond.Wait()
+	}
+
+	if m.closed {
+		return nil
+	}
+
+	job := m.queue[0]
+	m.queue = m.queue[1:]
+
+	return job
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+
+	for {
+		job := m.next()
+		if job == nil {
+			return
+		}
+
+		m.execute(job)
+	}
+}
+
+// runSafely turns a panic in a sim into an error, so one bad sim fails on its own rather than taking down the server.
+func (m *Manager) runSafely(job *Job, ctx context.Context) (simID int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sim panicked: %v", r)
+		}
+	}()
+
+	return job.run(ctx, job)
+}
+
+func (m *Manager) execute(job *Job) {
+	job.mu.Lock()
+	now := time.Now()
+	job.status.State = Running
+	job.status.StartedAt = &now
+	ctx, cancel := job.ctx, job.cancel
+	job.mu.Unlock()
+
+	job.notify()
+
+	simID, err := m.runSafely(job, ctx)
+
+	job.mu.Lock()
+	pausing := job.pausing
+	job.mu.Unlock()
+
+	// a run that finished before it was cancelled or paused is done, only one that stopped early isn't
+	switch {
+	case err == nil:
+		job.finish(Done, simID, nil)
+	case ctx.Err() != nil && pausing:
+		job.pause()
+	case ctx.Err() != nil:
+		job.finish(Cancelled, 0, nil)
+	default:
+		job.finish(Failed, 0, err)
+	}
+
+	cancel()
+}
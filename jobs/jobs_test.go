@@ -0,0 +1,450 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"otter/database"
+	"otter/models"
+	"otter/simulator"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const CALL = 1000
+
+// source is one call, bought at the call and sold at 2x.
+var source = database.NewMemory(
+	[]models.Asset{{FileID: 1, ContractAddress: "CA", Name: "Token", CallTimestamp: CALL}},
+	[]models.Event{
+		{FileID: 1, SOLPrice: 150, TokenPrice: 0.001, Timestamp: CALL, BlockNumber: 1},
+		{FileID: 1, SOLPrice: 150, TokenPrice: 0.0025, Timestamp: CALL + 5, BlockNumber: 3},
+		{FileID: 1, SOLPrice: 150, TokenPrice: 0.0025, Timestamp: CALL + 10, BlockNumber: 8},
+	},
+)
+
+var config = models.SimConfig{
+	Version:        models.SIM_CONFIG_VERSION,
+	Name:           "job",
+	BuyAmount:      1,
+	TPs:            []float64{2},
+	TPAmounts:      []float64{1},
+	Slippage:       5,
+	StartTimestamp: CALL - 100,
+	EndTimestamp:   CALL + 100,
+}
+
+// simRun runs a sim of config on source, once gate is closed if there is one.
+func simRun(gate <-chan struct{}) RunFunc {
+	return func(ctx context.Context, job *Job) (int, error) {
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+
+		s, err := simulator.Init(source, config, simulator.DefaultSettings())
+		if err != nil {
+			return 0, err
+		}
+
+		result, err := s.Run(ctx, job)
+		if err != nil {
+			return 0, err
+		}
+		if len(result.Events) != 2 {
+			return 0, errors.New("the sim didn't buy and sell")
+		}
+
+		return result.Metadata.ID, nil
+	}
+}
+
+// wait reads a job's messages until it's done, and returns them.
+func wait(t *testing.T, m *Manager, id string) []Message {
+	t.Helper()
+
+	messages, unsubscribe, err := m.Subscribe(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	got := []Message{}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return got
+			}
+			got = append(got, msg)
+		case <-timeout:
+			t.Fatalf("job %s never finished", id)
+		}
+	}
+}
+
+// waitFor polls a job until it's in state.
+func waitFor(t *testing.T, m *Manager, id string, state State) Status {
+	t.Helper()
+
+	for i := 0; i < 1000; i++ {
+		status, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == state {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("job %s never got %s", id, state)
+	return Status{}
+}
+
+func TestJobsRunSims(t *testing.T) {
+	m := NewManager(2)
+	defer m.Shutdown()
+
+	a := m.Submit(config, simRun(nil))
+	b := m.Submit(config, simRun(nil))
+	if a.State != Queued || a.ConfigHash != config.Hash() || a.SimName != "job" {
+		t.Errorf("submitted %+v", a)
+	}
+
+	for _, id := range []string{a.ID, b.ID} {
+		messages := wait(t, m, id)
+		done := messages[len(messages)-1]
+		if done.Event != "done" || done.Data.(DoneMessage).State != Done {
+			t.Fatalf("job %s ended with %+v", id, done)
+		}
+
+		status, _ := m.Get(id)
+		if !status.Done || status.SimID == 0 || status.CurrentTimestamp != CALL+10 || status.FinishedAt == nil {
+			t.Errorf("job %s finished as %+v", id, status)
+		}
+	}
+
+	if list := m.List(); len(list) != 2 || list[0].ID != a.ID || list[1].ID != b.ID {
+		t.Errorf("got list %+v", list)
+	}
+	if _, err := m.Get("nope"); err != ErrJobNotFound {
+		t.Errorf("got %v for an unknown job", err)
+	}
+}
+
+func TestJobsBeyondTheLimitQueue(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	gate := make(chan struct{})
+	a := m.Submit(config, simRun(gate))
+	b := m.Submit(config, simRun(nil))
+	c := m.Submit(config, simRun(nil))
+
+	waitFor(t, m, a.ID, Running)
+	for _, id := range []string{b.ID, c.ID} {
+		if status, _ := m.Get(id); status.State != Queued {
+			t.Errorf("job %s is %s with one worker busy", id, status.State)
+		}
+	}
+
+	close(gate)
+	wait(t, m, c.ID)
+
+	// first in, first out
+	var last time.Time
+	for _, id := range []string{a.ID, b.ID, c.ID} {
+		status, _ := m.Get(id)
+		if status.State != Done || status.StartedAt.Before(last) {
+			t.Errorf("job %s is %+v", id, status)
+		}
+		last = *status.StartedAt
+	}
+}
+
+func TestCancel(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	gate := make(chan struct{})
+	defer close(gate)
+
+	running := m.Submit(config, simRun(gate))
+	queued := m.Submit(config, simRun(nil))
+	waitFor(t, m, running.ID, Running)
+
+	// a queued job is cancelled straight away
+	if err := m.Cancel(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := m.Get(queued.ID); status.State != Cancelled || !status.Done {
+		t.Errorf("the queued job is %+v", status)
+	}
+
+	if err := m.Cancel(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, m, running.ID)
+	if status, _ := m.Get(running.ID); status.State != Cancelled || status.SimID != 0 {
+		t.Errorf("the running job is %+v", status)
+	}
+
+	if err := m.Cancel(running.ID); err != ErrJobFinished {
+		t.Errorf("cancelling a finished job: got %v", err)
+	}
+	if err := m.Cancel("nope"); err != ErrJobNotFound {
+		t.Errorf("cancelling an unknown job: got %v", err)
+	}
+}
+
+func TestACancelAfterTheRunIsDone(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	run := simRun(nil)
+	status := m.Submit(config, func(ctx context.Context, job *Job) (int, error) {
+		simID, err := run(ctx, job)
+
+		// the cancel lands once the sim is stored
+		m.Cancel(job.Status().ID)
+		return simID, err
+	})
+
+	wait(t, m, status.ID)
+	if status, _ := m.Get(status.ID); status.State != Done || status.SimID == 0 {
+		t.Errorf("got %+v, want the job done", status)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	failed := m.Submit(config, func(ctx context.Context, job *Job) (int, error) { return 0, errors.New("no events") })
+	panicked := m.Submit(config, func(ctx context.Context, job *Job) (int, error) { panic("boom") })
+
+	wait(t, m, panicked.ID)
+	for id, want := range map[string]string{failed.ID: "no events", panicked.ID: "sim panicked: boom"} {
+		if status, _ := m.Get(id); status.State != Failed || status.Error != want {
+			t.Errorf("got %+v, want it failed with %q", status, want)
+		}
+	}
+}
+
+func TestEverySubscriberGetsEveryMessage(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	gate := make(chan struct{})
+	status := m.Submit(config, func(ctx context.Context, job *Job) (int, error) {
+		<-gate
+		job.Publish("trade", 1)
+		job.Publish("trade", 2)
+		return 7, nil
+	})
+
+	results := make([][]Message, 2)
+	var wg sync.WaitGroup
+	for i := range results {
+		messages, unsubscribe, err := m.Subscribe(status.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer unsubscribe()
+			for msg := range messages {
+				results[i] = append(results[i], msg)
+			}
+		}()
+	}
+
+	close(gate)
+	wg.Wait()
+
+	for i, got := range results {
+		if len(got) != 3 || got[0].Data != 1 || got[1].Data != 2 || got[2].Data.(DoneMessage).SimID != 7 {
+			t.Errorf("subscriber %d got %+v", i, got)
+		}
+	}
+
+	// a late subscriber only gets the end
+	if got := wait(t, m, status.ID); len(got) != 1 || got[0].Event != "done" {
+		t.Errorf("a late subscriber got %+v", got)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	gate := make(chan struct{})
+	running := m.SubmitPausable(config, simRun(gate))
+	queued := m.SubmitPausable(config, simRun(nil))
+	waitFor(t, m, running.ID, Running)
+
+	// a queued job leaves the queue
+	if err := m.Pause(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := m.Get(queued.ID); status.State != Paused {
+		t.Errorf("the queued job is %s", status.State)
+	}
+
+	// a running one is stopped, and its subscribers told
+	messages, unsubscribe, err := m.Subscribe(running.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	if err := m.Pause(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg.Event != "paused" {
+		t.Errorf("got %s, want paused", msg.Event)
+	}
+	for _, id := range []string{running.ID, queued.ID} {
+		if err := m.Pause(id); err != ErrJobPaused {
+			t.Errorf("pausing a paused job: got %v", err)
+		}
+	}
+
+	if err := m.Resume(running.ID); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-messages; msg.Event != "resumed" {
+		t.Errorf("got %s, want resumed", msg.Event)
+	}
+	close(gate)
+	wait(t, m, running.ID)
+
+	if err := m.Resume(queued.ID); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, m, queued.ID)
+
+	for _, id := range []string{running.ID, queued.ID} {
+		if status, _ := m.Get(id); status.State != Done || status.SimID == 0 {
+			t.Errorf("job %s is %+v", id, status)
+		}
+	}
+
+	if err := m.Resume(running.ID); err != ErrJobNotPaused {
+		t.Errorf("resuming a finished job: got %v", err)
+	}
+	if err := m.Pause(running.ID); err != ErrJobFinished {
+		t.Errorf("pausing a finished job: got %v", err)
+	}
+
+	other := m.Submit(config, simRun(nil))
+	if err := m.Pause(other.ID); err != ErrNotPausable {
+		t.Errorf("pausing a job that isn't pausable: got %v", err)
+	}
+}
+
+func TestResumeAfterShutdown(t *testing.T) {
+	m := NewManager(1)
+
+	paused := m.SubmitPausable(config, simRun(make(chan struct{})))
+	waitFor(t, m, paused.ID, Running)
+	if err := m.Pause(paused.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, m, paused.ID, Paused)
+
+	m.Shutdown()
+
+	if err := m.Resume(paused.ID); err != ErrShutDown {
+		t.Errorf("got %v, want %v", err, ErrShutDown)
+	}
+	if status, _ := m.Get(paused.ID); status.State != Paused {
+		t.Errorf("the paused job is %s", status.State)
+	}
+}
+
+func TestFinishedJobsAreForgotten(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+	m.keepFinished = 2
+
+	// a job that hasn't finished is never forgotten, however old
+	gate := make(chan struct{})
+	blocking := m.SubmitPausable(config, simRun(gate))
+	waitFor(t, m, blocking.ID, Running)
+	if err := m.Pause(blocking.ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, m, blocking.ID, Paused)
+
+	ids := []string{blocking.ID}
+	for i := 0; i < 4; i += 1 {
+		status := m.Submit(config, simRun(nil))
+		wait(t, m, status.ID)
+		ids = append(ids, status.ID)
+	}
+
+	// queueing the fourth job forgot the first, leaving the two after it
+	if _, err := m.Get(ids[1]); err != ErrJobNotFound {
+		t.Errorf("got %v, want the oldest finished job forgotten", err)
+	}
+
+	got := []string{}
+	for _, status := range m.List() {
+		got = append(got, status.ID)
+	}
+	if want := []string{ids[0], ids[2], ids[3], ids[4]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	queuedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	paused := m.Restore(Status{ID: "paused", State: Paused, QueuedAt: queuedAt}, config, simRun(nil))
+	running := m.Restore(Status{ID: "running", State: Running, QueuedAt: queuedAt}, config, simRun(nil))
+
+	if paused.ID != "paused" || paused.State != Paused || !paused.QueuedAt.Equal(queuedAt) || paused.ConfigHash != config.Hash() {
+		t.Errorf("restored %+v", paused)
+	}
+
+	// a job that was running when the server stopped runs again
+	wait(t, m, running.ID)
+	if status, _ := m.Get(running.ID); status.State != Done {
+		t.Errorf("the running job is %s", status.State)
+	}
+	if status, _ := m.Get(paused.ID); status.State != Paused {
+		t.Errorf("the paused job is %s", status.State)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	m := NewManager(1)
+	defer m.Shutdown()
+
+	var mu sync.Mutex
+	states := []State{}
+	m.Observe(func(status Status) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, status.State)
+	})
+
+	wait(t, m, m.Submit(config, simRun(nil)).ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) != 3 || states[0] != Queued || states[1] != Running || states[2] != Done {
+		t.Errorf("observed %v", states)
+	}
+}
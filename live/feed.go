@@ -0,0 +1,240 @@
+// Package live runs strategies on live feeds of calls and swaps, rather than on the events database, so a
+// strategy can be forward-tested with the same simulator the backtests use.
+package live
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"otter/models"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// Message types on a feed.
+const (
+	MESSAGE_CALL = "call"
+	MESSAGE_SWAP = "swap"
+	MESSAGE_END  = "end" // the feed has no more messages, a connection that closes without one has dropped
+)
+
+// Message is one message on a feed: a call the strategy can trade, or a swap. A feed sends one JSON
+// object per line over HTTP (NDJSON), one per server-sent event's data, or one per websocket message.
+type Message struct {
+	Type string `json:"type"` // call, swap or end
+	Call *Call  `json:"call,omitempty"`
+	Swap *Swap  `json:"swap,omitempty"`
+}
+
+// Call is sent when a token is called. Swaps for a file ID are ignored until its call has been sent.
+type Call struct {
+	FileID          int    `json:"file_id"`
+	Name            string `json:"name"`
+	ContractAddress string `json:"contract_address"`
+	Description     string `json:"description,omitempty"`
+	ImageURL        string `json:"image_url,omitempty"`
+	CallTimestamp   int64  `json:"call_timestamp"`
+}
+
+// Swap is a single swap, priced the same way as the events table: SOL/USD and the token in SOL. SwapID orders
+// the swaps in a block, like the events table's swap_id. It's optional, but without one a swap that's resent
+// part way through a block can't be told apart from a new one.
+type Swap struct {
+	FileID      int     `json:"file_id"`
+	SOLPrice    float64 `json:"sol_price"`
+	TokenPrice  float64 `json:"token_price"`
+	Timestamp   int64   `json:"timestamp"`
+	BlockNumber int64   `json:"block_number"`
+	SwapID      int64   `json:"swap_id,omitempty"`
+}
+
+func CallMessage(a models.Asset) Message {
+	return Message{Type: MESSAGE_CALL, Call: &Call{
+		FileID:          a.FileID,
+		Name:            a.Name,
+		ContractAddress: a.ContractAddress,
+		Description:     a.Description,
+		ImageURL:        a.ImageURL,
+		CallTimestamp:   a.CallTimestamp,
+	}}
+}
+
+func SwapMessage(e models.Event) Message {
+	return Message{Type: MESSAGE_SWAP, Swap: &Swap{
+		FileID:      e.FileID,
+		SOLPrice:    e.SOLPrice,
+		TokenPrice:  e.TokenPrice,
+		Timestamp:   e.Timestamp,
+		BlockNumber: e.BlockNumber,
+		SwapID:      e.SwapID,
+	}}
+}
+
+func (c Call) Asset() models.Asset {
+	return models.Asset{
+		FileID:          c.FileID,
+		Name:            c.Name,
+		ContractAddress: c.ContractAddress,
+		Description:     c.Description,
+		ImageURL:        c.ImageURL,
+		CallTimestamp:   c.CallTimestamp,
+		TradingHistory:  make(map[int64]float64, 0),
+	}
+}
+
+func (s Swap) Event() models.Event {
+	return models.Event{
+		FileID:      s.FileID,
+		SOLPrice:    s.SOLPrice,
+		TokenPrice:  s.TokenPrice,
+		Timestamp:   s.Timestamp,
+		BlockNumber: s.BlockNumber,
+		SwapID:      s.SwapID,
+	}
+}
+
+// Source is a connection to a feed. Next blocks until a message arrives, and returns io.EOF if the
+// connection closes. Cancelling the context the source was dialled with closes it.
+type Source interface {
+	Next() (Message, error)
+	Close() error
+}
+
+// Dial connects to a feed: ws:// and wss:// URLs are websockets, http:// and https:// are NDJSON, or
+// server-sent events if the feed answers with text/event-stream.
+func Dial(ctx context.Context, url string) (Source, error) {
+	if err := CheckFeed(url); err != nil {
+		return nil, err
+	}
+
+	if isWebsocket(url) {
+		return dialWebsocket(ctx, url)
+	}
+	return dialHTTP(ctx, url)
+}
+
+// CheckFeed checks a feed URL has a scheme Dial can connect to.
+func CheckFeed(url string) error {
+	if isWebsocket(url) || strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return nil
+	}
+
+	return fmt.Errorf("unsupported feed %q, expected a ws://, wss://, http:// or https:// URL", url)
+}
+
+func isWebsocket(url string) bool {
+	return strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")
+}
+
+type ndjsonSource struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+func dialHTTP(ctx context.Context, url string) (Source, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/x-ndjson, text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return &sseSource{body: resp.Body, r: bufio.NewReader(resp.Body)}, nil
+	}
+	return &ndjsonSource{body: resp.Body, dec: json.NewDecoder(resp.Body)}, nil
+}
+
+func (s *ndjsonSource) Next() (Message, error) {
+	var m Message
+	err := s.dec.Decode(&m)
+	return m, err
+}
+
+func (s *ndjsonSource) Close() error {
+	return s.body.Close()
+}
+
+// sseSource reads server-sent events, each event's data is a message. Event names are ignored, the message
+// has its own type.
+type sseSource struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+}
+
+func (s *sseSource) Next() (Message, error) {
+	var data []string
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return Message{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "" && len(data) > 0:
+			var m Message
+			err := json.Unmarshal([]byte(strings.Join(data, "\n")), &m)
+			return m, err
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+func (s *sseSource) Close() error {
+	return s.body.Close()
+}
+
+type websocketSource struct {
+	conn   *websocket.Conn
+	closed chan struct{}
+}
+
+func dialWebsocket(ctx context.Context, url string) (*websocketSource, error) {
+	config, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := config.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &websocketSource{conn: conn, closed: make(chan struct{})}
+
+	// a websocket read doesn't take a context, closing the connection is what unblocks it
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.closed:
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *websocketSource) Next() (Message, error) {
+	var m Message
+	err := websocket.JSON.Receive(s.conn, &m)
+	return m, err
+}
+
+func (s *websocketSource) Close() error {
+	close(s.closed)
+	return s.conn.Close()
+}
@@ -0,0 +1,290 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"otter/database"
+	"otter/models"
+	"otter/simulator"
+	"time"
+)
+
+// SAVE_INTERVAL is how often a paper session stores its wallet, if anything has changed.
+const SAVE_INTERVAL = 5 * time.Second
+
+// RECONNECT_DELAY is the first wait before reconnecting to a dropped feed, doubling up to MAX_RECONNECT_DELAY.
+const (
+	RECONNECT_DELAY     = time.Second
+	MAX_RECONNECT_DELAY = 30 * time.Second
+)
+
+// FEED_BUFFER is the messages read ahead of the strategy.
+const FEED_BUFFER = 4096
+
+// messageConnected comes before each connection's messages, so handle knows swaps may be sent again. A feed
+// never sends it.
+const messageConnected = "connected"
+
+// Store keeps a paper session's latest state, *database.ResultStore is the real one.
+type Store interface {
+	UpdateSim(r *models.SimResult, stored database.SimRows) (database.SimRows, error)
+}
+
+// FeedStatus is published as a "feed" message whenever a paper session connects to, or loses, its feed.
+type FeedStatus struct {
+	Feed      string `json:"feed"`
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Paper is a paper trading session: a sim played on a live feed instead of the events database.
+type Paper struct {
+	Feed     string
+	Sim      *simulator.Simulator
+	ID       int // the sim ID the session is stored under
+	Store    Store
+	Progress simulator.ProgressReporter
+	OnStored func(id int) // called once the session is first stored, with the ID the store kept
+
+	SaveInterval time.Duration
+
+	startedAt time.Time
+	last      *database.Cursor // the last swap played
+	taken     int              // swaps taken from the last swap's block
+	resent    int              // swaps of that block still to skip, a reconnect can send them again
+	block     []models.Event   // swaps in the current block, played once the block is complete
+	dirty     bool
+	stored    database.SimRows // what the store has already
+}
+
+func NewPaper(feed string, sim *simulator.Simulator, store Store, progress simulator.ProgressReporter) *Paper {
+	return &Paper{
+		Feed:         feed,
+		Sim:          sim,
+		ID:           models.NewSimID(),
+		Store:        store,
+		Progress:     progress,
+		SaveInterval: SAVE_INTERVAL,
+	}
+}
+
+// Run trades the feed until it ends, a swap after the config's end timestamp arrives, or ctx is cancelled.
+// Swaps before the start timestamp are ignored. The wallet is stored under p.ID as soon as the session starts
+// and every SaveInterval after, so it can be loaded like any other sim while it runs. The final state is
+// always stored, even if the session is cancelled.
+func (p *Paper) Run(ctx context.Context) (*models.SimResult, error) {
+	if p.Sim.Candles != nil {
+		return nil, errors.New("paper trading plays swaps, candles can't be used")
+	}
+	if err := CheckFeed(p.Feed); err != nil {
+		return nil, err
+	}
+
+	p.Sim.Start(p.Progress)
+	p.startedAt = time.Now()
+
+	if err := p.save(); err != nil {
+		return nil, err
+	}
+
+	feedCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	messages := make(chan Message, FEED_BUFFER)
+	followed := make(chan error, 1)
+	go func() {
+		followed <- p.follow(feedCtx, messages)
+		close(messages)
+	}()
+
+	ticker := time.NewTicker(p.SaveInterval)
+	defer ticker.Stop()
+
+	var err error
+	for running := true; running; {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				err = <-followed
+				running = false
+			} else {
+				running = p.handle(m)
+			}
+		case <-ticker.C:
+			// a quiet feed still gets its last block played and stored
+			p.playBlock()
+			if p.dirty {
+				if err := p.save(); err != nil {
+					return nil, err
+				}
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			running = false
+		}
+	}
+
+	p.playBlock()
+	if saveErr := p.save(); saveErr != nil {
+		return nil, saveErr
+	}
+
+	return p.result(), err
+}
+
+// handle plays a message through the sim. It returns false once the session is past its end timestamp.
+func (p *Paper) handle(m Message) bool {
+	switch {
+	case m.Type == messageConnected:
+		p.resent = p.taken
+	case m.Type == MESSAGE_CALL && m.Call != nil:
+		p.dirty = p.Sim.AddCall(m.Call.Asset()) || p.dirty
+	case m.Type == MESSAGE_SWAP && m.Swap != nil:
+		e := m.Swap.Event()
+		database.NormalisePrices(&e)
+
+		if e.Timestamp > p.Sim.SimulatorEndBlock {
+			return false
+		}
+
+		if e.Timestamp < p.Sim.SimulatorStartBlock || p.replayed(e) {
+			return true
+		}
+
+		// a block is played as one page, the same as a backtest
+		if len(p.block) > 0 && p.block[0].BlockNumber != e.BlockNumber {
+			p.playBlock()
+		}
+
+		if p.last == nil || p.last.Timestamp != e.Timestamp || p.last.BlockNumber != e.BlockNumber {
+			p.taken, p.resent = 0, 0
+		}
+		p.taken += 1
+
+		p.block = append(p.block, e)
+		c := database.CursorOf(e)
+		p.last = &c
+	}
+
+	return true
+}
+
+// replayed is whether a swap has already been taken, a reconnect can resend swaps, the last block's included.
+// Swaps with IDs are compared by their position. Without them, a feed is taken to resend the last block from
+// its start, so as many of its swaps as were taken before the reconnect are skipped.
+func (p *Paper) replayed(e models.Event) bool {
+	switch {
+	case p.last == nil:
+		return false
+	case p.last.SwapID != 0 && e.SwapID != 0:
+		return !p.last.Before(e)
+	case p.last.Timestamp != e.Timestamp || p.last.BlockNumber != e.BlockNumber:
+		return !p.last.Before(e)
+	case p.resent > 0:
+		p.resent -= 1
+		return true
+	}
+
+	return false
+}
+
+func (p *Paper) playBlock() {
+	if len(p.block) == 0 {
+		return
+	}
+
+	p.Sim.Play(p.block)
+	p.block = nil
+	p.dirty = true
+}
+
+func (p *Paper) result() *models.SimResult {
+	r := p.Sim.Result(p.ID)
+	r.Metadata.Date = p.startedAt.Format("2006-01-02 15:04:05")
+	r.Metadata.Paper = true
+
+	return r
+}
+
+func (p *Paper) save() error {
+	r := p.result()
+	stored, err := p.Store.UpdateSim(r, p.stored)
+	if err != nil {
+		return fmt.Errorf("saving paper sim %d: %w", p.ID, err)
+	}
+
+	// the store picks another ID if the session's is taken
+	if !p.stored.Saved {
+		p.ID = r.Metadata.ID
+		if p.OnStored != nil {
+			p.OnStored(p.ID)
+		}
+	}
+	p.stored = stored
+
+	p.dirty = false
+	return nil
+}
+
+// follow reads the feed into messages, reconnecting whenever it drops. It returns nil once the feed ends.
+func (p *Paper) follow(ctx context.Context, messages chan<- Message) error {
+	delay := RECONNECT_DELAY
+
+	for {
+		err := p.read(ctx, messages, &delay)
+		if err == nil || ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Printf("paper sim %d: %s, reconnecting in %s", p.ID, err, delay)
+		p.Progress.Publish("feed", FeedStatus{Feed: p.Feed, Error: err.Error()})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, MAX_RECONNECT_DELAY)
+	}
+}
+
+// read reads one connection to the feed, until the feed ends (nil) or the connection drops. delay is reset
+// once a message arrives.
+func (p *Paper) read(ctx context.Context, messages chan<- Message, delay *time.Duration) error {
+	source, err := Dial(ctx, p.Feed)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	p.Progress.Publish("feed", FeedStatus{Feed: p.Feed, Connected: true})
+
+	select {
+	case messages <- Message{Type: messageConnected}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for {
+		m, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			return errors.New("feed closed the connection")
+		}
+		if err != nil {
+			return err
+		}
+		if m.Type == MESSAGE_END {
+			return nil
+		}
+		*delay = RECONNECT_DELAY
+
+		select {
+		case messages <- m:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"otter/database"
+	"otter/internal/testutil"
+	"otter/models"
+	"otter/simulator"
+	"otter/synth"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps every state a paper session saves.
+type memoryStore struct {
+	mu    sync.Mutex
+	saved []*models.SimResult
+}
+
+func (m *memoryStore) UpdateSim(r *models.SimResult, stored database.SimRows) (database.SimRows, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.saved = append(m.saved, r)
+	return database.SimRows{Saved: true, Trades: len(r.Events), Skips: len(r.Skips), Balances: len(r.BalanceTracking)}, nil
+}
+
+func synthetic(t *testing.T) (*database.Memory, models.SimConfig) {
+	t.Helper()
+
+	cfg := synth.DefaultConfig()
+	cfg.Seed = 7
+
+	c := &synth.Collector{}
+	if _, err := synth.Generate(cfg, c); err != nil {
+		t.Fatal(err)
+	}
+
+	config := models.SimConfig{
+		Version:        models.SIM_CONFIG_VERSION,
+		Name:           "paper",
+		BuyAmount:      1,
+		TPs:            []float64{2, 4},
+		TPAmounts:      []float64{0.5, 1},
+		Slippage:       5,
+		StartTimestamp: cfg.Start,
+		EndTimestamp:   cfg.Start + 24*60*60,
+	}
+
+	return database.NewMemory(c.Assets, c.Events), config
+}
+
+// settings reads every event as a single page, so a block is never split across pages in the backtest.
+func settings() simulator.Settings {
+	s := simulator.DefaultSettings()
+	s.BatchSize = 24 * 60 * 60
+	s.PageSize = 1 << 20
+	return s
+}
+
+func backtest(t *testing.T, source *database.Memory, config models.SimConfig) *models.SimResult {
+	t.Helper()
+
+	s, err := simulator.Init(source, config, settings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Run(context.Background(), testutil.NoProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func paperTrade(t *testing.T, feed string, config models.SimConfig) (*models.SimResult, *memoryStore) {
+	t.Helper()
+
+	s, err := simulator.Init(database.NewMemory(nil, nil), config, settings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryStore{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := NewPaper(feed, &s, store, testutil.NoProgress{}).Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result, store
+}
+
+func sameTrading(t *testing.T, got *models.SimResult, want *models.SimResult) {
+	t.Helper()
+
+	if len(want.Events) == 0 {
+		t.Fatal("the backtest made no trades")
+	}
+	if !reflect.DeepEqual(got.Events, want.Events) {
+		t.Errorf("got %d trades, the backtest made %d", len(got.Events), len(want.Events))
+	}
+	if !reflect.DeepEqual(got.Skips, want.Skips) {
+		t.Errorf("got skips %+v, the backtest has %+v", got.Skips, want.Skips)
+	}
+	if !reflect.DeepEqual(got.Ledger, want.Ledger) {
+		t.Error("the ledger is different to the backtest's")
+	}
+	// the wallet's worth is summed over a map, so it's only the same to within rounding
+	if len(got.BalanceTracking) != len(want.BalanceTracking) {
+		t.Fatalf("got %d balance points, the backtest has %d", len(got.BalanceTracking), len(want.BalanceTracking))
+	}
+	for i, b := range want.BalanceTracking {
+		g := got.BalanceTracking[i]
+		if g.BlockNumber != b.BlockNumber || g.Timestamp != b.Timestamp || !testutil.Near(g.USD, b.USD) {
+			t.Fatalf("balance point %d is %+v, the backtest has %+v", i, g, b)
+		}
+	}
+	if !testutil.Near(got.Portfolio.SOLBalance, want.Portfolio.SOLBalance) || !testutil.Near(got.Portfolio.TotalUSDWorth, want.Portfolio.TotalUSDWorth) {
+		t.Errorf("got portfolio %+v, the backtest has %+v", got.Portfolio, want.Portfolio)
+	}
+}
+
+// replay serves a player of the source as fast as the clients read, until the test ends.
+func replay(t *testing.T, source *database.Memory, from int64, to int64) (*Player, *httptest.Server) {
+	t.Helper()
+
+	player := NewPlayer(source, from, to, 0)
+	player.Lead = simulator.BUY_WINDOW
+	player.Options = database.StreamOptions{PageSize: 1000}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go player.Run(ctx)
+
+	server := httptest.NewServer(player.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		cancel()
+	})
+
+	return player, server
+}
+
+func TestPaperTradingAReplayMatchesTheBacktest(t *testing.T) {
+	source, config := synthetic(t)
+	want := backtest(t, source, config)
+
+	feeds := map[string]func(url string) string{
+		"ndjson":    func(url string) string { return url + "/feed" },
+		"sse":       func(url string) string { return url + "/feed?format=sse" },
+		"websocket": func(url string) string { return "ws" + strings.TrimPrefix(url, "http") + "/feed" },
+	}
+
+	for name, feed := range feeds {
+		t.Run(name, func(t *testing.T) {
+			// every client shares the replay's clock, so each feed gets its own
+			_, server := replay(t, source, config.StartTimestamp, config.EndTimestamp)
+
+			got, store := paperTrade(t, feed(server.URL), config)
+			sameTrading(t, got, want)
+
+			// the empty wallet is stored straight away, so the session can be loaded before anything happens
+			first, last := store.saved[0], store.saved[len(store.saved)-1]
+			if len(first.Events) != 0 || !first.Metadata.Paper || first.Metadata.ID != got.Metadata.ID {
+				t.Errorf("the first save was %+v", first.Metadata)
+			}
+			if !reflect.DeepEqual(last.Metadata, got.Metadata) || !reflect.DeepEqual(last.Events, got.Events) {
+				t.Error("the final state wasn't saved")
+			}
+		})
+	}
+}
+
+// flakyFeed drops its first connection part way through, without an end message.
+type flakyFeed struct {
+	messages []Message
+	after    int
+
+	mu      sync.Mutex
+	dropped bool
+}
+
+func (f *flakyFeed) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	messages := f.messages
+	if !f.dropped {
+		messages = messages[:f.after]
+	}
+	f.dropped = true
+	f.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	for _, m := range messages {
+		enc.Encode(m)
+	}
+}
+
+// record reads everything a player sends one client.
+func record(t *testing.T, player *Player) []Message {
+	t.Helper()
+
+	s := player.subscribe()
+	defer player.unsubscribe(s)
+
+	var messages []Message
+	for {
+		select {
+		case m := <-s.messages:
+			messages = append(messages, m)
+			if m.Type == MESSAGE_END {
+				return messages
+			}
+		case <-time.After(time.Minute):
+			t.Fatal("the replay didn't end")
+		}
+	}
+}
+
+func TestPaperTradingReconnectsWithoutReplayingSwaps(t *testing.T) {
+	source, config := synthetic(t)
+	want := backtest(t, source, config)
+
+	player, _ := replay(t, source, config.StartTimestamp, config.EndTimestamp)
+
+	server := httptest.NewServer(&flakyFeed{messages: record(t, player), after: 5000})
+	defer server.Close()
+
+	got, _ := paperTrade(t, server.URL, config)
+	sameTrading(t, got, want)
+}
+
+func TestPaperTradingReconnectsWithoutReplayingTheLastBlock(t *testing.T) {
+	source, config := synthetic(t)
+	want := backtest(t, source, config)
+
+	player, _ := replay(t, source, config.StartTimestamp, config.EndTimestamp)
+	messages := record(t, player)
+
+	// drops at the end of a block with two swaps, which is played while the session waits to reconnect, then
+	// gets the whole block again
+	first := -1
+	for i := 1000; i+2 < len(messages) && first < 0; i++ {
+		a, b, c := messages[i], messages[i+1], messages[i+2]
+		if a.Type == MESSAGE_SWAP && b.Type == MESSAGE_SWAP && a.Swap.BlockNumber == b.Swap.BlockNumber &&
+			(c.Type != MESSAGE_SWAP || c.Swap.BlockNumber != b.Swap.BlockNumber) {
+			first = i
+		}
+	}
+	if first < 0 {
+		t.Fatal("no block has two swaps")
+	}
+
+	// a feed that doesn't number its swaps is taken to send the block again from its start
+	withoutIDs := make([]Message, len(messages))
+	for i, m := range messages {
+		if m.Type == MESSAGE_SWAP {
+			swap := *m.Swap
+			swap.SwapID = 0
+			m.Swap = &swap
+		}
+		withoutIDs[i] = m
+	}
+
+	for name, messages := range map[string][]Message{"swap ids": messages, "no swap ids": withoutIDs} {
+		t.Run(name, func(t *testing.T) {
+			s, err := simulator.Init(database.NewMemory(nil, nil), config, settings())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paper := NewPaper("", &s, &memoryStore{}, testutil.NoProgress{})
+			s.Start(testutil.NoProgress{})
+
+			for _, m := range messages[:first+2] {
+				paper.handle(m)
+			}
+			paper.playBlock() // the ticker plays the quiet feed's last block
+			paper.handle(Message{Type: messageConnected})
+			for _, m := range messages[first:] {
+				paper.handle(m)
+			}
+			paper.playBlock()
+
+			sameTrading(t, paper.result(), want)
+		})
+	}
+}
+
+// swapAt is a swap message in block 10, at timestamp 100.
+func swapAt(fileID int, swapID int64, price float64) Message {
+	return Message{Type: MESSAGE_SWAP, Swap: &Swap{FileID: fileID, SOLPrice: 150, TokenPrice: price, Timestamp: 100, BlockNumber: 10, SwapID: swapID}}
+}
+
+func TestPaperTradingTakesEverySwapOfABlock(t *testing.T) {
+	connected := Message{Type: messageConnected}
+
+	tests := map[string]struct {
+		messages []Message
+		want     []float64 // the token prices of the swaps taken
+	}{
+		"two swaps of a token":   {[]Message{swapAt(1, 0, 0.1), swapAt(1, 0, 0.2)}, []float64{0.1, 0.2}},
+		"file ids out of order":  {[]Message{swapAt(2, 0, 0.1), swapAt(1, 0, 0.2), swapAt(3, 0, 0.3)}, []float64{0.1, 0.2, 0.3}},
+		"a block sent again":     {[]Message{swapAt(2, 0, 0.1), swapAt(1, 0, 0.2), connected, swapAt(2, 0, 0.1), swapAt(1, 0, 0.2), swapAt(1, 0, 0.3)}, []float64{0.1, 0.2, 0.3}},
+		"swaps sent again by id": {[]Message{swapAt(2, 1, 0.1), swapAt(1, 2, 0.2), connected, swapAt(1, 2, 0.2), swapAt(1, 3, 0.3)}, []float64{0.1, 0.2, 0.3}},
+		// a feed that carries on where it was doesn't resend anything
+		"carried on by id": {[]Message{swapAt(1, 1, 0.1), connected, swapAt(1, 2, 0.2)}, []float64{0.1, 0.2}},
+		// without a reconnect, the same swap again is a new one
+		"the same swap twice": {[]Message{swapAt(1, 0, 0.1), swapAt(1, 0, 0.1)}, []float64{0.1, 0.1}},
+	}
+
+	config := models.SimConfig{Version: models.SIM_CONFIG_VERSION, BuyAmount: 1, TPs: []float64{2}, TPAmounts: []float64{1}, StartTimestamp: 50, EndTimestamp: 200}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := simulator.Init(database.NewMemory(nil, nil), config, settings())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Start(testutil.NoProgress{})
+
+			paper := NewPaper("", &s, &memoryStore{}, testutil.NoProgress{})
+			for _, m := range test.messages {
+				paper.handle(m)
+			}
+
+			got := []float64{}
+			for _, e := range paper.block {
+				got = append(got, e.TokenPrice)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPaperTradingStopsAtTheEndTimestamp(t *testing.T) {
+	source, config := synthetic(t)
+	config.EndTimestamp = config.StartTimestamp + 6*60*60
+	want := backtest(t, source, config)
+
+	// the feed carries on past the end
+	_, server := replay(t, source, config.StartTimestamp, config.StartTimestamp+24*60*60)
+
+	got, _ := paperTrade(t, server.URL+"/feed", config)
+	sameTrading(t, got, want)
+}
@@ -0,0 +1,494 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"otter/database"
+	"otter/models"
+	"otter/simulator"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// SUBSCRIBER_BUFFER is the messages a client can fall behind before it holds the replay up.
+const SUBSCRIBER_BUFFER = 1024
+
+// errSeek stops a replay part way through, so it can start again from the new position.
+var errSeek = errors.New("replay sought")
+
+// Player replays stored calls and swaps as a live feed, a local stand-in for a live data provider. Every
+// client follows the same replay clock, which starts when the first client connects and can be paused,
+// sought and sped up while it plays.
+type Player struct {
+	Source simulator.Source
+	From   int64
+	To     int64
+	Lead   int64 // how many seconds before its call timestamp a call is sent
+
+	Options database.StreamOptions
+
+	mu          sync.Mutex
+	speed       float64   // 1 is real time, 10 ten times as fast, 0 as fast as the slowest client reads
+	position    int64     // the replay time at anchor
+	anchor      time.Time // when position was set
+	started     bool
+	paused      bool
+	done        bool
+	sought      bool // a seek is waiting to be played from position
+	subscribers map[*subscriber]bool
+	changed     chan struct{} // closed and replaced whenever the controls change
+}
+
+// PlayerStatus is where a replay is up to.
+type PlayerStatus struct {
+	From     int64   `json:"from"`
+	To       int64   `json:"to"`
+	Position int64   `json:"position"`
+	Speed    float64 `json:"speed"`
+	Started  bool    `json:"started"`
+	Paused   bool    `json:"paused"`
+	Done     bool    `json:"done"`
+	Clients  int     `json:"clients"`
+}
+
+type subscriber struct {
+	messages chan Message
+	gone     chan struct{}
+}
+
+func NewPlayer(source simulator.Source, from int64, to int64, speed float64) *Player {
+	return &Player{
+		Source:      source,
+		From:        from,
+		To:          to,
+		speed:       speed,
+		position:    from,
+		subscribers: make(map[*subscriber]bool),
+		changed:     make(chan struct{}),
+	}
+}
+
+// Run plays the replay to every client until ctx is cancelled. Once the replay ends, clients are sent an end
+// message and disconnected, and a seek starts it again for the next ones.
+func (p *Player) Run(ctx context.Context) error {
+	assets, err := p.Source.GetContractAddressInfo()
+	if err != nil {
+		return fmt.Errorf("loading calls: %w", err)
+	}
+
+	calls := make([]models.Asset, 0, len(assets))
+	for _, a := range assets {
+		calls = append(calls, a)
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].CallTimestamp != calls[j].CallTimestamp {
+			return calls[i].CallTimestamp < calls[j].CallTimestamp
+		}
+		return calls[i].FileID < calls[j].FileID
+	})
+
+	for {
+		if err := p.waitFor(ctx, func() bool { return p.started && (!p.done || p.sought) }); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		from := p.position
+		p.sought = false
+		p.done = false
+		p.mu.Unlock()
+
+		err := p.play(ctx, calls, from)
+		if errors.Is(err, errSeek) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.done = true
+		p.position = p.To
+		p.mu.Unlock()
+
+		p.broadcast(Message{Type: MESSAGE_END})
+	}
+}
+
+// play sends the calls and swaps from a timestamp to the end of the replay. A call is sent Lead seconds before
+// its call timestamp, calls already sent before a seek are sent again.
+func (p *Player) play(ctx context.Context, calls []models.Asset, from int64) error {
+	next := sort.Search(len(calls), func(i int) bool { return calls[i].CallTimestamp >= from-p.Lead })
+	announce := func(until int64) {
+		for ; next < len(calls) && calls[next].CallTimestamp-p.Lead <= until; next++ {
+			p.broadcast(CallMessage(calls[next]))
+		}
+	}
+
+	announce(from)
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream := p.Source.StreamEvents(streamCtx, from, p.To, p.Options)
+	defer stream.Close()
+
+	for stream.Next() {
+		for _, e := range stream.Page() {
+			if err := p.waitUntil(ctx, e.Timestamp); err != nil {
+				return err
+			}
+
+			announce(e.Timestamp)
+			p.broadcast(SwapMessage(e))
+
+			p.mu.Lock()
+			if p.speed <= 0 {
+				p.position = e.Timestamp
+			}
+			p.mu.Unlock()
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return fmt.Errorf("streaming events: %w", err)
+	}
+
+	// calls with no swaps left in the range still happened
+	announce(p.To)
+
+	return nil
+}
+
+// now is the replay time, p.mu must be held.
+func (p *Player) now() int64 {
+	if !p.started || p.paused || p.done || p.speed <= 0 {
+		return p.position
+	}
+
+	return p.position + int64(time.Since(p.anchor).Seconds()*p.speed)
+}
+
+// waitUntil waits for the replay clock to reach a timestamp, or returns errSeek if the replay is sought.
+func (p *Player) waitUntil(ctx context.Context, timestamp int64) error {
+	for {
+		p.mu.Lock()
+		if p.sought {
+			p.mu.Unlock()
+			return errSeek
+		}
+
+		var wait time.Duration
+		if !p.paused && p.speed > 0 {
+			if now := p.now(); now < timestamp {
+				wait = time.Duration(float64(timestamp-now) / p.speed * float64(time.Second))
+			}
+		}
+		if !p.paused && wait == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+
+		paused, changed := p.paused, p.changed
+		p.mu.Unlock()
+
+		// paused waits for the controls to change
+		var timer <-chan time.Time
+		if !paused {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-timer:
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// waitFor waits until ready is true, ready is called with p.mu held.
+func (p *Player) waitFor(ctx context.Context, ready func() bool) error {
+	for {
+		p.mu.Lock()
+		ok, changed := ready(), p.changed
+		p.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notify wakes everything waiting on the controls, p.mu must be held.
+func (p *Player) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// broadcast sends a message to every client. A client that's behind holds the replay up until it catches up
+// or disconnects.
+func (p *Player) broadcast(m Message) {
+	p.mu.Lock()
+	subscribers := make([]*subscriber, 0, len(p.subscribers))
+	for s := range p.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	p.mu.Unlock()
+
+	for _, s := range subscribers {
+		select {
+		case s.messages <- m:
+		case <-s.gone:
+		}
+	}
+}
+
+// subscribe adds a client, the first one starts the replay. A client that connects after the end gets the end
+// message straight away.
+func (p *Player) subscribe() *subscriber {
+	s := &subscriber{messages: make(chan Message, SUBSCRIBER_BUFFER), gone: make(chan struct{})}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		s.messages <- Message{Type: MESSAGE_END}
+	}
+	p.subscribers[s] = true
+
+	if !p.started {
+		p.started = true
+		p.anchor = time.Now()
+		p.notify()
+	}
+
+	return s
+}
+
+func (p *Player) unsubscribe(s *subscriber) {
+	p.mu.Lock()
+	delete(p.subscribers, s)
+	p.mu.Unlock()
+
+	close(s.gone)
+}
+
+func (p *Player) Status() PlayerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PlayerStatus{
+		From:     p.From,
+		To:       p.To,
+		Position: p.now(),
+		Speed:    p.speed,
+		Started:  p.started,
+		Paused:   p.paused,
+		Done:     p.done,
+		Clients:  len(p.subscribers),
+	}
+}
+
+func (p *Player) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		p.position = p.now()
+		p.paused = true
+		p.notify()
+	}
+}
+
+func (p *Player) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		p.anchor = time.Now()
+		p.paused = false
+		p.notify()
+	}
+}
+
+// SeekTo moves the replay to a timestamp, clients are sent every call and swap again from there.
+func (p *Player) SeekTo(timestamp int64) error {
+	if timestamp < p.From || timestamp > p.To {
+		return fmt.Errorf("timestamp %d is outside the replay, %d to %d", timestamp, p.From, p.To)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.position = timestamp
+	p.anchor = time.Now()
+	p.sought = true
+	p.done = false
+	p.notify()
+
+	return nil
+}
+
+func (p *Player) SetSpeed(speed float64) error {
+	if speed < 0 {
+		return fmt.Errorf("speed %g is negative, use 0 to replay as fast as possible", speed)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.position = p.now()
+	p.anchor = time.Now()
+	p.speed = speed
+	p.notify()
+
+	return nil
+}
+
+// Handler serves the replay and its controls:
+//
+//	GET  /feed             the feed, a websocket, SSE (Accept: text/event-stream or ?format=sse) or NDJSON
+//	GET  /status           where the replay is up to
+//	POST /pause, /resume
+//	POST /seek?timestamp=  move to a timestamp in the replay
+//	POST /speed?speed=     1 is real time, 0 as fast as possible
+func (p *Player) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /feed", p.serveFeed)
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, p.Status())
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, req *http.Request) {
+		p.Pause()
+		writeJSON(w, http.StatusOK, p.Status())
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, req *http.Request) {
+		p.Resume()
+		writeJSON(w, http.StatusOK, p.Status())
+	})
+	mux.HandleFunc("POST /seek", func(w http.ResponseWriter, req *http.Request) {
+		timestamp, err := strconv.ParseInt(req.URL.Query().Get("timestamp"), 10, 64)
+		if err == nil {
+			err = p.SeekTo(timestamp)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, p.Status())
+	})
+	mux.HandleFunc("POST /speed", func(w http.ResponseWriter, req *http.Request) {
+		speed, err := strconv.ParseFloat(req.URL.Query().Get("speed"), 64)
+		if err == nil {
+			err = p.SetSpeed(speed)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, p.Status())
+	})
+
+	return mux
+}
+
+func (p *Player) serveFeed(w http.ResponseWriter, req *http.Request) {
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: func(conn *websocket.Conn) {
+			ctx, cancel := context.WithCancel(conn.Request().Context())
+			defer cancel()
+
+			// a hijacked connection isn't watched by the server, reading is how a disconnect is noticed
+			go func() {
+				var discard []byte
+				for websocket.Message.Receive(conn, &discard) == nil {
+				}
+				cancel()
+			}()
+
+			send := func(m Message) error { return websocket.JSON.Send(conn, m) }
+			p.serve(ctx, send, func() {})
+		}}.ServeHTTP(w, req)
+		return
+	}
+
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	accept := req.Header.Get("Accept")
+	format := req.URL.Query().Get("format")
+	if format == "sse" || (format == "" && strings.Contains(accept, "text/event-stream") && !strings.Contains(accept, "application/x-ndjson")) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		send := func(m Message) error {
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, data)
+			return err
+		}
+		p.serve(req.Context(), send, flush)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	send := func(m Message) error { return enc.Encode(m) }
+	p.serve(req.Context(), send, flush)
+}
+
+// serve sends a client the replay until it ends or the client disconnects. flush is called whenever the client
+// has caught up.
+func (p *Player) serve(ctx context.Context, send func(Message) error, flush func()) {
+	s := p.subscribe()
+	defer p.unsubscribe(s)
+
+	flush()
+
+	for {
+		select {
+		case m := <-s.messages:
+			if err := send(m); err != nil {
+				log.Println("replay:", err)
+				return
+			}
+			if m.Type == MESSAGE_END {
+				flush()
+				return
+			}
+			if len(s.messages) == 0 {
+				flush()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,138 @@
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func post(t *testing.T, url string) (int, PlayerStatus) {
+	t.Helper()
+
+	resp, err := http.Post(url, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var status PlayerStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+
+	return resp.StatusCode, status
+}
+
+func TestPlayerSeeksAndSpeedsUp(t *testing.T) {
+	source, config := synthetic(t)
+	from, to := config.StartTimestamp, config.EndTimestamp
+	seek := from + 12*60*60
+
+	player, server := replay(t, source, from, to)
+	player.SetSpeed(1)
+
+	if code, _ := post(t, fmt.Sprintf("%s/seek?timestamp=%d", server.URL, to+1)); code != http.StatusBadRequest {
+		t.Errorf("seeking past the end got %d", code)
+	}
+	if code, _ := post(t, server.URL+"/speed?speed=-1"); code != http.StatusBadRequest {
+		t.Errorf("a negative speed got %d", code)
+	}
+
+	if code, status := post(t, fmt.Sprintf("%s/seek?timestamp=%d", server.URL, seek)); code != http.StatusOK || status.Position != seek {
+		t.Fatalf("seeking got %d, %+v", code, status)
+	}
+	if code, status := post(t, server.URL+"/speed?speed=0"); code != http.StatusOK || status.Speed != 0 || status.Started {
+		t.Fatalf("speeding up got %d, %+v", code, status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	feed, err := Dial(ctx, server.URL+"/feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	swaps, last := 0, seek
+	for {
+		m, err := feed.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Type == MESSAGE_END {
+			break
+		}
+		if m.Type == MESSAGE_CALL && m.Call.CallTimestamp < seek-player.Lead {
+			t.Fatalf("got a call from %d, before the seek", m.Call.CallTimestamp)
+		}
+		if m.Type == MESSAGE_SWAP {
+			if m.Swap.Timestamp < last {
+				t.Fatalf("got a swap at %d after %d", m.Swap.Timestamp, last)
+			}
+			last = m.Swap.Timestamp
+			swaps += 1
+		}
+	}
+	if swaps == 0 {
+		t.Fatal("no swaps were replayed")
+	}
+
+	if status := player.Status(); !status.Done || status.Position != to {
+		t.Errorf("the finished replay's status is %+v", status)
+	}
+
+	// a client that connects after the end is told straight away
+	late, err := Dial(ctx, server.URL+"/feed?format=sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+
+	if m, err := late.Next(); err != nil || m.Type != MESSAGE_END {
+		t.Errorf("a late client got %+v, %v", m, err)
+	}
+}
+
+func TestPlayerPauses(t *testing.T) {
+	source, config := synthetic(t)
+
+	player, server := replay(t, source, config.StartTimestamp, config.EndTimestamp)
+
+	if code, status := post(t, server.URL+"/pause"); code != http.StatusOK || !status.Paused {
+		t.Fatalf("pausing got %d, %+v", code, status)
+	}
+
+	s := player.subscribe()
+	defer player.unsubscribe(s)
+
+	// calls due at the start are sent, but no swaps until it resumes
+	timeout := time.After(200 * time.Millisecond)
+	for paused := true; paused; {
+		select {
+		case m := <-s.messages:
+			if m.Type != MESSAGE_CALL {
+				t.Fatalf("got a %s while paused", m.Type)
+			}
+		case <-timeout:
+			paused = false
+		}
+	}
+	if status := player.Status(); status.Position != config.StartTimestamp {
+		t.Errorf("the paused replay moved to %d", status.Position)
+	}
+
+	post(t, server.URL+"/resume")
+
+	for {
+		select {
+		case m := <-s.messages:
+			if m.Type == MESSAGE_SWAP {
+				return
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("no swaps after resuming")
+		}
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
-	"encoding/json"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"otter/analysis"
+	"otter/checkpoints"
 	"otter/database"
+	"otter/jobs"
+	"otter/live"
 	"otter/models"
+	"otter/settings"
 	"otter/simulator"
+	"otter/webhooks"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -18,35 +30,91 @@ import (
 	"github.com/gin-contrib/cors"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 var forever chan bool
 var ShutdownSignal = make(chan os.Signal, 1)
 
 var DBConnection database.Database
+var Results *database.ResultStore
 
 type Sim struct {
 	Meta models.SimulatorMetadata `json:"meta"`
 }
 
-type requestSimInput struct {
-	BuyAmount      float64              `json:"buy_amount"`
-	TPs            []float64            `json:"tps"`
-	TPAmounts      []float64            `json:"tp_amounts"`
-	CustomOpts     models.CustomOptions `json:"custom_opts"`
-	Name           string               `json:"name"`
-	Slippage       float64              `json:"slippage"`
-	StartTimestamp int64                `json:"start_timestamp"`
-	EndTimestamp   int64                `json:"end_timestamp"`
-}
+var Jobs *jobs.Manager
+
+// Checkpoints keeps the server's unfinished sims on disk, it's nil for the other commands.
+var Checkpoints *checkpoints.Store
+
+// Webhooks tells the configured URLs about every job, see settings.Webhooks.
+var Webhooks *webhooks.Notifier
 
-var RunningSims []*simulator.SimStatus
+// Settings are loaded from the settings file and environment before any command runs.
+var Settings settings.Settings
 
 func main() {
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	commands := map[string]func(args []string) int{
+		"serve":    serveCommand,
+		"run":      runCommand,
+		"list":     listCommand,
+		"show":     showCommand,
+		"sweep":    sweepCommand,
+		"batch":    batchCommand,
+		"harvest":  harvestCommand,
+		"ingest":   ingestCommand,
+		"audit":    auditCommand,
+		"migrate":  migrateCommand,
+		"import":   importCommand,
+		"generate": generateCommand,
+		"candles":  candlesCommand,
+		"paper":    paperCommand,
+		"replay":   replayCommand,
+		"export":   exportCommand,
+	}
+
+	cmd, ok := commands[command]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command", command)
+		fmt.Fprintln(os.Stderr, "usage: otter <serve|run|list|show|sweep|batch|harvest|ingest|audit|migrate|import|export|generate|candles|paper|replay> [flags]")
+		os.Exit(EXIT_USAGE)
+	}
+
+	var err error
+	Settings, err = settings.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid settings:", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	os.Exit(cmd(args))
+}
+
+// serveCommand starts the web API. Running otter without a command does the same.
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.Int("port", Settings.Server.Port, "port the web API listens on")
+	maxSims := fs.Int("max-sims", Settings.Server.MaxSims, "number of sims that can run at the same time, the rest are queued")
+	fs.Parse(args)
+
+	if err := openStores(*maxSims, true); err != nil {
+		log.Fatal(err)
+	}
+	if err := restoreSims(); err != nil {
+		log.Fatal(err)
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
+		AllowOrigins:     Settings.Server.CORSOrigins,
 		AllowMethods:     []string{"OPTIONS", "PUT", "POST", "GET"},
 		AllowHeaders:     []string{"Origin", "ngrok-skip-browser-warning", "Content-Type"},
 		ExposeHeaders:    []string{"Content-Length"},
@@ -56,119 +124,885 @@ func main() {
 	r.GET("/list_sims", listSimsHandler)
 	r.GET("/load_sim", loadSimHandler)
 	r.POST("/run_sim", requestSimHandler)
+	r.POST("/rerun_sim", rerunSimHandler)
+	r.POST("/paper_sim", paperSimHandler)
 	r.GET("/running_sims", runningSimsHandler)
-
-	r.Run(":8080")
+	r.GET("/sim_job", simJobHandler)
+	r.POST("/cancel_sim", cancelSimHandler)
+	r.POST("/pause_sim", pauseSimHandler)
+	r.POST("/resume_sim", resumeSimHandler)
+	r.GET("/sim_events/:id", simEventsHandler)
+	r.GET("/export_sim", exportSimHandler)
+	r.GET("/compare_sims", compareSimsHandler)
+	r.GET("/audit", auditHandler)
+	r.GET("/candles", candlesHandler)
+	r.GET("/token_chart", tokenChartHandler)
 
 	signal.Notify(ShutdownSignal, syscall.SIGINT, syscall.SIGTERM)
-	go shutdown()
+	go func() {
+		<-ShutdownSignal
+		shutdown()
+		os.Exit(0)
+	}()
+
+	if err := r.Run(fmt.Sprintf(":%d", *port)); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+// openStores opens the events database, the results database and starts the job manager. The events database
+// is migrated first if migrate is set, which only serve does.
+func openStores(maxSims int, migrate bool) error {
+	var err error
+
+	Results, err = database.OpenResultStore(Settings.Database.ResultsPath)
+	if err != nil {
+		return err
+	}
+
+	if migrate {
+		DBConnection, _, err = database.ConnectAndMigrate(Settings.Database.EventsPath)
+	} else {
+		DBConnection, err = database.Connect(Settings.Database.EventsPath)
+	}
+	if err != nil {
+		return err
+	}
+	if err := DBConnection.UseEventsTable(Settings.Database.EventsTable); err != nil {
+		return err
+	}
+
+	Webhooks = webhooks.NewNotifier(webhooks.Config{
+		URLs:        Settings.Webhooks.URLs,
+		Secret:      Settings.Webhooks.Secret,
+		Events:      Settings.Webhooks.Events,
+		MaxAttempts: Settings.Webhooks.MaxAttempts,
+	}, Results)
+
+	Jobs = jobs.NewManager(maxSims)
+	Jobs.Observe(Webhooks.JobChanged)
+	setupValidation()
+
+	return nil
 }
 
-// requestSimHandler starts a new simulation based on JSON input
+// restoreSims opens the checkpoint directory and carries on the sims the last server didn't finish.
+func restoreSims() error {
+	var err error
+	Checkpoints, err = checkpoints.Open(Settings.Server.CheckpointDir)
+	if err != nil {
+		return err
+	}
+
+	records, err := Checkpoints.Jobs()
+	if err != nil {
+		return fmt.Errorf("loading unfinished sims: %w", err)
+	}
+
+	Jobs.SetJournal(Checkpoints)
+	for _, r := range records {
+		Jobs.Restore(r.Status, r.Config, simJob(r.Config))
+	}
+	if len(records) > 0 {
+		log.Printf("restored %d unfinished sims from %s", len(records), Checkpoints.Dir)
+	}
+
+	return nil
+}
+
+// requestSimHandler queues a new simulation based on a SimConfig JSON document
 func requestSimHandler(c *gin.Context) {
-	var input requestSimInput
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON payload"})
+	config, ok := bindSimConfig(c)
+	if !ok {
 		return
 	}
 
-	dbConn := database.Connect()
-	s := simulator.Init(&dbConn,
-		input.BuyAmount,
-		input.TPs,
-		input.TPAmounts,
-		models.CustomOptions{NYTradingTimes: input.CustomOpts.NYTradingTimes},
-		input.Name,
-		input.Slippage,
-		input.StartTimestamp,
-		input.EndTimestamp,
-	)
+	submitSim(c, config)
+}
 
-	var simStatus = &simulator.SimStatus{}
+// bindSimConfig reads a SimConfig JSON document from the request body, responding with an error if it can't.
+func bindSimConfig(c *gin.Context) (models.SimConfig, bool) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON payload"})
+		return models.SimConfig{}, false
+	}
 
-	RunningSims = append(RunningSims, simStatus)
+	// fields the request leaves out come from this deployment's sim defaults
+	body, err = Settings.MergeSimDefaults(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON payload"})
+		return models.SimConfig{}, false
+	}
 
-	go s.Run(simStatus)
+	// configs without a version are from before versioning, and go through the same migration as stored sims
+	config, err := models.MigrateSimConfig(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid JSON payload"})
+		return models.SimConfig{}, false
+	}
 
-	c.JSON(http.StatusAccepted, gin.H{"status": "simulation started"})
+	return config, true
 }
 
-// listSimsHandler scans sim_output for all .json files, parses them into Sim structs,
-// and returns a JSON array of all available sims
-func listSimsHandler(c *gin.Context) {
-	dir := "sim_output"
-	files, err := ioutil.ReadDir(dir)
+// rerunSimHandler queues a new simulation with the exact config of a stored one
+// Call: POST /rerun_sim?id=<sim_id>
+func rerunSimHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid id parameter"})
+		return
+	}
+
+	config, err := Results.GetConfig(id)
+	if errors.Is(err, database.ErrSimNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	var sims []models.SimulatorMetadata
-	for _, f := range files {
-		if f.IsDir() || !strings.HasSuffix(f.Name(), "_metadata.json") {
-			continue
+	submitSim(c, config)
+}
+
+// submitSim validates a config and queues it, responding with the job ID.
+func submitSim(c *gin.Context, config models.SimConfig) {
+	if !checkSimConfig(c, config) {
+		return
+	}
+
+	status := Jobs.SubmitPausable(config, runSimJob(config))
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "simulation queued", "job_id": status.ID})
+}
+
+// runSimJob makes the job a /run_sim request queues, the handler's tests swap it out so no sim runs.
+var runSimJob = simJob
+
+// checkSimConfig validates a config, responding with the invalid fields if it isn't valid.
+func checkSimConfig(c *gin.Context, config models.SimConfig) bool {
+	err := binding.Validator.ValidateStruct(config)
+	if err == nil {
+		return true
+	}
+
+	if fields, ok := validationErrors(err); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid simulation settings", "fields": fields})
+		return false
+	}
+
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	return false
+}
+
+// paperSimHandler starts paper trading a SimConfig JSON document on a live feed. The session is a job that
+// runs until it's cancelled, the feed ends or a swap after end_timestamp arrives, and takes up one of the
+// max_sims slots while it does. Its sim_id can be loaded with /load_sim as soon as the job starts.
+// Call: POST /paper_sim?feed=<ws://, wss://, http:// or https:// URL>
+func paperSimHandler(c *gin.Context) {
+	feed := c.Query("feed")
+	if err := live.CheckFeed(feed); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	config, ok := bindSimConfig(c)
+	if !ok || !checkSimConfig(c, config) {
+		return
+	}
+	if config.Candles != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "paper trading plays swaps, candles can't be used"})
+		return
+	}
+
+	status := Jobs.Submit(config, paperJob(config, feed))
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "paper trading queued", "job_id": status.ID})
+}
+
+// simJob runs a sim to completion and stores the result.
+func simJob(config models.SimConfig) jobs.RunFunc {
+	return func(ctx context.Context, job *jobs.Job) (int, error) {
+		s, err := simulator.Init(&DBConnection, config, Settings.Simulator)
+		if err != nil {
+			return 0, err
+		}
+
+		if Checkpoints != nil {
+			if err := useCheckpoints(&s, job.Status().ID); err != nil {
+				return 0, err
+			}
 		}
 
-		path := filepath.Join(dir, f.Name())
-		data, err := ioutil.ReadFile(path)
+		result, err := s.Run(ctx, job)
 		if err != nil {
-			continue
+			return 0, err
 		}
 
-		var sim models.SimulatorMetadata
-		if err := json.Unmarshal(data, &sim); err != nil {
-			fmt.Println(err)
-			continue
+		if err := Results.SaveSim(result); err != nil {
+			return 0, fmt.Errorf("saving sim: %w", err)
 		}
 
-		sims = append(sims, sim)
+		return result.Metadata.ID, nil
+	}
+}
+
+// useCheckpoints has a sim save checkpoints for a job, carrying on from the job's last one.
+func useCheckpoints(s *simulator.Simulator, id string) error {
+	c, err := Checkpoints.LoadState(id)
+	if err != nil {
+		return err
+	}
+
+	// a checkpoint of another config can't be carried on
+	if c != nil && c.ConfigHash == s.Config.Hash() {
+		log.Printf("job %s: carrying on from %d", id, c.Cursor.Timestamp)
+		s.Resume = c
+	}
+
+	s.SaveCheckpoint = func(c *simulator.Checkpoint) error { return Checkpoints.SaveState(id, c) }
+	s.CheckpointInterval = time.Duration(Settings.Server.CheckpointSeconds) * time.Second
+
+	return nil
+}
+
+// paperJob paper trades a config on a feed, storing the session as it goes.
+func paperJob(config models.SimConfig, feed string) jobs.RunFunc {
+	return func(ctx context.Context, job *jobs.Job) (int, error) {
+		// calls come from the feed, not the events database
+		s, err := simulator.Init(database.NewMemory(nil, nil), config, Settings.Simulator)
+		if err != nil {
+			return 0, err
+		}
+
+		paper := live.NewPaper(feed, &s, Results, job)
+		paper.OnStored = job.SetSimID
+
+		if _, err := paper.Run(ctx); err != nil {
+			return 0, err
+		}
+
+		return paper.ID, nil
+	}
+}
+
+// listSimsHandler returns a JSON array of the metadata of every stored sim
+func listSimsHandler(c *gin.Context) {
+	sims, err := Results.ListSims()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, sims)
 }
 
-// runningSimsHandler returns currently processing simulations and prunes completed ones
+// runningSimsHandler returns the simulations that are queued, in progress or have failed
 func runningSimsHandler(c *gin.Context) {
-	var active []*simulator.SimStatus
-	var remaining []*simulator.SimStatus
-	for _, s := range RunningSims {
-		if !s.Done {
-			active = append(active, s)
-			remaining = append(remaining, s)
+	active := []jobs.Status{}
+	for _, status := range Jobs.List() {
+		if status.State == jobs.Queued || status.State == jobs.Running || status.State == jobs.Failed {
+			active = append(active, status)
 		}
 	}
-	// update global slice to only include still-running sims
-	RunningSims = remaining
 
 	c.JSON(http.StatusOK, active)
 }
 
-// loadSimHandler returns the raw JSON payload for a given simulation
-// Call: GET /load_sim?id=<filename_without_extension>
+// simJobHandler returns the status of a job in any state, including the sim ID once it's done
+// Call: GET /sim_job?id=<job_id>
+func simJobHandler(c *gin.Context) {
+	status, err := Jobs.Get(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// cancelSimHandler stops a running simulation, or removes it from the queue
+// Call: POST /cancel_sim?id=<job_id>
+func cancelSimHandler(c *gin.Context) {
+	err := Jobs.Cancel(c.Query("id"))
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "cancelling"})
+}
+
+// pauseSimHandler stops a queued or running simulation until it's resumed, it carries on from its last
+// checkpoint. Paper trading sessions can't be paused.
+// Call: POST /pause_sim?id=<job_id>
+func pauseSimHandler(c *gin.Context) {
+	err := Jobs.Pause(c.Query("id"))
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "pausing"})
+}
+
+// resumeSimHandler queues a paused simulation again
+// Call: POST /resume_sim?id=<job_id>
+func resumeSimHandler(c *gin.Context) {
+	err := Jobs.Resume(c.Query("id"))
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "resumed"})
+}
+
+// simEventsHandler streams a job's progress and trades as server-sent events, finishing with a "done" event
+// Call: GET /sim_events/<job_id>
+func simEventsHandler(c *gin.Context) {
+	messages, unsubscribe, err := Jobs.Subscribe(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	defer unsubscribe()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+
+			c.SSEvent(msg.Event, msg.Data)
+			return msg.Event != "done"
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// loadSimHandler returns one panel of a stored simulation
+// Call: GET /load_sim?id=<sim_id>&panel=<metadata|config|portfolio|assets|balance_updates|trade_history|ledger|metrics>
+// balance_updates also takes &resolution=<raw|1m|5m|1h|lttb>&points=<lttb target, default 1000>
 func loadSimHandler(c *gin.Context) {
-	dir := "sim_output"
-	id := c.Query("id")
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid id parameter"})
+		return
+	}
 
 	panel := c.Query("panel")
 
-	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing id parameter"})
+	// without a resolution balance_updates keeps its original map[block]usd shape
+	var resolution *analysis.Resolution
+	if c.Query("resolution") != "" {
+		points, err := strconv.Atoi(c.DefaultQuery("points", "1000"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "points must be an integer"})
+			return
+		}
+
+		r, err := analysis.ParseResolution(c.Query("resolution"), points)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		resolution = &r
+	}
+
+	data, err := loadSimPanel(id, panel, resolution)
+	if errors.Is(err, database.ErrSimNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if data == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown panel " + panel})
 		return
 	}
 
-	// sanitize filename to avoid directory traversal
-	safeId := filepath.Base(id)
-	target := filepath.Join(dir, safeId+"_"+panel+".json")
+	c.JSON(http.StatusOK, data)
+}
 
-	data, err := ioutil.ReadFile(target)
+// loadSimPanel returns the data for a panel in the same shape the old sim_output files had.
+// A nil result means the panel doesn't exist.
+func loadSimPanel(id int, panel string, resolution *analysis.Resolution) (any, error) {
+	if _, err := Results.GetMetadata(id); err != nil {
+		return nil, err
+	}
+
+	switch panel {
+	case "metadata":
+		return Results.GetMetadata(id)
+	case "config":
+		return Results.GetConfig(id)
+	case "portfolio":
+		return Results.GetPortfolio(id)
+	case "trade_history":
+		return Results.GetTradeHistory(id)
+	case "ledger":
+		return Results.GetLedger(id)
+	case "metrics":
+		return Results.GetMetrics(id)
+	case "balance_updates":
+		points, err := Results.GetBalanceTracking(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if resolution != nil {
+			return analysis.Resample(points, *resolution)
+		}
+
+		balances := make(map[int64]float64, len(points))
+		for _, p := range points {
+			balances[p.BlockNumber] = p.USD
+		}
+		return balances, nil
+	case "assets":
+		ledger, err := Results.GetLedger(id)
+		if err != nil {
+			return nil, err
+		}
+
+		assets := make(map[int]models.Asset, len(ledger))
+		for _, l := range ledger {
+			assets[l.FileID] = models.Asset{
+				FileID:          l.FileID,
+				Name:            l.Name,
+				ContractAddress: l.ContractAddress,
+				Description:     l.Description,
+				CallTimestamp:   l.CallTimestamp,
+				EntryPrice:      l.EntryPrice,
+				TPPrice:         l.TPPrice,
+				TPStage:         l.TPStage,
+				ImageURL:        l.ImageURL,
+				Price:           l.Price,
+				Balance:         l.Balance,
+				TradingHistory:  make(map[int64]float64, 0),
+			}
+		}
+		return assets, nil
+	}
+
+	return nil, nil
+}
+
+// compareSimsHandler lines up two or more stored sims: settings that differ, metrics side by side,
+// equity curves on a common time grid and the calls they traded differently.
+// Call: GET /compare_sims?ids=<sim_id>,<sim_id>[,...]&points=<grid size, default 500>
+func compareSimsHandler(c *gin.Context) {
+	var ids []int
+	seen := make(map[int]bool)
+	for _, raw := range strings.Split(c.Query("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sim id " + raw})
+			return
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) < 2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least two sim ids are needed to compare"})
+		return
+	}
+
+	points, err := strconv.Atoi(c.DefaultQuery("points", "500"))
+	if err != nil || points < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "points must be a positive integer"})
+		return
+	}
+
+	sims := make([]analysis.SimData, 0, len(ids))
+	for _, id := range ids {
+		sim, err := loadSimData(id)
+		if errors.Is(err, database.ErrSimNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("sim %d not found", id)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		sims = append(sims, sim)
+	}
+
+	c.JSON(http.StatusOK, analysis.Compare(sims, points))
+}
+
+func loadSimData(id int) (analysis.SimData, error) {
+	var (
+		sim analysis.SimData
+		err error
+	)
+
+	if sim.Metadata, err = Results.GetMetadata(id); err != nil {
+		return sim, err
+	}
+	if sim.Metrics, err = Results.GetMetrics(id); err != nil {
+		return sim, err
+	}
+	if sim.Balances, err = Results.GetBalanceTracking(id); err != nil {
+		return sim, err
+	}
+	if sim.Trades, err = Results.GetTradeHistory(id); err != nil {
+		return sim, err
+	}
+	sim.Ledger, err = Results.GetLedger(id)
+
+	return sim, err
+}
+
+// auditHandler reports problems in an events table, see otter audit. The cleaned table is only written from the CLI.
+// Call: GET /audit?table=<events table, default events>&gap=<seconds, default 3600>&samples=<default 10>
+func auditHandler(c *gin.Context) {
+	gap, err := strconv.ParseInt(c.DefaultQuery("gap", "3600"), 10, 64)
+	if err != nil || gap < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gap must be a positive number of seconds"})
+		return
+	}
+
+	samples, err := strconv.Atoi(c.DefaultQuery("samples", "10"))
+	if err != nil || samples < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "samples must be a positive integer"})
+		return
+	}
+
+	report, err := DBConnection.Audit(c.Request.Context(), database.AuditOptions{
+		Table:       c.DefaultQuery("table", "events"),
+		GapSeconds:  gap,
+		MinSOLPrice: Settings.Simulator.MinSOLPrice,
+		Samples:     samples,
+	})
 	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// candlesHandler returns a token's OHLC candles in SOL, or SOL/USD's with file_id=sol. Without from and to it covers
+// every event.
+// Call: GET /candles?file_id=<file_id|sol>&interval=<1s|1m|5m|1h>&from=<timestamp>&to=<timestamp>
+func candlesHandler(c *gin.Context) {
+	interval := c.DefaultQuery("interval", "1m")
+	if _, err := database.CandleInterval(interval); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	series := c.Query("file_id")
+	fileID, err := strconv.Atoi(series)
+	if series != "sol" && err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file_id must be a file ID or sol"})
+		return
+	}
+
+	start, end, err := DBConnection.GetSimulationStartAndEnd()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, p := range []struct {
+		name  string
+		value *int64
+	}{{"from", &start}, {"to", &end}} {
+		if q := c.Query(p.name); q != "" {
+			if *p.value, err = strconv.ParseInt(q, 10, 64); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": p.name + " must be a unix timestamp"})
+				return
+			}
+		}
+	}
+	if end < start {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return
+	}
+
+	var candles []database.Candle
+	var id any = fileID
+	if series == "sol" {
+		id = series
+		candles, err = DBConnection.SOLCandles(c.Request.Context(), interval, start, end)
+	} else {
+		candles, err = DBConnection.TokenCandles(c.Request.Context(), fileID, interval, start, end)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"file_id": id, "interval": interval, "candles": candles})
+}
+
+// tokenChartHandler returns a token's price over the time a sim held it, plus a margin either side, with the sim's
+// trades and skipped trades as markers. Without a resolution every swap is returned.
+// Call: GET /token_chart?sim_id=<sim_id>&file_id=<file_id>&margin=<seconds, default 600>&resolution=<raw|1s|1m|5m|1h|lttb>&points=<lttb target, default 1000>
+func tokenChartHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Query("sim_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid sim_id parameter"})
+		return
+	}
+	fileID, err := strconv.Atoi(c.Query("file_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid file_id parameter"})
+		return
+	}
+	margin, err := strconv.ParseInt(c.DefaultQuery("margin", "600"), 10, 64)
+	if err != nil || margin < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "margin must be a number of seconds"})
+		return
+	}
+
+	// candle intervals are read as candles, anything else is resampled from the swaps
+	resolution := c.DefaultQuery("resolution", "raw")
+	_, candles := database.CANDLE_INTERVALS[resolution]
+
+	var lttb *analysis.Resolution
+	if !candles {
+		points, err := strconv.Atoi(c.DefaultQuery("points", "1000"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "points must be an integer"})
+			return
+		}
+
+		r, err := analysis.ParseResolution(resolution, points)
+		if err != nil || r.Kind == "bucket" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown resolution " + resolution + ", expected raw, 1s, 1m, 5m, 1h or lttb"})
+			return
+		}
+		lttb = &r
+	}
+
+	config, err := Results.GetConfig(id)
+	if errors.Is(err, database.ErrSimNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	assets, err := DBConnection.GetContractAddressInfo()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	asset, ok := assets[fileID]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("file_id %d isn't in the events database", fileID)})
+		return
+	}
+
+	history, err := Results.GetTradeHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	allSkips, err := Results.GetSkips(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ledger, err := Results.GetLedger(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	trades := []models.SimEvent{}
+	for _, t := range history {
+		if t.FileID == fileID {
+			trades = append(trades, t)
+		}
+	}
+	skips := []models.Skip{}
+	for _, s := range allSkips {
+		if s.FileID == fileID {
+			skips = append(skips, s)
+		}
+	}
+	holding := false
+	for _, l := range ledger {
+		holding = holding || (l.FileID == fileID && l.Balance > 0)
+	}
+
+	from, to := analysis.ChartWindow(asset.CallTimestamp, trades, holding, config.EndTimestamp)
+	from, to = from-margin, to+margin
+
+	markers := analysis.ChartMarkers(trades, skips, asset.CallTimestamp, config.StartTimestamp, config.EndTimestamp)
+
+	chart := gin.H{
+		"sim_id":           id,
+		"file_id":          fileID,
+		"name":             asset.Name,
+		"contract_address": asset.ContractAddress,
+		"call_timestamp":   asset.CallTimestamp,
+		"from":             from,
+		"to":               to,
+		"resolution":       resolution,
+		"markers":          markers,
+	}
+
+	if candles {
+		chart["candles"], err = DBConnection.TokenCandles(c.Request.Context(), fileID, resolution, from, to)
+	} else {
+		var prices []models.PricePoint
+		prices, err = DBConnection.TokenPrices(c.Request.Context(), fileID, from, to)
+
+		// a no_swap marker is priced at the first swap after the call, if there was one
+		for i, m := range markers {
+			if m.Price != 0 {
+				continue
+			}
+			for _, p := range prices {
+				if p.Timestamp >= m.Timestamp {
+					markers[i].Price, markers[i].BlockNumber = p.Price, p.BlockNumber
+					break
+				}
+			}
+		}
+
+		if lttb.Kind == "lttb" {
+			prices = analysis.DownsamplePrices(prices, markers, lttb.Points)
+		}
+		chart["prices"] = prices
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.Data(http.StatusOK, "application/json", data)
+	c.JSON(http.StatusOK, chart)
+}
+
+// exportSimHandler returns a stored sim as Parquet or Arrow IPC. If no table is given, every table is returned in a zip archive.
+// Call: GET /export_sim?id=<sim_id>&format=<parquet|arrow>&table=<trades|balances|ledger|metrics>
+func exportSimHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing or invalid id parameter"})
+		return
+	}
+
+	format := c.DefaultQuery("format", database.FormatParquet)
+	if format != database.FormatParquet && format != database.FormatArrow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be parquet or arrow"})
+		return
+	}
+
+	exists, err := Results.SimExists(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": database.ErrSimNotFound.Error()})
+		return
+	}
+
+	table := c.Query("table")
+	if table != "" {
+		// buffer the table, so a failed export can still be reported as an error
+		var buf bytes.Buffer
+		if err := Results.ExportSim(id, table, format, &buf); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filename := fmt.Sprint(id) + "_" + table + database.ExportExtension(format)
+		c.Header("Content-Disposition", "attachment; filename="+filename)
+		c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+		return
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, table := range database.ExportTables {
+		f, err := archive.Create(fmt.Sprint(id) + "_" + table + database.ExportExtension(format))
+		if err == nil {
+			err = Results.ExportSim(id, table, format, f)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+fmt.Sprint(id)+"_"+format+".zip")
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+// exportSimFiles writes every export table of a sim into dir, one file per table.
+func exportSimFiles(id int, format string, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	for _, table := range database.ExportTables {
+		path := filepath.Join(dir, fmt.Sprint(id)+"_"+table+database.ExportExtension(format))
+
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+
+		err = Results.ExportSim(id, table, format, f)
+		f.Close()
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+
+		fmt.Println("wrote", path)
+	}
+
+	return nil
 }
 
 func shutdown() {
+	Jobs.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhooks.CLOSE_TIMEOUT)
+	Webhooks.Close(ctx)
+	cancel()
+
 	DBConnection.Disconnect()
+	Results.Close()
 }
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SIM_CONFIG_VERSION is bumped whenever SimConfig changes shape, MigrateSimConfig upgrades older documents.
+const SIM_CONFIG_VERSION = 1
+
+// CONFIG_HASH_VERSION is bumped whenever Hash changes what it covers, so stored hashes can be redone.
+const CONFIG_HASH_VERSION = 2
+
+// SimConfig is every setting a sim runs with. It's accepted as-is by /run_sim and stored verbatim with
+// each sim, so any stored sim can be re-run exactly. See validation.go for the checks that can't be struct tags.
+type SimConfig struct {
+	Version        int           `json:"version"`
+	BuyAmount      float64       `json:"buy_amount" binding:"gt=0"`
+	TPs            []float64     `json:"tps" binding:"required,min=1,max=20,dive,gt=0"`
+	TPAmounts      []float64     `json:"tp_amounts" binding:"required,eqfield=TPs,dive,gt=0,lte=1"`
+	CustomOpts     CustomOptions `json:"custom_opts"`
+	Name           string        `json:"name" binding:"max=200"`
+	Slippage       float64       `json:"slippage" binding:"gte=0,lte=100"`
+	StartTimestamp int64         `json:"start_timestamp" binding:"required,gt=0"`
+	EndTimestamp   int64         `json:"end_timestamp" binding:"required,gtfield=StartTimestamp"`
+	Candles        string        `json:"candles,omitempty" binding:"omitempty,oneof=1s 1m 5m 1h"` // plays candles of this interval instead of every swap
+}
+
+// MigrateSimConfig reads a config document of any version and upgrades it to the current one.
+// Version 0 is the metadata written before configs were versioned: TPAmounts might be stored under its
+// Go field name, and the slippage and time range were never stored, so they're left empty.
+func MigrateSimConfig(raw []byte) (SimConfig, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return SimConfig{}, err
+	}
+
+	version := 0
+	if v, ok := doc["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return SimConfig{}, fmt.Errorf("invalid config version: %w", err)
+		}
+	}
+
+	if version > SIM_CONFIG_VERSION {
+		return SimConfig{}, fmt.Errorf("config version %d is newer than this build supports (%d)", version, SIM_CONFIG_VERSION)
+	}
+
+	if version == 0 {
+		if _, ok := doc["tp_amounts"]; !ok {
+			if legacy, ok := doc["TPAmounts"]; ok {
+				doc["tp_amounts"] = legacy
+			}
+		}
+		delete(doc, "TPAmounts")
+	}
+
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return SimConfig{}, err
+	}
+
+	var config SimConfig
+	if err := json.Unmarshal(upgraded, &config); err != nil {
+		return SimConfig{}, err
+	}
+	config.Version = SIM_CONFIG_VERSION
+
+	return config, nil
+}
+
+// Hash identifies a config by the fields that change how a sim trades, so the name is left out.
+// Sims run with the same hash traded the same way.
+func (c SimConfig) Hash() string {
+	c.Name = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
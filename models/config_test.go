@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	config := SimConfig{Version: SIM_CONFIG_VERSION, Name: "ladder", BuyAmount: 1, TPs: []float64{2, 4}, TPAmounts: []float64{0.5, 1}, Slippage: 5}
+
+	tests := map[string]struct {
+		change func(c *SimConfig)
+		same   bool
+	}{
+		"the name":     {func(c *SimConfig) { c.Name = "renamed" }, true},
+		"the slippage": {func(c *SimConfig) { c.Slippage = 6 }, false},
+		"a tp":         {func(c *SimConfig) { c.TPs = []float64{2, 5} }, false},
+		"the candles":  {func(c *SimConfig) { c.Candles = "1m" }, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			changed := config
+			test.change(&changed)
+
+			if same := changed.Hash() == config.Hash(); same != test.same {
+				t.Errorf("changing %s: got the same hash %v, want %v", name, same, test.same)
+			}
+		})
+	}
+}
+
+func TestMigrateSimConfig(t *testing.T) {
+	tests := map[string]struct {
+		raw       string
+		tpAmounts []float64
+		err       bool
+	}{
+		"unversioned, the old name":     {`{"name": "a", "tps": [2], "TPAmounts": [1]}`, []float64{1}, false},
+		"unversioned, the new name":     {`{"name": "a", "tps": [2], "tp_amounts": [0.5]}`, []float64{0.5}, false},
+		"unversioned, both names":       {`{"name": "a", "tps": [2], "TPAmounts": [1], "tp_amounts": [0.5]}`, []float64{0.5}, false},
+		"version 1":                     {`{"version": 1, "name": "a", "tps": [2], "tp_amounts": [0.5]}`, []float64{0.5}, false},
+		"version 1, the old name":       {`{"version": 1, "name": "a", "tps": [2], "TPAmounts": [1]}`, nil, false},
+		"a newer version":               {fmt.Sprintf(`{"version": %d, "name": "a"}`, SIM_CONFIG_VERSION+1), nil, true},
+		"a version that isn't a number": {`{"version": "one", "name": "a"}`, nil, true},
+		"not an object":                 {`[1]`, nil, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config, err := MigrateSimConfig([]byte(test.raw))
+			if test.err {
+				if err == nil {
+					t.Errorf("got %+v, want an error", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Version != SIM_CONFIG_VERSION || config.Name != "a" || !reflect.DeepEqual(config.TPAmounts, test.tpAmounts) {
+				t.Errorf("got %+v, want tp_amounts %v", config, test.tpAmounts)
+			}
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package models
 
+import (
+	"math/rand"
+	"sort"
+)
+
 type Event struct {
 	FileID           int
 	EventDisplayType string
@@ -8,30 +13,34 @@ type Event struct {
 	TokenPrice       float64 // token1_swap_value_usd represents the Token value, in SOL.
 	Timestamp        int64
 	BlockNumber      int64
+	SwapID           int64 // orders the swaps within a block, 0 for a candle
 }
 
 type CustomOptions struct {
 	NYTradingTimes bool `json:"ny_trading_times"`
 }
 
+// SimulatorMetadata is the config a sim was run with, plus when it ran and the ID it was stored under.
 type SimulatorMetadata struct {
-	BuyAmount  float64       `json:"buy_amount"`
-	TPs        []float64     `json:"tps"`
-	TPAmounts  []float64     `json:"tp_amounts`
-	CustomOpts CustomOptions `json:"custom_opts"`
-	Name       string        `json:"name"`
-	Date       string        `json:"date"`
-	ID         int           `json:"id"`
+	SimConfig
+	Date  string `json:"date"`
+	ID    int    `json:"id"`
+	Paper bool   `json:"paper,omitempty"` // paper traded on a live feed, see live.RunPaper
+}
+
+// NewSimID picks a random 9 digit sim ID. The result store picks another if it's taken.
+func NewSimID() int {
+	return rand.Intn(999999999-111111111+1) + 111111111
 }
 
 type Wallet struct {
-	Balance         float64           `json:"balance"` // SOL
-	TokenUSDWorth   float64           `json:"token_usd_worth"`
-	TokenSOLWorth   float64           `json:"token_sol_worth"`
-	TotalUSDWorth   float64           `json:"total_usd_worth"`
-	BalanceTracking map[int64]float64 `json:"balance_tracking"` // USD
-	Assets          map[int]Asset     `json:"assets"`           // map[file_id]Asset
-	Events          []SimEvent        `json:"sim_events"`
+	Balance         float64        `json:"balance"` // SOL
+	TokenUSDWorth   float64        `json:"token_usd_worth"`
+	TokenSOLWorth   float64        `json:"token_sol_worth"`
+	TotalUSDWorth   float64        `json:"total_usd_worth"`
+	BalanceTracking []BalancePoint `json:"balance_tracking"` // USD, in block order
+	Assets          map[int]Asset  `json:"assets"`           // map[file_id]Asset
+	Events          []SimEvent     `json:"sim_events"`
 }
 
 type Portfolio struct {
@@ -43,12 +52,94 @@ type Portfolio struct {
 
 type SimEvent struct {
 	BlockNumber int64
+	Timestamp   int64   `json:"timestamp"`
 	Type        string  `json:"type"`
 	SOLChange   float64 `json:"sol_change"` // details +- of sol on the event
 	FileID      int     `json:"file_id"`
 	TokenPrice  float64 `json:"token_price"`
 }
 
+// Skip reasons. SKIP_NO_SWAP isn't recorded by the sim, it's what a call that was never bought or skipped had.
+const (
+	SKIP_BALANCE       = "balance"       // the wallet couldn't afford the buy and keep its fee reserve
+	SKIP_TRADING_HOURS = "trading_hours" // the call was outside NY trading hours
+	SKIP_SLIPPAGE      = "slippage"      // the price moved too far between a take profit being queued and sold
+	SKIP_NO_SWAP       = "no_swap"       // there was no swap within 2 seconds of the call
+)
+
+// Skip is a trade the strategy wanted to make but didn't. A skipped buy is recorded once per call, a take profit
+// every time slippage cancels it.
+type Skip struct {
+	BlockNumber int64   `json:"block_number"`
+	Timestamp   int64   `json:"timestamp"`
+	FileID      int     `json:"file_id"`
+	Type        string  `json:"type"` // BUY or SELL, the trade that was skipped
+	Reason      string  `json:"reason"`
+	TokenPrice  float64 `json:"token_price"`
+}
+
+// PricePoint is a token's price, in SOL, at one swap.
+type PricePoint struct {
+	BlockNumber int64   `json:"block_number"`
+	Timestamp   int64   `json:"timestamp"`
+	Price       float64 `json:"price"`
+}
+
+type BalancePoint struct {
+	BlockNumber int64   `json:"block_number"`
+	Timestamp   int64   `json:"timestamp"`
+	USD         float64 `json:"usd"`
+}
+
+// LedgerEntry is the per-call summary of everything a sim did with one token.
+type LedgerEntry struct {
+	FileID          int     `json:"file_id"`
+	Name            string  `json:"name"`
+	ContractAddress string  `json:"contract_address"`
+	Description     string  `json:"description"`
+	ImageURL        string  `json:"image_url"`
+	CallTimestamp   int64   `json:"call_timestamp"`
+	EntryPrice      float64 `json:"entry_price"`
+	TPPrice         float64 `json:"tp_price"`
+	TPStage         int     `json:"tp_stage"`
+	Price           float64 `json:"price"`   // last seen price, in SOL
+	Balance         float64 `json:"balance"` // tokens still held at the end of the sim
+	Buys            int     `json:"buys"`
+	Sells           int     `json:"sells"`
+	SOLIn           float64 `json:"sol_in"`
+	SOLOut          float64 `json:"sol_out"`
+	PnL             float64 `json:"pnl"` // SOL, including the value of any tokens still held
+}
+
+// SimMetrics are the headline numbers of a sim, computed by the sim_metrics view in the results database.
+type SimMetrics struct {
+	SimID           int     `json:"sim_id"`
+	Name            string  `json:"name"`
+	StartUSD        float64 `json:"start_usd"`
+	EndUSD          float64 `json:"end_usd"`
+	ReturnPct       float64 `json:"return_pct"`
+	MaxDrawdownPct  float64 `json:"max_drawdown_pct"`
+	CallsTraded     int     `json:"calls_traded"`
+	WinningCalls    int     `json:"winning_calls"`
+	WinRate         float64 `json:"win_rate"`
+	TotalBuys       int     `json:"total_buys"`
+	TotalSells      int     `json:"total_sells"`
+	SOLIn           float64 `json:"sol_in"`
+	SOLOut          float64 `json:"sol_out"`
+	PnL             float64 `json:"pnl"` // SOL
+	FinalSOLBalance float64 `json:"final_sol_balance"`
+}
+
+// SimResult is everything a finished simulation produces, ready to be persisted.
+type SimResult struct {
+	Metadata        SimulatorMetadata
+	Portfolio       Portfolio
+	BalanceTracking []BalancePoint
+	Events          []SimEvent
+	Skips           []Skip
+	Ledger          []LedgerEntry
+}
+
 type Asset struct {
 	FileID          int               `json:"file_id"`
 	Name            string            `json:"name"`
@@ -63,7 +154,7 @@ type Asset struct {
 	ImageURL        string            `json:"image_url"`
 	Price           float64           `json:"price"`
 	Balance         float64           `json:"balance"`
-	TradingHistory  map[int64]float64 `json:"trading_history"` // map[blockNumber]TokenPrice
+	TradingHistory  map[int64]float64 `json:"trading_history"` // map[blockNumber]TokenPrice, no longer recorded, it grew with every swap
 }
 
 func DeepCopyWallet(src *Wallet) *Wallet {
@@ -96,3 +187,51 @@ func DeepCopyWallet(src *Wallet) *Wallet {
 
 	return dst
 }
+
+// BuildLedger folds a sim's trade events into one LedgerEntry per asset, ordered by file_id.
+// Only assets that appear in the events end up in the ledger.
+func BuildLedger(assets map[int]Asset, events []SimEvent) []LedgerEntry {
+	entries := make(map[int]*LedgerEntry)
+
+	for _, e := range events {
+		entry, ok := entries[e.FileID]
+		if !ok {
+			a := assets[e.FileID]
+			entry = &LedgerEntry{
+				FileID:          e.FileID,
+				Name:            a.Name,
+				ContractAddress: a.ContractAddress,
+				Description:     a.Description,
+				ImageURL:        a.ImageURL,
+				CallTimestamp:   a.CallTimestamp,
+				EntryPrice:      a.EntryPrice,
+				TPPrice:         a.TPPrice,
+				TPStage:         a.TPStage,
+				Price:           a.Price,
+				Balance:         a.Balance,
+			}
+			entries[e.FileID] = entry
+		}
+
+		switch e.Type {
+		case "BUY":
+			entry.Buys += 1
+			entry.SOLIn += -e.SOLChange
+		case "SELL":
+			entry.Sells += 1
+			entry.SOLOut += e.SOLChange
+		}
+	}
+
+	ledger := make([]LedgerEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.PnL = entry.SOLOut + entry.Balance*entry.Price - entry.SOLIn
+		ledger = append(ledger, *entry)
+	}
+
+	sort.Slice(ledger, func(i, j int) bool {
+		return ledger[i].FileID < ledger[j].FileID
+	})
+
+	return ledger
+}
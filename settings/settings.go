@@ -0,0 +1,303 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"otter/models"
+	"otter/simulator"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ENV_FILE names the settings file to load. Without it otter.yaml, otter.yml or otter.toml is loaded
+// from the working directory if one exists, otherwise the defaults are used.
+const ENV_FILE = "OTTER_CONFIG"
+
+var defaultFiles = []string{"otter.yaml", "otter.yml", "otter.toml"}
+
+// Settings is everything a deployment can change without recompiling. Every scalar setting can also be
+// overridden by the environment variable in its env tag, which takes precedence over the file.
+type Settings struct {
+	Server    Server             `yaml:"server" toml:"server"`
+	Database  Database           `yaml:"database" toml:"database"`
+	Simulator simulator.Settings `yaml:"simulator" toml:"simulator"`
+	Webhooks  Webhooks           `yaml:"webhooks" toml:"webhooks"`
+
+	// SimDefaults are SimConfig fields (by their JSON names) used for any field a /run_sim request,
+	// or a config file passed to otter run / sweep, leaves out.
+	SimDefaults map[string]any `yaml:"sim_defaults" toml:"sim_defaults"`
+}
+
+type Server struct {
+	Port        int      `yaml:"port" toml:"port" env:"OTTER_PORT" validate:"min=1,max=65535"`
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins" env:"OTTER_CORS_ORIGINS" validate:"min=1,dive,required"`
+	MaxSims     int      `yaml:"max_sims" toml:"max_sims" env:"OTTER_MAX_SIMS" validate:"min=1"`
+
+	// unfinished sims and their checkpoints are kept here, to carry on after a restart
+	CheckpointDir     string `yaml:"checkpoint_dir" toml:"checkpoint_dir" env:"OTTER_CHECKPOINT_DIR" validate:"required"`
+	CheckpointSeconds int    `yaml:"checkpoint_seconds" toml:"checkpoint_seconds" env:"OTTER_CHECKPOINT_SECONDS" validate:"min=1"`
+}
+
+type Database struct {
+	EventsPath  string `yaml:"events_path" toml:"events_path" env:"OTTER_EVENTS_DB" validate:"required"`
+	ResultsPath string `yaml:"results_path" toml:"results_path" env:"OTTER_RESULTS_DB" validate:"required"`
+	OutputDir   string `yaml:"output_dir" toml:"output_dir" env:"OTTER_OUTPUT_DIR" validate:"required"`
+	EventsTable string `yaml:"events_table" toml:"events_table" env:"OTTER_EVENTS_TABLE" validate:"required"` // events_clean to sim on the audited copy
+}
+
+// Webhooks are POSTed to every URL when a sim is queued, starts, completes or fails, and when a sweep
+// completes. Events limits which are sent, all of them are by default.
+type Webhooks struct {
+	URLs        []string `yaml:"urls" toml:"urls" env:"OTTER_WEBHOOK_URLS" validate:"dive,url"`
+	Secret      string   `yaml:"secret" toml:"secret" env:"OTTER_WEBHOOK_SECRET"`
+	Events      []string `yaml:"events" toml:"events" env:"OTTER_WEBHOOK_EVENTS" validate:"dive,oneof=sim.queued sim.started sim.completed sim.failed sweep.completed"`
+	MaxAttempts int      `yaml:"max_attempts" toml:"max_attempts" env:"OTTER_WEBHOOK_ATTEMPTS" validate:"min=1"`
+}
+
+func Default() Settings {
+	return Settings{
+		Server: Server{
+			Port:        8080,
+			CORSOrigins: []string{"*"},
+			MaxSims:     2,
+
+			CheckpointDir:     "sim_checkpoints",
+			CheckpointSeconds: 60,
+		},
+		Database: Database{
+			EventsPath:  "ultracalls.duckdb",
+			ResultsPath: "sim_results.duckdb",
+			OutputDir:   "sim_output",
+			EventsTable: "events",
+		},
+		Simulator: simulator.DefaultSettings(),
+		Webhooks: Webhooks{
+			MaxAttempts: 5,
+		},
+	}
+}
+
+// Load reads the settings file named by OTTER_CONFIG (or the default file), applies the environment
+// overrides and validates the result.
+func Load() (Settings, error) {
+	s := Default()
+
+	path := os.Getenv(ENV_FILE)
+	if path == "" {
+		for _, name := range defaultFiles {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+	}
+
+	if path != "" {
+		if err := readFile(path, &s); err != nil {
+			return s, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&s).Elem()); err != nil {
+		return s, err
+	}
+
+	if err := s.Validate(); err != nil {
+		if path != "" {
+			err = fmt.Errorf("%s: %w", path, err)
+		}
+		return s, err
+	}
+
+	return s, nil
+}
+
+// readFile decodes a YAML or TOML file over the defaults already in s. Unknown keys are an error,
+// so a misspelt setting doesn't silently fall back to its default.
+func readFile(path string, s *Settings) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(s)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return nil
+}
+
+// applyEnv walks the settings and overrides every field that has an env tag and a set environment variable.
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		value := v.Field(i)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			value.SetString(raw)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", name, raw)
+			}
+			value.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", name, raw)
+			}
+			value.SetFloat(f)
+		case reflect.Slice:
+			items := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			value.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("%s: can't be set from the environment", name)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks every setting, and that the sim defaults are SimConfig fields of the right type.
+func (s Settings) Validate() error {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		return strings.SplitN(f.Tag.Get("yaml"), ",", 2)[0]
+	})
+
+	var errs []error
+
+	var verrs validator.ValidationErrors
+	if err := v.Struct(s); errors.As(err, &verrs) {
+		for _, e := range verrs {
+			// the namespace starts with the struct name, e.g. "Settings.server.port"
+			field := e.Namespace()
+			if i := strings.Index(field, "."); i != -1 {
+				field = field[i+1:]
+			}
+
+			rule := e.Tag()
+			if e.Param() != "" {
+				rule += "=" + e.Param()
+			}
+			errs = append(errs, fmt.Errorf("%s is invalid (%v), it must satisfy %s", field, e.Value(), rule))
+		}
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+
+	// unsigned deliveries can't be told apart from anyone else's POSTs
+	if len(s.Webhooks.URLs) > 0 && strings.TrimSpace(s.Webhooks.Secret) == "" {
+		errs = append(errs, fmt.Errorf("webhooks.secret is empty, it's needed to sign deliveries to webhooks.urls"))
+	}
+
+	if err := checkSimDefaults(s.SimDefaults); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkSimDefaults(defaults map[string]any) error {
+	if len(defaults) == 0 {
+		return nil
+	}
+
+	known := map[string]bool{}
+	t := reflect.TypeOf(models.SimConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.SplitN(t.Field(i).Tag.Get("json"), ",", 2)[0]] = true
+	}
+
+	for key := range defaults {
+		if !known[key] || key == "version" {
+			return fmt.Errorf("sim_defaults: %q isn't a sim config field", key)
+		}
+	}
+
+	raw, err := json.Marshal(defaults)
+	if err != nil {
+		return fmt.Errorf("sim_defaults: %w", err)
+	}
+
+	if _, err := models.MigrateSimConfig(raw); err != nil {
+		return fmt.Errorf("sim_defaults: %w", err)
+	}
+
+	return nil
+}
+
+// MergeSimDefaults fills in every top level field a sim config document leaves out from SimDefaults.
+func (s Settings) MergeSimDefaults(raw []byte) ([]byte, error) {
+	if len(s.SimDefaults) == 0 {
+		return raw, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	// unversioned requests may still carry TPAmounts under its old name
+	if legacy, ok := doc["TPAmounts"]; ok {
+		if _, ok := doc["tp_amounts"]; !ok {
+			doc["tp_amounts"] = legacy
+		}
+		delete(doc, "TPAmounts")
+	}
+
+	for key, value := range s.SimDefaults {
+		if _, ok := doc[key]; ok {
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		doc[key] = encoded
+	}
+
+	return json.Marshal(doc)
+}
@@ -0,0 +1,251 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// inDir runs the test in a new working directory, so no otter.yaml from the repo is picked up.
+func inDir(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv(ENV_FILE, "")
+
+	return dir
+}
+
+func write(t *testing.T, path string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	inDir(t)
+
+	s, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, Default()) {
+		t.Errorf("got %+v, want the defaults", s)
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	files := map[string]string{
+		"otter.yaml": "server:\n  port: 9000\nsimulator:\n  starting_balance: 20\nsim_defaults:\n  slippage: 5\n",
+		"otter.yml":  "server:\n  port: 9000\nsimulator:\n  starting_balance: 20\nsim_defaults:\n  slippage: 5\n",
+		"otter.toml": "[server]\nport = 9000\n[simulator]\nstarting_balance = 20\n[sim_defaults]\nslippage = 5\n",
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			dir := inDir(t)
+			write(t, filepath.Join(dir, name), content)
+
+			s, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// settings the file leaves out keep their defaults
+			if s.Server.Port != 9000 || s.Simulator.StartingBalance != 20 || s.Server.MaxSims != 2 || s.SimDefaults["slippage"] == nil {
+				t.Errorf("got %+v", s)
+			}
+		})
+	}
+}
+
+func TestLoadTheFileNamedByTheEnvironment(t *testing.T) {
+	dir := inDir(t)
+	write(t, filepath.Join(dir, "otter.yaml"), "server:\n  port: 9000\n")
+	write(t, filepath.Join(dir, "other.yaml"), "server:\n  port: 9001\n")
+	t.Setenv(ENV_FILE, filepath.Join(dir, "other.yaml"))
+
+	s, err := Load()
+	if err != nil || s.Server.Port != 9001 {
+		t.Errorf("got port %d, %v", s.Server.Port, err)
+	}
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	files := map[string]struct{ content, want string }{
+		"otter.yaml": {"server:\n  prot: 9000\n", "field prot not found"},
+		"otter.toml": {"[server]\nprot = 9000\n", "fields in the document are missing in the target struct"},
+	}
+
+	for name, file := range files {
+		t.Run(name, func(t *testing.T) {
+			dir := inDir(t)
+			write(t, filepath.Join(dir, name), file.content)
+
+			if _, err := Load(); err == nil || !strings.HasPrefix(err.Error(), name+": ") || !strings.Contains(err.Error(), file.want) {
+				t.Errorf("got %v, want %q", err, file.want)
+			}
+		})
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	dir := inDir(t)
+	write(t, filepath.Join(dir, "otter.yaml"), "server:\n  port: 70000\n")
+
+	_, err := Load()
+	if err == nil || !strings.Contains(err.Error(), "otter.yaml") || !strings.Contains(err.Error(), "server.port is invalid (70000)") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWebhooksNeedASecret(t *testing.T) {
+	tests := map[string]struct {
+		webhooks Webhooks
+		valid    bool
+	}{
+		"no urls":   {Webhooks{MaxAttempts: 1}, true},
+		"a secret":  {Webhooks{URLs: []string{"https://hooks.example"}, Secret: "s3cret", MaxAttempts: 1}, true},
+		"no secret": {Webhooks{URLs: []string{"https://hooks.example"}, MaxAttempts: 1}, false},
+		"blank":     {Webhooks{URLs: []string{"https://hooks.example"}, Secret: "  ", MaxAttempts: 1}, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := Default()
+			s.Webhooks = test.webhooks
+
+			err := s.Validate()
+			if test.valid && err != nil {
+				t.Errorf("got %v", err)
+			}
+			if !test.valid && (err == nil || !strings.Contains(err.Error(), "webhooks.secret")) {
+				t.Errorf("got %v, want a webhooks.secret error", err)
+			}
+		})
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	dir := inDir(t)
+	write(t, filepath.Join(dir, "otter.yaml"), "server:\n  port: 9000\n")
+
+	t.Setenv("OTTER_PORT", " 9100 ")
+	t.Setenv("OTTER_CORS_ORIGINS", "https://a.example, ,https://b.example")
+	t.Setenv("OTTER_STARTING_BALANCE", "12.5")
+	t.Setenv("OTTER_EVENTS_DB", "other.duckdb")
+
+	s, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.Port != 9100 {
+		t.Errorf("got port %d, the environment comes before the file", s.Server.Port)
+	}
+	if !reflect.DeepEqual(s.Server.CORSOrigins, []string{"https://a.example", "https://b.example"}) {
+		t.Errorf("got origins %q", s.Server.CORSOrigins)
+	}
+	if s.Simulator.StartingBalance != 12.5 || s.Database.EventsPath != "other.duckdb" {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestEnvironmentErrors(t *testing.T) {
+	tests := map[string]struct {
+		name, value string
+		want        string
+	}{
+		"int":   {"OTTER_PORT", "eighty", `OTTER_PORT: "eighty" is not an integer`},
+		"float": {"OTTER_STARTING_BALANCE", "ten", `OTTER_STARTING_BALANCE: "ten" is not a number`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			inDir(t)
+			t.Setenv(test.name, test.value)
+
+			if _, err := Load(); err == nil || err.Error() != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckSimDefaults(t *testing.T) {
+	tests := map[string]struct {
+		defaults map[string]any
+		err      string
+	}{
+		"none":           {nil, ""},
+		"known fields":   {map[string]any{"slippage": 5, "tps": []any{2, 4}, "candles": "1m"}, ""},
+		"unknown field":  {map[string]any{"slipage": 5}, `sim_defaults: "slipage" isn't a sim config field`},
+		"the version":    {map[string]any{"version": 1}, `sim_defaults: "version" isn't a sim config field`},
+		"the wrong type": {map[string]any{"tps": "2,4"}, "sim_defaults: "},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkSimDefaults(test.defaults)
+			if test.err == "" && err != nil {
+				t.Errorf("got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+				t.Errorf("got %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMergeSimDefaults(t *testing.T) {
+	s := Default()
+	s.SimDefaults = map[string]any{"slippage": 5, "tp_amounts": []any{1}, "name": "default"}
+
+	tests := map[string]struct {
+		request string
+		want    map[string]any
+	}{
+		"fills in what's left out": {`{"tps": [2]}`,
+			map[string]any{"tps": []any{2.0}, "slippage": 5.0, "tp_amounts": []any{1.0}, "name": "default"}},
+		"keeps what's set": {`{"slippage": 10, "name": "mine"}`,
+			map[string]any{"slippage": 10.0, "tp_amounts": []any{1.0}, "name": "mine"}},
+		"keeps a null": {`{"name": null}`,
+			map[string]any{"name": nil, "slippage": 5.0, "tp_amounts": []any{1.0}}},
+		"renames the legacy TPAmounts": {`{"TPAmounts": [0.5]}`,
+			map[string]any{"tp_amounts": []any{0.5}, "slippage": 5.0, "name": "default"}},
+		"prefers tp_amounts over TPAmounts": {`{"TPAmounts": [0.5], "tp_amounts": [0.25]}`,
+			map[string]any{"tp_amounts": []any{0.25}, "slippage": 5.0, "name": "default"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			merged, err := s.MergeSimDefaults([]byte(test.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got map[string]any
+			if err := json.Unmarshal(merged, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := s.MergeSimDefaults([]byte(`{"tps": [2`)); err == nil {
+		t.Error("merged invalid JSON")
+	}
+
+	// without defaults the request isn't touched, whatever it is
+	if merged, err := Default().MergeSimDefaults([]byte(`{"TPAmounts": [1]}`)); err != nil || string(merged) != `{"TPAmounts": [1]}` {
+		t.Errorf("got %s, %v", merged, err)
+	}
+}
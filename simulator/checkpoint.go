@@ -0,0 +1,71 @@
+package simulator
+
+import (
+	"otter/database"
+	"otter/models"
+	"time"
+)
+
+// CHECKPOINT_INTERVAL is how often a sim saves a checkpoint by default, see Simulator.SaveCheckpoint.
+const CHECKPOINT_INTERVAL = time.Minute
+
+// Checkpoint is a sim's whole state between two pages of events: enough to carry on from where it stopped and
+// finish with the same result as a sim that never stopped.
+type Checkpoint struct {
+	ConfigHash      string
+	Cursor          database.Cursor // the last event played
+	Wallet          models.Wallet   // assets included, with their queued take profits and trading history
+	Stats           Statistics
+	Skips           []models.Skip
+	Skipped         map[int]bool
+	EventsProcessed int64
+	SavedAt         time.Time
+}
+
+// checkpoint is the sim's state after the event at cursor. It shares the sim's wallet, so it has to be saved
+// before the sim plays anything else.
+func (s *Simulator) checkpoint(cursor database.Cursor) *Checkpoint {
+	return &Checkpoint{
+		ConfigHash:      s.Config.Hash(),
+		Cursor:          cursor,
+		Wallet:          *s.Wallet,
+		Stats:           s.Stats,
+		Skips:           s.Skips,
+		Skipped:         s.skipped,
+		EventsProcessed: s.eventsProcessed,
+		SavedAt:         time.Now(),
+	}
+}
+
+// restore picks up a checkpoint's state in place of a new wallet.
+func (s *Simulator) restore(c *Checkpoint) {
+	wallet := c.Wallet
+	s.Wallet = &wallet
+	s.Stats = c.Stats
+	s.Skips = c.Skips
+	s.skipped = c.Skipped
+	s.eventsProcessed = c.EventsProcessed
+
+	// gob leaves empty collections out
+	if s.Wallet.Assets == nil {
+		s.Wallet.Assets = make(map[int]models.Asset)
+	}
+	for id, asset := range s.Wallet.Assets {
+		if asset.TradingHistory == nil {
+			asset.TradingHistory = make(map[int64]float64)
+			s.Wallet.Assets[id] = asset
+		}
+	}
+	if s.Wallet.BalanceTracking == nil {
+		s.Wallet.BalanceTracking = []models.BalancePoint{}
+	}
+	if s.Wallet.Events == nil {
+		s.Wallet.Events = []models.SimEvent{}
+	}
+	if s.Skips == nil {
+		s.Skips = []models.Skip{}
+	}
+	if s.skipped == nil {
+		s.skipped = map[int]bool{}
+	}
+}
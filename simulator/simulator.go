@@ -1,21 +1,48 @@
 package simulator
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math"
-	"math/rand"
 	"otter/database"
 	"otter/models"
-	"sort"
 	"time"
 )
 
+// EventSource streams the events a sim plays through, in (timestamp, block_number) order.
+type EventSource interface {
+	StreamEvents(ctx context.Context, from int64, to int64, opts database.StreamOptions) *database.EventStream
+}
+
+// MetadataSource resolves file IDs to the calls a sim can trade. It has to return fresh assets every time,
+// a sim's wallet changes them.
+type MetadataSource interface {
+	GetContractAddressInfo() (map[int]models.Asset, error)
+}
+
+// CandleSource streams a token's candles as events, one per interval, for sims that play candles instead of
+// every swap. See database.StreamCandles.
+type CandleSource interface {
+	StreamCandles(ctx context.Context, from int64, to int64, interval string, opts database.StreamOptions) *database.EventStream
+}
+
+// Source is everything a sim reads. The events database (*database.Database) is the real one,
+// *database.Memory serves calls and events from memory for tests.
+type Source interface {
+	EventSource
+	MetadataSource
+}
+
 type Simulator struct {
-	DBConnection *database.Database
-	CAInfo       map[int]models.Asset
+	Events EventSource
+
+	// set when the sim plays candles, Span is the seconds each event covers
+	Candles CandleSource
+	Span    int64
+
+	CAInfo map[int]models.Asset
+	Config models.SimConfig // stored with the results, so the sim can be re-run
 
 	SimulatorStartBlock int64
 	BuyingEnabled       bool
@@ -26,15 +53,34 @@ type Simulator struct {
 	BuyAmount float64
 
 	SlippagePercentage float64
-	Status             *SimStatus
+	Progress           ProgressReporter
 
 	TPs       []float64
 	TPAmounts []float64
 
 	CustomOpts models.CustomOptions
 
+	Settings Settings
+
 	Wallet *models.Wallet
 	Stats  Statistics
+
+	Skips   []models.Skip
+	skipped map[int]bool // calls whose buy has been skipped already
+
+	// Resume carries the sim on from a checkpoint, rather than starting with a new wallet
+	Resume *Checkpoint
+
+	// SaveCheckpoint, if set, is given the sim's state every CheckpointInterval, and once more if the sim is
+	// cancelled. The checkpoint has to be written before it returns. A failed save is logged, and the sim
+	// carries on.
+	SaveCheckpoint     func(*Checkpoint) error
+	CheckpointInterval time.Duration
+
+	startedAt       time.Time
+	lastProgress    time.Time
+	eventsProcessed int64
+	startEvents     int64 // eventsProcessed when this run started, a resumed sim has played some already
 }
 
 type Statistics struct {
@@ -44,40 +90,110 @@ type Statistics struct {
 	TotalSellAmount float64
 }
 
-type SimStatus struct {
-	StartTimestamp   int    `json:"start_timestamp"`
-	CurrentTimestamp int    `json:"current_timestamp"`
-	EndTimestamp     int    `json:"end_timestamp"`
-	SimName          string `json:"sim_name"`
-	Done             bool   `json:"done"`
+// ProgressReporter is told how far through its time range a running sim has got, and is sent
+// live "progress" and "trade" messages as the sim runs.
+type ProgressReporter interface {
+	SetRange(start int64, end int64)
+	SetProgress(current int64)
+	Publish(event string, data any)
+}
+
+// Progress is published at most every PROGRESS_INTERVAL while a sim runs.
+type Progress struct {
+	CurrentTimestamp int64   `json:"current_timestamp"`
+	Percent          float64 `json:"percent"`
+	EventsProcessed  int64   `json:"events_processed"`
+	EventsPerSecond  float64 `json:"events_per_second"`
+	EquityUSD        float64 `json:"equity_usd"`
+	OpenPositions    int     `json:"open_positions"`
 }
 
+// BATCH_SIZE is the seconds of events a single query scans.
 const BATCH_SIZE = 250
 
+// PAGE_SIZE is the most events a single query reads, PREFETCH the pages read ahead while the sim works.
+const (
+	PAGE_SIZE = 10000
+	PREFETCH  = 4
+)
+
+const PROGRESS_INTERVAL = 250 * time.Millisecond
+
+// STARTING_BALANCE is the SOL every sim's wallet starts with.
+const STARTING_BALANCE = 100.0
+
+// MIN_SOL_PRICE is the SOL/USD price below which Codex's price is taken to be invalid, and the balance isn't tracked.
+const MIN_SOL_PRICE = 50.0
+
+// BUY_RESERVE is the SOL that always has to be left in the wallet after a buy, for fees.
+const BUY_RESERVE = 0.1
+
+// BUY_WINDOW is the seconds either side of a call that a swap can be bought on.
+const BUY_WINDOW = 2
+
 // const TAKE_PROFIT_1 = 20
 
-func Init(db *database.Database, buyAmount float64, TPs []float64, TPAmounts []float64, CustomOpts models.CustomOptions, SimulatorName string, slippage float64, startTimestamp int64, endTimestamp int64) Simulator {
+// Settings are shared by every sim a deployment runs, unlike SimConfig which is per sim.
+// They're loaded from the settings file, see the settings package.
+type Settings struct {
+	BatchSize       int64   `yaml:"batch_size" toml:"batch_size" env:"OTTER_BATCH_SIZE" validate:"gt=0"`
+	PageSize        int     `yaml:"page_size" toml:"page_size" env:"OTTER_PAGE_SIZE" validate:"gt=0"`
+	Prefetch        int     `yaml:"prefetch" toml:"prefetch" env:"OTTER_PREFETCH" validate:"gte=0"`
+	StartingBalance float64 `yaml:"starting_balance" toml:"starting_balance" env:"OTTER_STARTING_BALANCE" validate:"gt=0"`
+	MinSOLPrice     float64 `yaml:"min_sol_price" toml:"min_sol_price" env:"OTTER_MIN_SOL_PRICE" validate:"gte=0"`
+}
+
+func DefaultSettings() Settings {
+	return Settings{
+		BatchSize:       BATCH_SIZE,
+		PageSize:        PAGE_SIZE,
+		Prefetch:        PREFETCH,
+		StartingBalance: STARTING_BALANCE,
+		MinSOLPrice:     MIN_SOL_PRICE,
+	}
+}
+
+func Init(source Source, config models.SimConfig, settings Settings) (Simulator, error) {
 	s := Simulator{
-		DBConnection: db,
+		Events:   source,
+		Config:   config,
+		Settings: settings,
 		Stats: Statistics{
 			TotalBuys:       0,
 			TotalSells:      0,
 			TotalBuyAmount:  0.0,
 			TotalSellAmount: 0.0,
 		},
-		TPs:                 TPs,
-		TPAmounts:           TPAmounts,
-		CustomOpts:          CustomOpts,
-		Name:                SimulatorName,
-		BuyAmount:           buyAmount,
-		SlippagePercentage:  slippage,
-		SimulatorStartBlock: startTimestamp,
-		SimulatorEndBlock:   endTimestamp,
+		TPs:                 config.TPs,
+		TPAmounts:           config.TPAmounts,
+		CustomOpts:          config.CustomOpts,
+		Name:                config.Name,
+		BuyAmount:           config.BuyAmount,
+		SlippagePercentage:  config.Slippage,
+		SimulatorStartBlock: config.StartTimestamp,
+		SimulatorEndBlock:   config.EndTimestamp,
 	}
 
-	s.CAInfo, _ = db.GetContractAddressInfo()
+	s.Span = 1
+	if config.Candles != "" {
+		seconds, err := database.CandleInterval(config.Candles)
+		if err != nil {
+			return s, err
+		}
 
-	return s
+		candles, ok := source.(CandleSource)
+		if !ok {
+			return s, fmt.Errorf("%T can't play candles", source)
+		}
+
+		s.Candles = candles
+		s.Span = seconds
+	}
+
+	var err error
+	s.CAInfo, err = source.GetContractAddressInfo()
+
+	return s, err
 }
 
 func (s *Simulator) UpdateWalletBalance(e models.Event) {
@@ -93,30 +209,41 @@ func (s *Simulator) UpdateWalletBalance(e models.Event) {
 	s.Wallet.TotalUSDWorth = tokenUSDWorth + SOLUSDWorth
 	s.Wallet.TokenSOLWorth = tokenSOLWorth
 	s.Wallet.TokenUSDWorth = tokenUSDWorth
-	if !(math.IsNaN(e.SOLPrice)) && !math.IsNaN(tokenSOLWorth) && !math.IsNaN(s.Wallet.Balance) && e.SOLPrice > 50 {
-		s.Wallet.BalanceTracking[e.BlockNumber] = (tokenSOLWorth + s.Wallet.Balance) * e.SOLPrice
-	} else {
-		// fucked up sol price
+	if !(math.IsNaN(e.SOLPrice)) && !math.IsNaN(tokenSOLWorth) && !math.IsNaN(s.Wallet.Balance) && e.SOLPrice > s.Settings.MinSOLPrice {
+		point := models.BalancePoint{
+			BlockNumber: e.BlockNumber,
+			Timestamp:   e.Timestamp,
+			USD:         (tokenSOLWorth + s.Wallet.Balance) * e.SOLPrice,
+		}
+
+		// a block can be updated more than once (e.g. after a sell), keep the latest value
+		if n := len(s.Wallet.BalanceTracking); n > 0 && s.Wallet.BalanceTracking[n-1].BlockNumber == e.BlockNumber {
+			s.Wallet.BalanceTracking[n-1] = point
+		} else {
+			s.Wallet.BalanceTracking = append(s.Wallet.BalanceTracking, point)
+		}
 	}
 }
 
-func (s *Simulator) process_events_chronologically(events []models.Event) (int, bool) {
-	sort.Slice(events, func(i, j int) bool {
-		return events[i].BlockNumber < events[j].BlockNumber
-	})
-
+// process_events_chronologically plays a page of events through the strategy. Pages come out of the stream
+// already in (timestamp, block_number) order.
+func (s *Simulator) process_events_chronologically(events []models.Event) {
 	previous_block_number := 0
 	last_known_timestamp := 0
 	for _, event := range events {
 		if asset, ok := s.Wallet.Assets[event.FileID]; ok {
 			if !math.IsNaN(event.TokenPrice) {
-				// buy tx
-				if asset.Balance == 0 && (event.Timestamp >= asset.CallTimestamp-2 && event.Timestamp <= asset.CallTimestamp+2) {
-					if s.Wallet.Balance > s.BuyAmount+0.1 {
+				// buy tx, on a swap within BUY_WINDOW seconds of the call, or a candle that overlaps them (candles are
+				// played at the end of their span)
+				if asset.Balance == 0 && (event.Timestamp >= asset.CallTimestamp-BUY_WINDOW && event.Timestamp-s.Span+1 <= asset.CallTimestamp+BUY_WINDOW) {
+					if s.Wallet.Balance <= s.BuyAmount+BUY_RESERVE {
+						s.skipBuy(event, models.SKIP_BALANCE)
+					} else {
 						tm := time.Unix(event.Timestamp, 0)
 
 						if s.CustomOpts.NYTradingTimes {
 							if tm.Hour() < 9 || tm.Hour() > 16 {
+								s.skipBuy(event, models.SKIP_TRADING_HOURS)
 								continue
 							}
 						}
@@ -131,13 +258,14 @@ func (s *Simulator) process_events_chronologically(events []models.Event) (int,
 
 						event := models.SimEvent{
 							BlockNumber: event.BlockNumber,
+							Timestamp:   event.Timestamp,
 							Type:        "BUY",
 							SOLChange:   -s.BuyAmount,
 							FileID:      event.FileID,
 							TokenPrice:  event.TokenPrice,
 						}
 
-						s.Wallet.Events = append(s.Wallet.Events, event)
+						s.recordTrade(event)
 					}
 				}
 
@@ -163,26 +291,33 @@ func (s *Simulator) process_events_chronologically(events []models.Event) (int,
 							asset.Balance -= tokenSaleAmount
 
 							if len(s.TPs) > 1 && len(s.TPs) >= asset.TPStage+2 {
-								fmt.Println(asset.TPStage)
 								asset.TPStage += 1
 								asset.TPPrice = asset.EntryPrice * s.TPs[asset.TPStage]
 							}
 
 							event := models.SimEvent{
 								BlockNumber: event.BlockNumber,
+								Timestamp:   event.Timestamp,
 								Type:        "SELL",
 								SOLChange:   saleValue,
 								FileID:      event.FileID,
 								TokenPrice:  event.TokenPrice,
 							}
 
-							s.Wallet.Events = append(s.Wallet.Events, event)
+							s.recordTrade(event)
 
 							s.Stats.TotalSells += 1
 							asset.QueuedTP = 0
 							asset.QueuedPrice = 0.0
 						} else {
-							// fmt.Println("Slippage exceeded 10%. Cancelling TP.")
+							s.Skips = append(s.Skips, models.Skip{
+								BlockNumber: event.BlockNumber,
+								Timestamp:   event.Timestamp,
+								FileID:      event.FileID,
+								Type:        "SELL",
+								Reason:      models.SKIP_SLIPPAGE,
+								TokenPrice:  event.TokenPrice,
+							})
 							asset.QueuedTP = 0
 							asset.QueuedPrice = 0.0
 						}
@@ -190,7 +325,6 @@ func (s *Simulator) process_events_chronologically(events []models.Event) (int,
 					}
 
 					asset.Price = event.TokenPrice
-					asset.TradingHistory[event.BlockNumber] = event.TokenPrice
 				}
 			}
 
@@ -204,150 +338,223 @@ func (s *Simulator) process_events_chronologically(events []models.Event) (int,
 
 		previous_block_number = int(event.BlockNumber)
 		last_known_timestamp = int(event.Timestamp)
-
-		s.Status.CurrentTimestamp = int(event.Timestamp)
 	}
 
-	return last_known_timestamp, true
-}
+	s.eventsProcessed += int64(len(events))
 
-func (s *Simulator) fetch_next_event_batch(next_ts int64) []models.Event {
-	events, _ := s.DBConnection.BatchGetEventsForTimestamps(next_ts, BATCH_SIZE)
-	return events
-}
+	if len(events) != 0 {
+		s.Progress.SetProgress(int64(last_known_timestamp))
 
-func (s *Simulator) Run(simStatus *SimStatus) {
-	simStatus.StartTimestamp = int(s.SimulatorStartBlock)
-	simStatus.CurrentTimestamp = int(s.SimulatorStartBlock)
-	simStatus.EndTimestamp = int(s.SimulatorEndBlock)
-	simStatus.SimName = s.Name
+		if time.Since(s.lastProgress) >= PROGRESS_INTERVAL {
+			s.publishProgress(int64(last_known_timestamp))
+		}
+	}
+}
 
-	s.Status = simStatus
+// skipBuy records a call's buy being skipped, the first time it happens. Every swap in the buy window tries again.
+func (s *Simulator) skipBuy(e models.Event, reason string) {
+	if s.skipped[e.FileID] {
+		return
+	}
+	s.skipped[e.FileID] = true
+
+	s.Skips = append(s.Skips, models.Skip{
+		BlockNumber: e.BlockNumber,
+		Timestamp:   e.Timestamp,
+		FileID:      e.FileID,
+		Type:        "BUY",
+		Reason:      reason,
+		TokenPrice:  e.TokenPrice,
+	})
+}
 
-	s.InitWallet()
+func (s *Simulator) recordTrade(e models.SimEvent) {
+	s.Wallet.Events = append(s.Wallet.Events, e)
+	s.Progress.Publish("trade", e)
+}
 
-	// sim_start is used if you want to run a full simulation, start to end.
-	// However, date range can be narrowed, and should be. Remember to add support for that.
-	nextBlock := s.SimulatorStartBlock
-	fmt.Println("NEXT BLOCK ->", nextBlock)
-	for {
-		if nextBlock > s.SimulatorEndBlock {
-			break
-		}
-		events := s.fetch_next_event_batch(nextBlock)
+func (s *Simulator) publishProgress(current int64) {
+	p := Progress{
+		CurrentTimestamp: current,
+		EventsProcessed:  s.eventsProcessed,
+		EquityUSD:        s.Wallet.TotalUSDWorth,
+	}
 
-		b, con := s.process_events_chronologically(events)
-		nextBlock = int64(b) + 1
+	if s.SimulatorEndBlock > s.SimulatorStartBlock {
+		p.Percent = math.Min(100, math.Max(0, float64(current-s.SimulatorStartBlock)/float64(s.SimulatorEndBlock-s.SimulatorStartBlock)*100))
+	}
 
-		if !con {
-			break
-		}
+	if elapsed := time.Since(s.startedAt).Seconds(); elapsed > 0 {
+		p.EventsPerSecond = float64(s.eventsProcessed-s.startEvents) / elapsed
 	}
 
-	finalAssets := models.DeepCopyWallet(s.Wallet)
-	finalAssets.Assets = make(map[int]models.Asset)
-	for i, asset := range s.Wallet.Assets {
-		if len(asset.TradingHistory) != 0 {
-			asset.TradingHistory = make(map[int64]float64, 0)
-			finalAssets.Assets[i] = asset
+	for _, asset := range s.Wallet.Assets {
+		if asset.Balance > 0 {
+			p.OpenPositions += 1
 		}
 	}
 
-	newBalances := make(map[int64]float64, 0)
+	s.lastProgress = time.Now()
+	s.Progress.Publish("progress", p)
+}
+
+// Start resets the wallet for a new run, or restores it from s.Resume. Run calls it, live runners call it
+// before they Play any events.
+func (s *Simulator) Start(progress ProgressReporter) {
+	progress.SetRange(s.SimulatorStartBlock, s.SimulatorEndBlock)
+
+	s.Progress = progress
+	s.startedAt = time.Now()
 
-	keys := make([]int64, 0, len(s.Wallet.BalanceTracking))
-	for id := range s.Wallet.BalanceTracking {
-		keys = append(keys, id)
+	if s.Resume != nil {
+		s.restore(s.Resume)
+		s.startEvents = s.eventsProcessed
+		progress.SetProgress(s.Resume.Cursor.Timestamp)
+		return
 	}
 
-	sort.Slice(keys, func(i, j int) bool {
-		return keys[i] < keys[j]
-	})
+	s.InitWallet()
+	s.Skips = []models.Skip{}
+	s.skipped = map[int]bool{}
+}
 
-	for i, block := range keys {
-		bal := s.Wallet.BalanceTracking[block]
-		if i == 0 {
-			newBalances[block] = bal
-		} else {
-			prev := keys[i-1]
-			// @business_rule Only store balance changes that are more then 10$ diff
-			if bal != s.Wallet.BalanceTracking[prev] && ((bal-s.Wallet.BalanceTracking[prev] > 10) || (bal-s.Wallet.BalanceTracking[prev] < -10)) {
-				newBalances[block] = bal
-			}
-		}
+// Play runs a page of events through the strategy. Events have to come in (timestamp, block_number) order.
+func (s *Simulator) Play(events []models.Event) {
+	s.process_events_chronologically(events)
+}
+
+// AddCall makes a call tradable mid-run, for live feeds that announce calls as they happen. It returns false
+// if the sim already has the call, a repeated announcement never resets a position.
+func (s *Simulator) AddCall(asset models.Asset) bool {
+	if _, ok := s.Wallet.Assets[asset.FileID]; ok {
+		return false
 	}
 
-	finalAssets.BalanceTracking = newBalances
+	if asset.TradingHistory == nil {
+		asset.TradingHistory = make(map[int64]float64, 0)
+	}
 
-	currentTime := time.Now()
+	s.CAInfo[asset.FileID] = asset
+	s.Wallet.Assets[asset.FileID] = asset
 
-	simID := rand.Intn(999999999-111111111+1) + 111111111
+	return true
+}
 
-	simulatorMetadata := models.SimulatorMetadata{
-		BuyAmount:  s.BuyAmount,
-		TPs:        s.TPs,
-		TPAmounts:  s.TPAmounts,
-		CustomOpts: s.CustomOpts,
-		Name:       s.Name,
-		Date:       currentTime.Format("2006-01-02 15:04:05"),
-		ID:         simID,
+// Run plays the events between the start and end timestamps through the strategy, and returns the
+// results for the caller to persist. Cancelling ctx stops the sim after the current page of events.
+// Any database error stops the sim, a partial result is never returned. A sim with s.Resume set carries on
+// after the checkpoint's cursor.
+func (s *Simulator) Run(ctx context.Context, progress ProgressReporter) (*models.SimResult, error) {
+	s.Start(progress)
+
+	opts := database.StreamOptions{
+		Window:   s.Settings.BatchSize,
+		PageSize: s.Settings.PageSize,
+		Prefetch: s.Settings.Prefetch,
 	}
 
-	portfolio := models.Portfolio{
-		SOLBalance:    s.Wallet.Balance,
-		TokenUSDWorth: s.Wallet.TokenUSDWorth,
-		TokenSOLWorth: s.Wallet.TokenSOLWorth,
-		TotalUSDWorth: s.Wallet.TotalUSDWorth,
+	var cursor *database.Cursor
+	if s.Resume != nil {
+		c := s.Resume.Cursor
+		cursor = &c
+		opts.After = cursor
 	}
 
-	metaBytes, metaErr := json.MarshalIndent(simulatorMetadata, "", "  ")
-	if metaErr != nil {
-		log.Fatal("meta err" + metaErr.Error())
+	interval := s.CheckpointInterval
+	if interval <= 0 {
+		interval = CHECKPOINT_INTERVAL
 	}
+	lastCheckpoint := time.Now()
 
-	ioutil.WriteFile("sim_output/"+fmt.Sprint(simID)+"_metadata.json", metaBytes, 0644)
+	// a cancelled sim is checkpointed where it stopped, so it can carry on from there
+	stopped := func(err error) (*models.SimResult, error) {
+		if cursor != nil {
+			s.saveCheckpoint(*cursor)
+		}
+		return nil, err
+	}
 
-	portBytes, portErr := json.MarshalIndent(portfolio, "", "  ")
-	if portErr != nil {
-		log.Fatal("port err" + portErr.Error())
+	var stream *database.EventStream
+	if s.Candles != nil {
+		stream = s.Candles.StreamCandles(ctx, s.SimulatorStartBlock, s.SimulatorEndBlock, s.Config.Candles, opts)
+	} else {
+		stream = s.Events.StreamEvents(ctx, s.SimulatorStartBlock, s.SimulatorEndBlock, opts)
 	}
+	defer stream.Close()
 
-	ioutil.WriteFile("sim_output/"+fmt.Sprint(simID)+"_portfolio.json", portBytes, 0644)
+	for stream.Next() {
+		if err := ctx.Err(); err != nil {
+			return stopped(err)
+		}
 
-	assetBytes, assetErr := json.MarshalIndent(finalAssets.Assets, "", "  ")
-	if assetErr != nil {
-		log.Fatal("asset err" + assetErr.Error())
-	}
+		page := stream.Page()
+		s.process_events_chronologically(page)
 
-	ioutil.WriteFile("sim_output/"+fmt.Sprint(simID)+"_assets.json", assetBytes, 0644)
+		c := database.CursorOf(page[len(page)-1])
+		cursor = &c
 
-	balanceBytes, balanceErr := json.MarshalIndent(finalAssets.BalanceTracking, "", "  ")
-	if balanceErr != nil {
-		log.Fatal("balance err" + balanceErr.Error())
+		if time.Since(lastCheckpoint) >= interval {
+			s.saveCheckpoint(c)
+			lastCheckpoint = time.Now()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return stopped(err)
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
 	}
 
-	ioutil.WriteFile("sim_output/"+fmt.Sprint(simID)+"_balance_updates.json", balanceBytes, 0644)
+	// a final update, so subscribers always see where the sim ended
+	s.publishProgress(s.SimulatorEndBlock)
 
-	tHistoryBytes, tHistoryErr := json.MarshalIndent(finalAssets.Events, "", "  ")
+	return s.Result(models.NewSimID()), nil
+}
 
-	if tHistoryErr != nil {
-		log.Fatal("t history err" + tHistoryErr.Error())
+func (s *Simulator) saveCheckpoint(cursor database.Cursor) {
+	if s.SaveCheckpoint == nil {
+		return
 	}
 
-	ioutil.WriteFile("sim_output/"+fmt.Sprint(simID)+"_trade_history.json", tHistoryBytes, 0644)
+	if err := s.SaveCheckpoint(s.checkpoint(cursor)); err != nil {
+		log.Printf("sim %s: saving a checkpoint: %s", s.Name, err)
+	}
+}
+
+// Result is the sim's state so far, stored under id.
+func (s *Simulator) Result(id int) *models.SimResult {
+	simulatorMetadata := models.SimulatorMetadata{
+		SimConfig: s.Config,
+		Date:      time.Now().Format("2006-01-02 15:04:05"),
+		ID:        id,
+	}
+
+	portfolio := models.Portfolio{
+		SOLBalance:    s.Wallet.Balance,
+		TokenUSDWorth: s.Wallet.TokenUSDWorth,
+		TokenSOLWorth: s.Wallet.TokenSOLWorth,
+		TotalUSDWorth: s.Wallet.TotalUSDWorth,
+	}
 
-	s.Status.Done = true
+	return &models.SimResult{
+		Metadata:        simulatorMetadata,
+		Portfolio:       portfolio,
+		BalanceTracking: s.Wallet.BalanceTracking, // stored raw, resampling happens when the curve is read
+		Events:          s.Wallet.Events,
+		Skips:           s.Skips,
+		Ledger:          models.BuildLedger(s.Wallet.Assets, s.Wallet.Events),
+	}
 }
 
 func (s *Simulator) InitWallet() {
 	w := models.Wallet{
-		Balance:       100,
+		Balance:       s.Settings.StartingBalance,
 		TokenUSDWorth: 0.0,
 		TokenSOLWorth: 0.0,
 		TotalUSDWorth: 0.0,
 
 		Assets:          make(map[int]models.Asset, 0),
-		BalanceTracking: make(map[int64]float64, 0),
+		BalanceTracking: []models.BalancePoint{},
 		Events:          []models.SimEvent{},
 	}
 
@@ -0,0 +1,427 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"otter/database"
+	"otter/internal/testutil"
+	"otter/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const CALL = 1000
+
+// call is a token called at CALL, so buys can happen from CALL-2 to CALL+2.
+func call(fileID int) models.Asset {
+	return models.Asset{FileID: fileID, ContractAddress: "CA", Name: "Token", CallTimestamp: CALL}
+}
+
+// swap is an event with a SOL price of $150 and the token's price in SOL.
+func swap(fileID int, timestamp int64, block int64, price float64) models.Event {
+	return models.Event{FileID: fileID, SOLPrice: 150, TokenPrice: price, Timestamp: timestamp, BlockNumber: block}
+}
+
+func testConfig(tps []float64, amounts []float64, slippage float64) models.SimConfig {
+	return models.SimConfig{
+		Version:        models.SIM_CONFIG_VERSION,
+		Name:           "test",
+		BuyAmount:      1,
+		TPs:            tps,
+		TPAmounts:      amounts,
+		Slippage:       slippage,
+		StartTimestamp: 0,
+		EndTimestamp:   10_000,
+	}
+}
+
+func runSim(t *testing.T, source Source, config models.SimConfig, settings Settings) *models.SimResult {
+	t.Helper()
+
+	// tiny pages, so every test also runs across page boundaries
+	settings.PageSize = 2
+
+	s, err := Init(source, config, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Run(context.Background(), testutil.NoProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+type trade struct {
+	Type  string
+	Block int64
+	Price float64
+	SOL   float64
+}
+
+func checkTrades(t *testing.T, result *models.SimResult, want ...trade) {
+	t.Helper()
+
+	if len(result.Events) != len(want) {
+		t.Fatalf("got %d trades %+v, want %d", len(result.Events), result.Events, len(want))
+	}
+
+	for i, e := range result.Events {
+		w := want[i]
+		if e.Type != w.Type || e.BlockNumber != w.Block || !testutil.Near(e.TokenPrice, w.Price) || !testutil.Near(e.SOLChange, w.SOL) {
+			t.Errorf("trade %d: got %s at block %d, price %g, %g SOL, want %+v", i, e.Type, e.BlockNumber, e.TokenPrice, e.SOLChange, w)
+		}
+	}
+}
+
+func checkBalance(t *testing.T, result *models.SimResult, want float64) {
+	t.Helper()
+
+	if !testutil.Near(result.Portfolio.SOLBalance, want) {
+		t.Errorf("got a SOL balance of %g, want %g", result.Portfolio.SOLBalance, want)
+	}
+}
+
+func TestBuysWithinTwoSecondsOfTheCall(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL-3, 1, 0.001),
+		swap(1, CALL-2, 2, 0.002),
+		swap(1, CALL, 3, 0.003), // already holding, not bought again
+	})
+
+	result := runSim(t, source, testConfig([]float64{10}, []float64{1}, 5), DefaultSettings())
+
+	checkTrades(t, result, trade{"BUY", 2, 0.002, -1})
+	checkBalance(t, result, 99)
+
+	if got := result.Ledger; len(got) != 1 || !testutil.Near(got[0].Balance, 500) {
+		t.Errorf("unexpected ledger %+v", got)
+	}
+}
+
+func TestNoBuyOutsideTheWindowOrWithoutBalance(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL-3, 1, 0.001),
+		swap(1, CALL+3, 2, 0.001),
+	})
+
+	result := runSim(t, source, testConfig([]float64{2}, []float64{1}, 5), DefaultSettings())
+	checkTrades(t, result)
+
+	// a buy has to leave BUY_RESERVE in the wallet
+	source = database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL, 1, 0.001),
+		swap(1, CALL+1, 2, 0.001), // tries again, but the skip is only recorded once
+	})
+
+	settings := DefaultSettings()
+	settings.StartingBalance = 1 + BUY_RESERVE
+	result = runSim(t, source, testConfig([]float64{2}, []float64{1}, 5), settings)
+	checkTrades(t, result)
+
+	want := []models.Skip{{BlockNumber: 1, Timestamp: CALL, FileID: 1, Type: "BUY", Reason: models.SKIP_BALANCE, TokenPrice: 0.001}}
+	if !reflect.DeepEqual(result.Skips, want) {
+		t.Errorf("got skips %+v, want %+v", result.Skips, want)
+	}
+
+	settings.StartingBalance = 1 + BUY_RESERVE + 0.01
+	result = runSim(t, source, testConfig([]float64{2}, []float64{1}, 5), settings)
+	checkTrades(t, result, trade{"BUY", 1, 0.001, -1})
+}
+
+func TestTakeProfitLadder(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL, 10, 0.001),      // buy 1000 tokens, first TP at 0.002
+		swap(1, CALL+5, 11, 0.0025),   // over the TP, queued
+		swap(1, CALL+6, 12, 0.0025),   // the sell waits until more than 3 blocks after it was queued
+		swap(1, CALL+7, 14, 0.0025),   //
+		swap(1, CALL+8, 15, 0.0025),   // sells half, second TP at 0.004
+		swap(1, CALL+9, 16, 0.003),    // under the second TP
+		swap(1, CALL+10, 17, 0.005),   // queued
+		swap(1, CALL+11, 21, 0.00505), // sells the rest, 1% slippage
+		swap(1, CALL+12, 30, 0.01),    // nothing left to sell
+	})
+
+	result := runSim(t, source, testConfig([]float64{2, 4}, []float64{0.5, 1}, 5), DefaultSettings())
+
+	checkTrades(t, result,
+		trade{"BUY", 10, 0.001, -1},
+		trade{"SELL", 15, 0.0025, 1.25},
+		trade{"SELL", 21, 0.00505, 2.525},
+	)
+	checkBalance(t, result, 100-1+1.25+2.525)
+}
+
+func TestSlippageCancelsTheTakeProfit(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL, 10, 0.001),
+		swap(1, CALL+5, 11, 0.003),  // queued at 0.003
+		swap(1, CALL+6, 15, 0.0025), // -16.7%, over the 5% allowed, so the TP is dropped
+		swap(1, CALL+7, 16, 0.0025), // still over the TP price, queued again
+		swap(1, CALL+8, 20, 0.0026), // +4%, sold
+	})
+
+	result := runSim(t, source, testConfig([]float64{2}, []float64{1}, 5), DefaultSettings())
+
+	checkTrades(t, result,
+		trade{"BUY", 10, 0.001, -1},
+		trade{"SELL", 20, 0.0026, 2.6},
+	)
+	checkBalance(t, result, 101.6)
+
+	want := []models.Skip{{BlockNumber: 15, Timestamp: CALL + 6, FileID: 1, Type: "SELL", Reason: models.SKIP_SLIPPAGE, TokenPrice: 0.0025}}
+	if !reflect.DeepEqual(result.Skips, want) {
+		t.Errorf("got skips %+v, want %+v", result.Skips, want)
+	}
+
+	// with no slippage allowed, only an exact price sells
+	result = runSim(t, source, testConfig([]float64{2}, []float64{1}, 0), DefaultSettings())
+	checkTrades(t, result, trade{"BUY", 10, 0.001, -1})
+	checkBalance(t, result, 99)
+}
+
+func TestEventsAreOrderedAndPricesUninverted(t *testing.T) {
+	inverted := swap(1, CALL, 10, 0.001)
+	inverted.SOLPrice, inverted.TokenPrice = inverted.TokenPrice, inverted.SOLPrice
+
+	// given out of order, the TP would be queued before the buy
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL+8, 20, 0.0025),
+		swap(1, CALL+5, 11, 0.0025),
+		inverted,
+	})
+
+	result := runSim(t, source, testConfig([]float64{2}, []float64{1}, 5), DefaultSettings())
+
+	checkTrades(t, result,
+		trade{"BUY", 10, 0.001, -1},
+		trade{"SELL", 20, 0.0025, 2.5},
+	)
+}
+
+func TestOnlyTheTimeRangeIsPlayed(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL, 10, 0.001),
+		swap(1, CALL+5, 11, 0.0025),
+		swap(1, CALL+101, 20, 0.0025), // after the end
+	})
+
+	config := testConfig([]float64{2}, []float64{1}, 5)
+	config.EndTimestamp = CALL + 100
+
+	result := runSim(t, source, config, DefaultSettings())
+	checkTrades(t, result, trade{"BUY", 10, 0.001, -1})
+}
+
+func TestFixtureFiles(t *testing.T) {
+	source, err := database.LoadMemory("testdata/metadata.csv", "testdata/events.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig([]float64{2}, []float64{1}, 5)
+	config.StartTimestamp = 1700000000
+	config.EndTimestamp = 1700000100
+
+	result := runSim(t, source, config, DefaultSettings())
+
+	checkTrades(t, result,
+		trade{"BUY", 101, 0.0001, -1},
+		trade{"SELL", 114, 0.000251, 2.51},
+	)
+	checkBalance(t, result, 101.51)
+}
+
+func TestCandles(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL+10, 10, 0.001),  // too late to buy, but its candle (960-1019) has the call in it
+		swap(1, CALL+30, 19, 0.002),  //
+		swap(1, CALL+31, 20, 0.0025), // closes the next candle over the TP, queued
+		swap(1, CALL+90, 30, 0.0026), // sold at the close of the one after, +4%
+	})
+
+	config := testConfig([]float64{2}, []float64{1}, 5)
+	result := runSim(t, source, config, DefaultSettings())
+	checkTrades(t, result)
+
+	config.Candles = "1m"
+	result = runSim(t, source, config, DefaultSettings())
+	checkTrades(t, result,
+		trade{"BUY", 10, 0.001, -1},
+		trade{"SELL", 30, 0.0026, 2.6},
+	)
+
+	// only sources that can build candles can play them
+	if _, err := Init(struct{ Source }{source}, config, DefaultSettings()); err == nil {
+		t.Error("a source without candles was accepted")
+	}
+}
+
+func TestCandleTradesAreNeverEarlierThanTheirSwaps(t *testing.T) {
+	events := []models.Event{
+		swap(1, CALL-1, 10, 0.001),
+		swap(2, CALL, 11, 0.01),
+		swap(1, CALL+3, 12, 0.0015),
+		swap(2, CALL+30, 14, 0.025),  // 2's TP queued
+		swap(1, CALL+45, 16, 0.0022), // 1's TP queued
+		swap(2, CALL+70, 20, 0.026),
+		swap(1, CALL+130, 25, 0.0023),
+	}
+	source := database.NewMemory([]models.Asset{call(1), call(2)}, events)
+	config := testConfig([]float64{2}, []float64{1}, 5)
+
+	swaps := runSim(t, source, config, DefaultSettings())
+	if len(swaps.Events) != 4 {
+		t.Fatalf("got %d trades on swaps, want 4", len(swaps.Events))
+	}
+
+	// one swap a second is the same on 1s candles
+	config.Candles = "1s"
+	if got := runSim(t, source, config, DefaultSettings()); !reflect.DeepEqual(got.Events, swaps.Events) {
+		t.Errorf("1s candles traded %+v, swaps traded %+v", got.Events, swaps.Events)
+	}
+
+	// a candle's trade is at the end of it, after the swap that set its close
+	for _, interval := range []string{"1m", "5m"} {
+		config.Candles = interval
+		span := database.CANDLE_INTERVALS[interval]
+
+		result := runSim(t, source, config, DefaultSettings())
+		if len(result.Events) == 0 {
+			t.Fatalf("%s: no trades", interval)
+		}
+		for _, trade := range result.Events {
+			for _, e := range events {
+				if e.BlockNumber != trade.BlockNumber || e.FileID != trade.FileID {
+					continue
+				}
+				if trade.Timestamp < e.Timestamp || trade.Timestamp >= e.Timestamp-e.Timestamp%span+span {
+					t.Errorf("%s: %s at %d, on a swap at %d", interval, trade.Type, trade.Timestamp, e.Timestamp)
+				}
+			}
+		}
+	}
+}
+
+func TestResumingACheckpointMatchesAnUninterruptedRun(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1), call(2)}, []models.Event{
+		swap(1, CALL, 1, 0.001),
+		swap(2, CALL+1, 2, 0.01),
+		swap(1, CALL+5, 3, 0.0025), // 1's first TP queued
+		swap(2, CALL+6, 4, 0.015),
+		swap(1, CALL+7, 8, 0.0026), // sold
+		swap(2, CALL+8, 9, 0.025),  // 2's first TP queued
+		swap(1, CALL+9, 12, 0.0045),
+		swap(2, CALL+10, 14, 0.05), // slipped too far, skipped
+		swap(1, CALL+11, 16, 0.0046),
+		swap(2, CALL+12, 18, 0.021),
+		swap(1, CALL+13, 20, 0.0047),
+	})
+
+	config := testConfig([]float64{2, 4}, []float64{0.5, 1}, 5)
+	settings := DefaultSettings()
+	settings.PageSize = 2
+
+	// a checkpoint after every page, through gob the way they're stored
+	checkpoints := [][]byte{}
+	s, err := Init(source, config, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CheckpointInterval = time.Nanosecond
+	s.SaveCheckpoint = func(c *Checkpoint) error {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(c)
+		checkpoints = append(checkpoints, buf.Bytes())
+		return err
+	}
+
+	want, err := s.Run(context.Background(), testutil.NoProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Events) < 3 || len(want.Skips) == 0 || len(checkpoints) < 4 {
+		t.Fatalf("got %d trades, %d skips and %d checkpoints", len(want.Events), len(want.Skips), len(checkpoints))
+	}
+
+	for i, data := range checkpoints {
+		var c Checkpoint
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+
+		// a checkpoint is the size of the wallet, not of every swap played so far
+		for id, asset := range c.Wallet.Assets {
+			if len(asset.TradingHistory) > 0 {
+				t.Fatalf("checkpoint %d has a trading history for %d", i, id)
+			}
+		}
+
+		s, err := Init(source, config, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Resume = &c
+
+		got, err := s.Run(context.Background(), testutil.NoProgress{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got.Events, want.Events) || !reflect.DeepEqual(got.Skips, want.Skips) || !reflect.DeepEqual(got.Ledger, want.Ledger) {
+			t.Errorf("resumed after checkpoint %d: got trades %+v, skips %+v, want %+v, %+v", i, got.Events, got.Skips, want.Events, want.Skips)
+		}
+		if len(got.BalanceTracking) != len(want.BalanceTracking) || !testutil.Near(got.Portfolio.TotalUSDWorth, want.Portfolio.TotalUSDWorth) {
+			t.Errorf("resumed after checkpoint %d: got %d balance points and $%g, want %d and $%g", i,
+				len(got.BalanceTracking), got.Portfolio.TotalUSDWorth, len(want.BalanceTracking), want.Portfolio.TotalUSDWorth)
+		}
+	}
+}
+
+func TestCancellingSavesACheckpoint(t *testing.T) {
+	source := database.NewMemory([]models.Asset{call(1)}, []models.Event{
+		swap(1, CALL, 1, 0.001),
+		swap(1, CALL+1, 2, 0.001),
+		swap(1, CALL+2, 3, 0.001),
+	})
+
+	settings := DefaultSettings()
+	settings.PageSize = 1
+
+	s, err := Init(source, testConfig([]float64{2}, []float64{1}, 5), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved *Checkpoint
+	s.SaveCheckpoint = func(c *Checkpoint) error {
+		saved = c
+		return nil
+	}
+
+	// cancelled by the first buy
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := s.Run(ctx, cancelOnTrade{cancel}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the sim cancelled", err)
+	}
+	if saved == nil || saved.Cursor.BlockNumber != 1 || saved.Stats.TotalBuys != 1 || saved.ConfigHash != s.Config.Hash() {
+		t.Fatalf("got checkpoint %+v", saved)
+	}
+}
+
+type cancelOnTrade struct {
+	cancel context.CancelFunc
+}
+
+func (cancelOnTrade) SetRange(start int64, end int64) {}
+func (cancelOnTrade) SetProgress(current int64)       {}
+func (c cancelOnTrade) Publish(event string, data any) {
+	if event == "trade" {
+		c.cancel()
+	}
+}
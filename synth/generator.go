@@ -0,0 +1,400 @@
+// Package synth generates synthetic calls and events that follow known price paths, so strategies can be
+// checked against answers that are known up front rather than only against historical data.
+package synth
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"otter/ingest"
+	"otter/models"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Solana produces a block every 400ms.
+const BLOCKS_PER_SECOND = 2.5
+
+type Config struct {
+	Seed        int64
+	Start       int64 // unix timestamp the first day starts at
+	Days        int
+	CallsPerDay float64
+
+	// Scenarios are picked for each call with these weights, every scenario equally if it's empty
+	Scenarios map[string]float64
+
+	Duration time.Duration // events are generated for this long after each call
+	Interval time.Duration // mean time between a token's swaps
+	RugAfter time.Duration // when a rug pull happens, after the call
+
+	SOLPrice float64 // SOL/USD at the start
+	SOLVol   float64 // annualised volatility of SOL/USD
+
+	StartBlock int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Seed:        1,
+		Start:       1700000000,
+		Days:        1,
+		CallsPerDay: 24,
+		Duration:    2 * time.Hour,
+		Interval:    5 * time.Second,
+		RugAfter:    30 * time.Minute,
+		SOLPrice:    150,
+		SOLVol:      0.8,
+		StartBlock:  250_000_000,
+	}
+}
+
+func (c Config) Validate() error {
+	problems := []string{}
+
+	if c.Days < 1 {
+		problems = append(problems, "days has to be at least 1")
+	}
+	if c.CallsPerDay <= 0 {
+		problems = append(problems, "calls per day has to be positive")
+	}
+	if c.Duration < time.Minute {
+		problems = append(problems, "duration has to be at least a minute")
+	}
+	if c.Interval < time.Second {
+		problems = append(problems, "interval has to be at least a second")
+	}
+	if c.RugAfter <= 0 || c.RugAfter >= c.Duration {
+		problems = append(problems, "rug after has to be between 0 and the duration")
+	}
+	if c.SOLPrice <= 0 || c.SOLVol < 0 {
+		problems = append(problems, "the SOL price has to be positive and its volatility can't be negative")
+	}
+	for name, weight := range c.Scenarios {
+		if !validScenario(name) {
+			problems = append(problems, fmt.Sprintf("unknown scenario %q, expected one of %s", name, strings.Join(SCENARIOS, ", ")))
+		}
+		if weight < 0 {
+			problems = append(problems, fmt.Sprintf("scenario %s has a negative weight", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+func validScenario(name string) bool {
+	for _, s := range SCENARIOS {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Call is a generated call. Params are what was drawn for its price path, stored in file_metadata.additional
+// along with the scenario.
+type Call struct {
+	FileID        int
+	Address       string
+	CallTimestamp int64
+	Scenario      string
+	LaunchPrice   float64 // SOL, the price at the call
+	Params        map[string]any
+	Events        int
+}
+
+// Writer receives the generated data. Calls are written after their events, once their params are known.
+type Writer interface {
+	WriteEvent(e models.Event) error
+	WriteCall(c Call) error
+}
+
+// Generate draws the calls and their events. The same config always generates the same data.
+func Generate(cfg Config, w Writer) ([]Call, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := rand.New(rand.NewSource(cfg.Seed))
+
+	scenarios, weights := scenarioWeights(cfg.Scenarios)
+
+	span := time.Duration(cfg.Days)*24*time.Hour + cfg.Duration
+	sol := newSOLPath(rand.New(rand.NewSource(r.Int63())), cfg.Start, span, cfg.SOLPrice, cfg.SOLVol)
+
+	// calls arrive as a Poisson process
+	end := cfg.Start + int64(cfg.Days)*24*60*60
+	meanGap := 24 * 60 * 60 / cfg.CallsPerDay
+
+	calls := []Call{}
+	at := float64(cfg.Start)
+	for {
+		at += r.ExpFloat64() * meanGap
+		if int64(at) >= end {
+			break
+		}
+
+		call := Call{
+			FileID:        len(calls) + 1,
+			Address:       address(r),
+			CallTimestamp: int64(at),
+			Scenario:      pick(r, scenarios, weights),
+		}
+
+		// every call gets its own source, so a call's path doesn't depend on the ones before it
+		if err := generateCall(cfg, rand.New(rand.NewSource(r.Int63())), sol, &call, w); err != nil {
+			return calls, err
+		}
+
+		calls = append(calls, call)
+	}
+
+	return calls, nil
+}
+
+func generateCall(cfg Config, r *rand.Rand, sol *solPath, call *Call, w Writer) error {
+	p, err := newPath(call.Scenario, r, cfg)
+	if err != nil {
+		return err
+	}
+
+	// bonding curve tokens are called at launch, the rest somewhere around it
+	call.LaunchPrice = LAUNCH_PRICE
+	if call.Scenario != BONDING_CURVE {
+		call.LaunchPrice *= math.Exp(r.NormFloat64() * 0.5)
+	}
+
+	duration := cfg.Duration.Seconds()
+	interval := cfg.Interval.Seconds()
+
+	previous := call.LaunchPrice
+	elapsed, dt := 0.0, 0.0
+	for elapsed <= duration {
+		// the first swap is at the call, so it can be bought
+		multiple := 1.0
+		if elapsed > 0 {
+			multiple = p.step(r, elapsed, dt)
+		}
+
+		price := call.LaunchPrice * multiple
+		timestamp := call.CallTimestamp + int64(elapsed)
+
+		side := "Buy"
+		if price < previous {
+			side = "Sell"
+		}
+		previous = price
+
+		err := w.WriteEvent(models.Event{
+			FileID:           call.FileID,
+			EventDisplayType: side,
+			QuoteToken:       "token1",
+			SOLPrice:         sol.at(timestamp),
+			TokenPrice:       price,
+			Timestamp:        timestamp,
+			BlockNumber:      cfg.StartBlock + int64(float64(timestamp-cfg.Start)*BLOCKS_PER_SECOND),
+		})
+		if err != nil {
+			return err
+		}
+		call.Events += 1
+
+		dt = max(1, math.Round(r.ExpFloat64()*interval))
+		elapsed += dt
+	}
+
+	call.Params = p.params()
+
+	return w.WriteCall(*call)
+}
+
+func scenarioWeights(configured map[string]float64) ([]string, []float64) {
+	if len(configured) == 0 {
+		weights := make([]float64, len(SCENARIOS))
+		for i := range weights {
+			weights[i] = 1
+		}
+		return SCENARIOS, weights
+	}
+
+	// sorted, so the same weights pick the same scenarios whatever order the map iterates in
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	weights := make([]float64, len(names))
+	for i, name := range names {
+		weights[i] = configured[name]
+	}
+
+	return names, weights
+}
+
+func pick(r *rand.Rand, names []string, weights []float64) string {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	x := r.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return names[i]
+		}
+		x -= w
+	}
+
+	return names[len(names)-1]
+}
+
+const base58 = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// address is a made up contract address, ending in "pump" like pump.fun's.
+func address(r *rand.Rand) string {
+	b := make([]byte, 40)
+	for i := range b {
+		b[i] = base58[r.Intn(len(base58))]
+	}
+
+	return string(b) + "pump"
+}
+
+// CSVWriter writes the calls and events as a metadata and an events CSV, ready for otter ingest.
+type CSVWriter struct {
+	MetadataPath string
+	EventsPath   string
+
+	files    []*os.File
+	metadata *csv.Writer
+	events   *csv.Writer
+}
+
+func NewCSVWriter(dir string) (*CSVWriter, error) {
+	w := &CSVWriter{
+		MetadataPath: filepath.Join(dir, ingest.METADATA_FILE),
+		EventsPath:   filepath.Join(dir, "events.csv"),
+	}
+
+	for _, f := range []struct {
+		path   string
+		header []string
+		writer **csv.Writer
+	}{
+		{w.MetadataPath, ingest.METADATA_COLUMNS, &w.metadata},
+		{w.EventsPath, ingest.EVENT_COLUMNS, &w.events},
+	} {
+		file, err := os.Create(f.path)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files = append(w.files, file)
+
+		*f.writer = csv.NewWriter(file)
+		(*f.writer).Write(f.header)
+	}
+
+	return w, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (w *CSVWriter) WriteEvent(e models.Event) error {
+	return w.events.Write([]string{
+		strconv.Itoa(e.FileID),
+		e.EventDisplayType,
+		e.QuoteToken,
+		formatFloat(e.SOLPrice),
+		formatFloat(e.TokenPrice),
+		strconv.FormatInt(e.Timestamp, 10),
+		strconv.FormatInt(e.BlockNumber, 10),
+	})
+}
+
+func (w *CSVWriter) WriteCall(c Call) error {
+	additional := map[string]any{"synthetic": true, "scenario": c.Scenario, "launch_price": c.LaunchPrice}
+	for k, v := range c.Params {
+		additional[k] = v
+	}
+
+	data, err := json.Marshal(additional)
+	if err != nil {
+		return err
+	}
+
+	symbol := strings.ToUpper(strings.ReplaceAll(c.Scenario, "_", ""))
+	if len(symbol) > 4 {
+		symbol = symbol[:4]
+	}
+
+	return w.metadata.Write([]string{
+		strconv.Itoa(c.FileID),
+		c.Address,
+		strconv.FormatInt(c.CallTimestamp, 10),
+		"",
+		"",
+		string(data),
+		fmt.Sprintf("Synthetic %s #%d", strings.ReplaceAll(c.Scenario, "_", " "), c.FileID),
+		fmt.Sprintf("%s%d", symbol, c.FileID),
+		"synthetic " + c.Scenario + " call",
+		"1000000000",
+		"",
+	})
+}
+
+// Close flushes and closes both files, returning the first error either had.
+func (w *CSVWriter) Close() error {
+	var first error
+	for _, cw := range []*csv.Writer{w.metadata, w.events} {
+		if cw == nil {
+			continue
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil && first == nil {
+			first = err
+		}
+	}
+	for _, f := range w.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Collector keeps the generated data in memory, in the shape database.NewMemory takes.
+type Collector struct {
+	Assets []models.Asset
+	Events []models.Event
+}
+
+func (c *Collector) WriteEvent(e models.Event) error {
+	c.Events = append(c.Events, e)
+	return nil
+}
+
+func (c *Collector) WriteCall(call Call) error {
+	c.Assets = append(c.Assets, models.Asset{
+		FileID:          call.FileID,
+		ContractAddress: call.Address,
+		CallTimestamp:   call.CallTimestamp,
+		Name:            fmt.Sprintf("Synthetic %s #%d", strings.ReplaceAll(call.Scenario, "_", " "), call.FileID),
+		Description:     "synthetic " + call.Scenario + " call",
+	})
+	return nil
+}
@@ -0,0 +1,223 @@
+package synth
+
+import (
+	"context"
+	"math"
+	"otter/database"
+	"otter/internal/testutil"
+	"otter/models"
+	"otter/simulator"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func generate(t *testing.T, cfg Config) ([]Call, *Collector) {
+	t.Helper()
+
+	c := &Collector{}
+	calls, err := Generate(cfg, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) == 0 {
+		t.Fatal("no calls generated")
+	}
+
+	return calls, c
+}
+
+func only(scenario string) Config {
+	cfg := DefaultConfig()
+	cfg.Scenarios = map[string]float64{scenario: 1}
+	return cfg
+}
+
+// eventsOf splits the events up by call.
+func eventsOf(c *Collector) map[int][]models.Event {
+	byCall := map[int][]models.Event{}
+	for _, e := range c.Events {
+		byCall[e.FileID] = append(byCall[e.FileID], e)
+	}
+	return byCall
+}
+
+func TestTheSameSeedGeneratesTheSameData(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 42
+
+	callsA, a := generate(t, cfg)
+	callsB, b := generate(t, cfg)
+	if !reflect.DeepEqual(callsA, callsB) || !reflect.DeepEqual(a, b) {
+		t.Error("the same seed generated different data")
+	}
+
+	cfg.Seed = 43
+	_, c := generate(t, cfg)
+	if reflect.DeepEqual(a.Events, c.Events) {
+		t.Error("a different seed generated the same events")
+	}
+}
+
+func TestEventsAreBuyableAndOrdered(t *testing.T) {
+	calls, c := generate(t, DefaultConfig())
+	byCall := eventsOf(c)
+
+	for _, call := range calls {
+		events := byCall[call.FileID]
+		if len(events) != call.Events {
+			t.Fatalf("call %d has %d events, expected %d", call.FileID, len(events), call.Events)
+		}
+
+		// the first swap is at the call, so the sim can buy it
+		if events[0].Timestamp != call.CallTimestamp || events[0].TokenPrice != call.LaunchPrice {
+			t.Errorf("call %d starts with %+v", call.FileID, events[0])
+		}
+
+		for i, e := range events {
+			if e.SOLPrice <= e.TokenPrice || e.TokenPrice <= 0 {
+				t.Fatalf("call %d event %d has prices %g and %g", call.FileID, i, e.SOLPrice, e.TokenPrice)
+			}
+			if i > 0 && (e.Timestamp <= events[i-1].Timestamp || e.BlockNumber <= events[i-1].BlockNumber) {
+				t.Fatalf("call %d event %d is out of order", call.FileID, i)
+			}
+		}
+	}
+}
+
+func TestRugPullsAtRugAfter(t *testing.T) {
+	cfg := only(RUG_PULL)
+	cfg.RugAfter = 20 * time.Minute
+
+	calls, c := generate(t, cfg)
+	byCall := eventsOf(c)
+
+	for _, call := range calls {
+		rise := call.Params["rise"].(float64)
+		for _, e := range byCall[call.FileID] {
+			multiple := e.TokenPrice / call.LaunchPrice
+			before := e.Timestamp < call.CallTimestamp+int64(cfg.RugAfter.Seconds())
+
+			if before && multiple > rise*1.1 || !before && multiple > rise*0.0011 {
+				t.Fatalf("call %d is at %gx %ds after the call", call.FileID, multiple, e.Timestamp-call.CallTimestamp)
+			}
+		}
+	}
+}
+
+func TestPumpAndDumpPeaks(t *testing.T) {
+	calls, c := generate(t, only(PUMP_AND_DUMP))
+	byCall := eventsOf(c)
+
+	for _, call := range calls {
+		peak := call.Params["peak"].(float64)
+		floor := call.Params["floor"].(float64)
+		events := byCall[call.FileID]
+
+		high := 0.0
+		for _, e := range events {
+			high = max(high, e.TokenPrice/call.LaunchPrice)
+		}
+		if high < peak*0.9 || high > peak*1.1 {
+			t.Errorf("call %d peaked at %gx, expected %gx", call.FileID, high, peak)
+		}
+
+		last := events[len(events)-1].TokenPrice / call.LaunchPrice
+		if math.Abs(last/floor-1) > 0.1 {
+			t.Errorf("call %d ended at %gx, expected %gx", call.FileID, last, floor)
+		}
+	}
+}
+
+func TestBondingCurveGraduates(t *testing.T) {
+	cfg := only(BONDING_CURVE)
+	cfg.Duration = 4 * time.Hour
+
+	calls, _ := generate(t, cfg)
+
+	graduated := 0
+	for _, call := range calls {
+		if call.LaunchPrice != LAUNCH_PRICE {
+			t.Errorf("call %d launched at %g", call.FileID, call.LaunchPrice)
+		}
+		if call.Params["graduated"] != true {
+			continue
+		}
+		graduated += 1
+
+		// 85 SOL in on top of the 30 virtual
+		want := math.Pow((CURVE_VIRTUAL_SOL+CURVE_GRADUATION_SOL)/CURVE_VIRTUAL_SOL, 2)
+		if got := call.Params["graduation_multiple"].(float64); !testutil.Near(got, want) {
+			t.Errorf("call %d graduated at %gx, expected %gx", call.FileID, got, want)
+		}
+	}
+
+	// they're all drawn to graduate within 3 hours
+	if graduated < len(calls)*3/4 {
+		t.Errorf("only %d of %d calls graduated", graduated, len(calls))
+	}
+}
+
+func TestConfigIsValidated(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Scenarios = map[string]float64{"moon": 1}
+	if _, err := Generate(cfg, &Collector{}); err == nil {
+		t.Error("an unknown scenario was accepted")
+	}
+
+	cfg = DefaultConfig()
+	cfg.RugAfter = cfg.Duration
+	if _, err := Generate(cfg, &Collector{}); err == nil {
+		t.Error("a rug after the duration was accepted")
+	}
+}
+
+// simulate runs a 2x take profit, selling everything, over the generated calls.
+func simulate(t *testing.T, cfg Config) (int, *models.SimResult) {
+	t.Helper()
+
+	calls, c := generate(t, cfg)
+
+	config := models.SimConfig{
+		Version:        models.SIM_CONFIG_VERSION,
+		Name:           "synthetic",
+		BuyAmount:      1,
+		TPs:            []float64{2},
+		TPAmounts:      []float64{1},
+		Slippage:       5,
+		StartTimestamp: cfg.Start,
+		EndTimestamp:   cfg.Start + int64(cfg.Days)*24*60*60 + int64(cfg.Duration.Seconds()),
+	}
+
+	s, err := simulator.Init(database.NewMemory(c.Assets, c.Events), config, simulator.DefaultSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Run(context.Background(), testutil.NoProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(calls), result
+}
+
+func TestPumpAndDumpTakesProfit(t *testing.T) {
+	calls, result := simulate(t, only(PUMP_AND_DUMP))
+
+	// every pump is at least 3x, so every buy doubles
+	gained := result.Portfolio.SOLBalance - simulator.DefaultSettings().StartingBalance
+	if gained < float64(calls)*0.9 || gained > float64(calls)*1.1 {
+		t.Errorf("gained %g SOL over %d calls", gained, calls)
+	}
+}
+
+func TestRugPullLosesTheBuy(t *testing.T) {
+	calls, result := simulate(t, only(RUG_PULL))
+
+	// a rug never rises 2x, so every buy is lost
+	lost := simulator.DefaultSettings().StartingBalance - result.Portfolio.SOLBalance
+	if !testutil.Near(lost, float64(calls)) {
+		t.Errorf("lost %g SOL over %d calls", lost, calls)
+	}
+}
@@ -0,0 +1,243 @@
+package synth
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Scenarios are the price models a call can follow.
+const (
+	PUMP_AND_DUMP = "pump_and_dump"
+	SLOW_BLEED    = "slow_bleed"
+	RUG_PULL      = "rug_pull"
+	GBM_JUMPS     = "gbm_jumps"
+	BONDING_CURVE = "bonding_curve"
+)
+
+var SCENARIOS = []string{PUMP_AND_DUMP, SLOW_BLEED, RUG_PULL, GBM_JUMPS, BONDING_CURVE}
+
+// pump.fun's bonding curve starts with 30 virtual SOL against 1,073,000,191 tokens, and graduates to a DEX
+// once 85 SOL has been put in.
+const (
+	CURVE_VIRTUAL_SOL    = 30.0
+	CURVE_VIRTUAL_TOKENS = 1_073_000_191.0
+	CURVE_GRADUATION_SOL = 85.0
+)
+
+// LAUNCH_PRICE is the price, in SOL, a token starts at on the bonding curve.
+const LAUNCH_PRICE = CURVE_VIRTUAL_SOL / CURVE_VIRTUAL_TOKENS
+
+// NOISE is the standard deviation of the tick to tick noise on a scenario's shape.
+const NOISE = 0.01
+
+// path is a token's price, as a multiple of the price it was called at. step moves it on by dt seconds,
+// to elapsed seconds after the call.
+type path interface {
+	step(r *rand.Rand, elapsed float64, dt float64) float64
+
+	// params are what was drawn for this token, the known answers a sim can be checked against
+	params() map[string]any
+}
+
+func newPath(scenario string, r *rand.Rand, cfg Config) (path, error) {
+	duration := cfg.Duration.Seconds()
+
+	switch scenario {
+	case PUMP_AND_DUMP:
+		return &pumpAndDump{
+			peak:  3 + r.Float64()*7,
+			pump:  300 + r.Float64()*900,
+			dump:  600 + r.Float64()*1200,
+			floor: 0.05 + r.Float64()*0.25,
+		}, nil
+	case SLOW_BLEED:
+		loss := 0.6 + r.Float64()*0.35
+		return &gbm{
+			drift: math.Log(1-loss) / duration,
+			vol:   0.3 / math.Sqrt(3600),
+			value: 1,
+			extra: map[string]any{"loss": loss},
+		}, nil
+	case RUG_PULL:
+		return &rugPull{
+			at:    cfg.RugAfter.Seconds(),
+			rise:  1 + r.Float64()*0.5,
+			left:  0.001,
+			value: 1,
+		}, nil
+	case GBM_JUMPS:
+		return &gbm{
+			drift:     0,
+			vol:       1.5 / math.Sqrt(3600),
+			jumpRate:  2.0 / 3600,
+			jumpMean:  0,
+			jumpSD:    0.4,
+			value:     1,
+			withJumps: true,
+		}, nil
+	case BONDING_CURVE:
+		graduateIn := (10 + r.Float64()*170) * 60
+		return &bondingCurve{
+			inflow:     CURVE_GRADUATION_SOL / graduateIn,
+			flowSD:     CURVE_GRADUATION_SOL / math.Sqrt(graduateIn),
+			virtualSOL: CURVE_VIRTUAL_SOL,
+			after:      gbm{vol: 0.8 / math.Sqrt(3600), value: 1},
+			graduateIn: graduateIn,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown scenario %q", scenario)
+}
+
+// noisy adds the tick to tick noise to a shape.
+func noisy(r *rand.Rand, value float64) float64 {
+	return value * math.Exp(r.NormFloat64()*NOISE)
+}
+
+// pumpAndDump climbs to peak times the call price over pump seconds, then falls to floor times it over dump seconds.
+type pumpAndDump struct {
+	peak, pump, dump, floor float64
+}
+
+func (p *pumpAndDump) step(r *rand.Rand, elapsed float64, dt float64) float64 {
+	switch {
+	case elapsed < p.pump:
+		return noisy(r, math.Pow(p.peak, elapsed/p.pump))
+	case elapsed < p.pump+p.dump:
+		return noisy(r, p.peak*math.Pow(p.floor/p.peak, (elapsed-p.pump)/p.dump))
+	}
+
+	return noisy(r, p.floor)
+}
+
+func (p *pumpAndDump) params() map[string]any {
+	return map[string]any{"peak": p.peak, "peak_at": int64(p.pump), "floor": p.floor, "floor_at": int64(p.pump + p.dump)}
+}
+
+// gbm is geometric Brownian motion, per second, with optional Poisson jumps (Merton's model). drift is the
+// log drift, so without jumps the median path ends at exp(drift * seconds).
+type gbm struct {
+	drift, vol                 float64
+	jumpRate, jumpMean, jumpSD float64
+	withJumps                  bool
+	value                      float64
+	jumps                      int
+	extra                      map[string]any
+}
+
+func (g *gbm) step(r *rand.Rand, elapsed float64, dt float64) float64 {
+	g.value *= math.Exp(g.drift*dt + g.vol*math.Sqrt(dt)*r.NormFloat64())
+
+	if g.withJumps && r.Float64() < 1-math.Exp(-g.jumpRate*dt) {
+		g.value *= math.Exp(g.jumpMean + g.jumpSD*r.NormFloat64())
+		g.jumps += 1
+	}
+
+	return g.value
+}
+
+func (g *gbm) params() map[string]any {
+	p := map[string]any{"drift_per_hour": g.drift * 3600, "vol_per_hour": g.vol * math.Sqrt(3600)}
+	if g.withJumps {
+		p["jumps_per_hour"] = g.jumpRate * 3600
+		p["jump_sd"] = g.jumpSD
+		p["jumps"] = g.jumps
+	}
+	for k, v := range g.extra {
+		p[k] = v
+	}
+
+	return p
+}
+
+// rugPull drifts up to rise times the call price until at seconds, when the liquidity is pulled and only
+// left times the price remains.
+type rugPull struct {
+	at, rise, left float64
+	value          float64
+}
+
+func (p *rugPull) step(r *rand.Rand, elapsed float64, dt float64) float64 {
+	if elapsed < p.at {
+		return noisy(r, math.Pow(p.rise, elapsed/p.at))
+	}
+
+	return noisy(r, p.rise*p.left)
+}
+
+func (p *rugPull) params() map[string]any {
+	return map[string]any{"rug_at": int64(p.at), "rise": p.rise, "left": p.left}
+}
+
+// bondingCurve prices the token off pump.fun's constant product curve as SOL flows in, until 85 SOL has been
+// put in and it graduates. From there it trades like any other token.
+type bondingCurve struct {
+	inflow, flowSD float64
+	virtualSOL     float64
+	graduateIn     float64
+	graduatedAt    float64
+	graduated      bool
+	atGraduation   float64
+	after          gbm
+}
+
+func (c *bondingCurve) step(r *rand.Rand, elapsed float64, dt float64) float64 {
+	if c.graduated {
+		return c.atGraduation * c.after.step(r, elapsed, dt)
+	}
+
+	// the curve completes at exactly 85 SOL, whatever's left of the last buy doesn't go in
+	c.virtualSOL = max(CURVE_VIRTUAL_SOL, c.virtualSOL+c.inflow*dt+c.flowSD*math.Sqrt(dt)*r.NormFloat64())
+	c.virtualSOL = min(c.virtualSOL, CURVE_VIRTUAL_SOL+CURVE_GRADUATION_SOL)
+
+	// price = virtual SOL / virtual tokens, and the tokens shrink as SOL goes in so the product stays constant
+	multiple := math.Pow(c.virtualSOL/CURVE_VIRTUAL_SOL, 2)
+
+	if c.virtualSOL-CURVE_VIRTUAL_SOL >= CURVE_GRADUATION_SOL {
+		c.graduated = true
+		c.graduatedAt = elapsed
+		c.atGraduation = multiple
+	}
+
+	return multiple
+}
+
+func (c *bondingCurve) params() map[string]any {
+	p := map[string]any{"graduated": c.graduated, "expected_graduation": int64(c.graduateIn)}
+	if c.graduated {
+		p["graduated_at"] = int64(c.graduatedAt)
+		p["graduation_multiple"] = c.atGraduation
+	}
+
+	return p
+}
+
+// solPath is SOL/USD as geometric Brownian motion, a point a minute, shared by every call.
+type solPath struct {
+	start  int64
+	prices []float64
+}
+
+func newSOLPath(r *rand.Rand, start int64, length time.Duration, price float64, annualVol float64) *solPath {
+	minutes := int(length.Minutes()) + 2
+	vol := annualVol / math.Sqrt(365*24*60)
+
+	p := &solPath{start: start, prices: make([]float64, minutes)}
+	for i := range p.prices {
+		p.prices[i] = price
+		price *= math.Exp(-vol*vol/2 + vol*r.NormFloat64())
+	}
+
+	return p
+}
+
+// at is the SOL price at a timestamp, interpolated between the minutes.
+func (p *solPath) at(timestamp int64) float64 {
+	offset := float64(timestamp-p.start) / 60
+	i := min(max(int(offset), 0), len(p.prices)-2)
+	frac := min(max(offset-float64(i), 0), 1)
+
+	return p.prices[i] * math.Pow(p.prices[i+1]/p.prices[i], frac)
+}
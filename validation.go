@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"otter/models"
+	"otter/simulator"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError is a single invalid field, named by its JSON path (e.g. "tp_amounts[1]"), so a dashboard can highlight it.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// setupValidation makes validation errors use JSON field names and registers the cross-field checks
+// that can't be expressed as struct tags.
+func setupValidation() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterStructValidation(validateSimConfig, models.SimConfig{})
+}
+
+func validateSimConfig(sl validator.StructLevel) {
+	config := sl.Current().Interface().(models.SimConfig)
+
+	// buys only happen while the wallet holds more than the buy amount plus the reserve
+	if config.BuyAmount+simulator.BUY_RESERVE >= Settings.Simulator.StartingBalance {
+		sl.ReportError(config.BuyAmount, "buy_amount", "BuyAmount", "ltbalance", fmt.Sprint(Settings.Simulator.StartingBalance-simulator.BUY_RESERVE))
+	}
+}
+
+// validationErrors converts a bind error into field level errors. ok is false if err isn't a validation error
+// (e.g. the body isn't valid JSON).
+func validationErrors(err error) ([]FieldError, bool) {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return nil, false
+	}
+
+	fields := make([]FieldError, 0, len(errs))
+	for _, e := range errs {
+		// the namespace starts with the struct name, e.g. "SimConfig.tp_amounts[1]"
+		field := e.Namespace()
+		if i := strings.Index(field, "."); i != -1 {
+			field = field[i+1:]
+		}
+
+		// cross-field rules name the other field by its Go name
+		param := e.Param()
+		if strings.HasSuffix(e.Tag(), "field") {
+			param = jsonName(param)
+		}
+
+		fields = append(fields, FieldError{
+			Field:   field,
+			Rule:    e.Tag(),
+			Param:   param,
+			Message: validationMessage(field, e.Tag(), param),
+		})
+	}
+
+	return fields, true
+}
+
+func validationMessage(field string, rule string, param string) string {
+	switch rule {
+	case "required":
+		return field + " is required"
+	case "min":
+		return fmt.Sprintf("%s needs at least %s entries", field, param)
+	case "max":
+		return fmt.Sprintf("%s can have at most %s entries", field, param)
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", field, param)
+	case "gte":
+		return fmt.Sprintf("%s must be at least %s", field, param)
+	case "lte":
+		return fmt.Sprintf("%s must be at most %s", field, param)
+	case "eqfield":
+		return fmt.Sprintf("%s must have the same number of entries as %s", field, param)
+	case "gtfield":
+		return fmt.Sprintf("%s must be after %s", field, param)
+	case "oneof":
+		return fmt.Sprintf("%s must be one of %s", field, strings.ReplaceAll(param, " ", ", "))
+	case "ltbalance":
+		return fmt.Sprintf("%s must be below %s SOL, the starting balance less the fee reserve", field, param)
+	}
+
+	return fmt.Sprintf("%s failed the %s check", field, rule)
+}
+
+// jsonName maps the Go field names used as validator params back to their JSON names.
+func jsonName(goField string) string {
+	if f, ok := reflect.TypeOf(models.SimConfig{}).FieldByName(goField); ok {
+		return strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	}
+
+	return goField
+}
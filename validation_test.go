@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"otter/jobs"
+	"otter/models"
+	"otter/settings"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const validConfig = `{"version": 1, "name": "test", "buy_amount": 1, "tps": [2, 4], "tp_amounts": [0.5, 1],
+	"slippage": 5, "start_timestamp": 1000, "end_timestamp": 2000}`
+
+// runSim posts a config to /run_sim. The job it queues runs waitForShutdown rather than a sim, so there's no
+// events database to read.
+func runSim(t *testing.T, body string) (int, map[string]any) {
+	t.Helper()
+
+	Settings = settings.Default()
+	Settings.Simulator.StartingBalance = 10
+	Jobs = jobs.NewManager(1)
+	t.Cleanup(Jobs.Shutdown)
+	setupValidation()
+
+	runSimJob = func(config models.SimConfig) jobs.RunFunc { return waitForShutdown }
+	t.Cleanup(func() { runSimJob = simJob })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/run_sim", requestSimHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/run_sim", strings.NewReader(body)))
+
+	var response map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("got %s: %v", w.Body, err)
+	}
+
+	return w.Code, response
+}
+
+// waitForShutdown is a job that never finishes by itself.
+func waitForShutdown(ctx context.Context, job *jobs.Job) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// withField is validConfig with one field replaced.
+func withField(t *testing.T, field string, value any) string {
+	t.Helper()
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(validConfig), &doc); err != nil {
+		t.Fatal(err)
+	}
+	doc[field] = value
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestRunSimQueuesAValidConfig(t *testing.T) {
+	code, response := runSim(t, validConfig)
+	if code != http.StatusAccepted || response["job_id"] == "" {
+		t.Fatalf("got %d %v", code, response)
+	}
+
+	// queued, or already taken by the worker, but it can't have finished
+	status, err := Jobs.Get(response["job_id"].(string))
+	if err != nil || (status.State != jobs.Queued && status.State != jobs.Running) || status.SimName != "test" {
+		t.Errorf("got %+v, %v", status, err)
+	}
+}
+
+func TestRunSimRejectsInvalidFields(t *testing.T) {
+	tests := map[string]struct {
+		body string
+		want []FieldError
+	}{
+		"buy amount and reserve over the balance": {withField(t, "buy_amount", 9.9),
+			[]FieldError{{Field: "buy_amount", Rule: "ltbalance", Param: "9.9", Message: "buy_amount must be below 9.9 SOL, the starting balance less the fee reserve"}}},
+		"fewer tp amounts than tps": {withField(t, "tp_amounts", []float64{1}),
+			[]FieldError{{Field: "tp_amounts", Rule: "eqfield", Param: "tps", Message: "tp_amounts must have the same number of entries as tps"}}},
+		"more tp amounts than tps": {withField(t, "tp_amounts", []float64{0.5, 0.5, 1}),
+			[]FieldError{{Field: "tp_amounts", Rule: "eqfield", Param: "tps", Message: "tp_amounts must have the same number of entries as tps"}}},
+		"a tp amount over 1": {withField(t, "tp_amounts", []float64{0.5, 1.5}),
+			[]FieldError{{Field: "tp_amounts[1]", Rule: "lte", Param: "1", Message: "tp_amounts[1] must be at most 1"}}},
+		// every invalid field is reported, not just the first
+		"no tps": {withField(t, "tps", []float64{}), []FieldError{
+			{Field: "tps", Rule: "min", Param: "1", Message: "tps needs at least 1 entries"},
+			{Field: "tp_amounts", Rule: "eqfield", Param: "tps", Message: "tp_amounts must have the same number of entries as tps"},
+		}},
+		"no buy amount": {withField(t, "buy_amount", 0),
+			[]FieldError{{Field: "buy_amount", Rule: "gt", Param: "0", Message: "buy_amount must be greater than 0"}}},
+		"slippage over 100": {withField(t, "slippage", 101),
+			[]FieldError{{Field: "slippage", Rule: "lte", Param: "100", Message: "slippage must be at most 100"}}},
+		"ends before it starts": {withField(t, "end_timestamp", 500),
+			[]FieldError{{Field: "end_timestamp", Rule: "gtfield", Param: "start_timestamp", Message: "end_timestamp must be after start_timestamp"}}},
+		"unknown candles": {withField(t, "candles", "1d"),
+			[]FieldError{{Field: "candles", Rule: "oneof", Param: "1s 1m 5m 1h", Message: "candles must be one of 1s, 1m, 5m, 1h"}}},
+		"no start": {withField(t, "start_timestamp", 0),
+			[]FieldError{{Field: "start_timestamp", Rule: "required", Message: "start_timestamp is required"}}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			code, response := runSim(t, test.body)
+			if code != http.StatusBadRequest || response["error"] != "invalid simulation settings" {
+				t.Fatalf("got %d %v", code, response)
+			}
+
+			raw, _ := json.Marshal(response["fields"])
+			var fields []FieldError
+			if err := json.Unmarshal(raw, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fields, test.want) {
+				t.Errorf("got %+v, want %+v", fields, test.want)
+			}
+		})
+	}
+}
+
+func TestRunSimTakesTheBuyAmountUpToTheReserve(t *testing.T) {
+	// 9.8 leaves more than the 0.1 SOL reserve, 9.9 doesn't
+	if code, response := runSim(t, withField(t, "buy_amount", 9.8)); code != http.StatusAccepted {
+		t.Errorf("got %d %v", code, response)
+	}
+}
+
+func TestRunSimRejectsInvalidJSON(t *testing.T) {
+	code, response := runSim(t, `{"tps": [2`)
+	if code != http.StatusBadRequest || response["error"] != "invalid JSON payload" {
+		t.Errorf("got %d %v", code, response)
+	}
+}
+
+func TestRunSimMigratesUnversionedConfigs(t *testing.T) {
+	// TPAmounts is the old name tp_amounts was stored under
+	body := strings.Replace(strings.Replace(validConfig, `"version": 1, `, "", 1), `"tp_amounts"`, `"TPAmounts"`, 1)
+
+	if code, response := runSim(t, body); code != http.StatusAccepted {
+		t.Errorf("got %d %v", code, response)
+	}
+}
@@ -0,0 +1,358 @@
+// Package webhooks tells outside services (chat bots, CI) when sims are queued, start and finish, and when a
+// sweep completes, by POSTing a signed JSON payload to every configured URL.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"otter/jobs"
+	"otter/models"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook events.
+const (
+	EVENT_SIM_QUEUED      = "sim.queued"
+	EVENT_SIM_STARTED     = "sim.started"
+	EVENT_SIM_COMPLETED   = "sim.completed"
+	EVENT_SIM_FAILED      = "sim.failed"
+	EVENT_SWEEP_COMPLETED = "sweep.completed"
+)
+
+// Headers sent with every delivery. The signature is "sha256=" and the hex HMAC-SHA256 of the timestamp
+// header, a ".", and the body, keyed with the secret.
+const (
+	HEADER_EVENT     = "X-Otter-Event"
+	HEADER_DELIVERY  = "X-Otter-Delivery"
+	HEADER_TIMESTAMP = "X-Otter-Timestamp"
+	HEADER_SIGNATURE = "X-Otter-Signature"
+)
+
+// MAX_ATTEMPTS is how many times a delivery is tried by default. RETRY_DELAY is the wait before the first
+// retry, doubling up to MAX_RETRY_DELAY.
+const (
+	MAX_ATTEMPTS    = 5
+	RETRY_DELAY     = time.Second
+	MAX_RETRY_DELAY = time.Minute
+)
+
+// QUEUE_SIZE is the deliveries a URL can have waiting before new ones are dropped.
+const QUEUE_SIZE = 256
+
+// REQUEST_TIMEOUT is how long a receiver has to answer one attempt.
+const REQUEST_TIMEOUT = 10 * time.Second
+
+// CLOSE_TIMEOUT is how long otter waits for queued deliveries when it exits.
+const CLOSE_TIMEOUT = 30 * time.Second
+
+// Payload is the body of every webhook.
+type Payload struct {
+	ID        string `json:"id"` // the same on every attempt, so a receiver can ignore repeats
+	Event     string `json:"event"`
+	Timestamp int64  `json:"timestamp"`
+	Sim       *Sim   `json:"sim,omitempty"`
+	Sweep     *Sweep `json:"sweep,omitempty"`
+}
+
+// Sim is a sim job, metrics are only sent once it's completed.
+type Sim struct {
+	JobID      string             `json:"job_id"`
+	SimID      int                `json:"sim_id,omitempty"`
+	Name       string             `json:"name"`
+	ConfigHash string             `json:"config_hash"`
+	State      jobs.State         `json:"state"`
+	Error      string             `json:"error,omitempty"`
+	Metrics    *models.SimMetrics `json:"metrics,omitempty"`
+}
+
+type Sweep struct {
+	Name string `json:"name"`
+	Sims []Sim  `json:"sims"`
+}
+
+// MetricsStore loads a finished sim's metrics, *database.ResultStore is the real one.
+type MetricsStore interface {
+	GetMetrics(simID int) (models.SimMetrics, error)
+}
+
+type Config struct {
+	URLs        []string
+	Secret      string   // signs every delivery, nothing is signed without one
+	Events      []string // the events sent, all of them if empty
+	MaxAttempts int
+
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Notifier delivers webhooks in the background. Each URL has its own queue, so a slow or broken receiver
+// doesn't hold up the others, and gets its events in the order they happened.
+type Notifier struct {
+	config  Config
+	events  map[string]bool
+	metrics MetricsStore
+	client  *http.Client
+
+	mu     sync.Mutex
+	queues []chan *delivery
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// delivery is a queued payload. A completed sim's metrics are loaded by the first URL to get to it, so a job
+// changing state never waits on the results database.
+type delivery struct {
+	Payload
+	metricsOf int // the sim whose metrics go in the payload
+
+	once sync.Once
+	body []byte
+	err  error
+}
+
+func NewNotifier(config Config, metrics MetricsStore) *Notifier {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = MAX_ATTEMPTS
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = RETRY_DELAY
+	}
+	if config.MaxRetryDelay <= 0 {
+		config.MaxRetryDelay = MAX_RETRY_DELAY
+	}
+
+	n := &Notifier{
+		config:  config,
+		metrics: metrics,
+		client:  &http.Client{Timeout: REQUEST_TIMEOUT},
+	}
+
+	if len(config.Events) > 0 {
+		n.events = make(map[string]bool)
+		for _, e := range config.Events {
+			n.events[e] = true
+		}
+	}
+
+	for _, url := range config.URLs {
+		queue := make(chan *delivery, QUEUE_SIZE)
+		n.queues = append(n.queues, queue)
+
+		n.wg.Add(1)
+		go n.deliver(url, queue)
+	}
+
+	return n
+}
+
+// Wants is whether an event is sent anywhere.
+func (n *Notifier) Wants(event string) bool {
+	return len(n.queues) > 0 && (n.events == nil || n.events[event])
+}
+
+// JobChanged sends the sim webhook for a job's new state, it's a jobs.Observer. Cancelled jobs don't send one,
+// and a completed sim's metrics are loaded when it's delivered.
+func (n *Notifier) JobChanged(status jobs.Status) {
+	events := map[jobs.State]string{
+		jobs.Queued:  EVENT_SIM_QUEUED,
+		jobs.Running: EVENT_SIM_STARTED,
+		jobs.Done:    EVENT_SIM_COMPLETED,
+		jobs.Failed:  EVENT_SIM_FAILED,
+	}
+
+	event, ok := events[status.State]
+	if !ok || !n.Wants(event) {
+		return
+	}
+
+	sim := SimFromStatus(status)
+	metricsOf := 0
+	if status.State == jobs.Done {
+		metricsOf = status.SimID
+	}
+
+	n.send(event, &sim, nil, metricsOf)
+}
+
+// SweepCompleted sends the sweep.completed webhook, with every sim the sweep ran.
+func (n *Notifier) SweepCompleted(name string, sims []Sim) {
+	if n.Wants(EVENT_SWEEP_COMPLETED) {
+		n.Send(EVENT_SWEEP_COMPLETED, nil, &Sweep{Name: name, Sims: sims})
+	}
+}
+
+func SimFromStatus(status jobs.Status) Sim {
+	return Sim{
+		JobID:      status.ID,
+		SimID:      status.SimID,
+		Name:       status.SimName,
+		ConfigHash: status.ConfigHash,
+		State:      status.State,
+		Error:      status.Error,
+	}
+}
+
+// Send queues a webhook to every URL. A URL whose queue is full misses it.
+func (n *Notifier) Send(event string, sim *Sim, sweep *Sweep) {
+	n.send(event, sim, sweep, 0)
+}
+
+func (n *Notifier) send(event string, sim *Sim, sweep *Sweep, metricsOf int) {
+	d := &delivery{
+		Payload: Payload{
+			ID:        uuid.NewString(),
+			Event:     event,
+			Timestamp: time.Now().Unix(),
+			Sim:       sim,
+			Sweep:     sweep,
+		},
+		metricsOf: metricsOf,
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	for i, queue := range n.queues {
+		select {
+		case queue <- d:
+		default:
+			log.Printf("webhooks: %s is %d deliveries behind, dropping %s %s", n.config.URLs[i], QUEUE_SIZE, d.Event, d.ID)
+		}
+	}
+}
+
+// Close delivers everything already queued, waiting at most until ctx is done. Deliveries still waiting
+// after that are dropped.
+func (n *Notifier) Close(ctx context.Context) {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, queue := range n.queues {
+			close(queue)
+		}
+	}
+	n.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Println("webhooks: gave up on deliveries still waiting:", ctx.Err())
+	}
+}
+
+// deliver sends a URL's queue in order, trying each payload until it's accepted, rejected, or out of attempts.
+func (n *Notifier) deliver(url string, queue <-chan *delivery) {
+	defer n.wg.Done()
+
+	for d := range queue {
+		p := d.Payload
+		body, err := n.encode(d)
+		if err != nil {
+			log.Printf("webhooks: encoding %s %s: %s", p.Event, p.ID, err)
+			continue
+		}
+
+		delay := n.config.RetryDelay
+		for attempt := 1; ; attempt++ {
+			retry, err := n.post(url, p, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == n.config.MaxAttempts {
+				log.Printf("webhooks: giving up on %s %s to %s after %d attempts: %s", p.Event, p.ID, url, attempt, err)
+				break
+			}
+
+			time.Sleep(delay)
+			delay = min(delay*2, n.config.MaxRetryDelay)
+		}
+	}
+}
+
+// encode is a delivery's body, the same for every URL.
+func (n *Notifier) encode(d *delivery) ([]byte, error) {
+	d.once.Do(func() {
+		if d.metricsOf != 0 {
+			metrics, err := n.metrics.GetMetrics(d.metricsOf)
+			if err != nil {
+				log.Printf("webhooks: loading metrics of sim %d: %s", d.metricsOf, err)
+			} else {
+				d.Sim.Metrics = &metrics
+			}
+		}
+
+		d.body, d.err = json.Marshal(d.Payload)
+	})
+
+	return d.body, d.err
+}
+
+// post makes one attempt at a delivery. Network errors, 429s and 5xxs are worth retrying, other
+// rejections aren't.
+func (n *Notifier) post(url string, p Payload, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "otter-webhooks")
+	req.Header.Set(HEADER_EVENT, p.Event)
+	req.Header.Set(HEADER_DELIVERY, p.ID)
+	req.Header.Set(HEADER_TIMESTAMP, timestamp)
+	if n.config.Secret != "" {
+		req.Header.Set(HEADER_SIGNATURE, Sign(n.config.Secret, timestamp, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+}
+
+// Sign returns the signature header of a delivery.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a delivery's signature, for receivers written in Go.
+func Verify(secret string, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
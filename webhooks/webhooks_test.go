@@ -0,0 +1,239 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"otter/jobs"
+	"otter/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records every delivery, answering the first failures with 503.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	failures int
+
+	mu         sync.Mutex
+	attempts   []string // delivery IDs, one per attempt
+	deliveries []Payload
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	if !Verify(r.secret, req.Header.Get(HEADER_TIMESTAMP), body, req.Header.Get(HEADER_SIGNATURE)) {
+		r.t.Errorf("bad signature %q", req.Header.Get(HEADER_SIGNATURE))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts = append(r.attempts, req.Header.Get(HEADER_DELIVERY))
+	if len(r.attempts) <= r.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var p Payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		r.t.Error(err)
+	}
+	if p.Event != req.Header.Get(HEADER_EVENT) || p.ID != req.Header.Get(HEADER_DELIVERY) {
+		r.t.Errorf("headers don't match the payload %+v", p)
+	}
+	r.deliveries = append(r.deliveries, p)
+}
+
+type metricsStore map[int]models.SimMetrics
+
+func (m metricsStore) GetMetrics(simID int) (models.SimMetrics, error) {
+	metrics, ok := m[simID]
+	if !ok {
+		return metrics, errors.New("no such sim")
+	}
+	return metrics, nil
+}
+
+func notifier(url string, events []string, metrics MetricsStore) *Notifier {
+	return NewNotifier(Config{
+		URLs:          []string{url},
+		Secret:        "shh",
+		Events:        events,
+		MaxAttempts:   3,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Millisecond,
+	}, metrics)
+}
+
+func closeNotifier(t *testing.T, n *Notifier) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	n.Close(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("deliveries didn't finish")
+	}
+}
+
+func TestJobsSendSignedWebhooks(t *testing.T) {
+	r := &receiver{t: t, secret: "shh"}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := notifier(server.URL, nil, metricsStore{42: {SimID: 42, ReturnPct: 12.5}})
+
+	manager := jobs.NewManager(1)
+	manager.Observe(n.JobChanged)
+
+	config := models.SimConfig{Name: "webhook"}
+	ok := manager.Submit(config, func(ctx context.Context, job *jobs.Job) (int, error) { return 42, nil })
+	failed := manager.Submit(config, func(ctx context.Context, job *jobs.Job) (int, error) { return 0, errors.New("boom") })
+
+	for _, id := range []string{ok.ID, failed.ID} {
+		messages, unsubscribe, err := manager.Subscribe(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range messages {
+		}
+		unsubscribe()
+	}
+	manager.Shutdown()
+	closeNotifier(t, n)
+
+	byJob := map[string][]Payload{}
+	for _, p := range r.deliveries {
+		if p.Sim == nil || p.Sim.ConfigHash != config.Hash() {
+			t.Fatalf("delivery %s is %+v", p.Event, p.Sim)
+		}
+		byJob[p.Sim.JobID] = append(byJob[p.Sim.JobID], p)
+	}
+
+	want := map[string][]string{
+		ok.ID:     {EVENT_SIM_QUEUED, EVENT_SIM_STARTED, EVENT_SIM_COMPLETED},
+		failed.ID: {EVENT_SIM_QUEUED, EVENT_SIM_STARTED, EVENT_SIM_FAILED},
+	}
+	for id, events := range want {
+		got := byJob[id]
+		if len(got) != len(events) {
+			t.Fatalf("job %s got %d deliveries, want %v", id, len(got), events)
+		}
+		for i, event := range events {
+			if got[i].Event != event {
+				t.Errorf("job %s delivery %d is %s, want %s", id, i, got[i].Event, event)
+			}
+		}
+	}
+
+	completed := byJob[ok.ID][2].Sim
+	if completed.SimID != 42 || completed.Metrics == nil || completed.Metrics.ReturnPct != 12.5 {
+		t.Errorf("the completed sim was %+v", completed)
+	}
+	if sim := byJob[failed.ID][2].Sim; sim.Error != "boom" || sim.Metrics != nil {
+		t.Errorf("the failed sim was %+v", sim)
+	}
+}
+
+func TestWebhooksAreRetried(t *testing.T) {
+	r := &receiver{t: t, secret: "shh", failures: 2}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := notifier(server.URL, nil, metricsStore{})
+	n.SweepCompleted("grid", []Sim{{Name: "grid 1", State: jobs.Done}})
+	closeNotifier(t, n)
+
+	if len(r.attempts) != 3 || r.attempts[0] != r.attempts[2] {
+		t.Errorf("got attempts %v, want 3 of the same delivery", r.attempts)
+	}
+	if len(r.deliveries) != 1 || r.deliveries[0].Sweep == nil || r.deliveries[0].Sweep.Name != "grid" {
+		t.Errorf("got deliveries %+v", r.deliveries)
+	}
+}
+
+func TestWebhooksGiveUp(t *testing.T) {
+	r := &receiver{t: t, secret: "shh", failures: 10}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := notifier(server.URL, []string{EVENT_SWEEP_COMPLETED}, metricsStore{})
+
+	// only the events asked for are sent
+	n.JobChanged(jobs.Status{ID: "job", State: jobs.Queued})
+	n.SweepCompleted("grid", nil)
+	closeNotifier(t, n)
+
+	if len(r.attempts) != 3 || len(r.deliveries) != 0 {
+		t.Errorf("got %d attempts and %d deliveries, want 3 and none", len(r.attempts), len(r.deliveries))
+	}
+}
+
+// slowMetrics answers once it's released.
+type slowMetrics struct {
+	metricsStore
+	release chan struct{}
+}
+
+func (s slowMetrics) GetMetrics(simID int) (models.SimMetrics, error) {
+	<-s.release
+	return s.metricsStore.GetMetrics(simID)
+}
+
+func TestJobChangesDontWaitForMetrics(t *testing.T) {
+	r := &receiver{t: t, secret: "shh"}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	metrics := slowMetrics{metricsStore{42: {SimID: 42, ReturnPct: 7}}, make(chan struct{})}
+	n := notifier(server.URL, nil, metrics)
+
+	changed := make(chan struct{})
+	go func() {
+		n.JobChanged(jobs.Status{ID: "job", SimID: 42, State: jobs.Done, Done: true})
+		close(changed)
+	}()
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job waited on its metrics")
+	}
+
+	close(metrics.release)
+	closeNotifier(t, n)
+
+	if len(r.deliveries) != 1 || r.deliveries[0].Sim.Metrics == nil || r.deliveries[0].Sim.Metrics.ReturnPct != 7 {
+		t.Errorf("got deliveries %+v", r.deliveries)
+	}
+}
+
+func TestRestoredJobsArentAnnounced(t *testing.T) {
+	r := &receiver{t: t, secret: "shh"}
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	n := notifier(server.URL, nil, metricsStore{})
+
+	manager := jobs.NewManager(1)
+	manager.Observe(n.JobChanged)
+
+	run := func(ctx context.Context, job *jobs.Job) (int, error) { return 0, nil }
+	manager.Restore(jobs.Status{ID: "paused", State: jobs.Paused}, models.SimConfig{}, run)
+	manager.Shutdown()
+	closeNotifier(t, n)
+
+	if len(r.attempts) != 0 {
+		t.Errorf("got %d deliveries for a restored job", len(r.attempts))
+	}
+}